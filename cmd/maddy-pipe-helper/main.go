@@ -0,0 +1,102 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// maddy-pipe-helper runs the command as a different user. It is used by
+// target.pipe module with the 'user' directive set.
+//
+// Usage: maddy-pipe-helper USER -- COMMAND [ARGS...]
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// Exit code used for helper failures, EX_TEMPFAIL from sysexits.h so
+// target.pipe considers them temporary.
+const exTempFail = 75
+
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "maddy-pipe-helper: "+format+"\n", args...)
+	os.Exit(exTempFail)
+}
+
+func main() {
+	if len(os.Args) < 4 || os.Args[2] != "--" {
+		fail("usage: %s USER -- COMMAND [ARGS...]", os.Args[0])
+	}
+
+	usr, err := user.Lookup(os.Args[1])
+	if err != nil {
+		fail("%v", err)
+	}
+	uid, err := strconv.Atoi(usr.Uid)
+	if err != nil {
+		fail("unexpected uid: %v", usr.Uid)
+	}
+	gid, err := strconv.Atoi(usr.Gid)
+	if err != nil {
+		fail("unexpected gid: %v", usr.Gid)
+	}
+	if uid == 0 || gid == 0 {
+		fail("refusing to run commands as root")
+	}
+
+	groupIDs, err := usr.GroupIds()
+	if err != nil {
+		fail("%v", err)
+	}
+	groups := make([]int, 0, len(groupIDs))
+	for _, g := range groupIDs {
+		id, err := strconv.Atoi(g)
+		if err != nil {
+			fail("unexpected gid: %v", g)
+		}
+		if id == 0 {
+			continue
+		}
+		groups = append(groups, id)
+	}
+
+	if err := syscall.Setgroups(groups); err != nil {
+		fail("setgroups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		fail("setgid: %v", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		fail("setuid: %v", err)
+	}
+
+	path, err := exec.LookPath(os.Args[3])
+	if err != nil {
+		fail("%v", err)
+	}
+
+	env := append(os.Environ(), "USER="+usr.Username, "LOGNAME="+usr.Username, "HOME="+usr.HomeDir)
+	if err := syscall.Exec(path, os.Args[3:], env); err != nil {
+		fail("exec: %v", err)
+	}
+}
@@ -19,13 +19,20 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package maddy
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/hooks"
 	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/tracing"
 )
 
 /*
@@ -33,20 +40,31 @@ Config matchers for module interfaces.
 */
 
 // logOut structure wraps log.Output and preserves
-// configuration directive it was constructed from, allowing
+// the function it was constructed with, allowing
 // dynamic reinitialization for purposes of log file rotation.
 type logOut struct {
-	args []string
+	reopen func() (log.Output, error)
 	log.Output
 }
 
+func (l logOut) WriteEntry(e log.Entry) {
+	if eo, ok := l.Output.(log.EntryOutput); ok {
+		eo.WriteEntry(e)
+		return
+	}
+	l.Output.Write(e.Stamp, e.Level == log.LevelDebug, e.Format())
+}
+
 func logOutput(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Children) != 0 {
+		if len(node.Args) != 0 {
+			return nil, config.NodeErr(node, "can't combine arguments with a block")
+		}
+		return logOutputBlock(node)
+	}
 	if len(node.Args) == 0 {
 		return nil, config.NodeErr(node, "expected at least 1 argument")
 	}
-	if len(node.Children) != 0 {
-		return nil, config.NodeErr(node, "can't declare block here")
-	}
 
 	return LogOutputOption(node.Args)
 }
@@ -60,6 +78,9 @@ func LogOutputOption(args []string) (log.Output, error) {
 		case "stderr_ts":
 			outs = append(outs, log.WriterOutput(os.Stderr, true))
 		case "syslog":
+			if module.DryRun {
+				continue
+			}
 			syslogOut, err := log.SyslogOutput()
 			if err != nil {
 				return nil, fmt.Errorf("failed to connect to syslog daemon: %v", err)
@@ -81,6 +102,9 @@ func LogOutputOption(args []string) (log.Output, error) {
 			// We change the actual argument, so logOut object will
 			// keep the absolute path for reinitialization.
 			args[i] = absPath
+			if module.DryRun {
+				continue
+			}
 
 			w, err := os.OpenFile(absPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o666)
 			if err != nil {
@@ -91,10 +115,222 @@ func LogOutputOption(args []string) (log.Output, error) {
 		}
 	}
 
+	return wrapLogOutputs(outs, func() (log.Output, error) {
+		return LogOutputOption(args)
+	})
+}
+
+// logOutputBlock handles the block form of the log directive:
+//
+//	log {
+//	    stderr
+//	    file /var/log/maddy.log {
+//	        format json
+//	        max_size 100M
+//	    }
+//	}
+func logOutputBlock(node config.Node) (log.Output, error) {
+	var (
+		outs  = make([]log.Output, 0, len(node.Children))
+		files = make(map[int]string)
+	)
+	for i, child := range node.Children {
+		switch child.Name {
+		case "stderr":
+			var (
+				format     string
+				timestamps bool
+			)
+			m := config.NewMap(nil, child)
+			m.Enum("format", false, false, []string{"text", "json"}, "text", &format)
+			m.Bool("timestamps", false, false, &timestamps)
+			if _, err := m.Process(); err != nil {
+				return nil, err
+			}
+			if len(child.Args) != 0 {
+				return nil, config.NodeErr(child, "no arguments expected")
+			}
+
+			if format == "json" {
+				outs = append(outs, log.JSONOutput(nopCloser{os.Stderr}))
+			} else {
+				outs = append(outs, log.WriterOutput(os.Stderr, timestamps))
+			}
+		case "syslog":
+			if len(child.Args) != 0 || len(child.Children) != 0 {
+				return nil, config.NodeErr(child, "no arguments or block expected")
+			}
+			if module.DryRun {
+				continue
+			}
+			syslogOut, err := log.SyslogOutput()
+			if err != nil {
+				return nil, config.NodeErr(child, "failed to connect to syslog daemon: %v", err)
+			}
+			outs = append(outs, syslogOut)
+		case "file":
+			var (
+				format string
+				opts   log.RotateOptions
+			)
+			if len(child.Args) != 1 {
+				return nil, config.NodeErr(child, "exactly one argument required")
+			}
+			m := config.NewMap(nil, child)
+			m.Enum("format", false, false, []string{"text", "json"}, "text", &format)
+			m.DataSize("max_size", false, false, 0, &opts.MaxSize)
+			m.Duration("rotate_interval", false, false, 0, &opts.Interval)
+			m.Int("max_backups", false, false, 0, &opts.MaxBackups)
+			m.Bool("compress", false, false, &opts.Compress)
+			if _, err := m.Process(); err != nil {
+				return nil, err
+			}
+
+			absPath, err := filepath.Abs(child.Args[0])
+			if err != nil {
+				return nil, config.NodeErr(child, "%v", err)
+			}
+			files[i] = absPath
+			if module.DryRun {
+				continue
+			}
+
+			w, err := log.RotatingFile(absPath, opts)
+			if err != nil {
+				return nil, config.NodeErr(child, "failed to create log file: %v", err)
+			}
+			if format == "json" {
+				outs = append(outs, log.JSONOutput(w))
+			} else {
+				outs = append(outs, log.WriteCloserOutput(w, true))
+			}
+		default:
+			return nil, config.NodeErr(child, "unknown log target: %s", child.Name)
+		}
+	}
+	if len(outs) == 0 && !module.DryRun {
+		return nil, config.NodeErr(node, "at least one log target is required")
+	}
+
+	// Use absolute paths for reinitialization since the working directory
+	// is changed to the state directory after the initial one.
+	reopenNode := node
+	reopenNode.Children = append([]config.Node(nil), node.Children...)
+	for i, path := range files {
+		reopenNode.Children[i].Args = []string{path}
+	}
+	return wrapLogOutputs(outs, func() (log.Output, error) {
+		return logOutputBlock(reopenNode)
+	})
+}
+
+func wrapLogOutputs(outs []log.Output, reopen func() (log.Output, error)) (log.Output, error) {
+	if module.DryRun {
+		// Don't touch log files when checking the configuration, all
+		// messages go to the terminal instead.
+		return logOut{reopen, log.WriterOutput(os.Stderr, false)}, nil
+	}
+
 	if len(outs) == 1 {
-		return logOut{args, outs[0]}, nil
+		return logOut{reopen, outs[0]}, nil
 	}
-	return logOut{args, log.MultiOutput(outs...)}, nil
+	return logOut{reopen, log.MultiOutput(outs...)}, nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// logLevels handles the log_level directive that overrides the log level for
+// specific modules:
+//
+//	log_level {
+//	    smtp debug
+//	    remote error
+//	}
+func logLevels(_ *config.Map, node config.Node) error {
+	if len(node.Args) != 0 {
+		return config.NodeErr(node, "no arguments expected")
+	}
+
+	levels := make(map[string]log.Level, len(node.Children))
+	for _, child := range node.Children {
+		if len(child.Args) != 1 || len(child.Children) != 0 {
+			return config.NodeErr(child, "expected exactly one argument: debug, info, error or off")
+		}
+		lvl, err := log.ParseLevel(child.Args[0])
+		if err != nil {
+			return config.NodeErr(child, "%v", err)
+		}
+		levels[child.Name] = lvl
+	}
+
+	log.SetModuleLevels(levels)
+	return nil
+}
+
+// tracingDirective handles the tracing directive that enables export of
+// OpenTelemetry spans to the OTLP/HTTP collector:
+//
+//	tracing {
+//	    endpoint http://127.0.0.1:4318
+//	    service_name maddy
+//	    sample_ratio 1.0
+//	    header Authorization "Bearer TOKEN"
+//	}
+func tracingDirective(_ *config.Map, node config.Node) error {
+	if len(node.Args) != 0 {
+		return config.NodeErr(node, "no arguments expected")
+	}
+
+	cfg := tracing.Config{
+		Headers: map[string]string{},
+	}
+	m := config.NewMap(nil, node)
+	m.String("endpoint", false, true, "", &cfg.Endpoint)
+	m.String("service_name", false, false, "maddy", &cfg.ServiceName)
+	m.Float("sample_ratio", false, false, 1.0, &cfg.SampleRatio)
+	m.Callback("header", func(_ *config.Map, child config.Node) error {
+		if len(child.Args) != 2 {
+			return config.NodeErr(child, "expected two arguments: name and value")
+		}
+		cfg.Headers[child.Args[0]] = child.Args[1]
+		return nil
+	})
+	if _, err := m.Process(); err != nil {
+		return err
+	}
+
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return config.NodeErr(node, "sample_ratio should be in range [0, 1]")
+	}
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return config.NodeErr(node, "endpoint should be a http:// or https:// URL")
+	}
+
+	// Utility commands don't process messages, no need to start
+	// the exporter.
+	if module.NoRun || module.DryRun {
+		return nil
+	}
+
+	shutdown, err := tracing.Setup(cfg)
+	if err != nil {
+		return config.NodeErr(node, "%v", err)
+	}
+	hooks.AddHook(hooks.EventShutdown, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdown(ctx); err != nil {
+			log.Println("failed to flush tracing spans:", err)
+		}
+	})
+	return nil
 }
 
 func defaultLogOutput() (interface{}, error) {
@@ -108,7 +344,7 @@ func reinitLogging() {
 		return
 	}
 
-	newOut, err := LogOutputOption(out.args)
+	newOut, err := out.reopen()
 	if err != nil {
 		log.Println("Can't reinitialize logger:", err)
 		return
@@ -20,9 +20,12 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 )
@@ -35,6 +38,9 @@ type matcher struct {
 	mapper        func(*Map, Node) (interface{}, error)
 	store         *reflect.Value
 
+	// Textual representation of defaultVal, nil if it is not known.
+	defaultArgs []string
+
 	customCallback func(*Map, Node) error
 }
 
@@ -62,6 +68,79 @@ type Map struct {
 	Globals map[string]interface{}
 	// Config block used by Process.
 	Block Node
+
+	defaults []Node
+}
+
+var (
+	defaultsRecorder   func(block Node, defaults []Node)
+	defaultsRecorderLk sync.Mutex
+)
+
+// RecordDefaults makes Map.Process report the directives that are not
+// specified in the processed block to f, along with their default values.
+// Only defaults of directives defined using typed helpers (String, Int,
+// Duration, etc) are known.
+//
+// It is used to produce the configuration dump with defaults filled in. Pass
+// nil to stop recording.
+func RecordDefaults(f func(block Node, defaults []Node)) {
+	defaultsRecorderLk.Lock()
+	defer defaultsRecorderLk.Unlock()
+	defaultsRecorder = f
+}
+
+func (m *Map) setDefaultArgs(name string, args ...string) {
+	if len(args) == 0 {
+		return
+	}
+	matcher := m.entries[name]
+	matcher.defaultArgs = args
+	m.entries[name] = matcher
+}
+
+func nonEmpty(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return []string{s}
+}
+
+func formatBool(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func formatDataSize(size int64) string {
+	switch {
+	case size == 0:
+		return "0"
+	case size%(1024*1024*1024) == 0:
+		return strconv.FormatInt(size/(1024*1024*1024), 10) + "G"
+	case size%(1024*1024) == 0:
+		return strconv.FormatInt(size/(1024*1024), 10) + "M"
+	case size%1024 == 0:
+		return strconv.FormatInt(size/1024, 10) + "K"
+	default:
+		return strconv.FormatInt(size, 10) + "B"
+	}
+}
+
+// locateErr prefixes the error with the location of the node unless the error
+// message already includes a location in the same file.
+func locateErr(node Node, err error) error {
+	if node.File == "" || strings.HasPrefix(err.Error(), node.File+":") {
+		return err
+	}
+	return fmt.Errorf("%s:%d: %w", node.File, node.Line, err)
+}
+
+// Defaults returns the directives that were not specified in the block
+// processed by the last Process call along with their default values.
+func (m *Map) Defaults() []Node {
+	return m.defaults
 }
 
 func NewMap(globals map[string]interface{}, block Node) *Map {
@@ -105,6 +184,7 @@ func (m *Map) EnumList(name string, inheritGlobal, required bool, allowed, defau
 
 		return node.Args, nil
 	}, store)
+	m.setDefaultArgs(name, defaultVal...)
 }
 
 // Enum maps a configuration directive to a string variable.
@@ -132,6 +212,7 @@ func (m *Map) Enum(name string, inheritGlobal, required bool, allowed []string,
 
 		return nil, NodeErr(node, "invalid argument, valid values are: %v", allowed)
 	}, store)
+	m.setDefaultArgs(name, nonEmpty(defaultVal)...)
 }
 
 // EnumMapped is similar to Map.Enum but maps a stirng to a custom type.
@@ -221,6 +302,7 @@ func (m *Map) Duration(name string, inheritGlobal, required bool, defaultVal tim
 
 		return dur, nil
 	}, store)
+	m.setDefaultArgs(name, defaultVal.String())
 }
 
 func ParseDataSize(s string) (int, error) {
@@ -303,6 +385,7 @@ func (m *Map) DataSize(name string, inheritGlobal, required bool, defaultVal int
 
 		return int64(dur), nil
 	}, store)
+	m.setDefaultArgs(name, formatDataSize(defaultVal))
 }
 
 // Bool maps presence of some configuration directive to a boolean variable.
@@ -335,6 +418,7 @@ func (m *Map) Bool(name string, inheritGlobal, defaultVal bool, store *bool) {
 		}
 		return nil, NodeErr(node, "bool argument should be 'yes' or 'no'")
 	}, store)
+	m.setDefaultArgs(name, formatBool(defaultVal))
 }
 
 // StringList maps configuration directive with the specified name to variable
@@ -358,6 +442,7 @@ func (m *Map) StringList(name string, inheritGlobal, required bool, defaultVal [
 
 		return node.Args, nil
 	}, store)
+	m.setDefaultArgs(name, defaultVal...)
 }
 
 // String maps configuration directive with the specified name to variable
@@ -380,6 +465,7 @@ func (m *Map) String(name string, inheritGlobal, required bool, defaultVal strin
 
 		return node.Args[0], nil
 	}, store)
+	m.setDefaultArgs(name, nonEmpty(defaultVal)...)
 }
 
 // Int maps configuration directive with the specified name to variable
@@ -406,6 +492,7 @@ func (m *Map) Int(name string, inheritGlobal, required bool, defaultVal int, sto
 		}
 		return i, nil
 	}, store)
+	m.setDefaultArgs(name, strconv.Itoa(defaultVal))
 }
 
 // UInt maps configuration directive with the specified name to variable
@@ -432,6 +519,7 @@ func (m *Map) UInt(name string, inheritGlobal, required bool, defaultVal uint, s
 		}
 		return uint(i), nil
 	}, store)
+	m.setDefaultArgs(name, strconv.FormatUint(uint64(defaultVal), 10))
 }
 
 // Int32 maps configuration directive with the specified name to variable
@@ -458,6 +546,7 @@ func (m *Map) Int32(name string, inheritGlobal, required bool, defaultVal int32,
 		}
 		return int32(i), nil
 	}, store)
+	m.setDefaultArgs(name, strconv.FormatInt(int64(defaultVal), 10))
 }
 
 // UInt32 maps configuration directive with the specified name to variable
@@ -484,6 +573,7 @@ func (m *Map) UInt32(name string, inheritGlobal, required bool, defaultVal uint3
 		}
 		return uint32(i), nil
 	}, store)
+	m.setDefaultArgs(name, strconv.FormatUint(uint64(defaultVal), 10))
 }
 
 // Int64 maps configuration directive with the specified name to variable
@@ -510,6 +600,7 @@ func (m *Map) Int64(name string, inheritGlobal, required bool, defaultVal int64,
 		}
 		return i, nil
 	}, store)
+	m.setDefaultArgs(name, strconv.FormatInt(defaultVal, 10))
 }
 
 // UInt64 maps configuration directive with the specified name to variable
@@ -536,6 +627,7 @@ func (m *Map) UInt64(name string, inheritGlobal, required bool, defaultVal uint6
 		}
 		return i, nil
 	}, store)
+	m.setDefaultArgs(name, strconv.FormatUint(defaultVal, 10))
 }
 
 // Float maps configuration directive with the specified name to variable
@@ -559,6 +651,7 @@ func (m *Map) Float(name string, inheritGlobal, required bool, defaultVal float6
 		}
 		return f, nil
 	}, store)
+	m.setDefaultArgs(name, strconv.FormatFloat(defaultVal, 'g', -1, 64))
 }
 
 // Custom maps configuration directive with the specified name to variable
@@ -645,6 +738,7 @@ func (m *Map) ProcessWith(globalCfg map[string]interface{}, block Node) (unknown
 	unknown = make([]Node, 0, len(block.Children))
 	matched := make(map[string]bool)
 	m.Values = make(map[string]interface{})
+	m.defaults = nil
 
 	for _, subnode := range block.Children {
 		matcher, ok := m.entries[subnode.Name]
@@ -658,7 +752,7 @@ func (m *Map) ProcessWith(globalCfg map[string]interface{}, block Node) (unknown
 
 		if matcher.customCallback != nil {
 			if err := matcher.customCallback(m, subnode); err != nil {
-				return nil, err
+				return nil, locateErr(subnode, err)
 			}
 			matched[subnode.Name] = true
 			continue
@@ -671,7 +765,7 @@ func (m *Map) ProcessWith(globalCfg map[string]interface{}, block Node) (unknown
 
 		val, err := matcher.mapper(m, subnode)
 		if err != nil {
-			return nil, err
+			return nil, locateErr(subnode, err)
 		}
 		m.Values[matcher.name] = val
 		if matcher.store != nil {
@@ -728,6 +822,20 @@ func (m *Map) ProcessWith(globalCfg map[string]interface{}, block Node) (unknown
 		if matcher.store != nil {
 			matcher.assign(val)
 		}
+		if !matcher.required && !(matcher.inheritGlobal && ok) && matcher.defaultArgs != nil {
+			m.defaults = append(m.defaults, Node{Name: matcher.name, Args: matcher.defaultArgs})
+		}
+	}
+
+	sort.Slice(m.defaults, func(i, j int) bool {
+		return m.defaults[i].Name < m.defaults[j].Name
+	})
+
+	defaultsRecorderLk.Lock()
+	recorder := defaultsRecorder
+	defaultsRecorderLk.Unlock()
+	if recorder != nil {
+		recorder(block, m.defaults)
 	}
 
 	return unknown, nil
@@ -19,7 +19,9 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package config
 
 import (
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestMapProcess(t *testing.T) {
@@ -493,3 +495,47 @@ func TestMap_Callback(t *testing.T) {
 		t.Error("Wrong directive returned in unmatched slice:", others[0].Name)
 	}
 }
+
+func TestMapDefaults(t *testing.T) {
+	cfg := Node{
+		Children: []Node{
+			{
+				Name: "foo",
+				Args: []string{"1"},
+			},
+		},
+	}
+
+	m := NewMap(map[string]interface{}{"quux": "global"}, cfg)
+
+	var (
+		foo, bar int
+		baz      time.Duration
+		size     int64
+		quux     string
+		custom   string
+	)
+	m.Int("foo", false, false, 5, &foo)
+	m.Int("bar", false, false, 5, &bar)
+	m.Duration("baz", false, false, 90*time.Second, &baz)
+	m.DataSize("size", false, false, 32*1024*1024, &size)
+	m.String("quux", true, false, "local", &quux)
+	m.Custom("custom", false, false, func() (interface{}, error) {
+		return "value", nil
+	}, func(_ *Map, n Node) (interface{}, error) {
+		return n.Args[0], nil
+	}, &custom)
+
+	if _, err := m.Process(); err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+
+	want := []Node{
+		{Name: "bar", Args: []string{"5"}},
+		{Name: "baz", Args: []string{"1m30s"}},
+		{Name: "size", Args: []string{"32M"}},
+	}
+	if !reflect.DeepEqual(m.Defaults(), want) {
+		t.Errorf("Wrong defaults:\nwant %+v\ngot  %+v", want, m.Defaults())
+	}
+}
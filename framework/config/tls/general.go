@@ -33,6 +33,17 @@ var strVersionsMap = map[string]uint16{
 	"":       0, // use crypto/tls defaults if value is not specified
 }
 
+// VersionName returns the name of TLS version as used in the configuration
+// (e.g. "tls1.2").
+func VersionName(version uint16) string {
+	for name, v := range strVersionsMap {
+		if v == version && name != "" {
+			return name
+		}
+	}
+	return "unknown"
+}
+
 var strCiphersMap = map[string]uint16{
 	// TLS 1.0 - 1.2 cipher suites.
 	"RSA-WITH-RC4128-SHA":                tls.TLS_RSA_WITH_RC4_128_SHA,
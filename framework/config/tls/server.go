@@ -68,6 +68,45 @@ func TLSDirective(m *config.Map, node config.Node) (interface{}, error) {
 	}, nil
 }
 
+// WithHandshakeHook returns a copy of the server TLS configuration returned by
+// TLSDirective that calls hook after each successful handshake.
+//
+// It is used by endpoints to collect statistics about negotiated TLS
+// parameters.
+func WithHandshakeHook(cfg *tls.Config, hook func(tls.ConnectionState)) *tls.Config {
+	if cfg == nil {
+		return nil
+	}
+
+	wrapVerify := func(c *tls.Config) {
+		verify := c.VerifyConnection
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			if verify != nil {
+				if err := verify(cs); err != nil {
+					return err
+				}
+			}
+			hook(cs)
+			return nil
+		}
+	}
+
+	cfg = cfg.Clone()
+	wrapVerify(cfg)
+	if getCfg := cfg.GetConfigForClient; getCfg != nil {
+		cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			c, err := getCfg(hello)
+			if err != nil || c == nil {
+				return c, err
+			}
+			c = c.Clone()
+			wrapVerify(c)
+			return c, nil
+		}
+	}
+	return cfg
+}
+
 func readTLSBlock(globals map[string]interface{}, blockNode config.Node) (*TLSConfig, error) {
 	baseCfg := tls.Config{}
 
@@ -26,6 +26,15 @@ import (
 
 var overrideServ string
 
+// OverrideServer makes DefaultResolver use the specified DNS server instead
+// of the system-wide configuration. It should be called before any modules
+// are initialized.
+//
+// The server argument is in form of "IP:PORT".
+func OverrideServer(server string) {
+	overrideServ = server
+}
+
 // override globally overrides the used DNS server address with one provided.
 // This function is meant only for testing. It should be called before any modules are
 // initialized to have full effect.
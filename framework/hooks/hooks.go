@@ -27,12 +27,13 @@ const (
 	EventShutdown Event = iota
 
 	// EventReload is triggered when the server process receives the SIGUSR2
-	// signal (on POSIX platforms) and indicates the request to reload the
-	// server configuration from persistent storage.
+	// signal (on POSIX platforms) or the reload is requested using the admin
+	// endpoint and indicates the request to reload the server configuration
+	// from persistent storage.
 	//
-	// Since it is by design problematic to reload the modules configuration,
-	// this event only applies to secondary files such as aliases mapping and
-	// TLS certificates.
+	// Changed configuration blocks are replaced before this event is
+	// triggered (see module.Reload), the event itself applies to secondary
+	// files such as aliases mapping and TLS certificates.
 	EventReload
 
 	// EventLogRotate is triggered when the server process receives the SIGUSR1
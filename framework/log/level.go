@@ -0,0 +1,94 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package log
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelError
+	LevelOff
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelError:
+		return "error"
+	case LevelOff:
+		return "off"
+	}
+	return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// ParseLevel returns the Level corresponding to the name returned
+// by Level.String.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "error":
+		return LevelError, nil
+	case "off":
+		return LevelOff, nil
+	}
+	return 0, fmt.Errorf("unknown log level: %s", s)
+}
+
+var moduleLevels atomic.Value // map[string]Level
+
+// SetModuleLevels sets the minimal level of messages written by loggers
+// with the specified names, overriding the Debug flag of the Logger.
+//
+// Level set for "name" also applies to loggers named "name/something"
+// unless there is a more specific entry.
+//
+// The map should not be modified after the call.
+func SetModuleLevels(levels map[string]Level) {
+	moduleLevels.Store(levels)
+}
+
+func moduleLevel(name string) (Level, bool) {
+	levels, _ := moduleLevels.Load().(map[string]Level)
+	if len(levels) == 0 {
+		return 0, false
+	}
+	for {
+		if lvl, ok := levels[name]; ok {
+			return lvl, true
+		}
+		i := strings.LastIndexByte(name, '/')
+		if i == -1 {
+			return 0, false
+		}
+		name = name[:i]
+	}
+}
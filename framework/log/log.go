@@ -57,25 +57,36 @@ func (l Logger) Zap() *zap.Logger {
 }
 
 func (l Logger) Debugf(format string, val ...interface{}) {
-	if !l.Debug {
+	if !l.DebugEnabled() {
 		return
 	}
-	l.log(true, l.formatMsg(fmt.Sprintf(format, val...), nil))
+	l.log(Entry{Level: LevelDebug, Message: fmt.Sprintf(format, val...)}, nil)
 }
 
 func (l Logger) Debugln(val ...interface{}) {
-	if !l.Debug {
+	if !l.DebugEnabled() {
 		return
 	}
-	l.log(true, l.formatMsg(strings.TrimRight(fmt.Sprintln(val...), "\n"), nil))
+	l.log(Entry{Level: LevelDebug, Message: strings.TrimRight(fmt.Sprintln(val...), "\n")}, nil)
 }
 
 func (l Logger) Printf(format string, val ...interface{}) {
-	l.log(false, l.formatMsg(fmt.Sprintf(format, val...), nil))
+	l.log(Entry{Level: LevelInfo, Message: fmt.Sprintf(format, val...)}, nil)
 }
 
 func (l Logger) Println(val ...interface{}) {
-	l.log(false, l.formatMsg(strings.TrimRight(fmt.Sprintln(val...), "\n"), nil))
+	l.log(Entry{Level: LevelInfo, Message: strings.TrimRight(fmt.Sprintln(val...), "\n")}, nil)
+}
+
+// DebugEnabled reports whether debug messages are written by the logger.
+//
+// The log level set for the logger name using SetModuleLevels takes
+// precedence over the Debug field.
+func (l Logger) DebugEnabled() bool {
+	if lvl, ok := moduleLevel(l.Name); ok {
+		return lvl == LevelDebug
+	}
+	return l.Debug
 }
 
 // Msg writes an event log message in a machine-readable format (currently
@@ -95,7 +106,7 @@ func (l Logger) Println(val ...interface{}) {
 func (l Logger) Msg(msg string, fields ...interface{}) {
 	m := make(map[string]interface{}, len(fields)/2)
 	fieldsToMap(fields, m)
-	l.log(false, l.formatMsg(msg, m))
+	l.log(Entry{Level: LevelInfo, Message: msg}, m)
 }
 
 // Error writes an event log message in a machine-readable format (currently
@@ -127,16 +138,16 @@ func (l Logger) Error(msg string, err error, fields ...interface{}) {
 	}
 	fieldsToMap(fields, allFields)
 
-	l.log(false, l.formatMsg(msg, allFields))
+	l.log(Entry{Level: LevelError, Message: msg}, allFields)
 }
 
 func (l Logger) DebugMsg(kind string, fields ...interface{}) {
-	if !l.Debug {
+	if !l.DebugEnabled() {
 		return
 	}
 	m := make(map[string]interface{}, len(fields)/2)
 	fieldsToMap(fields, m)
-	l.log(true, l.formatMsg(kind, m))
+	l.log(Entry{Level: LevelDebug, Message: kind}, m)
 }
 
 func fieldsToMap(fields []interface{}, out map[string]interface{}) {
@@ -159,28 +170,6 @@ func fieldsToMap(fields []interface{}, out map[string]interface{}) {
 	}
 }
 
-func (l Logger) formatMsg(msg string, fields map[string]interface{}) string {
-	formatted := strings.Builder{}
-
-	formatted.WriteString(msg)
-	formatted.WriteRune('\t')
-
-	if len(l.Fields)+len(fields) != 0 {
-		if fields == nil {
-			fields = make(map[string]interface{})
-		}
-		for k, v := range l.Fields {
-			fields[k] = v
-		}
-		if err := marshalOrderedJSON(&formatted, fields); err != nil {
-			// Fallback to printing the message with minimal processing.
-			return fmt.Sprintf("[BROKEN FORMATTING: %v] %v %+v", err, msg, fields)
-		}
-	}
-
-	return formatted.String()
-}
-
 type LogFormatter interface {
 	FormatLog() string
 }
@@ -189,7 +178,7 @@ type LogFormatter interface {
 // to it will be written as a separate log messages.
 // No line-buffering is done.
 func (l Logger) Write(s []byte) (int, error) {
-	l.log(false, strings.TrimRight(string(s), "\n"))
+	l.log(Entry{Level: LevelInfo, Message: strings.TrimRight(string(s), "\n"), Raw: true}, nil)
 	return len(s), nil
 }
 
@@ -197,28 +186,45 @@ func (l Logger) Write(s []byte) (int, error) {
 // but will use debug flag on messages. If Logger.Debug is false,
 // Write method of returned object will be no-op.
 func (l Logger) DebugWriter() io.Writer {
-	if !l.Debug {
+	if !l.DebugEnabled() {
 		return io.Discard
 	}
 	l.Debug = true
 	return &l
 }
 
-func (l Logger) log(debug bool, s string) {
-	if l.Name != "" {
-		s = l.Name + ": " + s
+func (l Logger) log(e Entry, fields map[string]interface{}) {
+	if lvl, ok := moduleLevel(l.Name); ok && e.Level < lvl {
+		return
 	}
 
-	if l.Out != nil {
-		l.Out.Write(time.Now(), debug, s)
-		return
+	out := l.Out
+	if out == nil {
+		out = DefaultLogger.Out
 	}
-	if DefaultLogger.Out != nil {
-		DefaultLogger.Out.Write(time.Now(), debug, s)
+	if out == nil {
+		// Logging is disabled - do nothing.
 		return
 	}
 
-	// Logging is disabled - do nothing.
+	if !e.Raw {
+		if fields == nil && len(l.Fields) != 0 {
+			fields = make(map[string]interface{}, len(l.Fields))
+		}
+		for k, v := range l.Fields {
+			fields[k] = v
+		}
+	}
+
+	e.Stamp = time.Now()
+	e.Module = l.Name
+	e.Fields = fields
+
+	if eo, ok := out.(EntryOutput); ok {
+		eo.WriteEntry(e)
+		return
+	}
+	out.Write(e.Stamp, e.Level == LevelDebug, e.Format())
 }
 
 // DefaultLogger is the global Logger object that is used by
@@ -0,0 +1,70 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package log
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONOutput(t *testing.T) {
+	var buf strings.Builder
+	l := Logger{
+		Out:    JSONOutput(nopCloser{&buf}),
+		Name:   "smtp",
+		Fields: map[string]interface{}{"msg_id": "abc"},
+	}
+	l.Msg("accepted", "message_id", "<x@example.org>")
+
+	want := `{"ts":"` + `","level":"info","module":"smtp","msg":"accepted","fields":{"message_id":"\u003cx@example.org\u003e","msg_id":"abc"}}` + "\n"
+	got := buf.String()
+	// Cut the timestamp.
+	if i, j := strings.Index(got, `"ts":"`), strings.Index(got, `","level"`); i != -1 && j != -1 {
+		got = got[:i+6] + got[j:]
+	}
+	if got != want {
+		t.Errorf("Wrong JSON output:\n got  %s want %s", got, want)
+	}
+}
+
+func TestModuleLevels(t *testing.T) {
+	var lines []string
+	out := FuncOutput(func(_ time.Time, _ bool, msg string) {
+		lines = append(lines, msg)
+	}, func() error { return nil })
+
+	SetModuleLevels(map[string]Level{
+		"smtp":          LevelDebug,
+		"smtp/pipeline": LevelError,
+	})
+	defer SetModuleLevels(nil)
+
+	Logger{Out: out, Name: "smtp"}.Debugf("1")
+	Logger{Out: out, Name: "smtp/sasl"}.Debugf("2")
+	Logger{Out: out, Name: "smtp/pipeline"}.Printf("3")
+	Logger{Out: out, Name: "smtp/pipeline"}.Error("4", os.ErrNotExist)
+	Logger{Out: out, Name: "remote"}.Debugf("5")
+
+	want := []string{"smtp: 1\t", "smtp/sasl: 2\t", "smtp/pipeline: 4\t{\"reason\":\"file does not exist\"}"}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Wrong messages written:\n got  %q\n want %q", lines, want)
+	}
+}
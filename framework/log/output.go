@@ -19,6 +19,8 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package log
 
 import (
+	"fmt"
+	"strings"
 	"time"
 )
 
@@ -27,6 +29,53 @@ type Output interface {
 	Close() error
 }
 
+// Entry is a single log message before formatting.
+type Entry struct {
+	Stamp   time.Time
+	Level   Level
+	Module  string
+	Message string
+	Fields  map[string]interface{}
+
+	// Raw is set for messages written using Logger.Write, these
+	// are not formatted and have no fields.
+	Raw bool
+}
+
+// Format returns the message in the text format used by Logger
+// for Output.Write.
+//
+//	module: message\t{"key":"value"}
+func (e Entry) Format() string {
+	formatted := strings.Builder{}
+	if e.Module != "" {
+		formatted.WriteString(e.Module)
+		formatted.WriteString(": ")
+	}
+	formatted.WriteString(e.Message)
+	if e.Raw {
+		return formatted.String()
+	}
+	formatted.WriteRune('\t')
+
+	if len(e.Fields) != 0 {
+		if err := marshalOrderedJSON(&formatted, e.Fields); err != nil {
+			// Fallback to printing the message with minimal processing.
+			return fmt.Sprintf("[BROKEN FORMATTING: %v] %v %+v", err, e.Message, e.Fields)
+		}
+	}
+
+	return formatted.String()
+}
+
+// EntryOutput is implemented by Output implementations that format
+// messages on their own. Logger passes messages to WriteEntry instead of
+// Write if it is available.
+type EntryOutput interface {
+	Output
+	WriteEntry(e Entry)
+}
+
 type multiOut struct {
 	outs []Output
 }
@@ -37,6 +86,20 @@ func (m multiOut) Write(stamp time.Time, debug bool, msg string) {
 	}
 }
 
+func (m multiOut) WriteEntry(e Entry) {
+	var formatted string
+	for _, out := range m.outs {
+		if eo, ok := out.(EntryOutput); ok {
+			eo.WriteEntry(e)
+			continue
+		}
+		if formatted == "" {
+			formatted = e.Format()
+		}
+		out.Write(e.Stamp, e.Level == LevelDebug, formatted)
+	}
+}
+
 func (m multiOut) Close() error {
 	for _, out := range m.outs {
 		if err := out.Close(); err != nil {
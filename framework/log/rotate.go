@@ -0,0 +1,259 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package log
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotateStampFormat is the format of the timestamp added to the names of
+// rotated files. It is chosen so lexicographical order of names matches
+// the chronological one.
+const rotateStampFormat = "2006-01-02T15-04-05.000"
+
+// openFile is replaced in tests to simulate failures.
+var openFile = os.OpenFile
+
+// RotateOptions control the log file rotation done by RotatingFile.
+type RotateOptions struct {
+	// Rotate the file once its size would exceed MaxSize bytes.
+	// Zero disables size-based rotation.
+	MaxSize int64
+
+	// Rotate the file when the current time crosses the boundary of
+	// Interval (e.g. midnight UTC for 24h). Zero disables time-based
+	// rotation.
+	Interval time.Duration
+
+	// Amount of rotated files to keep, older ones are removed.
+	// Zero means keep all files.
+	MaxBackups int
+
+	// Compress rotated files using gzip.
+	Compress bool
+}
+
+type rotatingFile struct {
+	path string
+	opts RotateOptions
+
+	lck     sync.Mutex
+	f       *os.File
+	size    int64
+	started time.Time
+
+	cleanupLck sync.Mutex
+	cleanupWg  sync.WaitGroup
+}
+
+// RotatingFile opens the file for appending and returns io.WriteCloser
+// that renames it to path.TIMESTAMP and creates a new one when conditions
+// set in opts are met.
+//
+// Removal of old files and compression are done in background, Close
+// waits for them to complete.
+func RotatingFile(path string, opts RotateOptions) (io.WriteCloser, error) {
+	rf := &rotatingFile{
+		path: path,
+		opts: opts,
+	}
+	if err := rf.open(time.Now()); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open(now time.Time) error {
+	f, err := openFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o666)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	rf.f = f
+	rf.size = info.Size()
+	rf.started = now
+	if rf.size != 0 {
+		// File already contains messages written since the last
+		// modification at least.
+		rf.started = info.ModTime()
+	}
+	return nil
+}
+
+func (rf *rotatingFile) shouldRotate(now time.Time, n int) bool {
+	if rf.size == 0 {
+		return false
+	}
+	if rf.opts.MaxSize > 0 && rf.size+int64(n) > rf.opts.MaxSize {
+		return true
+	}
+	if rf.opts.Interval > 0 && !now.Truncate(rf.opts.Interval).Equal(rf.started.Truncate(rf.opts.Interval)) {
+		return true
+	}
+	return false
+}
+
+// rotate renames the current file and opens a new one. On failure, the
+// current file is kept open so messages are not lost, rotation is retried on
+// the next write.
+func (rf *rotatingFile) rotate(now time.Time) error {
+	rotated := rf.path + "." + now.UTC().Format(rotateStampFormat)
+	if err := os.Rename(rf.path, rotated); err != nil {
+		return err
+	}
+	old := rf.f
+	if err := rf.open(now); err != nil {
+		// Move the file back so the retry does not leave multiple
+		// partially filled files behind.
+		if err := os.Rename(rotated, rf.path); err != nil {
+			fmt.Fprintf(os.Stderr, "!!! Failed to restore log file name: %v\n", err)
+		}
+		return err
+	}
+	if err := old.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "!!! Failed to close rotated log file: %v\n", err)
+	}
+
+	rf.cleanupWg.Add(1)
+	go func() {
+		defer rf.cleanupWg.Done()
+		rf.cleanup(rotated)
+	}()
+	return nil
+}
+
+func (rf *rotatingFile) cleanup(rotated string) {
+	rf.cleanupLck.Lock()
+	defer rf.cleanupLck.Unlock()
+
+	if rf.opts.Compress {
+		if err := compressFile(rotated); err != nil {
+			fmt.Fprintf(os.Stderr, "!!! Failed to compress rotated log file: %v\n", err)
+		}
+	}
+
+	if rf.opts.MaxBackups <= 0 {
+		return
+	}
+	backups, err := rf.backups()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "!!! Failed to list rotated log files: %v\n", err)
+		return
+	}
+	for len(backups) > rf.opts.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "!!! Failed to remove rotated log file: %v\n", err)
+		}
+		backups = backups[1:]
+	}
+}
+
+// backups returns the list of rotated files, oldest first.
+func (rf *rotatingFile) backups() ([]string, error) {
+	dir, base := filepath.Split(rf.path)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []string
+	for _, e := range entries {
+		stamp := strings.TrimPrefix(e.Name(), base+".")
+		if stamp == e.Name() {
+			continue
+		}
+		stamp = strings.TrimSuffix(stamp, ".gz")
+		if _, err := time.Parse(rotateStampFormat, stamp); err != nil {
+			continue
+		}
+		backups = append(backups, filepath.Join(dir, e.Name()))
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o666)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(dst.Name())
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (rf *rotatingFile) Write(b []byte) (int, error) {
+	rf.lck.Lock()
+	defer rf.lck.Unlock()
+
+	now := time.Now()
+	if rf.shouldRotate(now, len(b)) {
+		if err := rf.rotate(now); err != nil {
+			fmt.Fprintf(os.Stderr, "!!! Failed to rotate log file: %v\n", err)
+		}
+	}
+
+	n, err := rf.f.Write(b)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.lck.Lock()
+	err := rf.f.Close()
+	rf.lck.Unlock()
+
+	rf.cleanupWg.Wait()
+	return err
+}
@@ -0,0 +1,180 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package log
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile_Size(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "maddy.log")
+
+	f, err := RotatingFile(path, RotateOptions{
+		MaxSize:    10,
+		MaxBackups: 2,
+		Compress:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"line 1\n", "line 2\n", "line 3\n", "line 4\n"} {
+		if _, err := io.WriteString(f, line); err != nil {
+			t.Fatal(err)
+		}
+		// Make sure rotated files get different names.
+		time.Sleep(2 * time.Millisecond)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(current) != "line 4\n" {
+		t.Errorf("Wrong current file contents: %q", current)
+	}
+
+	backups, err := (&rotatingFile{path: path}).backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("Wrong amount of rotated files kept: %v", backups)
+	}
+	for i, want := range []string{"line 2\n", "line 3\n"} {
+		if !strings.HasSuffix(backups[i], ".gz") {
+			t.Fatalf("Rotated file is not compressed: %v", backups[i])
+		}
+		bf, err := os.Open(backups[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		gz, err := gzip.NewReader(bf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := io.ReadAll(gz)
+		bf.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != want {
+			t.Errorf("Wrong contents of %v: %q", backups[i], contents)
+		}
+	}
+}
+
+func TestRotatingFile_Interval(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "maddy.log")
+
+	if err := os.WriteFile(path, []byte("old\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	yesterday := time.Now().Add(-24 * time.Hour)
+	if err := os.Chtimes(path, yesterday, yesterday); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := RotatingFile(path, RotateOptions{Interval: 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(f, "new 1\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(f, "new 2\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(current) != "new 1\nnew 2\n" {
+		t.Errorf("Wrong current file contents: %q", current)
+	}
+	backups, err := (&rotatingFile{path: path}).backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 {
+		t.Fatalf("Expected one rotated file, got %v", backups)
+	}
+}
+
+func TestRotatingFile_OpenFailure(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "maddy.log")
+
+	f, err := RotatingFile(path, RotateOptions{MaxSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := io.WriteString(f, "line 1\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	openFile = func(string, int, os.FileMode) (*os.File, error) {
+		return nil, os.ErrPermission
+	}
+	_, err = io.WriteString(f, "line 2\n")
+	openFile = os.OpenFile
+	if err != nil {
+		t.Fatal("Write failed after failed rotation:", err)
+	}
+	if _, err := io.WriteString(f, "line 3\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(current) != "line 3\n" {
+		t.Errorf("Wrong current file contents: %q", current)
+	}
+	backups, err := (&rotatingFile{path: path}).backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 {
+		t.Fatalf("Wrong amount of rotated files: %v", backups)
+	}
+	contents, err := os.ReadFile(backups[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "line 1\nline 2\n" {
+		t.Errorf("Wrong contents of the rotated file: %q", contents)
+	}
+}
@@ -19,6 +19,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package log
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -91,5 +92,67 @@ func (nc nopCloser) Close() error {
 // systems have atomic (read: thread-safe) implementations for
 // stream I/O, so it should be safe to use WriterOutput with os.File.
 func WriterOutput(w io.Writer, timestamps bool) Output {
-	return wcOutput{timestamps, nopCloser{os.Stderr}}
+	return wcOutput{timestamps, nopCloser{w}}
+}
+
+type jsonOutput struct {
+	wc io.WriteCloser
+}
+
+func (j jsonOutput) Write(stamp time.Time, debug bool, msg string) {
+	lvl := LevelInfo
+	if debug {
+		lvl = LevelDebug
+	}
+	j.WriteEntry(Entry{Stamp: stamp, Level: lvl, Message: msg, Raw: true})
+}
+
+func (j jsonOutput) WriteEntry(e Entry) {
+	builder := strings.Builder{}
+	builder.WriteString(`{"ts":"`)
+	builder.WriteString(e.Stamp.UTC().Format("2006-01-02T15:04:05.000Z"))
+	builder.WriteString(`","level":"`)
+	builder.WriteString(e.Level.String())
+	builder.WriteString(`"`)
+	if e.Module != "" {
+		builder.WriteString(`,"module":`)
+		writeJSONString(&builder, e.Module)
+	}
+	builder.WriteString(`,"msg":`)
+	writeJSONString(&builder, e.Message)
+	if len(e.Fields) != 0 {
+		builder.WriteString(`,"fields":`)
+		fields := strings.Builder{}
+		if err := marshalOrderedJSON(&fields, e.Fields); err != nil {
+			writeJSONString(&builder, fmt.Sprintf("[BROKEN FORMATTING: %v] %+v", err, e.Fields))
+		} else {
+			builder.WriteString(fields.String())
+		}
+	}
+	builder.WriteString("}\n")
+
+	if _, err := io.WriteString(j.wc, builder.String()); err != nil {
+		fmt.Fprintf(os.Stderr, "!!! Failed to write message to log: %v\n", err)
+	}
+}
+
+func (j jsonOutput) Close() error {
+	return j.wc.Close()
+}
+
+func writeJSONString(b *strings.Builder, s string) {
+	// Marshal never fails for strings.
+	val, _ := json.Marshal(s)
+	b.Write(val)
+}
+
+// JSONOutput returns a log.Output implementation that writes
+// messages to the provided io.WriteCloser as JSON objects, one per line:
+//
+//	{"ts":"2006-01-02T15:04:05.000Z","level":"info","module":"smtp","msg":"accepted","fields":{"msg_id":"..."}}
+//
+// Closing returned log.Output object will close the underlying
+// io.WriteCloser. As with WriteCloserOutput, no serialization is provided.
+func JSONOutput(wc io.WriteCloser) Output {
+	return jsonOutput{wc}
 }
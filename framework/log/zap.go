@@ -11,7 +11,7 @@ type zapLogger struct {
 }
 
 func (l zapLogger) Enabled(level zapcore.Level) bool {
-	if l.L.Debug {
+	if l.L.DebugEnabled() {
 		return true
 	}
 	return level > zapcore.DebugLevel
@@ -48,7 +48,14 @@ func (l zapLogger) Write(entry zapcore.Entry, fields []zapcore.Field) error {
 	if entry.LoggerName != "" {
 		l.L.Name += "/" + entry.LoggerName
 	}
-	l.L.log(entry.Level == zapcore.DebugLevel, l.L.formatMsg(entry.Message, enc.Fields))
+	lvl := LevelInfo
+	switch {
+	case entry.Level == zapcore.DebugLevel:
+		lvl = LevelDebug
+	case entry.Level >= zapcore.ErrorLevel:
+		lvl = LevelError
+	}
+	l.L.log(Entry{Level: lvl, Message: entry.Message}, enc.Fields)
 	return nil
 }
 
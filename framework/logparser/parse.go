@@ -62,11 +62,105 @@ func (m MalformedMsg) Error() string {
 // JSON context values are unmarshalled without any additional processing,
 // notably that means that all numbers are represented as float64.
 func Parse(line string) (Msg, error) {
+	m, text, err := splitContext(line)
+	if err != nil {
+		return Msg{}, err
+	}
+
+	// Okay, the first one might contain the timestamp at start.
+	// Cut it away.
+	msgParts := strings.SplitN(text, " ", 2)
+	if len(msgParts) == 1 {
+		return Msg{}, MalformedMsg{Desc: "missing a timestamp"}
+	}
+
+	m.Stamp, err = time.ParseInLocation(ISO8601_UTC, msgParts[0], time.UTC)
+	if err != nil {
+		return Msg{}, MalformedMsg{Desc: "timestamp parse", Err: err}
+	}
+
+	parseText(&m, msgParts[1])
+	return m, nil
+}
+
+// ParseJSON parses the message from the maddy log in JSON format
+// (as written by the log target with 'format json').
+func ParseJSON(line string) (Msg, error) {
+	var obj struct {
+		Stamp   string                 `json:"ts"`
+		Level   string                 `json:"level"`
+		Module  string                 `json:"module"`
+		Message string                 `json:"msg"`
+		Fields  map[string]interface{} `json:"fields"`
+	}
+	if err := json.Unmarshal([]byte(line), &obj); err != nil {
+		return Msg{}, MalformedMsg{Desc: "json unmarshal", Err: err}
+	}
+
+	stamp, err := time.ParseInLocation(ISO8601_UTC, obj.Stamp, time.UTC)
+	if err != nil {
+		return Msg{}, MalformedMsg{Desc: "timestamp parse", Err: err}
+	}
+
+	m := Msg{
+		Stamp:   stamp,
+		Debug:   obj.Level == "debug",
+		Module:  obj.Module,
+		Message: obj.Message,
+		Context: obj.Fields,
+	}
+	if m.Context == nil {
+		m.Context = map[string]interface{}{}
+	}
+	return m, nil
+}
+
+// journalStampLayouts are the timestamp formats used by journalctl short-iso
+// and short-iso-precise output modes across systemd versions.
+var journalStampLayouts = []string{
+	"2006-01-02T15:04:05-0700",
+	"2006-01-02T15:04:05.000000-0700",
+	time.RFC3339,
+	time.RFC3339Nano,
+}
+
+// ParseJournal parses the message from the journald output.
+//
+// Both 'journalctl -o short-iso' (and short-iso-precise) and
+// 'journalctl -o cat' formats are accepted. In the latter case,
+// Stamp of the returned message is zero.
+func ParseJournal(line string) (Msg, error) {
+	m, text, err := splitContext(line)
+	if err != nil {
+		return Msg{}, err
+	}
+
+	// short-iso format is "TIMESTAMP HOSTNAME IDENTIFIER[PID]: MESSAGE".
+	fields := strings.SplitN(text, " ", 4)
+	if len(fields) == 4 && strings.HasSuffix(fields[2], ":") {
+		for _, layout := range journalStampLayouts {
+			stamp, err := time.Parse(layout, fields[0])
+			if err != nil {
+				continue
+			}
+			m.Stamp = stamp.UTC()
+			text = fields[3]
+			break
+		}
+	}
+
+	parseText(&m, text)
+	return m, nil
+}
+
+// splitContext splits the line into the message text and the JSON context
+// that follows the tab separator.
+func splitContext(line string) (Msg, string, error) {
 	parts := strings.Split(line, "\t")
 	if len(parts) != 2 {
 		// All messages even without a Context have a trailing \t,
 		// so this one is obviously malformed.
-		return Msg{}, MalformedMsg{Desc: "missing a tab separator"}
+		return Msg{}, "", MalformedMsg{Desc: "missing a tab separator"}
 	}
 
 	m := Msg{
@@ -77,24 +171,16 @@ func Parse(line string) (Msg, error) {
 	// if there is none.
 	if len(parts[1]) != 0 {
 		if err := json.Unmarshal([]byte(parts[1]), &m.Context); err != nil {
-			return Msg{}, MalformedMsg{Desc: "context unmarshal", Err: err}
+			return Msg{}, "", MalformedMsg{Desc: "context unmarshal", Err: err}
 		}
 	}
 
-	// Okay, the first one might contain the timestamp at start.
-	// Cut it away.
-	msgParts := strings.SplitN(parts[0], " ", 2)
-	if len(msgParts) == 1 {
-		return Msg{}, MalformedMsg{Desc: "missing a timestamp"}
-	}
-
-	var err error
-	m.Stamp, err = time.ParseInLocation(ISO8601_UTC, msgParts[0], time.UTC)
-	if err != nil {
-		return Msg{}, MalformedMsg{Desc: "timestamp parse", Err: err}
-	}
+	return m, parts[0], nil
+}
 
-	msgText := msgParts[1]
+// parseText fills Debug, Module and Message fields of m from the message text
+// that follows the timestamp.
+func parseText(m *Msg, msgText string) {
 	if strings.HasPrefix(msgText, "[debug] ") {
 		msgText = strings.TrimPrefix(msgText, "[debug] ")
 		m.Debug = true
@@ -104,21 +190,19 @@ func Parse(line string) (Msg, error) {
 	if len(moduleText) == 1 {
 		// No module prefix, that's fine.
 		m.Message = msgText
-		return m, nil
+		return
 	}
 
 	for _, ch := range moduleText[0] {
 		switch {
-		case unicode.IsDigit(ch), unicode.IsLetter(ch), ch == '/':
+		case unicode.IsDigit(ch), unicode.IsLetter(ch), ch == '/', ch == '.', ch == '_':
 		default:
 			// This is not a module prefix, don't treat it as such.
 			m.Message = msgText
-			return m, nil
+			return
 		}
 	}
 
 	m.Module = moduleText[0]
 	m.Message = moduleText[1]
-
-	return m, nil
 }
@@ -106,8 +106,85 @@ func TestParse(t *testing.T) {
 			"b": "bbb",
 		},
 	}, "")
+	test("2006-01-02T15:04:05.000Z check.dkim: hello\t", Msg{
+		Stamp:   time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC),
+		Module:  "check.dkim",
+		Message: "hello",
+		Context: map[string]interface{}{},
+	}, "")
 	test("module: hello\t", Msg{}, "timestamp parse")
 	test("hello\t", Msg{}, "missing a timestamp")
 	test("2006-01-02T15:04:05.000Z module: hello", Msg{}, "missing a tab separator")
 	test("2006-01-02T15:04:05.000Z [BROKEN FORMATTING: json: wtf lol omg]: hello map[stringasdasd]", Msg{}, "missing a tab separator")
 }
+
+func TestParseJournal(t *testing.T) {
+	test := func(line string, msg Msg) {
+		t.Helper()
+
+		parsed, err := ParseJournal(line)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+			return
+		}
+		if !reflect.DeepEqual(parsed, msg) {
+			t.Errorf("Wrong ParseJournal result,\n got  %#+v\n want %#+v", parsed, msg)
+		}
+	}
+
+	test("2006-01-02T15:04:05+0000 mx maddy[123]: smtp: hello\t{\"a\":1}", Msg{
+		Stamp:   time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC),
+		Module:  "smtp",
+		Message: "hello",
+		Context: map[string]interface{}{
+			"a": float64(1),
+		},
+	})
+	test("2006-01-02T17:04:05.123456+0200 mx maddy[123]: [debug] queue: hello\t", Msg{
+		Stamp:   time.Date(2006, time.January, 2, 15, 4, 5, 123456000, time.UTC),
+		Debug:   true,
+		Module:  "queue",
+		Message: "hello",
+		Context: map[string]interface{}{},
+	})
+	test("2006-01-02T15:04:05+00:00 mx maddy[123]: smtp: hello\t", Msg{
+		Stamp:   time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC),
+		Module:  "smtp",
+		Message: "hello",
+		Context: map[string]interface{}{},
+	})
+	test("smtp: hello\t{\"a\":1}", Msg{
+		Module:  "smtp",
+		Message: "hello",
+		Context: map[string]interface{}{
+			"a": float64(1),
+		},
+	})
+
+	if _, err := ParseJournal("smtp: hello"); err == nil {
+		t.Errorf("Expected an error for a line without a tab separator")
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	msg, err := ParseJSON(`{"ts":"2006-01-02T15:04:05.000Z","level":"debug","module":"smtp","msg":"hello","fields":{"a":1}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Msg{
+		Stamp:   time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC),
+		Debug:   true,
+		Module:  "smtp",
+		Message: "hello",
+		Context: map[string]interface{}{
+			"a": float64(1),
+		},
+	}
+	if !reflect.DeepEqual(msg, want) {
+		t.Errorf("Wrong ParseJSON result,\n got  %#+v\n want %#+v", msg, want)
+	}
+
+	if _, err := ParseJSON(`{"ts":"yesterday","msg":"hello"}`); err == nil {
+		t.Errorf("Expected an error for a malformed timestamp")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"io"
+	"time"
 )
 
 type Blob interface {
@@ -44,3 +45,23 @@ type BlobStore interface {
 	// Delete removes a set of keys from store. Non-existent keys are ignored.
 	Delete(ctx context.Context, keys []string) error
 }
+
+// BlobInfo describes a stored blob.
+type BlobInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// ListableBlobStore is implemented by blob stores that can enumerate stored
+// objects. It is used to check the consistency of the storage.
+type ListableBlobStore interface {
+	BlobStore
+
+	// List calls fn for each stored blob. Iteration is stopped and the error
+	// is returned if fn returns an error.
+	//
+	// Blobs created or removed while List is running may or may not be
+	// reported.
+	List(ctx context.Context, fn func(BlobInfo) error) error
+}
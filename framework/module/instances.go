@@ -21,20 +21,50 @@ package module
 import (
 	"fmt"
 	"io"
+	"sort"
+	"sync"
 
 	"github.com/foxcpp/maddy/framework/config"
-	"github.com/foxcpp/maddy/framework/hooks"
 	"github.com/foxcpp/maddy/framework/log"
 )
 
+type instance struct {
+	mod Module
+	cfg *config.Map
+
+	// ready is set when Init completes successfully.
+	ready bool
+}
+
+// openedInstance is an initialized instance that needs to be closed.
+type openedInstance struct {
+	mod Module
+
+	// owner is the instance that was being initialized when mod was
+	// initialized, for modules defined inline. It is nil for
+	// configuration blocks and endpoints.
+	owner Module
+}
+
 var (
-	instances = make(map[string]struct {
-		mod Module
-		cfg *config.Map
-	})
-	aliases = make(map[string]string)
+	// instancesLck protects instances, aliases and Initialized. It is not
+	// held during module initialization since it can recursively request
+	// other instances.
+	instancesLck sync.RWMutex
+	instances    = make(map[string]instance)
+	aliases      = make(map[string]string)
 
 	Initialized = make(map[string]bool)
+
+	// opened contains initialized instances implementing io.Closer in
+	// the initialization order. prevOpened is the list from before the last
+	// ResetInstances, it is used to carry inline modules of the kept
+	// instances over.
+	opened     []openedInstance
+	prevOpened []openedInstance
+
+	// initStack contains instances that are being initialized at the moment.
+	initStack []Module
 )
 
 // RegisterInstance adds module instance to the global registry.
@@ -42,10 +72,9 @@ var (
 // Instance name must be unique. Second RegisterInstance with same instance
 // name will replace previous.
 func RegisterInstance(inst Module, cfg *config.Map) {
-	instances[inst.InstanceName()] = struct {
-		mod Module
-		cfg *config.Map
-	}{inst, cfg}
+	instancesLck.Lock()
+	defer instancesLck.Unlock()
+	instances[inst.InstanceName()] = instance{mod: inst, cfg: cfg}
 }
 
 // RegisterAlias creates an association between a certain name and instance name.
@@ -53,10 +82,15 @@ func RegisterInstance(inst Module, cfg *config.Map) {
 // After RegisterAlias, module.GetInstance(aliasName) will return the same
 // result as module.GetInstance(instName).
 func RegisterAlias(aliasName, instName string) {
+	instancesLck.Lock()
+	defer instancesLck.Unlock()
 	aliases[aliasName] = instName
 }
 
 func HasInstance(name string) bool {
+	instancesLck.RLock()
+	defer instancesLck.RUnlock()
+
 	aliasedName := aliases[name]
 	if aliasedName != "" {
 		name = aliasedName
@@ -66,12 +100,107 @@ func HasInstance(name string) bool {
 	return ok
 }
 
+// HasInitialized reports whether the module instance with the specified name
+// was successfully initialized.
+func HasInitialized(name string) bool {
+	instancesLck.RLock()
+	defer instancesLck.RUnlock()
+	return instances[name].ready
+}
+
+// MarkInitialized registers already initialized module instance in the
+// global registry so GetInstance will not call Init for it again.
+//
+// It is used to keep unchanged instances during configuration reload.
+func MarkInitialized(inst Module, cfg *config.Map) {
+	instancesLck.Lock()
+	defer instancesLck.Unlock()
+	instances[inst.InstanceName()] = instance{mod: inst, cfg: cfg, ready: true}
+	Initialized[inst.InstanceName()] = true
+	keepInstance(inst)
+}
+
+// KeepInstance records the already initialized instance that is not in the
+// global registry (an endpoint) as used by the current set of instances.
+//
+// It is used to keep unchanged endpoints during configuration reload.
+func KeepInstance(inst Module) {
+	instancesLck.Lock()
+	defer instancesLck.Unlock()
+	keepInstance(inst)
+}
+
+// keepInstance moves inst and the inline modules it owns from prevOpened to
+// opened. instancesLck should be held.
+func keepInstance(inst Module) {
+	owners := map[Module]bool{inst: true}
+	var kept []openedInstance
+	// Owners are initialized after the modules they own, so walk the list
+	// backwards to find transitively owned modules.
+	for i := len(prevOpened) - 1; i >= 0; i-- {
+		o := prevOpened[i]
+		if o.mod == inst || (o.owner != nil && owners[o.owner]) {
+			owners[o.mod] = true
+			kept = append(kept, openedInstance{mod: o.mod, owner: o.owner})
+		}
+	}
+	for i := len(kept) - 1; i >= 0; i-- {
+		if kept[i].mod == inst {
+			kept[i].owner = nil
+		}
+		opened = append(opened, kept[i])
+	}
+}
+
+// InitInstance initializes the module instance that is not in the global
+// registry, such as an endpoint or an inline module definition, and records
+// it so it is closed together with the other instances.
+func InitInstance(inst Module, cfg *config.Map) error {
+	instancesLck.Lock()
+	var owner Module
+	if len(initStack) != 0 {
+		owner = initStack[len(initStack)-1]
+	}
+	instancesLck.Unlock()
+
+	if err := initInstance(inst, cfg); err != nil {
+		return err
+	}
+
+	instancesLck.Lock()
+	defer instancesLck.Unlock()
+	if _, ok := inst.(io.Closer); ok {
+		opened = append(opened, openedInstance{mod: inst, owner: owner})
+	}
+	return nil
+}
+
+func initInstance(inst Module, cfg *config.Map) error {
+	instancesLck.Lock()
+	initStack = append(initStack, inst)
+	instancesLck.Unlock()
+
+	defer func() {
+		instancesLck.Lock()
+		defer instancesLck.Unlock()
+		for i := len(initStack) - 1; i >= 0; i-- {
+			if initStack[i] == inst {
+				initStack = append(initStack[:i], initStack[i+1:]...)
+				break
+			}
+		}
+	}()
+
+	return inst.Init(cfg)
+}
+
 // GetInstance returns module instance from global registry, initializing it if
 // necessary.
 //
 // Error is returned if module initialization fails or module instance does not
 // exists.
 func GetInstance(name string) (Module, error) {
+	instancesLck.Lock()
 	aliasedName := aliases[name]
 	if aliasedName != "" {
 		name = aliasedName
@@ -79,27 +208,116 @@ func GetInstance(name string) (Module, error) {
 
 	mod, ok := instances[name]
 	if !ok {
+		instancesLck.Unlock()
 		return nil, fmt.Errorf("unknown config block: %s", name)
 	}
 
 	// Break circular dependencies.
 	if Initialized[name] {
+		instancesLck.Unlock()
 		return mod.mod, nil
 	}
 
 	Initialized[name] = true
-	if err := mod.mod.Init(mod.cfg); err != nil {
+	instancesLck.Unlock()
+
+	if err := initInstance(mod.mod, mod.cfg); err != nil {
 		return mod.mod, err
 	}
 
-	if closer, ok := mod.mod.(io.Closer); ok {
-		hooks.AddHook(hooks.EventShutdown, func() {
-			log.Debugf("close %s (%s)", mod.mod.Name(), mod.mod.InstanceName())
-			if err := closer.Close(); err != nil {
-				log.Printf("module %s (%s) close failed: %v", mod.mod.Name(), mod.mod.InstanceName(), err)
-			}
-		})
+	instancesLck.Lock()
+	if inst, ok := instances[name]; ok && inst.mod == mod.mod {
+		inst.ready = true
+		instances[name] = inst
 	}
+	if _, ok := mod.mod.(io.Closer); ok {
+		opened = append(opened, openedInstance{mod: mod.mod})
+	}
+	instancesLck.Unlock()
 
 	return mod.mod, nil
 }
+
+// OpenedInstances returns the initialized instances that implement io.Closer
+// in the order they were initialized. This includes endpoints and inline
+// module definitions initialized using InitInstance.
+func OpenedInstances() []Module {
+	instancesLck.RLock()
+	defer instancesLck.RUnlock()
+
+	mods := make([]Module, 0, len(opened))
+	for _, o := range opened {
+		mods = append(mods, o.mod)
+	}
+	return mods
+}
+
+// CloseInstance calls Close for the module instance if it implements
+// io.Closer.
+func CloseInstance(mod Module) error {
+	closer, ok := mod.(io.Closer)
+	if !ok {
+		return nil
+	}
+
+	log.Debugf("close %s (%s)", mod.Name(), mod.InstanceName())
+	return closer.Close()
+}
+
+// CloseInstances closes the module instances in the reverse order, so
+// instances are closed before the ones they depend on if mods is in
+// initialization order (see OpenedInstances). Errors are logged.
+func CloseInstances(mods []Module) {
+	for i := len(mods) - 1; i >= 0; i-- {
+		if err := CloseInstance(mods[i]); err != nil {
+			log.Printf("module %s (%s) close failed: %v", mods[i].Name(), mods[i].InstanceName(), err)
+		}
+	}
+}
+
+// InstanceNames returns the sorted list of names of all registered module
+// instances. Aliases are not included.
+func InstanceNames() []string {
+	instancesLck.RLock()
+	defer instancesLck.RUnlock()
+
+	names := make([]string, 0, len(instances))
+	for name := range instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ResetInstances clears the global registry and returns the function that
+// restores its previous state.
+//
+// It is used to build the new set of instances during configuration reload
+// while keeping the ability to roll back if that fails. CommitInstances should
+// be called once the new registry is in use.
+func ResetInstances() (restore func()) {
+	instancesLck.Lock()
+	defer instancesLck.Unlock()
+
+	oldInstances, oldAliases, oldInitialized, oldOpened := instances, aliases, Initialized, opened
+	instances = make(map[string]instance)
+	aliases = make(map[string]string)
+	Initialized = make(map[string]bool)
+	opened = nil
+	prevOpened = oldOpened
+
+	return func() {
+		instancesLck.Lock()
+		defer instancesLck.Unlock()
+		instances, aliases, Initialized, opened = oldInstances, oldAliases, oldInitialized, oldOpened
+		prevOpened = nil
+	}
+}
+
+// CommitInstances drops the previous state of the global registry saved by
+// ResetInstances once the new one is in use.
+func CommitInstances() {
+	instancesLck.Lock()
+	defer instancesLck.Unlock()
+	prevOpened = nil
+}
@@ -136,6 +136,12 @@ type MsgMetadata struct {
 	// header. It is only meaningful if server has seen the body at least once
 	// (e.g. the message was passed via queue).
 	TLSRequireOverride bool
+
+	// W3C traceparent value identifying the span that represents the
+	// message receipt. It is used to link spans of later processing (such
+	// as delivery attempts made by the queue) to it. Empty if tracing is
+	// disabled.
+	TraceParent string
 }
 
 // DeepCopy creates a copy of the MsgMetadata structure, also
@@ -28,10 +28,20 @@ var (
 	// NoRun makes sure modules do not start any bacground tests.
 	//
 	// If it set - modules should not perform any actual work and should stop
-	// once the configuration is read and verified to be correct.
+	// once the configuration is read and verified to be correct. In
+	// particular, endpoints do not accept connections and message queues do
+	// not attempt deliveries.
 	// TODO: Replace it with separation of Init and Run at interface level.
 	NoRun = false
 
+	// DryRun makes modules only validate their configuration without
+	// acquiring any external resources: listening sockets, database
+	// connections, files in the state directory, etc.
+	//
+	// It is used to check the configuration before starting the server and
+	// implies NoRun.
+	DryRun = false
+
 	modules     = make(map[string]FuncNewModule)
 	endpoints   = make(map[string]FuncNewEndpoint)
 	modulesLock sync.RWMutex
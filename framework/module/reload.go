@@ -0,0 +1,46 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package module
+
+import "context"
+
+// Drainer is an optional interface that can be implemented by endpoint
+// modules to support graceful replacement during configuration reload.
+//
+// Drain should stop accepting new connections and wait for the existing ones
+// to finish or for ctx to be cancelled, whichever happens first. Close is
+// called after Drain returns.
+type Drainer interface {
+	Drain(ctx context.Context) error
+}
+
+// Exclusive is an optional interface that should be implemented by modules
+// that own resources that can't be used by two module instances at once
+// (e.g. queue directory or database update notifications).
+//
+// Configuration reload fails if such module needs to be replaced, server
+// restart is required instead.
+type Exclusive interface {
+	Exclusive()
+}
+
+// Reload is the function that re-reads the server configuration and replaces
+// changed module instances. It is set by the server startup code and is nil
+// if the configuration reload is not supported by the running process.
+var Reload func() error
@@ -0,0 +1,40 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package module
+
+import (
+	"context"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+)
+
+// SpamTrainer is the interface used by modules that update spam classifiers
+// using feedback from users.
+//
+// Modules implementing this interface should be registered with namespace prefix
+// "imap.trainer".
+type SpamTrainer interface {
+	// Train is called when the user marks the message as spam or as
+	// legitimate (ham), e.g. by moving it into or out of the Junk mailbox.
+	// hdr and body contain the message as it is stored.
+	//
+	// Train is called asynchronously, errors returned by it are just logged.
+	Train(ctx context.Context, accountName string, spam bool, hdr textproto.Header, body buffer.Buffer) error
+}
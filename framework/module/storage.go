@@ -19,6 +19,8 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package module
 
 import (
+	"context"
+
 	imapbackend "github.com/emersion/go-imap/backend"
 )
 
@@ -48,3 +50,13 @@ type ManageableStorage interface {
 	CreateIMAPAcct(username string) error
 	DeleteIMAPAcct(username string) error
 }
+
+// MetadataStorage is an extended Storage interface that allows other modules
+// to read per-account settings stored as IMAP server annotations (RFC 5464).
+type MetadataStorage interface {
+	Storage
+
+	// AccountMetadata returns the value of the server annotation entry (e.g.
+	// "/private/vendor/maddy/spam-threshold") set by the account.
+	AccountMetadata(ctx context.Context, username, entry string) (string, bool, error)
+}
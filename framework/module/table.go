@@ -41,3 +41,14 @@ type MutableTable interface {
 	RemoveKey(k string) error
 	SetKey(k, v string) error
 }
+
+// BatchMutableTable is the interface that MutableTable can implement if it
+// can change multiple entries at once more efficiently than by separate
+// SetKey and RemoveKey calls.
+type BatchMutableTable interface {
+	MutableTable
+
+	// SetKeys replaces values of all specified keys. Keys without values
+	// are removed.
+	SetKeys(entries map[string][]string) error
+}
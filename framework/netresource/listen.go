@@ -0,0 +1,247 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package netresource provides listening sockets that can be handed over
+// between instances of the same endpoint.
+//
+// It is used to replace endpoints during configuration reload without
+// closing the listening socket: the new endpoint instance gets new
+// connections while the old one continues serving the already accepted
+// ones.
+package netresource
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+type sharedListener struct {
+	key string
+	l   net.Listener
+
+	// Handle that gets accepted connections.
+	active *handle
+	// Handle that will replace active one on Commit.
+	pending *handle
+
+	// Closed when active handle changes.
+	activeChanged chan struct{}
+}
+
+var (
+	listeners   = map[string]*sharedListener{}
+	listenersLk sync.Mutex
+	// Set between Begin and Commit/Rollback.
+	handover bool
+
+	errInUse = errors.New("address is already in use by another listener")
+)
+
+// handle is the net.Listener returned by Listen.
+type handle struct {
+	shared *sharedListener
+	conns  chan net.Conn
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (h *handle) Accept() (net.Conn, error) {
+	select {
+	case c := <-h.conns:
+		return c, nil
+	case <-h.done:
+		return nil, &net.OpError{Op: "accept", Net: h.shared.l.Addr().Network(), Addr: h.shared.l.Addr(), Err: net.ErrClosed}
+	}
+}
+
+func (h *handle) Addr() net.Addr {
+	return h.shared.l.Addr()
+}
+
+// Close stops the handle from accepting connections.
+//
+// If the handle is the active one for the socket, the socket itself is
+// closed.
+func (h *handle) Close() error {
+	var err error
+	h.closeOnce.Do(func() {
+		close(h.done)
+
+		listenersLk.Lock()
+		defer listenersLk.Unlock()
+
+		s := h.shared
+		switch {
+		case s.pending == h:
+			s.pending = nil
+		case s.active == h:
+			s.active = nil
+			if s.pending != nil {
+				// Socket is about to be taken over, keep it open.
+				s.active = s.pending
+				s.pending = nil
+				s.notifyActive()
+				return
+			}
+			delete(listeners, s.key)
+			err = s.l.Close()
+		}
+	})
+	return err
+}
+
+func (s *sharedListener) notifyActive() {
+	close(s.activeChanged)
+	s.activeChanged = make(chan struct{})
+}
+
+func (s *sharedListener) acceptLoop() {
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() { //nolint:staticcheck
+				continue
+			}
+			return
+		}
+
+		s.dispatch(c)
+	}
+}
+
+// dispatch passes the connection to the currently active handle, waiting for
+// the handle to change if the current one is closed without accepting it.
+func (s *sharedListener) dispatch(c net.Conn) {
+	for {
+		listenersLk.Lock()
+		h := s.active
+		changed := s.activeChanged
+		listenersLk.Unlock()
+
+		if h == nil {
+			c.Close()
+			return
+		}
+
+		select {
+		case h.conns <- c:
+			return
+		case <-h.done:
+		case <-changed:
+		}
+	}
+}
+
+func newHandle(s *sharedListener) *handle {
+	return &handle{
+		shared: s,
+		conns:  make(chan net.Conn),
+		done:   make(chan struct{}),
+	}
+}
+
+// Begin starts the handover, until Commit or Rollback is called, Listen can
+// return pending handles for already used addresses.
+func Begin() {
+	listenersLk.Lock()
+	defer listenersLk.Unlock()
+	handover = true
+}
+
+// Listen returns the listener for the specified address.
+//
+// If the socket for the address is already used by another handle and Begin
+// was called, the new handle will replace it once Commit is called. Until
+// that, the new handle does not get any connections. If the new handle is
+// closed before Commit, the old one is kept.
+func Listen(network, addr string) (net.Listener, error) {
+	key := network + ":" + addr
+
+	listenersLk.Lock()
+	defer listenersLk.Unlock()
+
+	if s, ok := listeners[key]; ok {
+		if !handover || s.pending != nil {
+			return nil, &net.OpError{Op: "listen", Net: network, Addr: s.l.Addr(), Err: errInUse}
+		}
+		s.pending = newHandle(s)
+		return s.pending, nil
+	}
+
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &sharedListener{
+		key:           key,
+		l:             l,
+		activeChanged: make(chan struct{}),
+	}
+	s.active = newHandle(s)
+	listeners[key] = s
+	go s.acceptLoop()
+
+	return s.active, nil
+}
+
+// Commit makes all pending handles active. Previously active handles are
+// closed, that is, they no longer accept new connections.
+func Commit() {
+	listenersLk.Lock()
+	handover = false
+	var superseded []*handle
+	for _, s := range listeners {
+		if s.pending == nil {
+			continue
+		}
+		if s.active != nil {
+			superseded = append(superseded, s.active)
+		}
+		s.active = s.pending
+		s.pending = nil
+		s.notifyActive()
+	}
+	listenersLk.Unlock()
+
+	for _, h := range superseded {
+		h.closeOnce.Do(func() {
+			close(h.done)
+		})
+	}
+}
+
+// Rollback closes all pending handles, previously active handles continue to
+// get connections.
+func Rollback() {
+	listenersLk.Lock()
+	handover = false
+	var pending []*handle
+	for _, s := range listeners {
+		if s.pending != nil {
+			pending = append(pending, s.pending)
+		}
+	}
+	listenersLk.Unlock()
+
+	for _, h := range pending {
+		h.Close()
+	}
+}
@@ -0,0 +1,182 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package netresource
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func acceptOne(t *testing.T, l net.Listener) <-chan string {
+	t.Helper()
+	res := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			res <- "error: " + err.Error()
+			return
+		}
+		defer c.Close()
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(c, buf); err != nil {
+			res <- "error: " + err.Error()
+			return
+		}
+		res <- string(buf)
+	}()
+	return res
+}
+
+func dialSend(t *testing.T, addr net.Addr, data string) {
+	t.Helper()
+	c, err := net.Dial(addr.Network(), addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readRes(t *testing.T, ch <-chan string) string {
+	t.Helper()
+	select {
+	case s := <-ch:
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatal("accept timed out")
+		return ""
+	}
+}
+
+func TestListen_Handover(t *testing.T) {
+	l1, err := Listen("tcp", freeAddr(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l1.Addr()
+
+	res := acceptOne(t, l1)
+	dialSend(t, addr, "conn1")
+	if s := readRes(t, res); s != "conn1" {
+		t.Fatal("Wrong data:", s)
+	}
+
+	if _, err := Listen("tcp", addr.String()); err == nil {
+		t.Fatal("Expected an error for the used address without Begin")
+	}
+
+	Begin()
+	l2, err := Listen("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l2.Close()
+
+	// Not committed yet, the old listener still gets connections.
+	res = acceptOne(t, l1)
+	dialSend(t, addr, "conn2")
+	if s := readRes(t, res); s != "conn2" {
+		t.Fatal("Wrong data:", s)
+	}
+
+	res1 := acceptOne(t, l1)
+	res2 := acceptOne(t, l2)
+	Commit()
+
+	if s := readRes(t, res1); s == "" || s[:6] != "error:" {
+		t.Fatal("Old listener is not closed:", s)
+	}
+	dialSend(t, addr, "conn3")
+	if s := readRes(t, res2); s != "conn3" {
+		t.Fatal("Wrong data:", s)
+	}
+
+	// Closing the superseded listener does not affect the socket.
+	if err := l1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	res = acceptOne(t, l2)
+	dialSend(t, addr, "conn4")
+	if s := readRes(t, res); s != "conn4" {
+		t.Fatal("Wrong data:", s)
+	}
+}
+
+func TestListen_PendingClose(t *testing.T) {
+	l1, err := Listen("tcp", freeAddr(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l1.Close()
+	addr := l1.Addr()
+
+	Begin()
+	l2, err := Listen("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen("tcp", addr.String()); err == nil {
+		t.Fatal("Expected an error for the second pending listener")
+	}
+	// Failed reload, new instance is not initialized completely.
+	Rollback()
+	if _, err := l2.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatal("Expected net.ErrClosed, got", err)
+	}
+	Commit()
+
+	res := acceptOne(t, l1)
+	dialSend(t, addr, "conn1")
+	if s := readRes(t, res); s != "conn1" {
+		t.Fatal("Wrong data:", s)
+	}
+}
+
+func TestListen_Close(t *testing.T) {
+	l, err := Listen("tcp", freeAddr(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatal("Expected net.ErrClosed, got", err)
+	}
+	if _, err := net.Dial("tcp", addr.String()); err == nil {
+		t.Fatal("Socket is not closed")
+	}
+}
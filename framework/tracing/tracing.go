@@ -0,0 +1,178 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package tracing provides helpers for OpenTelemetry tracing of connections
+// and message processing.
+//
+// Spans are created using the global TracerProvider, so if tracing is not
+// enabled using Setup, all functions in this package are cheap no-ops.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/foxcpp/maddy"
+
+var propagator = propagation.TraceContext{}
+
+type Config struct {
+	// OTLP/HTTP collector URL, such as http://127.0.0.1:4318. Path defaults
+	// to /v1/traces if not specified.
+	Endpoint string
+
+	// Additional HTTP headers sent to the collector (e.g. for
+	// authentication).
+	Headers map[string]string
+
+	ServiceName string
+
+	// Fraction of traces to sample, spans with a sampled parent are
+	// always sampled.
+	SampleRatio float64
+}
+
+// Setup configures the global TracerProvider to export spans to the OTLP
+// collector.
+//
+// Returned function should be called on shutdown to flush remaining spans.
+func Setup(cfg Config) (shutdown func(context.Context) error, err error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("tracing: malformed endpoint: %w", err)
+	}
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(u.Host),
+	}
+	switch u.Scheme {
+	case "http":
+		opts = append(opts, otlptracehttp.WithInsecure())
+	case "https":
+	default:
+		return nil, fmt.Errorf("tracing: unsupported endpoint scheme: %s", u.Scheme)
+	}
+	if u.Path != "" && u.Path != "/" {
+		opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+	}
+	if len(cfg.Headers) != 0 {
+		opts = append(opts, otlptracehttp.WithHeaders(cfg.Headers))
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %w", err)
+	}
+
+	res := resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(cfg.ServiceName),
+	)
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(linkSampler{
+			sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio)),
+		}),
+	)
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown, nil
+}
+
+// linkSampler samples all spans linked to a sampled span so that queued
+// delivery attempts are traced if the original transaction was traced.
+type linkSampler struct {
+	sdktrace.Sampler
+}
+
+func (s linkSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	for _, l := range p.Links {
+		if l.SpanContext.IsSampled() {
+			return sdktrace.SamplingResult{
+				Decision:   sdktrace.RecordAndSample,
+				Tracestate: trace.SpanContextFromContext(p.ParentContext).TraceState(),
+			}
+		}
+	}
+	return s.Sampler.ShouldSample(p)
+}
+
+func (s linkSampler) Description() string {
+	return "LinkSampler{" + s.Sampler.Description() + "}"
+}
+
+// Start creates a span as a child of the span in ctx, if any.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartLinked creates a new root span linked to the span identified by
+// the W3C traceparent value, as returned by TraceParent.
+//
+// It is used to relate asynchronous processing (such as queued delivery
+// attempts) to the span that initiated it.
+func StartLinked(ctx context.Context, name, traceParent string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	opts := []trace.SpanStartOption{
+		trace.WithNewRoot(),
+		trace.WithAttributes(attrs...),
+	}
+	if traceParent != "" {
+		remoteCtx := propagator.Extract(context.Background(), propagation.MapCarrier{
+			"traceparent": traceParent,
+		})
+		if sc := trace.SpanContextFromContext(remoteCtx); sc.IsValid() {
+			opts = append(opts, trace.WithLinks(trace.Link{SpanContext: sc}))
+		}
+	}
+	return otel.Tracer(instrumentationName).Start(ctx, name, opts...)
+}
+
+// TraceParent returns the W3C traceparent value for the span in ctx.
+// Empty string is returned if there is no span in ctx.
+func TraceParent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier["traceparent"]
+}
+
+// RecordError marks the span as failed with the specified error.
+// It is no-op if err is nil.
+func RecordError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// End is a shorthand for RecordError followed by span.End.
+func End(span trace.Span, err error) {
+	RecordError(span, err)
+	span.End()
+}
@@ -0,0 +1,202 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace/noop"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// collector is a minimal OTLP/HTTP collector stand-in that records received
+// spans.
+type collector struct {
+	lck     sync.Mutex
+	spans   []*tracepb.Span
+	headers http.Header
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/traces" {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req coltracepb.ExportTraceServiceRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.lck.Lock()
+	c.headers = r.Header.Clone()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+	c.lck.Unlock()
+
+	resp, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(resp)
+}
+
+func (c *collector) span(t *testing.T, name string) *tracepb.Span {
+	t.Helper()
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	for _, s := range c.spans {
+		if s.Name == name {
+			return s
+		}
+	}
+	t.Fatalf("span %s was not exported", name)
+	return nil
+}
+
+func setupCollector(t *testing.T, sampleRatio float64) (*collector, func()) {
+	t.Helper()
+	c := &collector{}
+	srv := httptest.NewServer(c)
+	t.Cleanup(srv.Close)
+
+	shutdown, err := Setup(Config{
+		Endpoint:    srv.URL,
+		Headers:     map[string]string{"X-Token": "secret"},
+		ServiceName: "maddy-test",
+		SampleRatio: sampleRatio,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+	})
+
+	return c, func() {
+		if err := shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	c, flush := setupCollector(t, 1)
+
+	ctx, parent := Start(context.Background(), "parent")
+	_, child := Start(ctx, "child")
+	End(child, errors.New("child failed"))
+	End(parent, nil)
+	flush()
+
+	p := c.span(t, "parent")
+	ch := c.span(t, "child")
+	if !bytes.Equal(ch.TraceId, p.TraceId) {
+		t.Error("child span belongs to a different trace")
+	}
+	if !bytes.Equal(ch.ParentSpanId, p.SpanId) {
+		t.Error("child span is not linked to the parent")
+	}
+	if ch.Status.GetCode() != tracepb.Status_STATUS_CODE_ERROR || ch.Status.GetMessage() != "child failed" {
+		t.Errorf("wrong child status: %v", ch.Status)
+	}
+	if p.Status.GetCode() == tracepb.Status_STATUS_CODE_ERROR {
+		t.Error("parent span is marked as failed")
+	}
+	if c.headers.Get("X-Token") != "secret" {
+		t.Error("configured header was not sent")
+	}
+}
+
+func TestStartLinked(t *testing.T) {
+	c, flush := setupCollector(t, 1)
+
+	ctx, orig := Start(context.Background(), "receipt")
+	traceParent := TraceParent(ctx)
+	orig.End()
+	if traceParent == "" {
+		t.Fatal("empty traceparent for a sampled span")
+	}
+
+	_, retry := StartLinked(context.Background(), "retry", traceParent)
+	retry.End()
+	_, broken := StartLinked(context.Background(), "broken", "not-a-traceparent")
+	broken.End()
+	flush()
+
+	o := c.span(t, "receipt")
+	r := c.span(t, "retry")
+	if bytes.Equal(r.TraceId, o.TraceId) {
+		t.Error("linked span should start a new trace")
+	}
+	if len(r.Links) != 1 {
+		t.Fatalf("expected 1 link, got %d", len(r.Links))
+	}
+	if !bytes.Equal(r.Links[0].TraceId, o.TraceId) || !bytes.Equal(r.Links[0].SpanId, o.SpanId) {
+		t.Error("link does not point to the original span")
+	}
+	if b := c.span(t, "broken"); len(b.Links) != 0 {
+		t.Error("malformed traceparent should be ignored")
+	}
+}
+
+func TestStartLinked_Sampling(t *testing.T) {
+	c, flush := setupCollector(t, 0)
+
+	_, root := Start(context.Background(), "unsampled")
+	root.End()
+	_, retry := StartLinked(context.Background(), "retry",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	retry.End()
+	_, unsampledRetry := StartLinked(context.Background(), "unsampled-retry",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00")
+	unsampledRetry.End()
+	flush()
+
+	c.span(t, "retry")
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	if len(c.spans) != 1 {
+		t.Errorf("expected only the span linked to the sampled one to be exported, got %d", len(c.spans))
+	}
+}
+
+func TestTraceParent_NoTracing(t *testing.T) {
+	ctx, span := Start(context.Background(), "noop")
+	defer span.End()
+	if tp := TraceParent(ctx); tp != "" {
+		t.Errorf("expected empty traceparent without a provider, got %s", tp)
+	}
+}
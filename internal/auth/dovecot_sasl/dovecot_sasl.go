@@ -101,6 +101,9 @@ func (a *Auth) Init(cfg *config.Map) error {
 	if err != nil {
 		return fmt.Errorf("%s: invalid server endpoint: %v", modName, err)
 	}
+	if module.DryRun {
+		return nil
+	}
 
 	// Dial once to check usability and also to get list of mechanisms.
 	conn, err := net.Dial(endp.Scheme, endp.Address())
@@ -0,0 +1,458 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package lockout implements the auth.lockout module that keeps track of
+// authentication attempts, writes the audit log and applies progressive
+// delays and temporary lockouts to usernames and client addresses that fail
+// authentication too often.
+package lockout
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth"
+)
+
+const modName = "auth.lockout"
+
+// cleanupInterval is the minimal interval between removals of expired
+// entries.
+const cleanupInterval = 1 * time.Minute
+
+// ErrUnknownKey is returned by Tracker.Clear if there is no state tracked for
+// the key.
+var ErrUnknownKey = errors.New("lockout: no state tracked for the key")
+
+// scope contains limits applied to either usernames or client addresses.
+type scope struct {
+	maxFailures int
+	window      time.Duration
+	lockout     time.Duration
+	maxLockout  time.Duration
+
+	// Only used for client addresses.
+	ipv4Prefix int
+	ipv6Prefix int
+}
+
+// lockoutFor returns the lockout duration for the n-th lockout. It is doubled
+// for each subsequent lockout.
+func (s scope) lockoutFor(n int) time.Duration {
+	d := s.lockout
+	for i := 1; i < n && d < s.maxLockout; i++ {
+		d *= 2
+	}
+	if d > s.maxLockout {
+		d = s.maxLockout
+	}
+	return d
+}
+
+// retention returns for how long the entry is kept after the last failure.
+func (s scope) retention() time.Duration {
+	if s.window > s.maxLockout {
+		return s.window
+	}
+	return s.maxLockout
+}
+
+type trackedKey struct {
+	key   string
+	scope *scope
+}
+
+type Tracker struct {
+	instName string
+	log      log.Logger
+	audit    log.Logger
+
+	auditLog bool
+	user     scope
+	ip       scope
+	delay    time.Duration
+	maxDelay time.Duration
+
+	store store
+	now   func() time.Time
+
+	// updateLck serializes read-modify-write updates of entries.
+	updateLck   sync.Mutex
+	lastCleanup time.Time
+}
+
+func New(_, instName string, _, _ []string) (module.Module, error) {
+	return &Tracker{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+		audit:    log.Logger{Name: modName + "/audit"},
+		now:      time.Now,
+	}, nil
+}
+
+func (t *Tracker) Name() string {
+	return modName
+}
+
+func (t *Tracker) InstanceName() string {
+	return t.instName
+}
+
+func (t *Tracker) Init(cfg *config.Map) error {
+	var (
+		driver    string
+		dsnParts  []string
+		tableName string
+	)
+	cfg.Bool("debug", true, false, &t.log.Debug)
+	cfg.Bool("audit_log", false, true, &t.auditLog)
+	cfg.Custom("username", false, false, func() (interface{}, error) {
+		return defaultUserScope, nil
+	}, scopeDirective(defaultUserScope, false), &t.user)
+	cfg.Custom("ip", false, false, func() (interface{}, error) {
+		return defaultIPScope, nil
+	}, scopeDirective(defaultIPScope, true), &t.ip)
+	cfg.Duration("delay", false, false, 1*time.Second, &t.delay)
+	cfg.Duration("max_delay", false, false, 10*time.Second, &t.maxDelay)
+	cfg.String("driver", false, false, "", &driver)
+	cfg.StringList("dsn", false, false, nil, &dsnParts)
+	cfg.String("table_name", false, false, "auth_lockout", &tableName)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if t.maxDelay < t.delay {
+		return config.NodeErr(cfg.Block, "max_delay should not be lower than delay")
+	}
+
+	if driver == "" {
+		t.store = newMemoryStore()
+		return nil
+	}
+	if len(dsnParts) == 0 {
+		return config.NodeErr(cfg.Block, "dsn is required if driver is set")
+	}
+	if module.DryRun {
+		return nil
+	}
+	s, err := newSQLStore(driver, strings.Join(dsnParts, " "), tableName)
+	if err != nil {
+		return config.NodeErr(cfg.Block, "%v", err)
+	}
+	t.store = s
+	return nil
+}
+
+var (
+	defaultUserScope = scope{
+		maxFailures: 10,
+		window:      15 * time.Minute,
+		lockout:     15 * time.Minute,
+		maxLockout:  24 * time.Hour,
+	}
+	defaultIPScope = scope{
+		maxFailures: 30,
+		window:      15 * time.Minute,
+		lockout:     15 * time.Minute,
+		maxLockout:  24 * time.Hour,
+		ipv4Prefix:  32,
+		ipv6Prefix:  64,
+	}
+)
+
+func scopeDirective(def scope, forIP bool) func(*config.Map, config.Node) (interface{}, error) {
+	return func(_ *config.Map, node config.Node) (interface{}, error) {
+		s := def
+		childM := config.NewMap(nil, node)
+		childM.Int("max_failures", false, false, def.maxFailures, &s.maxFailures)
+		childM.Duration("window", false, false, def.window, &s.window)
+		childM.Duration("lockout", false, false, def.lockout, &s.lockout)
+		childM.Duration("max_lockout", false, false, def.maxLockout, &s.maxLockout)
+		if forIP {
+			childM.Int("ipv4_prefix", false, false, def.ipv4Prefix, &s.ipv4Prefix)
+			childM.Int("ipv6_prefix", false, false, def.ipv6Prefix, &s.ipv6Prefix)
+		}
+		if _, err := childM.Process(); err != nil {
+			return nil, err
+		}
+
+		if s.maxFailures < 0 {
+			return nil, config.NodeErr(node, "max_failures should not be negative")
+		}
+		if s.maxLockout < s.lockout {
+			return nil, config.NodeErr(node, "max_lockout should not be lower than lockout")
+		}
+		if forIP && (s.ipv4Prefix < 1 || s.ipv4Prefix > 32) {
+			return nil, config.NodeErr(node, "ipv4_prefix should be in range 1-32")
+		}
+		if forIP && (s.ipv6Prefix < 1 || s.ipv6Prefix > 128) {
+			return nil, config.NodeErr(node, "ipv6_prefix should be in range 1-128")
+		}
+		return s, nil
+	}
+}
+
+func (t *Tracker) Close() error {
+	if t.store == nil {
+		return nil
+	}
+	return t.store.Close()
+}
+
+// ipKey returns the tracked key for the client address, addresses are
+// aggregated using the configured prefix length.
+func (t *Tracker) ipKey(ip net.IP) string {
+	bits, prefix := 128, t.ip.ipv6Prefix
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits, prefix = 32, t.ip.ipv4Prefix
+	}
+	mask := net.CIDRMask(prefix, bits)
+	return "ip:" + (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
+func (t *Tracker) keys(a auth.Attempt) []trackedKey {
+	keys := make([]trackedKey, 0, 2)
+	if t.user.maxFailures != 0 && a.Username != "" {
+		keys = append(keys, trackedKey{key: "user:" + a.Username, scope: &t.user})
+	}
+	if t.ip.maxFailures != 0 && a.RemoteIP != nil {
+		keys = append(keys, trackedKey{key: t.ipKey(a.RemoteIP), scope: &t.ip})
+	}
+	return keys
+}
+
+// get returns the entry for the key, failures outside of the window are
+// discarded.
+func (t *Tracker) get(k trackedKey, now time.Time) (Entry, bool, error) {
+	e, ok, err := t.store.Get(k.key)
+	if err != nil || !ok {
+		return Entry{}, false, err
+	}
+	if now.After(e.Expires) {
+		return Entry{}, false, nil
+	}
+	if !e.FirstFailure.IsZero() && now.Sub(e.FirstFailure) > k.scope.window {
+		e.Failures = 0
+		e.FirstFailure = time.Time{}
+	}
+	return e, true, nil
+}
+
+// delayFor returns the delay to apply after the specified amount of recent
+// failures. It is doubled for each subsequent failure.
+func (t *Tracker) delayFor(failures int) time.Duration {
+	if failures == 0 {
+		return 0
+	}
+	d := t.delay
+	for i := 1; i < failures && d < t.maxDelay; i++ {
+		d *= 2
+	}
+	if d > t.maxDelay {
+		d = t.maxDelay
+	}
+	return d
+}
+
+func (t *Tracker) Check(_ context.Context, a auth.Attempt) (time.Duration, error) {
+	now := t.now()
+	var delay time.Duration
+	for _, k := range t.keys(a) {
+		e, ok, err := t.get(k, now)
+		if err != nil {
+			// Do not block authentication if the state is not available.
+			t.log.Error("failed to read the state", err, "key", k.key)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if e.Locked(now) {
+			t.auditMsg(a, "locked_out", nil, "key", k.key, "locked_until", e.LockedUntil)
+			return 0, auth.ErrLockedOut
+		}
+		if d := t.delayFor(e.Failures); d > delay {
+			delay = d
+		}
+	}
+	if delay != 0 {
+		t.log.DebugMsg("delaying attempt", "username", a.Username, "src_ip", a.RemoteIP, "delay", delay)
+	}
+	return delay, nil
+}
+
+func (t *Tracker) Record(_ context.Context, a auth.Attempt, err error) {
+	now := t.now()
+
+	t.updateLck.Lock()
+	defer t.updateLck.Unlock()
+
+	switch {
+	case err == nil:
+		t.auditMsg(a, "success", nil)
+		// Successful authentication resets the username state. The client
+		// address state is kept so a single valid account does not allow
+		// to continue guessing other ones.
+		if t.user.maxFailures != 0 && a.Username != "" {
+			if err := t.store.Delete("user:" + a.Username); err != nil {
+				t.log.Error("failed to reset the state", err, "username", a.Username)
+			}
+		}
+	case exterrors.IsTemporary(err):
+		// Failures not caused by the client are not counted.
+		t.auditMsg(a, "error", err)
+	default:
+		t.auditMsg(a, "failure", err)
+		for _, k := range t.keys(a) {
+			if err := t.recordFailure(k, a, now); err != nil {
+				t.log.Error("failed to update the state", err, "key", k.key)
+			}
+		}
+	}
+
+	if now.Sub(t.lastCleanup) >= cleanupInterval {
+		t.lastCleanup = now
+		if err := t.store.Cleanup(now); err != nil {
+			t.log.Error("failed to remove expired entries", err)
+		}
+	}
+}
+
+func (t *Tracker) recordFailure(k trackedKey, a auth.Attempt, now time.Time) error {
+	e, ok, err := t.get(k, now)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		e = Entry{Key: k.key}
+	}
+
+	if e.Failures == 0 {
+		e.FirstFailure = now
+	}
+	e.Failures++
+	e.LastFailure = now
+
+	if e.Failures >= k.scope.maxFailures {
+		e.Lockouts++
+		dur := k.scope.lockoutFor(e.Lockouts)
+		e.LockedUntil = now.Add(dur)
+		e.Failures = 0
+		e.FirstFailure = time.Time{}
+		t.auditMsg(a, "lockout", nil, "key", k.key, "duration", dur, "locked_until", e.LockedUntil)
+	}
+
+	e.Expires = e.LastFailure.Add(k.scope.retention())
+	if e.LockedUntil.After(e.Expires) {
+		e.Expires = e.LockedUntil
+	}
+	return t.store.Put(e)
+}
+
+func (t *Tracker) auditMsg(a auth.Attempt, result string, err error, fields ...interface{}) {
+	if !t.auditLog {
+		return
+	}
+	fields = append([]interface{}{"endpoint", a.Endpoint, "username", a.Username, "result", result}, fields...)
+	if a.RemoteIP != nil {
+		fields = append(fields, "src_ip", a.RemoteIP.String())
+	}
+	if err != nil {
+		fields = append(fields, "reason", err.Error())
+	}
+	t.audit.Msg("authentication attempt", fields...)
+}
+
+// Entries returns the state tracked for usernames and client addresses.
+func (t *Tracker) Entries() ([]Entry, error) {
+	now := t.now()
+	all, err := t.store.List()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Entry, 0, len(all))
+	for _, e := range all {
+		if now.After(e.Expires) {
+			continue
+		}
+		res = append(res, e)
+	}
+	return res, nil
+}
+
+// Clear removes the state tracked for the key, lifting the lockout if any.
+//
+// The key is either "user:USERNAME" or "ip:ADDRESS", the address is
+// converted to the prefix using the configured prefix length.
+func (t *Tracker) Clear(key string) error {
+	if addr := strings.TrimPrefix(key, "ip:"); addr != key && !strings.Contains(addr, "/") {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return ErrUnknownKey
+		}
+		key = t.ipKey(ip)
+	}
+
+	t.updateLck.Lock()
+	defer t.updateLck.Unlock()
+
+	e, ok, err := t.store.Get(key)
+	if err != nil {
+		return err
+	}
+	if !ok || t.now().After(e.Expires) {
+		return ErrUnknownKey
+	}
+	if err := t.store.Delete(key); err != nil {
+		return err
+	}
+	t.log.Msg("state cleared", "key", key)
+	return nil
+}
+
+// ClearAll removes all tracked state and returns the amount of removed
+// entries.
+func (t *Tracker) ClearAll() (int, error) {
+	t.updateLck.Lock()
+	defer t.updateLck.Unlock()
+
+	all, err := t.store.List()
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range all {
+		if err := t.store.Delete(e.Key); err != nil {
+			return 0, err
+		}
+	}
+	t.log.Msg("state cleared", "count", len(all))
+	return len(all), nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,234 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package lockout
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+var errInvalidCreds = errors.New("invalid credentials")
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func testTracker(t *testing.T, cfg ...config.Node) (*Tracker, *testClock) {
+	t.Helper()
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := mod.(*Tracker)
+	tracker.log = testutils.Logger(t, modName)
+	tracker.audit = testutils.Logger(t, modName+"/audit")
+	clock := &testClock{now: time.Unix(1600000000, 0)}
+	tracker.now = clock.Now
+
+	if err := tracker.Init(config.NewMap(nil, config.Node{Children: cfg})); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tracker.Close() })
+	return tracker, clock
+}
+
+func scopeCfg(name string, directives ...string) config.Node {
+	node := config.Node{Name: name}
+	for i := 0; i < len(directives); i += 2 {
+		node.Children = append(node.Children, config.Node{
+			Name: directives[i],
+			Args: []string{directives[i+1]},
+		})
+	}
+	return node
+}
+
+func fail(tracker *Tracker, a auth.Attempt, times int) {
+	for i := 0; i < times; i++ {
+		tracker.Record(context.Background(), a, errInvalidCreds)
+	}
+}
+
+func checkAttempt(t *testing.T, tracker *Tracker, a auth.Attempt, delay time.Duration, locked bool) {
+	t.Helper()
+	d, err := tracker.Check(context.Background(), a)
+	if locked {
+		if !errors.Is(err, auth.ErrLockedOut) {
+			t.Fatalf("expected lockout, got %v", err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if d != delay {
+		t.Fatalf("wrong delay: want %v, got %v", delay, d)
+	}
+}
+
+func TestTracker_Delay(t *testing.T) {
+	tracker, _ := testTracker(t,
+		scopeCfg("username", "max_failures", "10"),
+		config.Node{Name: "delay", Args: []string{"1s"}},
+		config.Node{Name: "max_delay", Args: []string{"5s"}},
+	)
+	a := auth.Attempt{Username: "user", RemoteIP: net.IPv4(192, 0, 2, 1)}
+
+	checkAttempt(t, tracker, a, 0, false)
+	fail(tracker, a, 1)
+	checkAttempt(t, tracker, a, 1*time.Second, false)
+	fail(tracker, a, 1)
+	checkAttempt(t, tracker, a, 2*time.Second, false)
+	fail(tracker, a, 2)
+	checkAttempt(t, tracker, a, 5*time.Second, false)
+
+	tracker.Record(context.Background(), a, nil)
+	// Username state is reset on success, but the address is still
+	// tracked.
+	checkAttempt(t, tracker, auth.Attempt{Username: "user"}, 0, false)
+	checkAttempt(t, tracker, a, 5*time.Second, false)
+}
+
+func TestTracker_Lockout(t *testing.T) {
+	tracker, clock := testTracker(t,
+		scopeCfg("username", "max_failures", "3", "window", "10m", "lockout", "5m", "max_lockout", "15m"),
+		scopeCfg("ip", "max_failures", "0"),
+	)
+	a := auth.Attempt{Username: "user", RemoteIP: net.IPv4(192, 0, 2, 1)}
+
+	fail(tracker, a, 2)
+	checkAttempt(t, tracker, a, 2*time.Second, false)
+	fail(tracker, a, 1)
+	checkAttempt(t, tracker, a, 0, true)
+	// Other usernames are not affected.
+	checkAttempt(t, tracker, auth.Attempt{Username: "user2", RemoteIP: a.RemoteIP}, 0, false)
+
+	clock.Advance(5 * time.Minute)
+	checkAttempt(t, tracker, a, 0, false)
+
+	// The second lockout is longer.
+	fail(tracker, a, 3)
+	clock.Advance(5 * time.Minute)
+	checkAttempt(t, tracker, a, 0, true)
+	clock.Advance(5 * time.Minute)
+	checkAttempt(t, tracker, a, 0, false)
+
+	// And it is capped by max_lockout.
+	fail(tracker, a, 3)
+	fail(tracker, a, 3)
+	clock.Advance(15*time.Minute - time.Second)
+	checkAttempt(t, tracker, a, 0, true)
+	clock.Advance(time.Second)
+	checkAttempt(t, tracker, a, 0, false)
+}
+
+func TestTracker_Window(t *testing.T) {
+	tracker, clock := testTracker(t,
+		scopeCfg("username", "max_failures", "3", "window", "10m"),
+	)
+	a := auth.Attempt{Username: "user"}
+
+	fail(tracker, a, 2)
+	clock.Advance(11 * time.Minute)
+	checkAttempt(t, tracker, a, 0, false)
+	fail(tracker, a, 2)
+	checkAttempt(t, tracker, a, 2*time.Second, false)
+}
+
+func TestTracker_IPPrefix(t *testing.T) {
+	tracker, _ := testTracker(t,
+		scopeCfg("username", "max_failures", "0"),
+		scopeCfg("ip", "max_failures", "2", "ipv4_prefix", "24", "ipv6_prefix", "64"),
+	)
+
+	fail(tracker, auth.Attempt{Username: "a", RemoteIP: net.ParseIP("192.0.2.1")}, 1)
+	fail(tracker, auth.Attempt{Username: "b", RemoteIP: net.ParseIP("192.0.2.200")}, 1)
+	checkAttempt(t, tracker, auth.Attempt{Username: "c", RemoteIP: net.ParseIP("192.0.2.7")}, 0, true)
+	checkAttempt(t, tracker, auth.Attempt{Username: "c", RemoteIP: net.ParseIP("192.0.3.7")}, 0, false)
+
+	fail(tracker, auth.Attempt{RemoteIP: net.ParseIP("2001:db8::1")}, 1)
+	fail(tracker, auth.Attempt{RemoteIP: net.ParseIP("2001:db8::ffff:1")}, 1)
+	checkAttempt(t, tracker, auth.Attempt{RemoteIP: net.ParseIP("2001:db8::2")}, 0, true)
+	checkAttempt(t, tracker, auth.Attempt{RemoteIP: net.ParseIP("2001:db8:1::1")}, 0, false)
+
+	if err := tracker.Clear("ip:192.0.2.50"); err != nil {
+		t.Fatal(err)
+	}
+	checkAttempt(t, tracker, auth.Attempt{RemoteIP: net.ParseIP("192.0.2.7")}, 0, false)
+}
+
+func TestTracker_TemporaryErrors(t *testing.T) {
+	tracker, _ := testTracker(t)
+	a := auth.Attempt{Username: "user", RemoteIP: net.IPv4(192, 0, 2, 1)}
+
+	tracker.Record(context.Background(), a, exterrors.WithTemporary(errors.New("ldap is down"), true))
+	checkAttempt(t, tracker, a, 0, false)
+}
+
+func TestTracker_Expiry(t *testing.T) {
+	tracker, clock := testTracker(t,
+		scopeCfg("username", "max_failures", "1", "window", "1m", "lockout", "1m", "max_lockout", "1h"),
+	)
+	a := auth.Attempt{Username: "user"}
+
+	fail(tracker, a, 1)
+	entries, err := tracker.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Lockouts != 1 {
+		t.Fatalf("wrong entries: %+v", entries)
+	}
+
+	// Escalation is remembered until max_lockout passes without failures.
+	clock.Advance(1*time.Hour + time.Second)
+	fail(tracker, a, 1)
+	entries, err = tracker.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Lockouts != 1 {
+		t.Fatalf("lockout counter was not reset: %+v", entries)
+	}
+
+	clock.Advance(2 * time.Hour)
+	entries, err = tracker.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expired entries are returned: %+v", entries)
+	}
+}
@@ -0,0 +1,176 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package lockout
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// sqlStore keeps entries in a SQL table so the state can be shared between
+// multiple server instances.
+//
+// Queries are compatible with PostgreSQL and SQLite 3.24+.
+type sqlStore struct {
+	db *sql.DB
+
+	get     *sql.Stmt
+	put     *sql.Stmt
+	del     *sql.Stmt
+	list    *sql.Stmt
+	cleanup *sql.Stmt
+}
+
+func newSQLStore(driver, dsn, table string) (*sqlStore, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	s := &sqlStore{db: db}
+	if err := s.prepare(table); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *sqlStore) prepare(table string) error {
+	_, err := s.db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		key TEXT PRIMARY KEY NOT NULL,
+		failures INTEGER NOT NULL,
+		first_failure BIGINT NOT NULL,
+		last_failure BIGINT NOT NULL,
+		locked_until BIGINT NOT NULL,
+		lockouts INTEGER NOT NULL,
+		expires BIGINT NOT NULL
+	)`, table))
+	if err != nil {
+		return fmt.Errorf("failed to create table: %w", err)
+	}
+
+	const columns = `key, failures, first_failure, last_failure, locked_until, lockouts, expires`
+	queries := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&s.get, fmt.Sprintf(`SELECT %s FROM %s WHERE key = $1`, columns, table)},
+		{&s.put, fmt.Sprintf(`INSERT INTO %s(%s) VALUES ($1, $2, $3, $4, $5, $6, $7)
+			ON CONFLICT (key) DO UPDATE SET
+				failures = excluded.failures,
+				first_failure = excluded.first_failure,
+				last_failure = excluded.last_failure,
+				locked_until = excluded.locked_until,
+				lockouts = excluded.lockouts,
+				expires = excluded.expires`, table, columns)},
+		{&s.del, fmt.Sprintf(`DELETE FROM %s WHERE key = $1`, table)},
+		{&s.list, fmt.Sprintf(`SELECT %s FROM %s ORDER BY key`, columns, table)},
+		{&s.cleanup, fmt.Sprintf(`DELETE FROM %s WHERE expires < $1`, table)},
+	}
+	for _, q := range queries {
+		*q.stmt, err = s.db.Prepare(q.query)
+		if err != nil {
+			return fmt.Errorf("failed to prepare query: %w", err)
+		}
+	}
+	return nil
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanEntry(row scanner) (Entry, error) {
+	var (
+		e                                               Entry
+		firstFailure, lastFailure, lockedUntil, expires int64
+	)
+	if err := row.Scan(&e.Key, &e.Failures, &firstFailure, &lastFailure, &lockedUntil, &e.Lockouts, &expires); err != nil {
+		return Entry{}, err
+	}
+	e.FirstFailure = timeFromDB(firstFailure)
+	e.LastFailure = timeFromDB(lastFailure)
+	e.LockedUntil = timeFromDB(lockedUntil)
+	e.Expires = timeFromDB(expires)
+	return e, nil
+}
+
+func timeToDB(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func timeFromDB(v int64) time.Time {
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, v)
+}
+
+func (s *sqlStore) Get(key string) (Entry, bool, error) {
+	e, err := scanEntry(s.get.QueryRow(key))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Entry{}, false, nil
+		}
+		return Entry{}, false, err
+	}
+	return e, true, nil
+}
+
+func (s *sqlStore) Put(e Entry) error {
+	_, err := s.put.Exec(e.Key, e.Failures, timeToDB(e.FirstFailure), timeToDB(e.LastFailure),
+		timeToDB(e.LockedUntil), e.Lockouts, timeToDB(e.Expires))
+	return err
+}
+
+func (s *sqlStore) Delete(key string) error {
+	_, err := s.del.Exec(key)
+	return err
+}
+
+func (s *sqlStore) List() ([]Entry, error) {
+	rows, err := s.list.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []Entry
+	for rows.Next() {
+		e, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, e)
+	}
+	return res, rows.Err()
+}
+
+func (s *sqlStore) Cleanup(now time.Time) error {
+	_, err := s.cleanup.Exec(timeToDB(now))
+	return err
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,77 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package lockout
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/testutils"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestTracker_SQL(t *testing.T) {
+	dsn := filepath.Join(testutils.Dir(t), "lockout.db")
+	cfg := []config.Node{
+		{Name: "driver", Args: []string{"sqlite3"}},
+		{Name: "dsn", Args: []string{dsn}},
+		scopeCfg("username", "max_failures", "2", "lockout", "5m"),
+	}
+	node1, clock1 := testTracker(t, cfg...)
+	node2, clock2 := testTracker(t, cfg...)
+	a := auth.Attempt{Username: "user", RemoteIP: net.IPv4(192, 0, 2, 1)}
+
+	fail(node1, a, 1)
+	checkAttempt(t, node2, a, 1*time.Second, false)
+	fail(node2, a, 1)
+	checkAttempt(t, node1, a, 0, true)
+
+	entries, err := node1.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[1].Key != "user:user" || !entries[1].LockedUntil.Equal(clock2.now.Add(5*time.Minute)) {
+		t.Fatalf("wrong entries: %+v", entries)
+	}
+
+	if err := node2.Clear("user:user"); err != nil {
+		t.Fatal(err)
+	}
+	// The address is still tracked.
+	checkAttempt(t, node1, a, 2*time.Second, false)
+
+	// Expired entries are removed by either node.
+	clock1.Advance(48 * time.Hour)
+	node1.Record(context.Background(), a, nil)
+	all, err := node2.store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 0 {
+		t.Fatalf("expired entries were not removed: %+v", all)
+	}
+}
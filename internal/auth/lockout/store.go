@@ -0,0 +1,125 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package lockout
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Entry is the state tracked for a single username or client address.
+type Entry struct {
+	// Key is "user:USERNAME" or "ip:PREFIX".
+	Key string
+
+	// Failures within the current window.
+	Failures     int
+	FirstFailure time.Time
+	LastFailure  time.Time
+
+	// LockedUntil is zero if the key was never locked.
+	LockedUntil time.Time
+	// Lockouts is the amount of lockouts applied since the entry was created.
+	// It is used to progressively increase the lockout duration.
+	Lockouts int
+
+	// Expires is the time after which the entry is no longer relevant
+	// and can be removed.
+	Expires time.Time
+}
+
+// Locked reports whether the key is locked at the specified moment.
+func (e Entry) Locked(now time.Time) bool {
+	return now.Before(e.LockedUntil)
+}
+
+// store is the storage for tracked entries.
+//
+// Implementations do not need to handle expiration on Get, it is done by
+// the Tracker.
+type store interface {
+	Get(key string) (Entry, bool, error)
+	Put(e Entry) error
+	Delete(key string) error
+	List() ([]Entry, error)
+	// Cleanup removes entries that expired before the specified moment.
+	Cleanup(now time.Time) error
+	Close() error
+}
+
+type memoryStore struct {
+	lck     sync.Mutex
+	entries map[string]Entry
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		entries: make(map[string]Entry),
+	}
+}
+
+func (s *memoryStore) Get(key string) (Entry, bool, error) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	e, ok := s.entries[key]
+	return e, ok, nil
+}
+
+func (s *memoryStore) Put(e Entry) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	s.entries[e.Key] = e
+	return nil
+}
+
+func (s *memoryStore) Delete(key string) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+func (s *memoryStore) List() ([]Entry, error) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	res := make([]Entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		res = append(res, e)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Key < res[j].Key
+	})
+	return res, nil
+}
+
+func (s *memoryStore) Cleanup(now time.Time) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	for key, e := range s.entries {
+		if now.After(e.Expires) {
+			delete(s.entries, key)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
@@ -23,8 +23,10 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
 	"github.com/foxcpp/maddy/framework/log"
@@ -35,6 +37,15 @@ import (
 var (
 	ErrUnsupportedMech = errors.New("Unsupported SASL mechanism")
 	ErrInvalidAuthCred = errors.New("auth: invalid credentials")
+
+	// ErrLockedOutResp is returned by SASL servers created by CreateSASL
+	// instead of ErrLockedOut. Other errors are reported as
+	// ErrInvalidAuthCred so no details leak to the client.
+	ErrLockedOutResp = &smtp.SMTPError{
+		Code:         454,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Too many failed authentication attempts, try again later",
+	}
 )
 
 // SASLAuth is a wrapper that initializes sasl.Server using authenticators that
@@ -49,9 +60,17 @@ type SASLAuth struct {
 	Log         log.Logger
 	OnlyFirstID bool
 
+	// Name of the endpoint using SASLAuth, used to label metrics.
+	// If empty, metrics are not collected.
+	EndpointName string
+
 	AuthMap       module.Table
 	AuthNormalize authz.NormalizeFunc
 
+	// Tracker, if set, is consulted before each authentication attempt and
+	// notified about its result.
+	Tracker AttemptTracker
+
 	Plain []module.PlainAuth
 }
 
@@ -93,11 +112,64 @@ func (s *SASLAuth) usernameForAuth(ctx context.Context, saslUsername string) (st
 	return mapped, nil
 }
 
-func (s *SASLAuth) AuthPlain(username, password string) error {
+// AuthPlain verifies the credentials using configured providers.
+//
+// remoteAddr is the client address, it is used by the attempt tracker and
+// can be nil if unknown.
+func (s *SASLAuth) AuthPlain(remoteAddr net.Addr, username, password string) error {
 	if len(s.Plain) == 0 {
 		return ErrUnsupportedMech
 	}
 
+	var attempt Attempt
+	if s.Tracker != nil {
+		attempt = Attempt{
+			Endpoint: s.EndpointName,
+			Username: s.trackedUsername(username),
+			RemoteIP: remoteIP(remoteAddr),
+		}
+		delay, err := s.Tracker.Check(context.TODO(), attempt)
+		if err != nil {
+			s.countAttempt("locked_out")
+			return err
+		}
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+	}
+
+	err := s.authPlain(username, password)
+	if s.Tracker != nil {
+		s.Tracker.Record(context.TODO(), attempt, err)
+	}
+	if err != nil {
+		s.countAttempt("failure")
+	} else {
+		s.countAttempt("success")
+	}
+	return err
+}
+
+func (s *SASLAuth) countAttempt(result string) {
+	if s.EndpointName != "" {
+		authAttempts.WithLabelValues(s.EndpointName, result).Inc()
+	}
+}
+
+// trackedUsername returns the username used to track attempts. It is
+// normalized so variations of the same username share the counter.
+func (s *SASLAuth) trackedUsername(username string) string {
+	if s.AuthNormalize == nil {
+		return username
+	}
+	normalized, err := s.AuthNormalize(username)
+	if err != nil {
+		return username
+	}
+	return normalized
+}
+
+func (s *SASLAuth) authPlain(username, password string) error {
 	var lastErr error
 	for _, p := range s.Plain {
 		username, err := s.usernameForAuth(context.TODO(), username)
@@ -126,9 +198,12 @@ func (s *SASLAuth) CreateSASL(mech string, remoteAddr net.Addr, successCb func(i
 				return ErrInvalidAuthCred
 			}
 
-			err := s.AuthPlain(username, password)
+			err := s.AuthPlain(remoteAddr, username, password)
 			if err != nil {
 				s.Log.Error("authentication failed", err, "username", username, "src_ip", remoteAddr)
+				if errors.Is(err, ErrLockedOut) {
+					return ErrLockedOutResp
+				}
 				return ErrInvalidAuthCred
 			}
 
@@ -136,9 +211,12 @@ func (s *SASLAuth) CreateSASL(mech string, remoteAddr net.Addr, successCb func(i
 		})
 	case sasl.Login:
 		return sasl.NewLoginServer(func(username, password string) error {
-			err := s.AuthPlain(username, password)
+			err := s.AuthPlain(remoteAddr, username, password)
 			if err != nil {
 				s.Log.Error("authentication failed", err, "username", username, "src_ip", remoteAddr)
+				if errors.Is(err, ErrLockedOut) {
+					return ErrLockedOutResp
+				}
 				return ErrInvalidAuthCred
 			}
 
@@ -168,6 +246,15 @@ func (s *SASLAuth) AddProvider(m *config.Map, node config.Node) error {
 	return nil
 }
 
+// SetTracker sets the authentication attempt tracker by parsing the
+// 'auth_lockout' configuration directive.
+func (s *SASLAuth) SetTracker(m *config.Map, node config.Node) error {
+	if s.Tracker != nil {
+		return config.NodeErr(node, "auth_lockout: can be specified only once")
+	}
+	return modconfig.GroupFromNode("auth.lockout", node.Args, node, m.Globals, &s.Tracker)
+}
+
 type FailingSASLServ struct{ Err error }
 
 func (s FailingSASLServ) Next([]byte) ([]byte, bool, error) {
@@ -19,10 +19,13 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package auth
 
 import (
+	"context"
 	"errors"
 	"net"
 	"testing"
+	"time"
 
+	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
@@ -87,3 +90,131 @@ func TestCreateSASL(t *testing.T) {
 		}
 	})
 }
+
+type mockTracker struct {
+	locked   bool
+	attempts []Attempt
+	results  []error
+}
+
+func (m *mockTracker) Check(_ context.Context, a Attempt) (time.Duration, error) {
+	if m.locked {
+		return 0, ErrLockedOut
+	}
+	return 0, nil
+}
+
+func (m *mockTracker) Record(_ context.Context, a Attempt, err error) {
+	m.attempts = append(m.attempts, a)
+	m.results = append(m.results, err)
+}
+
+func TestSASLAuth_Tracker(t *testing.T) {
+	tracker := &mockTracker{}
+	a := SASLAuth{
+		Log:          testutils.Logger(t, "saslauth"),
+		EndpointName: "imap",
+		Plain: []module.PlainAuth{
+			&mockAuth{
+				db: map[string]bool{
+					"user1": true,
+				},
+			},
+		},
+		Tracker: tracker,
+	}
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 2525}
+
+	if err := a.AuthPlain(addr, "user1", "aa"); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if err := a.AuthPlain(addr, "user2", "aa"); err == nil {
+		t.Fatal("No error for invalid credentials")
+	}
+	if len(tracker.attempts) != 2 {
+		t.Fatal("Wrong amount of recorded attempts:", len(tracker.attempts))
+	}
+	if tracker.attempts[1].Username != "user2" || !tracker.attempts[1].RemoteIP.Equal(addr.IP) || tracker.attempts[1].Endpoint != "imap" {
+		t.Errorf("Wrong attempt recorded: %+v", tracker.attempts[1])
+	}
+	if tracker.results[0] != nil || tracker.results[1] == nil {
+		t.Errorf("Wrong results recorded: %v", tracker.results)
+	}
+
+	tracker.locked = true
+	if err := a.AuthPlain(addr, "user1", "aa"); !errors.Is(err, ErrLockedOut) {
+		t.Fatal("Expected lockout error, got", err)
+	}
+	if len(tracker.attempts) != 2 {
+		t.Fatal("Attempts rejected by tracker should not be recorded")
+	}
+}
+
+func TestCreateSASL_LockedOut(t *testing.T) {
+	a := SASLAuth{
+		Log: testutils.Logger(t, "saslauth"),
+		Plain: []module.PlainAuth{
+			&mockAuth{
+				db: map[string]bool{
+					"user1": true,
+				},
+			},
+		},
+		Tracker: &mockTracker{locked: true},
+	}
+	checkErr := func(t *testing.T, err error) {
+		t.Helper()
+		if err != ErrLockedOutResp {
+			t.Fatal("Expected lockout error, got", err)
+		}
+	}
+
+	t.Run("PLAIN", func(t *testing.T) {
+		srv := a.CreateSASL("PLAIN", &net.TCPAddr{}, func(string) error {
+			t.Fatal("Callback called for locked out account")
+			return nil
+		})
+		_, _, err := srv.Next([]byte("\x00user1\x00aa"))
+		checkErr(t, err)
+	})
+
+	t.Run("LOGIN", func(t *testing.T) {
+		srv := a.CreateSASL("LOGIN", &net.TCPAddr{}, func(string) error {
+			t.Fatal("Callback called for locked out account")
+			return nil
+		})
+		var err error
+		for _, resp := range [][]byte{nil, []byte("user1"), []byte("aa")} {
+			if _, _, err = srv.Next(resp); err != nil {
+				break
+			}
+		}
+		checkErr(t, err)
+	})
+}
+
+type failingAuth struct {
+	err error
+}
+
+func (m failingAuth) AuthPlain(_, _ string) error {
+	return m.err
+}
+
+func TestCreateSASL_ErrorMasked(t *testing.T) {
+	a := SASLAuth{
+		Log: testutils.Logger(t, "saslauth"),
+		Plain: []module.PlainAuth{
+			failingAuth{err: exterrors.WithTemporary(errors.New("dial tcp 10.0.0.1:5432: connection refused"), true)},
+		},
+	}
+
+	srv := a.CreateSASL("PLAIN", &net.TCPAddr{}, func(string) error {
+		t.Fatal("Callback called for failed authentication")
+		return nil
+	})
+	_, _, err := srv.Next([]byte("\x00user1\x00aa"))
+	if err != ErrInvalidAuthCred {
+		t.Fatal("Expected ErrInvalidAuthCred, got", err)
+	}
+}
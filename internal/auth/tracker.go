@@ -0,0 +1,66 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+)
+
+// ErrLockedOut is returned by AttemptTracker.Check if authentication attempts
+// for the username or the client address are temporarily blocked.
+var ErrLockedOut = exterrors.WithTemporary(errors.New("auth: too many failed attempts, try again later"), true)
+
+// Attempt describes a single authentication attempt.
+type Attempt struct {
+	// Name of the endpoint module that received the attempt.
+	Endpoint string
+	// Username as supplied by the client, after normalization.
+	Username string
+	// RemoteIP is nil if the client address is not known.
+	RemoteIP net.IP
+}
+
+// AttemptTracker is implemented by modules that keep track of authentication
+// attempts in order to slow down and block credentials guessing (e.g.
+// auth.lockout).
+type AttemptTracker interface {
+	// Check is called before the credentials are verified. It returns the
+	// delay that should be applied before verification or ErrLockedOut if
+	// the attempt should be rejected without verification.
+	Check(ctx context.Context, a Attempt) (time.Duration, error)
+
+	// Record is called with the verification result. err is nil if the
+	// attempt was successful.
+	Record(ctx context.Context, a Attempt, err error)
+}
+
+func remoteIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	return nil
+}
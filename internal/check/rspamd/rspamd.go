@@ -53,6 +53,9 @@ type Check struct {
 	tag        string
 	mtaName    string
 
+	controllerPath     string
+	controllerPassword string
+
 	ioErrAction       modconfig.FailAction
 	errorRespAction   modconfig.FailAction
 	addHdrAction      modconfig.FailAction
@@ -98,6 +101,8 @@ func (c *Check) Init(cfg *config.Map) error {
 		return tls.Config{}, nil
 	}, tls2.TLSClientBlock, &tlsConfig)
 	cfg.String("api_path", false, false, c.apiPath, &c.apiPath)
+	cfg.String("controller_path", false, false, "http://127.0.0.1:11334", &c.controllerPath)
+	cfg.String("controller_password", false, false, "", &c.controllerPassword)
 	cfg.String("settings_id", false, false, "", &c.settingsID)
 	cfg.String("tag", false, false, "maddy", &c.tag)
 	cfg.String("hostname", true, false, "", &c.mtaName)
@@ -348,6 +353,55 @@ func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer
 	return module.CheckResult{}
 }
 
+// Train implements module.SpamTrainer using learnspam and learnham endpoints
+// of the rspamd controller worker.
+func (c *Check) Train(ctx context.Context, accountName string, spam bool, hdr textproto.Header, body buffer.Buffer) error {
+	bodyR, err := body.Open()
+	if err != nil {
+		return err
+	}
+	defer bodyR.Close()
+
+	var buf bytes.Buffer
+	if err := textproto.WriteHeader(&buf, hdr); err != nil {
+		return err
+	}
+
+	endpoint := "/learnham"
+	if spam {
+		endpoint = "/learnspam"
+	}
+	r, err := http.NewRequestWithContext(ctx, "POST", c.controllerPath+endpoint, io.MultiReader(&buf, bodyR))
+	if err != nil {
+		return err
+	}
+	r.ContentLength = int64(buf.Len() + body.Len())
+	r.Header.Add("User-Agent", "maddy")
+	if c.controllerPassword != "" {
+		r.Header.Add("Password", c.controllerPassword)
+	}
+	// Used by rspamd for per-user statistics.
+	r.Header.Add("Deliver-To", accountName)
+
+	resp, err := c.client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// 208 is returned if the message was already learned.
+	if resp.StatusCode/100 != 2 {
+		var respData struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&respData); err == nil && respData.Error != "" {
+			return fmt.Errorf("%s: HTTP %d: %s", modName, resp.StatusCode, respData.Error)
+		}
+		return fmt.Errorf("%s: HTTP %d", modName, resp.StatusCode)
+	}
+	return nil
+}
+
 type response struct {
 	Score   float64 `json:"score"`
 	Action  string  `json:"action"`
@@ -0,0 +1,105 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rspamd
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestTrain(t *testing.T) {
+	var (
+		path   string
+		header http.Header
+		body   []byte
+		status = http.StatusOK
+		resp   = `{"success": true}`
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		body, err = io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		path, header = r.URL.Path, r.Header
+		w.WriteHeader(status)
+		io.WriteString(w, resp) //nolint:errcheck
+	}))
+	defer srv.Close()
+
+	c := &Check{
+		log:                testutils.Logger(t, modName),
+		controllerPath:     srv.URL,
+		controllerPassword: "secret",
+		client:             http.DefaultClient,
+	}
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Buy now")
+	msg := buffer.MemoryBuffer{Slice: []byte("Cheap!\r\n")}
+
+	if err := c.Train(context.Background(), "test@example.org", true, hdr, msg); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/learnspam" {
+		t.Errorf("Wrong endpoint: %s", path)
+	}
+	if string(body) != "Subject: Buy now\r\n\r\nCheap!\r\n" {
+		t.Errorf("Wrong body: %q", body)
+	}
+	for name, expected := range map[string]string{
+		"Password":   "secret",
+		"Deliver-To": "test@example.org",
+	} {
+		if v := header.Get(name); v != expected {
+			t.Errorf("Wrong %s: %v", name, v)
+		}
+	}
+
+	// Already learned message.
+	status = http.StatusAlreadyReported
+	if err := c.Train(context.Background(), "test@example.org", false, hdr, msg); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/learnham" {
+		t.Errorf("Wrong endpoint: %s", path)
+	}
+
+	status, resp = http.StatusBadRequest, `{"error": "not enough tokens"}`
+	err := c.Train(context.Background(), "test@example.org", false, hdr, msg)
+	if err == nil || !strings.Contains(err.Error(), "not enough tokens") {
+		t.Errorf("Expected an error with rspamd message, got %v", err)
+	}
+
+	status, resp = http.StatusUnauthorized, ""
+	c.controllerPassword = ""
+	if err := c.Train(context.Background(), "test@example.org", false, hdr, msg); err == nil {
+		t.Error("Expected an error for HTTP 401")
+	}
+	if _, ok := header["Password"]; ok {
+		t.Error("Password is sent when not configured")
+	}
+}
@@ -0,0 +1,251 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/foxcpp/maddy"
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "config",
+			Usage: "Configuration file inspection",
+			Description: `These subcommands read maddy.conf and initialize all modules defined in it
+in the dry-run mode: no ports are bound, no databases are opened and no
+files are created in the state directory.
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:  "check",
+					Usage: "Check the configuration for errors",
+					Description: `Parse the configuration file and initialize all modules defined in it
+without starting the server. All found errors are reported along with
+their location in the configuration file.
+
+Exit status is 1 if there are any errors.
+`,
+					Action: configCheck,
+				},
+				{
+					Name:  "dump",
+					Usage: "Print the expanded configuration",
+					Description: `Print the configuration after expansion of imports, macros, snippets and
+environment variables. Directives that are not specified explicitly are
+added to each block along with their default values.
+
+Errors found in the configuration are reported to stderr, defaults are
+not known for blocks that failed to initialize.
+`,
+					Flags: []cli.Flag{
+						&cli.BoolFlag{
+							Name:  "no-defaults",
+							Usage: "Do not add default values",
+						},
+					},
+					Action: configDump,
+				},
+			},
+		})
+}
+
+// readConfig parses the configuration file and initializes all modules in it
+// in the dry-run mode.
+func readConfig(ctx *cli.Context) (nodes []config.Node, errs []error, err error) {
+	cfgPath := ctx.String("config")
+	if cfgPath == "" {
+		return nil, nil, cli.Exit("Error: config is required", 2)
+	}
+	cfgFile, err := os.Open(cfgPath)
+	if err != nil {
+		return nil, nil, cli.Exit(fmt.Sprintf("Error: failed to open config: %v", err), 2)
+	}
+	defer cfgFile.Close()
+	nodes, err = parser.Read(cfgFile, cfgFile.Name())
+	if err != nil {
+		return nil, []error{err}, nil
+	}
+
+	module.DryRun = true
+	module.NoRun = true
+
+	globals, modBlocks, err := maddy.ReadGlobals(nodes)
+	if err != nil {
+		return nodes, []error{err}, nil
+	}
+	if err := maddy.InitDirs(); err != nil {
+		return nodes, []error{err}, nil
+	}
+
+	return nodes, maddy.CheckModules(globals, modBlocks), nil
+}
+
+func configCheck(ctx *cli.Context) error {
+	_, errs, err := readConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) != 0 {
+		return cli.Exit(fmt.Sprintf("%d error(s) found", len(errs)), 1)
+	}
+	return nil
+}
+
+func configDump(ctx *cli.Context) error {
+	var (
+		globalsRead bool
+		globalDefs  []config.Node
+		defaults    = make(map[string][]config.Node)
+	)
+	if !ctx.Bool("no-defaults") {
+		config.RecordDefaults(func(block config.Node, defs []config.Node) {
+			// Global directives are processed using a synthetic block without
+			// location, so are some inline module definitions.
+			if block.File == "" {
+				if !globalsRead {
+					globalDefs = defs
+					globalsRead = true
+				}
+				return
+			}
+
+			key := nodeKey(block)
+			defaults[key] = mergeDefaults(defaults[key], defs)
+		})
+		defer config.RecordDefaults(nil)
+	}
+
+	nodes, errs, err := readConfig(ctx)
+	if err != nil {
+		return err
+	}
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, "warning:", err)
+	}
+	if nodes == nil {
+		return cli.Exit("Error: failed to parse config", 1)
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+
+	writeNodes(w, nodes, defaults, 0)
+	if globalDefs = missingDefaults(nodes, globalDefs); len(globalDefs) != 0 {
+		fmt.Fprintln(w)
+		writeDefaults(w, globalDefs, 0)
+	}
+	return nil
+}
+
+func nodeKey(node config.Node) string {
+	return fmt.Sprintf("%s:%d:%s", node.File, node.Line, node.Name)
+}
+
+// mergeDefaults adds defaults reported by another config.Map processing the
+// same block.
+func mergeDefaults(known, defs []config.Node) []config.Node {
+outer:
+	for _, def := range defs {
+		for _, k := range known {
+			if k.Name == def.Name {
+				continue outer
+			}
+		}
+		known = append(known, def)
+	}
+	return known
+}
+
+// missingDefaults filters out defaults for directives present in the block.
+func missingDefaults(children, defs []config.Node) []config.Node {
+	present := make(map[string]bool, len(children))
+	for _, child := range children {
+		present[child.Name] = true
+	}
+
+	res := make([]config.Node, 0, len(defs))
+	for _, def := range defs {
+		if !present[def.Name] {
+			res = append(res, def)
+		}
+	}
+	return res
+}
+
+func writeNodes(w io.Writer, nodes []config.Node, defaults map[string][]config.Node, indent int) {
+	prevBlock := false
+	for i, node := range nodes {
+		defs := missingDefaults(node.Children, defaults[nodeKey(node)])
+		isBlock := len(node.Children) != 0 || len(defs) != 0
+
+		// Separate top-level blocks with empty lines for readability.
+		if indent == 0 && i != 0 && (isBlock || prevBlock) {
+			fmt.Fprintln(w)
+		}
+		prevBlock = isBlock
+
+		header := strings.Repeat("\t", indent) + quoteArgs(append([]string{node.Name}, node.Args...))
+		if !isBlock {
+			fmt.Fprintln(w, header)
+			continue
+		}
+
+		fmt.Fprintln(w, header, "{")
+		writeNodes(w, node.Children, defaults, indent+1)
+		writeDefaults(w, defs, indent+1)
+		fmt.Fprintln(w, strings.Repeat("\t", indent)+"}")
+	}
+}
+
+func writeDefaults(w io.Writer, defs []config.Node, indent int) {
+	if len(defs) == 0 {
+		return
+	}
+
+	fmt.Fprintln(w, strings.Repeat("\t", indent)+"# defaults")
+	for _, def := range defs {
+		fmt.Fprintln(w, strings.Repeat("\t", indent)+quoteArgs(append([]string{def.Name}, def.Args...)))
+	}
+}
+
+func quoteArgs(args []string) string {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		if arg == "" || arg == "{" || arg == "}" || strings.ContainsAny(arg, " \t\n\"#") {
+			arg = `"` + strings.ReplaceAll(arg, `"`, `\"`) + `"`
+		}
+		quoted = append(quoted, arg)
+	}
+	return strings.Join(quoted, " ")
+}
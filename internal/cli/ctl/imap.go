@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
@@ -141,6 +142,82 @@ func init() {
 						return mboxesRename(be, ctx)
 					},
 				},
+				{
+					Name:  "acl",
+					Usage: "Mailbox access control lists management",
+					Subcommands: []*cli.Command{
+						{
+							Name:      "list",
+							Usage:     "Show rights granted to other accounts",
+							ArgsUsage: "USERNAME MAILBOX",
+							Flags: []cli.Flag{
+								&cli.StringFlag{
+									Name:    "cfg-block",
+									Usage:   "Module configuration block to use",
+									EnvVars: []string{"MADDY_CFGBLOCK"},
+									Value:   "local_mailboxes",
+								},
+							},
+							Action: func(ctx *cli.Context) error {
+								be, err := openStorage(ctx)
+								if err != nil {
+									return err
+								}
+								defer closeIfNeeded(be)
+								return mboxesACLList(be, ctx)
+							},
+						},
+						{
+							Name:  "set",
+							Usage: "Change rights of the identifier",
+							Description: `IDENTIFIER is an account name, $group for groups defined using acl_groups
+or 'anyone' for all accounts.
+
+RIGHTS is a set of RFC 4314 rights (lrswipkxtea). If RIGHTS is prefixed
+with '+' or '-', rights are added or removed instead of being replaced.
+Use '--' before arguments to remove rights, e.g.
+  maddy imap-mboxes acl set -- USERNAME MAILBOX IDENTIFIER -w`,
+							ArgsUsage: "USERNAME MAILBOX IDENTIFIER RIGHTS",
+							Flags: []cli.Flag{
+								&cli.StringFlag{
+									Name:    "cfg-block",
+									Usage:   "Module configuration block to use",
+									EnvVars: []string{"MADDY_CFGBLOCK"},
+									Value:   "local_mailboxes",
+								},
+							},
+							Action: func(ctx *cli.Context) error {
+								be, err := openStorage(ctx)
+								if err != nil {
+									return err
+								}
+								defer closeIfNeeded(be)
+								return mboxesACLSet(be, ctx)
+							},
+						},
+						{
+							Name:      "remove",
+							Usage:     "Remove all rights of the identifier",
+							ArgsUsage: "USERNAME MAILBOX IDENTIFIER",
+							Flags: []cli.Flag{
+								&cli.StringFlag{
+									Name:    "cfg-block",
+									Usage:   "Module configuration block to use",
+									EnvVars: []string{"MADDY_CFGBLOCK"},
+									Value:   "local_mailboxes",
+								},
+							},
+							Action: func(ctx *cli.Context) error {
+								be, err := openStorage(ctx)
+								if err != nil {
+									return err
+								}
+								defer closeIfNeeded(be)
+								return mboxesACLRemove(be, ctx)
+							},
+						},
+					},
+				},
 			},
 		})
 	maddycli.AddSubcommand(&cli.Command{
@@ -537,6 +614,73 @@ func mboxesRename(be module.Storage, ctx *cli.Context) error {
 	return u.RenameMailbox(oldName, newName)
 }
 
+type aclStorage interface {
+	GetACL(username, mbox string) (map[string]string, error)
+	SetACL(username, mbox, identifier, rights string) error
+	DeleteACL(username, mbox, identifier string) error
+}
+
+func mboxesACLArgs(be module.Storage, ctx *cli.Context, names ...string) (aclStorage, []string, error) {
+	aclBe, ok := be.(aclStorage)
+	if !ok {
+		return nil, nil, cli.Exit("Error: storage does not support access control lists", 2)
+	}
+	args := make([]string, 0, len(names))
+	for i, name := range names {
+		arg := ctx.Args().Get(i)
+		if arg == "" {
+			return nil, nil, cli.Exit(fmt.Sprintf("Error: %s is required", name), 2)
+		}
+		args = append(args, arg)
+	}
+	return aclBe, args, nil
+}
+
+func mboxesACLList(be module.Storage, ctx *cli.Context) error {
+	aclBe, args, err := mboxesACLArgs(be, ctx, "USERNAME", "MAILBOX")
+	if err != nil {
+		return err
+	}
+
+	acl, err := aclBe.GetACL(args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	if len(acl) == 0 && !ctx.Bool("quiet") {
+		fmt.Fprintln(os.Stderr, "No rights granted.")
+	}
+
+	identifiers := make([]string, 0, len(acl))
+	for identifier := range acl {
+		identifiers = append(identifiers, identifier)
+	}
+	sort.Strings(identifiers)
+	for _, identifier := range identifiers {
+		fmt.Printf("%s\t%s\n", identifier, acl[identifier])
+	}
+
+	return nil
+}
+
+func mboxesACLSet(be module.Storage, ctx *cli.Context) error {
+	aclBe, args, err := mboxesACLArgs(be, ctx, "USERNAME", "MAILBOX", "IDENTIFIER", "RIGHTS")
+	if err != nil {
+		return err
+	}
+
+	return aclBe.SetACL(args[0], args[1], args[2], args[3])
+}
+
+func mboxesACLRemove(be module.Storage, ctx *cli.Context) error {
+	aclBe, args, err := mboxesACLArgs(be, ctx, "USERNAME", "MAILBOX", "IDENTIFIER")
+	if err != nil {
+		return err
+	}
+
+	return aclBe.DeleteACL(args[0], args[1], args[2])
+}
+
 func msgsAdd(be module.Storage, ctx *cli.Context) error {
 	username := ctx.Args().First()
 	if username == "" {
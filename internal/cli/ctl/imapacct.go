@@ -19,14 +19,20 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package ctl
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
 	"github.com/foxcpp/maddy/framework/module"
 	maddycli "github.com/foxcpp/maddy/internal/cli"
 	clitools2 "github.com/foxcpp/maddy/internal/cli/clitools"
+	"github.com/foxcpp/maddy/internal/mailarchive"
 	"github.com/urfave/cli/v2"
 )
 
@@ -181,6 +187,72 @@ APPENDLIMIT value (either global or per-account) cannot be larger than
 						return imapAcctAppendlimit(be, ctx)
 					},
 				},
+				{
+					Name:  "import",
+					Usage: "Import messages from Maildir, mbox or .eml files",
+					Description: `Import all mailboxes found at PATH into the account. The account is created if it does
+not exist. Messages are added to existing mailboxes, missing mailboxes are created.
+Flags, internal dates, folder hierarchy and SPECIAL-USE attributes are preserved.
+
+Supported formats:
+- maildir: Maildir++ directory (INBOX in the root, other mailboxes in .Name subdirectories)
+- mbox: directory with Name.mbox files (or a single mbox file)
+- eml-dir: directory per mailbox containing .eml files
+
+If the server is running, clients will see imported messages immediately.
+`,
+					ArgsUsage: "USERNAME PATH",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.StringFlag{
+							Name:  "format",
+							Usage: "Archive format (maildir, mbox or eml-dir)",
+							Value: "maildir",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return imapAcctImport(be, ctx)
+					},
+				},
+				{
+					Name:  "export",
+					Usage: "Export messages to Maildir, mbox or .eml files",
+					Description: `Export all mailboxes of the account to PATH. PATH should not exist or be an
+empty directory. See 'import' for the list of supported formats.
+`,
+					ArgsUsage: "USERNAME PATH",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.StringFlag{
+							Name:  "format",
+							Usage: "Archive format (maildir, mbox or eml-dir)",
+							Value: "maildir",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return imapAcctExport(be, ctx)
+					},
+				},
 			},
 		})
 }
@@ -290,3 +362,226 @@ func imapAcctRemove(be module.Storage, ctx *cli.Context) error {
 
 	return mbe.DeleteIMAPAcct(username)
 }
+
+var specialUseAttrs = []string{
+	imap.AllAttr, imap.ArchiveAttr, imap.DraftsAttr, imap.FlaggedAttr,
+	imap.JunkAttr, imap.SentAttr, imap.TrashAttr,
+}
+
+func withoutRecent(flags []string) []string {
+	res := make([]string, 0, len(flags))
+	for _, f := range flags {
+		if f != imap.RecentFlag {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+func imapAcctImport(be module.Storage, ctx *cli.Context) error {
+	mbe, ok := be.(module.ManageableStorage)
+	if !ok {
+		return cli.Exit("Error: storage backend does not support accounts management using maddy command", 2)
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+	path := ctx.Args().Get(1)
+	if path == "" {
+		return cli.Exit("Error: PATH is required", 2)
+	}
+
+	archive, err := mailarchive.Open(ctx.String("format"), path)
+	if err != nil {
+		return err
+	}
+	mboxes, err := archive.Mailboxes()
+	if err != nil {
+		return err
+	}
+
+	accts, err := mbe.ListIMAPAccts()
+	if err != nil {
+		return err
+	}
+	exists := false
+	for _, acct := range accts {
+		if acct == username {
+			exists = true
+		}
+	}
+	if !exists {
+		if err := mbe.CreateIMAPAcct(username); err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "Created storage account", username)
+	}
+
+	u, err := mbe.GetIMAPAcct(username)
+	if err != nil {
+		return err
+	}
+	delim := "."
+	infos, err := u.ListMailboxes(false)
+	if err != nil {
+		return err
+	}
+	if len(infos) != 0 && infos[0].Delimiter != "" {
+		delim = infos[0].Delimiter
+	}
+	suu, _ := u.(SpecialUseUser)
+
+	for _, mbox := range mboxes {
+		name := strings.Join(mbox.Path, delim)
+		if strings.EqualFold(name, imap.InboxName) {
+			name = imap.InboxName
+		}
+
+		if _, err := u.Status(name, []imap.StatusItem{imap.StatusMessages}); err != nil {
+			if mbox.SpecialUse != "" && suu != nil {
+				err = suu.CreateMailboxSpecial(name, mbox.SpecialUse)
+			} else {
+				err = u.CreateMailbox(name)
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			if err := u.SetSubscribed(name, mbox.Subscribed); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+
+		count := 0
+		err := archive.Messages(mbox.Path, func(msg mailarchive.Message) error {
+			date := msg.Date
+			if date.IsZero() {
+				date = time.Now()
+			}
+			if err := u.CreateMessage(name, withoutRecent(msg.Flags), date, bytes.NewReader(msg.Body), nil); err != nil {
+				return err
+			}
+			count++
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w (%d messages imported)", name, err, count)
+		}
+		fmt.Fprintf(os.Stderr, "%s: %d messages imported\n", name, count)
+	}
+
+	return nil
+}
+
+func imapAcctExport(be module.Storage, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return cli.Exit("Error: USERNAME is required", 2)
+	}
+	path := ctx.Args().Get(1)
+	if path == "" {
+		return cli.Exit("Error: PATH is required", 2)
+	}
+
+	u, err := be.GetIMAPAcct(username)
+	if err != nil {
+		return err
+	}
+	infos, err := u.ListMailboxes(false)
+	if err != nil {
+		return err
+	}
+	subscribedInfos, err := u.ListMailboxes(true)
+	if err != nil {
+		return err
+	}
+	subscribed := make(map[string]bool, len(subscribedInfos))
+	for _, info := range subscribedInfos {
+		subscribed[info.Name] = true
+	}
+
+	archive, err := mailarchive.Create(ctx.String("format"), path)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		mbox := mailarchive.Mailbox{
+			Path:       []string{info.Name},
+			Subscribed: subscribed[info.Name],
+		}
+		if info.Delimiter != "" {
+			mbox.Path = strings.Split(info.Name, info.Delimiter)
+		}
+		noSelect := false
+		for _, attr := range info.Attributes {
+			if attr == imap.NoSelectAttr {
+				noSelect = true
+			}
+			for _, su := range specialUseAttrs {
+				if attr == su {
+					mbox.SpecialUse = attr
+				}
+			}
+		}
+		if err := archive.CreateMailbox(mbox); err != nil {
+			return fmt.Errorf("%s: %w", info.Name, err)
+		}
+		if noSelect {
+			continue
+		}
+
+		count, err := exportMailbox(u, info.Name, archive, mbox.Path)
+		if err != nil {
+			return fmt.Errorf("%s: %w (%d messages exported)", info.Name, err, count)
+		}
+		fmt.Fprintf(os.Stderr, "%s: %d messages exported\n", info.Name, count)
+	}
+
+	return archive.Close()
+}
+
+func exportMailbox(u backend.User, name string, archive mailarchive.Writer, path []string) (int, error) {
+	_, mbox, err := u.GetMailbox(name, true, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer mbox.Close()
+
+	seq, _ := imap.ParseSeqSet("1:*")
+	ch := make(chan *imap.Message, 10)
+	var listErr error
+	go func() {
+		listErr = mbox.ListMessages(true, seq, []imap.FetchItem{imap.FetchFlags, imap.FetchInternalDate, "BODY.PEEK[]"}, ch)
+	}()
+
+	var (
+		count     int
+		appendErr error
+	)
+	for msg := range ch {
+		if appendErr != nil {
+			continue
+		}
+		var body []byte
+		for _, v := range msg.Body {
+			body, appendErr = io.ReadAll(v)
+		}
+		if appendErr != nil {
+			continue
+		}
+		appendErr = archive.AppendMessage(path, mailarchive.Message{
+			Flags: withoutRecent(msg.Flags),
+			Date:  msg.InternalDate,
+			Body:  body,
+		})
+		if appendErr == nil {
+			count++
+		}
+	}
+	if listErr != nil {
+		return count, listErr
+	}
+	return count, appendErr
+}
@@ -0,0 +1,274 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/storage/imapsql"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "imap-storage",
+			Usage: "IMAP storage maintenance",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "fsck",
+					Usage: "Check consistency of the message blob store",
+					Description: `Cross-reference messages stored in the database against objects in
+the blob store (msg_store) and report messages with missing blobs and blobs
+not referenced by any message.
+
+With --remove-orphans, unreferenced blobs older than the grace period are
+removed. The grace period protects blobs of messages that are being
+delivered at the time of the check, so the server can stay running.
+
+Exit status is 1 if any missing blobs are found, 0 otherwise.
+`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.BoolFlag{
+							Name:  "remove-orphans",
+							Usage: "Remove blobs not referenced by any message",
+						},
+						&cli.DurationFlag{
+							Name:  "grace-period",
+							Usage: "Minimal age of an unreferenced blob to be removed",
+							Value: imapsql.DefaultFsckGracePeriod,
+						},
+						&cli.BoolFlag{
+							Name:  "json",
+							Usage: "Print the report in JSON",
+						},
+					},
+					Action: imapStorageFsck,
+				},
+				{
+					Name:  "migrate",
+					Usage: "Copy accounts and messages to another storage",
+					Description: `Copy all accounts, mailboxes, messages and flags from one imapsql storage to
+another, e.g. from SQLite to PostgreSQL, or from 'fs' blob store to 's3'.
+UIDVALIDITY and UID values are preserved so clients do not need to download
+mail again after the switch.
+
+The command is incremental: repeated runs copy only messages added since the
+previous run, apply flag changes and remove messages and mailboxes removed
+from the source. This allows to migrate the bulk of data while the server is
+running and then make a short final pass with the server stopped before
+changing the configuration to use the new storage.
+
+The command can be interrupted and restarted at any time.
+`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:     "from",
+							Usage:    "Configuration block of the source storage",
+							Required: true,
+						},
+						&cli.StringFlag{
+							Name:     "to",
+							Usage:    "Configuration block of the destination storage",
+							Required: true,
+						},
+						&cli.StringSliceFlag{
+							Name:  "user",
+							Usage: "Migrate only the specified account (can be repeated)",
+						},
+						&cli.BoolFlag{
+							Name:    "quiet",
+							Aliases: []string{"q"},
+							Usage:   "Do not print per-mailbox progress",
+						},
+					},
+					Action: imapStorageMigrate,
+				},
+				{
+					Name:  "retention",
+					Usage: "Report or remove messages expired according to the retention policy",
+					Description: `Find messages older than allowed by the 'retention' directive of the storage
+configuration and print the amount of expired messages for each mailbox.
+
+By default, nothing is removed. With --apply, expired messages are removed
+the same way the server does it periodically.
+`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:    "cfg-block",
+							Usage:   "Module configuration block to use",
+							EnvVars: []string{"MADDY_CFGBLOCK"},
+							Value:   "local_mailboxes",
+						},
+						&cli.BoolFlag{
+							Name:  "apply",
+							Usage: "Remove expired messages",
+						},
+					},
+					Action: imapStorageRetention,
+				},
+			},
+		})
+}
+
+func imapStorageFsck(ctx *cli.Context) error {
+	globals, mod, err := getCfgBlockModule(ctx)
+	if err != nil {
+		return err
+	}
+
+	store, ok := mod.Instance.(*imapsql.Storage)
+	if !ok {
+		return cli.Exit(fmt.Sprintf("Error: configuration block %s is not imapsql storage", ctx.String("cfg-block")), 2)
+	}
+	if err := store.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+		return fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+	defer store.Close()
+
+	report, err := store.CheckBlobs(ctx.Context, imapsql.FsckOptions{
+		RemoveOrphans: ctx.Bool("remove-orphans"),
+		GracePeriod:   ctx.Duration("grace-period"),
+	})
+	if report == nil {
+		return err
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+	}
+
+	if ctx.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		for _, m := range report.Missing {
+			fmt.Printf("missing: %s (user %s, mailbox %s, UID %d)\n", m.Key, m.Username, m.Mailbox, m.UID)
+		}
+		removed := make(map[string]struct{}, len(report.Removed))
+		for _, key := range report.Removed {
+			removed[key] = struct{}{}
+		}
+		for _, o := range report.Orphaned {
+			status := "orphaned"
+			if _, ok := removed[o.Key]; ok {
+				status = "removed"
+			}
+			fmt.Printf("%s: %s (%d bytes, modified %s)\n", status, o.Key, o.Size, o.ModTime.Local().Format(time.RFC3339))
+		}
+		fmt.Printf("%d referenced, %d stored, %d missing, %d orphaned, %d removed\n",
+			report.Referenced, report.Stored, len(report.Missing), len(report.Orphaned), len(report.Removed))
+	}
+
+	if err != nil {
+		return cli.Exit("", 1)
+	}
+	if len(report.Missing) != 0 {
+		return cli.Exit("", 1)
+	}
+	return nil
+}
+
+func imapStorageMigrate(ctx *cli.Context) error {
+	if ctx.String("from") == ctx.String("to") {
+		return cli.Exit("Error: --from and --to should refer to different configuration blocks", 2)
+	}
+
+	globals, mods, err := getNamedCfgBlockModules(ctx, ctx.String("from"), ctx.String("to"))
+	if err != nil {
+		return err
+	}
+	stores := make([]*imapsql.Storage, 0, 2)
+	for _, mod := range mods {
+		store, ok := mod.Instance.(*imapsql.Storage)
+		if !ok {
+			return cli.Exit(fmt.Sprintf("Error: configuration block %s is not imapsql storage", mod.Instance.InstanceName()), 2)
+		}
+		if err := store.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+			return fmt.Errorf("Error: module initialization failed: %w", err)
+		}
+		defer store.Close()
+		stores = append(stores, store)
+	}
+
+	start := time.Now()
+	stats, err := imapsql.Migrate(ctx.Context, stores[0], stores[1], imapsql.MigrateOptions{
+		Users: ctx.StringSlice("user"),
+		OnMailbox: func(res imapsql.MailboxMigration) {
+			if ctx.Bool("quiet") || (res.Copied == 0 && res.Updated == 0 && res.Removed == 0 && !res.MailboxRemoved) {
+				return
+			}
+			if res.MailboxRemoved {
+				fmt.Fprintf(os.Stderr, "%s: %s: removed (%d messages)\n", res.Username, res.Mailbox, res.Removed)
+				return
+			}
+			fmt.Fprintf(os.Stderr, "%s: %s: %d copied, %d updated, %d removed\n", res.Username, res.Mailbox, res.Copied, res.Updated, res.Removed)
+		},
+	})
+	if stats != nil {
+		fmt.Printf("%d accounts, %d mailboxes: %d messages copied, %d updated, %d removed, %d blobs copied in %v\n",
+			stats.Users, stats.Mailboxes, stats.Copied, stats.Updated, stats.Removed, stats.BlobsCopied, time.Since(start).Round(time.Second))
+		if stats.MissingBlobs != 0 {
+			fmt.Fprintf(os.Stderr, "Warning: %d messages refer to blobs missing in the source store, see 'maddy imap-storage fsck'\n", stats.MissingBlobs)
+		}
+	}
+	return err
+}
+
+func imapStorageRetention(ctx *cli.Context) error {
+	be, err := openStorage(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeIfNeeded(be)
+
+	store, ok := be.(*imapsql.Storage)
+	if !ok {
+		return cli.Exit(fmt.Sprintf("Error: configuration block %s is not imapsql storage", ctx.String("cfg-block")), 2)
+	}
+	if !store.HasRetention() {
+		return cli.Exit("Error: retention policy is not configured", 2)
+	}
+
+	apply := ctx.Bool("apply")
+	total := 0
+	err = store.ExpireMessages(ctx.Context, !apply, func(res imapsql.RetentionResult) {
+		fmt.Printf("%s: %s: %d expired (max age %v)\n", res.Username, res.Mailbox, res.Expired, res.MaxAge)
+		total += res.Expired
+	})
+	if apply {
+		fmt.Printf("%d messages removed\n", total)
+	} else {
+		fmt.Printf("%d messages expired, use --apply to remove them\n", total)
+	}
+	return err
+}
@@ -0,0 +1,125 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "auth-lockout",
+			Usage: "Authentication lockouts management",
+			Description: `These subcommands can be used to inspect and lift lockouts applied by
+auth.lockout to usernames and client addresses after too many failed
+authentication attempts.
+
+The tracker is referred to by the name of its top-level configuration block.
+Requests are sent to the running server using the admin endpoint defined in
+maddy.conf.
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:      "list",
+					Usage:     "List tracked usernames and client addresses",
+					ArgsUsage: "BLOCK",
+					Flags: append(adminFlags(),
+						&cli.BoolFlag{
+							Name:  "locked",
+							Usage: "Show only locked entries",
+						},
+					),
+					Action: lockoutList,
+				},
+				{
+					Name:  "clear",
+					Usage: "Remove the tracked state, lifting the lockout",
+					Description: `KEY is either user:USERNAME or ip:ADDRESS. Addresses are converted
+into prefixes using the configured prefix length. If KEY is not specified,
+state for all usernames and addresses is removed.
+`,
+					ArgsUsage: "BLOCK [KEY]",
+					Flags:     adminFlags(),
+					Action:    lockoutClear,
+				},
+			},
+		})
+}
+
+func lockoutList(ctx *cli.Context) error {
+	block := ctx.Args().First()
+	if block == "" {
+		return cli.Exit("Error: BLOCK is required", 2)
+	}
+
+	var entries []struct {
+		Key         string     `json:"key"`
+		Failures    int        `json:"failures"`
+		Locked      bool       `json:"locked"`
+		LockedUntil *time.Time `json:"locked_until"`
+		Lockouts    int        `json:"lockouts"`
+	}
+	if err := adminRequest(ctx, http.MethodGet, "/v1/lockouts/"+url.PathEscape(block), time.Minute, &entries); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tFAILURES\tLOCKOUTS\tLOCKED UNTIL")
+	for _, e := range entries {
+		if ctx.Bool("locked") && !e.Locked {
+			continue
+		}
+		lockedUntil := "-"
+		if e.Locked && e.LockedUntil != nil {
+			lockedUntil = e.LockedUntil.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", e.Key, e.Failures, e.Lockouts, lockedUntil)
+	}
+	return w.Flush()
+}
+
+func lockoutClear(ctx *cli.Context) error {
+	block := ctx.Args().First()
+	if block == "" {
+		return cli.Exit("Error: BLOCK is required", 2)
+	}
+
+	path := "/v1/lockouts/" + url.PathEscape(block)
+	if key := ctx.Args().Get(1); key != "" {
+		return adminRequest(ctx, http.MethodDelete, path+"/"+url.PathEscape(key), time.Minute, nil)
+	}
+
+	var resp struct {
+		Cleared int `json:"cleared"`
+	}
+	if err := adminRequest(ctx, http.MethodDelete, path, time.Minute, &resp); err != nil {
+		return err
+	}
+	fmt.Printf("Removed state for %d usernames and addresses\n", resp.Cleared)
+	return nil
+}
@@ -0,0 +1,395 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	parser "github.com/foxcpp/maddy/framework/logparser"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "log",
+			Usage: "Log analysis",
+			Subcommands: []*cli.Command{
+				{
+					Name:      "trace",
+					Usage:     "Show the processing history of a message",
+					ArgsUsage: "MSGID|MESSAGE-ID|ADDRESS",
+					Description: `Find all log messages related to the message and print them as a timeline:
+receipt, checks, modifications, delivery attempts made by the queue,
+remote server responses and generated DSNs.
+
+The message can be specified either using the internal ID (msg_id field
+in the log), the Message-ID header value or an address of the sender
+or one of the recipients. In the last case, all matching messages are
+shown. DSNs generated for the matching messages are included as well.
+
+Logs are read from files specified using --file or from the standard
+input. Both maddy log files (in text or JSON format) and journald output
+('journalctl -o short-iso' or 'journalctl -o cat') are accepted:
+
+  journalctl -u maddy -o short-iso | maddy log trace foo@example.org
+`,
+					Flags: []cli.Flag{
+						&cli.StringSliceFlag{
+							Name:    "file",
+							Aliases: []string{"f"},
+							Usage:   "Log file to read, standard input is used if not specified",
+						},
+						&cli.BoolFlag{
+							Name:  "json",
+							Usage: "Print the result as JSON",
+						},
+					},
+					Action: logTrace,
+				},
+			},
+		})
+}
+
+type (
+	traceEvent struct {
+		Stamp   time.Time              `json:"time"`
+		Stage   string                 `json:"stage"`
+		Module  string                 `json:"module,omitempty"`
+		Message string                 `json:"message"`
+		Debug   bool                   `json:"debug,omitempty"`
+		Fields  map[string]interface{} `json:"fields,omitempty"`
+	}
+
+	tracedMsg struct {
+		ID        string       `json:"msg_id"`
+		MessageID string       `json:"message_id,omitempty"`
+		Sender    *string      `json:"sender,omitempty"`
+		Rcpts     []string     `json:"rcpts,omitempty"`
+		DSNFor    string       `json:"dsn_for,omitempty"`
+		Events    []traceEvent `json:"events"`
+	}
+)
+
+func logTrace(ctx *cli.Context) error {
+	query := ctx.Args().First()
+	if query == "" {
+		return cli.Exit("Error: MSGID, MESSAGE-ID or ADDRESS is required", 2)
+	}
+
+	var entries []parser.Msg
+	if files := ctx.StringSlice("file"); len(files) != 0 {
+		for _, path := range files {
+			f, err := os.Open(path)
+			if err != nil {
+				return cli.Exit(fmt.Sprintf("Error: %v", err), 2)
+			}
+			entries, err = readLogEntries(f, entries)
+			f.Close()
+			if err != nil {
+				return cli.Exit(fmt.Sprintf("Error: %s: %v", path, err), 2)
+			}
+		}
+	} else {
+		var err error
+		entries, err = readLogEntries(os.Stdin, nil)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Error: %v", err), 2)
+		}
+	}
+
+	msgs := traceMessages(entries, query)
+	if len(msgs) == 0 {
+		return cli.Exit(fmt.Sprintf("Error: no log messages found for %s", query), 1)
+	}
+
+	if ctx.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		return enc.Encode(msgs)
+	}
+
+	for i, msg := range msgs {
+		if i != 0 {
+			fmt.Println()
+		}
+		printTracedMsg(os.Stdout, msg)
+	}
+	return nil
+}
+
+// readLogEntries reads log messages related to some message (these that have
+// msg_id field) from r and appends them to entries.
+//
+// Lines that can't be parsed are silently skipped since the log may contain
+// arbitrary output of other programs.
+func readLogEntries(r io.Reader, entries []parser.Msg) ([]parser.Msg, error) {
+	scnr := bufio.NewScanner(r)
+	scnr.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for scnr.Scan() {
+		line := scnr.Text()
+		var (
+			msg parser.Msg
+			err error
+		)
+		if strings.HasPrefix(line, "{") {
+			msg, err = parser.ParseJSON(line)
+		} else {
+			msg, err = parser.Parse(line)
+			if err != nil {
+				msg, err = parser.ParseJournal(line)
+			}
+		}
+		if err != nil {
+			continue
+		}
+		if _, ok := msg.Context["msg_id"].(string); !ok {
+			continue
+		}
+		entries = append(entries, msg)
+	}
+	return entries, scnr.Err()
+}
+
+// traceMessages selects entries related to messages matching the query and
+// groups them by the message.
+func traceMessages(entries []parser.Msg, query string) []*tracedMsg {
+	ids := make(map[string]bool)
+	for _, e := range entries {
+		if entryMatches(e, query) {
+			ids[e.Context["msg_id"].(string)] = true
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	// Follow DSNs generated for selected messages. DSN might match the
+	// query by itself (e.g. it is sent to the original sender), it is
+	// still marked as such.
+	dsnFor := make(map[string]string)
+	for added := true; added; {
+		added = false
+		for _, e := range entries {
+			id := e.Context["msg_id"].(string)
+			dsnID, ok := e.Context["dsn_id"].(string)
+			if !ok || !ids[id] {
+				continue
+			}
+			if _, ok := dsnFor[dsnID]; !ok {
+				dsnFor[dsnID] = id
+			}
+			if !ids[dsnID] {
+				ids[dsnID] = true
+				added = true
+			}
+		}
+	}
+
+	var msgs []*tracedMsg
+	byID := make(map[string]*tracedMsg)
+	for _, e := range entries {
+		id := e.Context["msg_id"].(string)
+		if !ids[id] {
+			continue
+		}
+		msg := byID[id]
+		if msg == nil {
+			msg = &tracedMsg{ID: id, DSNFor: dsnFor[id]}
+			byID[id] = msg
+			msgs = append(msgs, msg)
+		}
+		msg.add(e)
+	}
+
+	for _, msg := range msgs {
+		sort.SliceStable(msg.Events, func(i, j int) bool {
+			return msg.Events[i].Stamp.Before(msg.Events[j].Stamp)
+		})
+	}
+	return msgs
+}
+
+func entryMatches(e parser.Msg, query string) bool {
+	if e.Context["msg_id"] == query {
+		return true
+	}
+	if msgID, ok := e.Context["message_id"].(string); ok && msgID != "" {
+		if strings.Trim(msgID, "<>") == strings.Trim(query, "<>") {
+			return true
+		}
+	}
+	for _, key := range []string{"sender", "rcpt"} {
+		if addr, ok := e.Context[key].(string); ok && strings.EqualFold(addr, query) {
+			return true
+		}
+	}
+	if rcpts, ok := e.Context["rcpts"].([]interface{}); ok {
+		for _, rcpt := range rcpts {
+			if addr, ok := rcpt.(string); ok && strings.EqualFold(addr, query) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (msg *tracedMsg) add(e parser.Msg) {
+	if msgID, ok := e.Context["message_id"].(string); ok && msgID != "" {
+		msg.MessageID = msgID
+	}
+	if sender, ok := e.Context["sender"].(string); ok && e.Message == "incoming message" {
+		msg.Sender = &sender
+	}
+	if rcpt, ok := e.Context["rcpt"].(string); ok {
+		msg.addRcpt(rcpt)
+	}
+	if rcpts, ok := e.Context["rcpts"].([]interface{}); ok {
+		for _, rcpt := range rcpts {
+			if rcpt, ok := rcpt.(string); ok {
+				msg.addRcpt(rcpt)
+			}
+		}
+	}
+
+	fields := make(map[string]interface{}, len(e.Context))
+	for k, v := range e.Context {
+		if k != "msg_id" {
+			fields[k] = v
+		}
+	}
+	msg.Events = append(msg.Events, traceEvent{
+		Stamp:   e.Stamp,
+		Stage:   eventStage(e),
+		Module:  e.Module,
+		Message: e.Message,
+		Debug:   e.Debug,
+		Fields:  fields,
+	})
+}
+
+func (msg *tracedMsg) addRcpt(rcpt string) {
+	for _, r := range msg.Rcpts {
+		if r == rcpt {
+			return
+		}
+	}
+	msg.Rcpts = append(msg.Rcpts, rcpt)
+}
+
+// eventStage roughly classifies the log message by the processing stage it
+// belongs to using the logger name and context fields.
+func eventStage(e parser.Msg) string {
+	module := e.Module
+	if i := strings.IndexByte(module, '/'); i != -1 {
+		module = module[:i]
+	}
+
+	switch {
+	case e.Context["dsn_id"] != nil:
+		return "dsn"
+	case e.Context["check"] != nil, strings.HasPrefix(module, "check."), module == "dnsbl":
+		return "check"
+	case strings.HasPrefix(module, "modify."):
+		return "modify"
+	case module == "queue":
+		return "queue"
+	case e.Context["target"] != nil, e.Context["remote_server"] != nil,
+		strings.HasPrefix(module, "target."), module == "remote":
+		return "delivery"
+	case module == "smtp", module == "submission", module == "lmtp":
+		return "receipt"
+	default:
+		return "other"
+	}
+}
+
+func printTracedMsg(w io.Writer, msg *tracedMsg) {
+	fmt.Fprintln(w, "Message", msg.ID)
+	if msg.MessageID != "" {
+		fmt.Fprintln(w, "  Message-ID:", msg.MessageID)
+	}
+	if msg.Sender != nil {
+		sender := *msg.Sender
+		if sender == "" {
+			sender = "<>"
+		}
+		fmt.Fprintln(w, "  Sender:", sender)
+	}
+	if len(msg.Rcpts) != 0 {
+		fmt.Fprintln(w, "  Recipients:", strings.Join(msg.Rcpts, ", "))
+	}
+	if msg.DSNFor != "" {
+		fmt.Fprintln(w, "  DSN for:", msg.DSNFor)
+	}
+	fmt.Fprintln(w)
+
+	for _, ev := range msg.Events {
+		stamp := "-"
+		if !ev.Stamp.IsZero() {
+			stamp = ev.Stamp.Format(parser.ISO8601_UTC)
+		}
+		text := ev.Message
+		if ev.Module != "" {
+			text = ev.Module + ": " + text
+		}
+		if ev.Debug {
+			text = "[debug] " + text
+		}
+		fmt.Fprintf(w, "  %s  %-8s  %s%s\n", stamp, ev.Stage, text, formatFields(ev.Fields))
+	}
+}
+
+func formatFields(fields map[string]interface{}) string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for _, k := range keys {
+		sb.WriteString(" ")
+		sb.WriteString(k)
+		sb.WriteString("=")
+
+		switch v := fields[k].(type) {
+		case string:
+			if v == "" || strings.ContainsAny(v, " \t\"=") {
+				sb.WriteString(strconv.Quote(v))
+			} else {
+				sb.WriteString(v)
+			}
+		default:
+			val, _ := json.Marshal(v)
+			sb.Write(val)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,203 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	parser "github.com/foxcpp/maddy/framework/logparser"
+)
+
+// testLog mixes the text, JSON and journald (short-iso and cat) formats.
+const testLog = `2024-01-02T10:00:00.000Z smtp: incoming message	{"msg_id":"aaaa0001","sender":"alice@example.org","src_ip":"192.0.2.1"}
+{"ts":"2024-01-02T10:00:01.000Z","module":"smtp","msg":"RCPT ok","fields":{"msg_id":"aaaa0001","rcpt":"bob@example.com"}}
+2024-01-02T10:00:01.500Z check.spf: neutral	{"msg_id":"aaaa0001","check":"spf"}
+2024-01-02T10:00:02+0000 mx maddy[1]: smtp: accepted	{"msg_id":"aaaa0001","message_id":"<m1@example.org>"}
+some unrelated output
+2024-01-02T10:00:02.500Z smtp: listening on tcp://0.0.0.0:25	{}
+2024-01-02T10:00:04.000Z remote: not delivered	{"msg_id":"aaaa0001","rcpt":"bob@example.com","remote_server":"mx.example.com"}
+2024-01-02T10:00:03.000Z queue: delivery attempt failed	{"msg_id":"aaaa0001","rcpt":"bob@example.com"}
+2024-01-02T10:00:05.000Z queue: generating DSN	{"msg_id":"aaaa0001","dsn_id":"dddd0001"}
+{"ts":"2024-01-02T10:00:06.000Z","module":"queue","msg":"delivery attempt failed","fields":{"msg_id":"dddd0001","rcpt":"alice@example.org"}}
+2024-01-02T10:00:07.000Z queue: generating DSN	{"msg_id":"dddd0001","dsn_id":"eeee0001"}
+{"ts":"2024-01-02T10:00:08.000Z","module":"queue","msg":"delivered","fields":{"msg_id":"eeee0001","rcpt":"postmaster@example.org"}}
+{"ts":"2024-01-02T11:00:00.000Z","module":"submission","msg":"incoming message","fields":{"msg_id":"bbbb0002","sender":"carol@example.org"}}
+{"ts":"2024-01-02T11:00:01.000Z","level":"debug","module":"modify.dkim","msg":"signed","fields":{"msg_id":"bbbb0002"}}
+target.lmtp/local_mailboxes: delivered	{"msg_id":"bbbb0002","rcpts":["dave@example.net","erin@example.net"]}
+`
+
+func readTestLog(t *testing.T) []parser.Msg {
+	t.Helper()
+	entries, err := readLogEntries(strings.NewReader(testLog), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestReadLogEntries(t *testing.T) {
+	entries := readTestLog(t)
+	// Unparsable lines and lines without msg_id are skipped.
+	if len(entries) != 13 {
+		t.Fatalf("Wrong number of entries: %d", len(entries))
+	}
+	if entries[3].Module != "smtp" || entries[3].Message != "accepted" || entries[3].Stamp.IsZero() {
+		t.Errorf("Wrong journald entry: %+v", entries[3])
+	}
+	if last := entries[len(entries)-1]; last.Module != "target.lmtp/local_mailboxes" || !last.Stamp.IsZero() {
+		t.Errorf("Wrong journald (cat) entry: %+v", last)
+	}
+}
+
+func TestEntryMatches(t *testing.T) {
+	e := parser.Msg{Context: map[string]interface{}{
+		"msg_id":     "aaaa0001",
+		"message_id": "<m1@example.org>",
+		"sender":     "alice@example.org",
+		"rcpts":      []interface{}{"bob@example.com"},
+	}}
+
+	for _, c := range []struct {
+		query   string
+		matches bool
+	}{
+		{"aaaa0001", true},
+		{"aaaa", false},
+		{"<m1@example.org>", true},
+		{"m1@example.org", true},
+		{"ALICE@example.org", true},
+		{"bob@EXAMPLE.com", true},
+		{"carol@example.org", false},
+	} {
+		if got := entryMatches(e, c.query); got != c.matches {
+			t.Errorf("entryMatches(%q) = %v, want %v", c.query, got, c.matches)
+		}
+	}
+}
+
+func TestTraceMessages(t *testing.T) {
+	entries := readTestLog(t)
+
+	type msgSummary struct {
+		ID     string
+		DSNFor string
+		Events int
+	}
+	aaaa := []msgSummary{
+		{"aaaa0001", "", 7},
+		{"dddd0001", "aaaa0001", 2},
+		{"eeee0001", "dddd0001", 1},
+	}
+
+	for _, c := range []struct {
+		name  string
+		query string
+		want  []msgSummary
+	}{
+		{"msg_id", "aaaa0001", aaaa},
+		{"Message-ID", "<m1@example.org>", aaaa},
+		{"Message-ID without brackets", "m1@example.org", aaaa},
+		{"recipient", "BOB@example.com", aaaa},
+		{"sender", "carol@example.org", []msgSummary{{"bbbb0002", "", 3}}},
+		{"recipient list", "erin@example.net", []msgSummary{{"bbbb0002", "", 3}}},
+		{"DSN", "dddd0001", []msgSummary{{"dddd0001", "", 2}, {"eeee0001", "dddd0001", 1}}},
+		{"DSN recipient", "postmaster@example.org", []msgSummary{{"eeee0001", "", 1}}},
+		{"address used by both", "alice@example.org", aaaa},
+		{"unknown", "frank@example.org", nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var got []msgSummary
+			for _, msg := range traceMessages(entries, c.query) {
+				got = append(got, msgSummary{msg.ID, msg.DSNFor, len(msg.Events)})
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("Wrong messages traced,\n got  %+v\n want %+v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestTraceMessages_Details(t *testing.T) {
+	msgs := traceMessages(readTestLog(t), "aaaa0001")
+	if len(msgs) == 0 {
+		t.Fatal("No messages traced")
+	}
+	msg := msgs[0]
+
+	if msg.MessageID != "<m1@example.org>" {
+		t.Errorf("Wrong Message-ID: %q", msg.MessageID)
+	}
+	if msg.Sender == nil || *msg.Sender != "alice@example.org" {
+		t.Errorf("Wrong sender: %v", msg.Sender)
+	}
+	if !reflect.DeepEqual(msg.Rcpts, []string{"bob@example.com"}) {
+		t.Errorf("Wrong recipients: %v", msg.Rcpts)
+	}
+
+	// Events are sorted by time regardless of the order in the log.
+	var stages []string
+	for i, ev := range msg.Events {
+		if i != 0 && ev.Stamp.Before(msg.Events[i-1].Stamp) {
+			t.Errorf("Events are not sorted: %v", msg.Events)
+		}
+		if _, ok := ev.Fields["msg_id"]; ok {
+			t.Errorf("msg_id is not removed from fields: %v", ev.Fields)
+		}
+		stages = append(stages, ev.Stage)
+	}
+	want := []string{"receipt", "receipt", "check", "receipt", "queue", "delivery", "dsn"}
+	if !reflect.DeepEqual(stages, want) {
+		t.Errorf("Wrong stages,\n got  %v\n want %v", stages, want)
+	}
+
+	dave := traceMessages(readTestLog(t), "dave@example.net")
+	if len(dave) != 1 || !reflect.DeepEqual(dave[0].Rcpts, []string{"dave@example.net", "erin@example.net"}) {
+		t.Errorf("Wrong recipients from the rcpts list: %+v", dave)
+	}
+}
+
+func TestEventStage(t *testing.T) {
+	for _, c := range []struct {
+		module string
+		ctx    map[string]interface{}
+		stage  string
+	}{
+		{"smtp", nil, "receipt"},
+		{"submission", nil, "receipt"},
+		{"lmtp", nil, "receipt"},
+		{"smtp", map[string]interface{}{"check": "spf"}, "check"},
+		{"check.dkim", nil, "check"},
+		{"dnsbl", nil, "check"},
+		{"modify.dkim", nil, "modify"},
+		{"queue", nil, "queue"},
+		{"queue", map[string]interface{}{"dsn_id": "x"}, "dsn"},
+		{"remote", nil, "delivery"},
+		{"target.lmtp/local_mailboxes", nil, "delivery"},
+		{"smtp", map[string]interface{}{"target": "remote"}, "delivery"},
+		{"smtp", map[string]interface{}{"remote_server": "mx.example.com"}, "delivery"},
+		{"tls", nil, "other"},
+	} {
+		e := parser.Msg{Module: c.module, Context: c.ctx}
+		if stage := eventStage(e); stage != c.stage {
+			t.Errorf("eventStage(%s, %v) = %s, want %s", c.module, c.ctx, stage, c.stage)
+		}
+	}
+}
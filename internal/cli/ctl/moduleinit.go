@@ -40,6 +40,24 @@ func closeIfNeeded(i interface{}) {
 }
 
 func getCfgBlockModule(ctx *cli.Context) (map[string]interface{}, *maddy.ModInfo, error) {
+	cfgBlock := ctx.String("cfg-block")
+	if cfgBlock == "" {
+		return nil, nil, cli.Exit("Error: cfg-block is required", 2)
+	}
+	return getNamedCfgBlockModule(ctx, cfgBlock)
+}
+
+func getNamedCfgBlockModule(ctx *cli.Context, cfgBlock string) (map[string]interface{}, *maddy.ModInfo, error) {
+	globals, mods, err := getNamedCfgBlockModules(ctx, cfgBlock)
+	if err != nil {
+		return nil, nil, err
+	}
+	return globals, mods[0], nil
+}
+
+// getNamedCfgBlockModules is similar to getNamedCfgBlockModule but returns
+// modules for multiple configuration blocks at once.
+func getNamedCfgBlockModules(ctx *cli.Context, cfgBlocks ...string) (map[string]interface{}, []*maddy.ModInfo, error) {
 	cfgPath := ctx.String("config")
 	if cfgPath == "" {
 		return nil, nil, cli.Exit("Error: config is required", 2)
@@ -54,6 +72,7 @@ func getCfgBlockModule(ctx *cli.Context) (map[string]interface{}, *maddy.ModInfo
 		return nil, nil, cli.Exit(fmt.Sprintf("Error: failed to parse config: %v", err), 2)
 	}
 
+	module.NoRun = true
 	globals, cfgNodes, err := maddy.ReadGlobals(cfgNodes)
 	if err != nil {
 		return nil, nil, err
@@ -63,29 +82,28 @@ func getCfgBlockModule(ctx *cli.Context) (map[string]interface{}, *maddy.ModInfo
 		return nil, nil, err
 	}
 
-	module.NoRun = true
 	_, mods, err := maddy.RegisterModules(globals, cfgNodes)
 	if err != nil {
 		return nil, nil, err
 	}
 	defer hooks.RunHooks(hooks.EventShutdown)
 
-	cfgBlock := ctx.String("cfg-block")
-	if cfgBlock == "" {
-		return nil, nil, cli.Exit("Error: cfg-block is required", 2)
-	}
-	var mod maddy.ModInfo
-	for _, m := range mods {
-		if m.Instance.InstanceName() == cfgBlock {
-			mod = m
-			break
+	res := make([]*maddy.ModInfo, 0, len(cfgBlocks))
+	for _, cfgBlock := range cfgBlocks {
+		var mod maddy.ModInfo
+		for _, m := range mods {
+			if m.Instance.InstanceName() == cfgBlock {
+				mod = m
+				break
+			}
 		}
-	}
-	if mod.Instance == nil {
-		return nil, nil, cli.Exit(fmt.Sprintf("Error: unknown configuration block: %s", cfgBlock), 2)
+		if mod.Instance == nil {
+			return nil, nil, cli.Exit(fmt.Sprintf("Error: unknown configuration block: %s", cfgBlock), 2)
+		}
+		res = append(res, &mod)
 	}
 
-	return globals, &mod, nil
+	return globals, res, nil
 }
 
 func openStorage(ctx *cli.Context) (module.Storage, error) {
@@ -131,3 +149,21 @@ func openUserDB(ctx *cli.Context) (module.PlainUserDB, error) {
 
 	return userDB, nil
 }
+
+func openTable(ctx *cli.Context, cfgBlock string) (module.Table, error) {
+	globals, mod, err := getNamedCfgBlockModule(ctx, cfgBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	tbl, ok := mod.Instance.(module.Table)
+	if !ok {
+		return nil, cli.Exit(fmt.Sprintf("Error: configuration block %s is not a table", cfgBlock), 2)
+	}
+
+	if err := mod.Instance.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+
+	return tbl, nil
+}
@@ -0,0 +1,357 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/future"
+	"github.com/foxcpp/maddy/framework/hooks"
+	"github.com/foxcpp/maddy/framework/module"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/foxcpp/maddy/internal/msgpipeline"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "pipeline",
+			Usage: "Message pipeline debugging",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "test",
+					Usage: "Show how the message would be handled by the endpoint",
+					Description: `Run the message through the pipeline of the endpoint defined in maddy.conf
+and print matched source and destination blocks, check results, address
+and header rewrites and delivery targets. Nothing is delivered, targets
+are not used at all.
+
+Checks, modifiers and tables are used as configured, so DNS lookups and
+queries to databases used by tables are performed as usual. Use --dns to
+direct DNS queries to a different server (e.g. a local stub).
+
+Endpoint-specific processing (such as header checks done by submission
+endpoint) is not performed.
+
+Exit status is 1 if the message is rejected.
+`,
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "endpoint",
+							Usage: "Endpoint to use, either module name (smtp, submission, lmtp) or one of its addresses",
+							Value: "smtp",
+						},
+						&cli.StringFlag{
+							Name:     "from",
+							Usage:    "MAIL FROM address, use <> for null sender",
+							Required: true,
+						},
+						&cli.StringSliceFlag{
+							Name:     "rcpt",
+							Usage:    "RCPT TO address, can be specified multiple times",
+							Required: true,
+						},
+						&cli.PathFlag{
+							Name:  "msg",
+							Usage: "Message to use, a simple test message is generated if not specified",
+						},
+						&cli.StringFlag{
+							Name:  "ip",
+							Usage: "IP address of the client",
+							Value: "127.0.0.1",
+						},
+						&cli.StringFlag{
+							Name:  "helo",
+							Usage: "Hostname sent by the client in EHLO",
+							Value: "localhost",
+						},
+						&cli.StringFlag{
+							Name:  "auth-user",
+							Usage: "Pretend the client is authenticated using the specified username",
+						},
+						&cli.BoolFlag{
+							Name:  "tls",
+							Usage: "Pretend the connection uses TLS",
+						},
+						&cli.StringFlag{
+							Name:  "dns",
+							Usage: "DNS server to use instead of the system resolver (IP:PORT)",
+						},
+					},
+					Action: pipelineTest,
+				},
+			},
+		})
+}
+
+type pipelineEndpoint interface {
+	Pipeline() *msgpipeline.MsgPipeline
+}
+
+func getEndpointPipeline(ctx *cli.Context) (*msgpipeline.MsgPipeline, error) {
+	cfgPath := ctx.String("config")
+	if cfgPath == "" {
+		return nil, cli.Exit("Error: config is required", 2)
+	}
+	cfgFile, err := os.Open(cfgPath)
+	if err != nil {
+		return nil, cli.Exit(fmt.Sprintf("Error: failed to open config: %v", err), 2)
+	}
+	defer cfgFile.Close()
+	cfgNodes, err := parser.Read(cfgFile, cfgFile.Name())
+	if err != nil {
+		return nil, cli.Exit(fmt.Sprintf("Error: failed to parse config: %v", err), 2)
+	}
+
+	module.NoRun = true
+	globals, cfgNodes, err := maddy.ReadGlobals(cfgNodes)
+	if err != nil {
+		return nil, err
+	}
+	if err := maddy.InitDirs(); err != nil {
+		return nil, err
+	}
+
+	endpoints, _, err := maddy.RegisterModules(globals, cfgNodes)
+	if err != nil {
+		return nil, err
+	}
+
+	name := ctx.String("endpoint")
+	var endp *maddy.ModInfo
+	for i, e := range endpoints {
+		matches := e.Instance.Name() == name
+		for _, addr := range e.Cfg.Args {
+			if addr == name {
+				matches = true
+			}
+		}
+		if !matches {
+			continue
+		}
+		if endp != nil {
+			return nil, cli.Exit(fmt.Sprintf("Error: multiple endpoints match %s, use the address to select one", name), 2)
+		}
+		endp = &endpoints[i]
+	}
+	if endp == nil {
+		return nil, cli.Exit(fmt.Sprintf("Error: unknown endpoint: %s", name), 2)
+	}
+	pipeEndp, ok := endp.Instance.(pipelineEndpoint)
+	if !ok {
+		return nil, cli.Exit(fmt.Sprintf("Error: endpoint %s does not use a message pipeline", name), 2)
+	}
+
+	if err := module.InitInstance(endp.Instance, config.NewMap(globals, endp.Cfg)); err != nil {
+		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+
+	return pipeEndp.Pipeline(), nil
+}
+
+func readTestMessage(ctx *cli.Context, from string, rcpts []string) (textproto.Header, buffer.Buffer, error) {
+	var r io.Reader
+	if path := ctx.Path("msg"); path != "" {
+		blob, err := os.ReadFile(path)
+		if err != nil {
+			return textproto.Header{}, nil, err
+		}
+		r = bytes.NewReader(blob)
+	} else {
+		msgID, err := module.GenerateMsgID()
+		if err != nil {
+			return textproto.Header{}, nil, err
+		}
+		r = strings.NewReader("From: <" + from + ">\r\n" +
+			"To: <" + strings.Join(rcpts, ">, <") + ">\r\n" +
+			"Subject: maddy pipeline test\r\n" +
+			"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+			"Message-ID: <" + msgID + "@pipeline-test.invalid>\r\n" +
+			"\r\n" +
+			"This is a test message.\r\n")
+	}
+
+	bufr := bufio.NewReader(r)
+	header, err := textproto.ReadHeader(bufr)
+	if err != nil {
+		return textproto.Header{}, nil, fmt.Errorf("malformed message header: %w", err)
+	}
+	body, err := io.ReadAll(bufr)
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	return header, buffer.MemoryBuffer{Slice: body}, nil
+}
+
+func describeRejection(err error) string {
+	var smtpErr *exterrors.SMTPError
+	if errors.As(err, &smtpErr) {
+		desc := fmt.Sprintf("%d %s %s", smtpErr.Code, smtpErr.EnhancedCode.FormatLog(), smtpErr.Message)
+		if reason := smtpErr.Error(); reason != smtpErr.Message {
+			desc += " (" + reason + ")"
+		}
+		return desc
+	}
+	if exterrors.IsTemporary(err) {
+		return "temporary error: " + err.Error()
+	}
+	return "permanent error: " + err.Error()
+}
+
+func pipelineTest(ctx *cli.Context) error {
+	ip := net.ParseIP(ctx.String("ip"))
+	if ip == nil {
+		return cli.Exit("Error: malformed IP address", 2)
+	}
+	from := ctx.String("from")
+	if from == "<>" {
+		from = ""
+	} else {
+		var err error
+		from, err = address.CleanDomain(from)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Error: malformed sender address: %v", err), 2)
+		}
+	}
+	rcpts := ctx.StringSlice("rcpt")
+
+	header, body, err := readTestMessage(ctx, from, rcpts)
+	if err != nil {
+		return err
+	}
+
+	if server := ctx.String("dns"); server != "" {
+		dns.OverrideServer(server)
+	}
+
+	pipeline, err := getEndpointPipeline(ctx)
+	if err != nil {
+		return err
+	}
+	defer hooks.RunHooks(hooks.EventShutdown)
+	defer module.CloseInstances(module.OpenedInstances())
+
+	connState := &module.ConnState{
+		Proto:      "ESMTP",
+		Hostname:   ctx.String("helo"),
+		LocalAddr:  &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25},
+		RemoteAddr: &net.TCPAddr{IP: ip, Port: 25000},
+		AuthUser:   ctx.String("auth-user"),
+		RDNSName:   future.New(),
+	}
+	if ctx.Bool("tls") {
+		connState.Proto = "ESMTPS"
+		connState.TLS.HandshakeComplete = true
+	}
+	if connState.AuthUser != "" {
+		connState.Proto += "A"
+	}
+	rdnsName, err := dns.LookupAddr(context.Background(), pipeline.Resolver, ip)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			err = nil
+		}
+		connState.RDNSName.Set(nil, err)
+	} else {
+		connState.RDNSName.Set(rdnsName, nil)
+	}
+
+	msgID, err := module.GenerateMsgID()
+	if err != nil {
+		return err
+	}
+	msgMeta := &module.MsgMetadata{
+		ID:           msgID,
+		OriginalFrom: from,
+		Conn:         connState,
+	}
+
+	traceCtx := msgpipeline.WithTracer(context.Background(), func(s string) {
+		fmt.Println(s)
+	})
+
+	if err := pipeline.RunEarlyChecks(traceCtx, connState); err != nil {
+		fmt.Println("connection rejected:", describeRejection(err))
+		return cli.Exit("", 1)
+	}
+
+	delivery, err := pipeline.Start(traceCtx, msgMeta, from)
+	if err != nil {
+		fmt.Println("MAIL FROM rejected:", describeRejection(err))
+		return cli.Exit("", 1)
+	}
+
+	accepted := 0
+	for _, rcpt := range rcpts {
+		cleanRcpt, err := address.CleanDomain(rcpt)
+		if err != nil {
+			fmt.Printf("RCPT TO %s rejected: malformed address: %v\n", rcpt, err)
+			continue
+		}
+		if err := delivery.AddRcpt(traceCtx, cleanRcpt, smtp.RcptOptions{}); err != nil {
+			fmt.Printf("RCPT TO %s rejected: %s\n", rcpt, describeRejection(err))
+			continue
+		}
+		accepted++
+	}
+	if accepted == 0 {
+		if err := delivery.Abort(traceCtx); err != nil {
+			return err
+		}
+		return cli.Exit("", 1)
+	}
+
+	if err := delivery.Body(traceCtx, header, body); err != nil {
+		fmt.Println("message rejected:", describeRejection(err))
+		if err := delivery.Abort(traceCtx); err != nil {
+			return err
+		}
+		return cli.Exit("", 1)
+	}
+	if err := delivery.Abort(traceCtx); err != nil {
+		return err
+	}
+
+	if msgMeta.Quarantine {
+		fmt.Println("message accepted and quarantined")
+	} else {
+		fmt.Println("message accepted")
+	}
+	return nil
+}
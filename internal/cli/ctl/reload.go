@@ -0,0 +1,203 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy"
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "reload",
+			Usage: "Reload the configuration of the running server",
+			Description: `Request the running server to re-read the configuration file and replace
+changed configuration blocks. Connections accepted before the reload are
+served using the old configuration.
+
+The request is sent using the admin endpoint defined in maddy.conf, unix
+socket addresses are preferred. Alternatively, SIGUSR2 can be sent to the
+server process.
+`,
+			Flags:  adminFlags(),
+			Action: reloadServer,
+		})
+}
+
+// adminFlags returns flags used by commands that send requests to the admin
+// endpoint.
+func adminFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "address",
+			Usage: "Admin endpoint address to use instead of the one from the configuration",
+		},
+		&cli.StringFlag{
+			Name:    "token",
+			Usage:   "Admin API token to use instead of the one from the configuration",
+			EnvVars: []string{"MADDY_ADMIN_TOKEN"},
+		},
+	}
+}
+
+// adminEndpoint reads the admin endpoint address and the API token from the
+// configuration file.
+func adminEndpoint(ctx *cli.Context) (addrs []string, token string, err error) {
+	cfgFile, err := os.Open(ctx.String("config"))
+	if err != nil {
+		return nil, "", cli.Exit(fmt.Sprintf("Error: failed to open config: %v", err), 2)
+	}
+	defer cfgFile.Close()
+	cfgNodes, err := parser.Read(cfgFile, cfgFile.Name())
+	if err != nil {
+		return nil, "", cli.Exit(fmt.Sprintf("Error: failed to parse config: %v", err), 2)
+	}
+
+	module.NoRun = true
+	_, cfgNodes, err = maddy.ReadGlobals(cfgNodes)
+	if err != nil {
+		return nil, "", err
+	}
+	// Relative paths in the configuration are relative to the state
+	// directory.
+	if err := maddy.InitDirs(); err != nil {
+		return nil, "", err
+	}
+
+	for _, node := range cfgNodes {
+		if node.Name != "admin" {
+			continue
+		}
+
+		var tokenFile string
+		for _, child := range node.Children {
+			if len(child.Args) != 1 {
+				continue
+			}
+			switch child.Name {
+			case "token":
+				token = child.Args[0]
+			case "token_file":
+				tokenFile = child.Args[0]
+			}
+		}
+		if tokenFile != "" {
+			tokenBlob, err := os.ReadFile(tokenFile)
+			if err != nil {
+				return nil, "", err
+			}
+			token = strings.TrimSpace(string(tokenBlob))
+		}
+
+		return node.Args, token, nil
+	}
+
+	return nil, "", cli.Exit("Error: no admin endpoint is configured, use --address or send SIGUSR2 to the server process", 2)
+}
+
+// adminRequest sends the request to the admin endpoint and decodes the JSON
+// response into out, if it is not nil.
+func adminRequest(ctx *cli.Context, method, path string, timeout time.Duration, out interface{}) error {
+	addrs := []string{ctx.String("address")}
+	token := ctx.String("token")
+	if addrs[0] == "" {
+		var cfgToken string
+		var err error
+		addrs, cfgToken, err = adminEndpoint(ctx)
+		if err != nil {
+			return err
+		}
+		if token == "" {
+			token = cfgToken
+		}
+	}
+
+	var endp config.Endpoint
+	for i, addr := range addrs {
+		parsed, err := config.ParseEndpoint(addr)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("Error: malformed endpoint: %v", err), 2)
+		}
+		if i == 0 || parsed.Scheme == "unix" {
+			endp = parsed
+		}
+		if parsed.Scheme == "unix" {
+			break
+		}
+	}
+
+	client := http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, endp.Network(), endp.Address())
+			},
+		},
+		Timeout: timeout,
+	}
+
+	req, err := http.NewRequest(method, "http://maddy"+path, nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if resp.StatusCode == http.StatusOK && out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+
+	var apiErr struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Error == "" {
+		return fmt.Errorf("Error: unexpected response: %s", resp.Status)
+	}
+	return cli.Exit(fmt.Sprintf("Error: %s", apiErr.Error), 1)
+}
+
+func reloadServer(ctx *cli.Context) error {
+	// Reload may take a while since modules can do I/O during
+	// initialization.
+	return adminRequest(ctx, http.MethodPost, "/v1/reload", 5*time.Minute, nil)
+}
@@ -0,0 +1,523 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/module"
+	maddycli "github.com/foxcpp/maddy/internal/cli"
+	clitools2 "github.com/foxcpp/maddy/internal/cli/clitools"
+	"github.com/urfave/cli/v2"
+)
+
+func init() {
+	formatFlag := &cli.StringFlag{
+		Name:    "format",
+		Aliases: []string{"f"},
+		Usage:   "Data format to use (csv or json), guessed from file extension by default",
+	}
+
+	maddycli.AddSubcommand(
+		&cli.Command{
+			Name:  "table",
+			Usage: "Table entries management",
+			Description: `These subcommands can be used to inspect and modify tables
+(such as aliases or sender authorization maps) defined in maddy.conf as
+top-level configuration blocks.
+
+Lookups work for any table, listing and modification require the table
+module to support it (table.file, table.sql_table and table.sql_query with
+list/add/set/del queries).
+`,
+			Subcommands: []*cli.Command{
+				{
+					Name:      "list",
+					Usage:     "List table keys",
+					ArgsUsage: "BLOCK",
+					Action: func(ctx *cli.Context) error {
+						tbl, err := openMutableTable(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(tbl)
+						return tableList(tbl, ctx)
+					},
+				},
+				{
+					Name:      "get",
+					Usage:     "Lookup the key",
+					ArgsUsage: "BLOCK KEY",
+					Action: func(ctx *cli.Context) error {
+						if ctx.Args().Len() != 2 {
+							return cli.Exit("Error: BLOCK and KEY are required", 2)
+						}
+						tbl, err := openTable(ctx, ctx.Args().First())
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(tbl)
+						return tableGet(tbl, ctx)
+					},
+				},
+				{
+					Name:      "set",
+					Usage:     "Create or replace the table entry",
+					ArgsUsage: "BLOCK KEY VALUE",
+					Action: func(ctx *cli.Context) error {
+						if ctx.Args().Len() != 3 {
+							return cli.Exit("Error: BLOCK, KEY and VALUE are required", 2)
+						}
+						tbl, err := openMutableTable(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(tbl)
+						return tbl.SetKey(ctx.Args().Get(1), ctx.Args().Get(2))
+					},
+				},
+				{
+					Name:      "remove",
+					Usage:     "Remove the table entry",
+					ArgsUsage: "BLOCK KEY",
+					Flags: []cli.Flag{
+						&cli.BoolFlag{
+							Name:    "yes",
+							Aliases: []string{"y"},
+							Usage:   "Don't ask for confirmation",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						if ctx.Args().Len() != 2 {
+							return cli.Exit("Error: BLOCK and KEY are required", 2)
+						}
+						tbl, err := openMutableTable(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(tbl)
+						return tableRemove(tbl, ctx)
+					},
+				},
+				{
+					Name:  "import",
+					Usage: "Import entries from CSV or JSON file",
+					Description: `Reads table entries from FILE (or stdin if it is not specified).
+
+CSV files should contain two columns: key and value, multiple rows with the
+same key define multiple values. JSON files should contain a single object
+mapping keys to lists of values (or to single values). Existing entries with
+the same keys are replaced.
+`,
+					ArgsUsage: "BLOCK [FILE]",
+					Flags: []cli.Flag{
+						formatFlag,
+						&cli.BoolFlag{
+							Name:  "replace",
+							Usage: "Remove existing entries that are not present in the imported data",
+						},
+						&cli.BoolFlag{
+							Name:    "yes",
+							Aliases: []string{"y"},
+							Usage:   "Don't ask for confirmation",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						// Resolve path before module initialization changes
+						// the working directory.
+						path, err := tableFilePath(ctx)
+						if err != nil {
+							return err
+						}
+						tbl, err := openMutableTable(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(tbl)
+						return tableImport(tbl, ctx, path)
+					},
+				},
+				{
+					Name:  "export",
+					Usage: "Export entries to CSV or JSON file",
+					Description: `Writes all table entries to FILE (or stdout if it is not specified).
+
+If table returns multiple values for a key, they are written as separate
+rows in CSV and as a list in JSON.
+`,
+					ArgsUsage: "BLOCK [FILE]",
+					Flags:     []cli.Flag{formatFlag},
+					Action: func(ctx *cli.Context) error {
+						// Resolve path before module initialization changes
+						// the working directory.
+						path, err := tableFilePath(ctx)
+						if err != nil {
+							return err
+						}
+						tbl, err := openMutableTable(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(tbl)
+						return tableExport(tbl, ctx, path)
+					},
+				},
+			},
+		})
+}
+
+func openMutableTable(ctx *cli.Context) (module.MutableTable, error) {
+	block := ctx.Args().First()
+	if block == "" {
+		return nil, cli.Exit("Error: BLOCK is required", 2)
+	}
+
+	tbl, err := openTable(ctx, block)
+	if err != nil {
+		return nil, err
+	}
+	mtbl, ok := tbl.(module.MutableTable)
+	if !ok {
+		closeIfNeeded(tbl)
+		return nil, cli.Exit(fmt.Sprintf("Error: table %s does not support modification", block), 2)
+	}
+	return mtbl, nil
+}
+
+func tableList(tbl module.MutableTable, ctx *cli.Context) error {
+	keys, err := tbl.Keys()
+	if err != nil {
+		return err
+	}
+
+	if len(keys) == 0 && !ctx.Bool("quiet") {
+		fmt.Fprintln(os.Stderr, "No entries.")
+	}
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Println(k)
+	}
+	return nil
+}
+
+func lookupAll(tbl module.Table, key string) ([]string, error) {
+	if multi, ok := tbl.(module.MultiTable); ok {
+		return multi.LookupMulti(context.Background(), key)
+	}
+
+	val, ok, err := tbl.Lookup(context.Background(), key)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return []string{val}, nil
+}
+
+func tableGet(tbl module.Table, ctx *cli.Context) error {
+	vals, err := lookupAll(tbl, ctx.Args().Get(1))
+	if err != nil {
+		return err
+	}
+	if len(vals) == 0 {
+		return cli.Exit("Error: no such key", 1)
+	}
+
+	for _, v := range vals {
+		fmt.Println(v)
+	}
+	return nil
+}
+
+func tableRemove(tbl module.MutableTable, ctx *cli.Context) error {
+	if !ctx.Bool("yes") {
+		if !clitools2.Confirmation("Are you sure you want to delete this entry?", false) {
+			return errors.New("Cancelled")
+		}
+	}
+
+	return tbl.RemoveKey(ctx.Args().Get(1))
+}
+
+type tableEntry struct {
+	Key    string
+	Values []string
+}
+
+func tableFilePath(ctx *cli.Context) (string, error) {
+	path := ctx.Args().Get(1)
+	if path == "" {
+		return "", nil
+	}
+	return filepath.Abs(path)
+}
+
+func tableFormat(ctx *cli.Context, path string) (string, error) {
+	format := ctx.String("format")
+	if format == "" {
+		format = strings.TrimPrefix(filepath.Ext(path), ".")
+	}
+	switch format {
+	case "":
+		return "csv", nil
+	case "csv", "json":
+		return format, nil
+	default:
+		return "", cli.Exit(fmt.Sprintf("Error: unknown format: %s", format), 2)
+	}
+}
+
+func readTableEntries(r io.Reader, format string) ([]tableEntry, error) {
+	var entries []tableEntry
+	switch format {
+	case "json":
+		// Values are lists, single strings are accepted too.
+		var m map[string]json.RawMessage
+		if err := json.NewDecoder(r).Decode(&m); err != nil {
+			return nil, err
+		}
+		for k, raw := range m {
+			var vals []string
+			if err := json.Unmarshal(raw, &vals); err != nil {
+				var val string
+				if err := json.Unmarshal(raw, &val); err != nil {
+					return nil, fmt.Errorf("%s: value should be a string or a list of strings", k)
+				}
+				vals = []string{val}
+			}
+			if len(vals) == 0 {
+				return nil, fmt.Errorf("%s: no values", k)
+			}
+			entries = append(entries, tableEntry{Key: k, Values: vals})
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Key < entries[j].Key
+		})
+	case "csv":
+		rd := csv.NewReader(r)
+		rd.FieldsPerRecord = 2
+		records, err := rd.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		// Rows with the same key define multiple values.
+		index := make(map[string]int, len(records))
+		for _, rec := range records {
+			if i, ok := index[rec[0]]; ok {
+				entries[i].Values = append(entries[i].Values, rec[1])
+				continue
+			}
+			index[rec[0]] = len(entries)
+			entries = append(entries, tableEntry{Key: rec[0], Values: []string{rec[1]}})
+		}
+	}
+
+	for _, e := range entries {
+		if e.Key == "" {
+			return nil, errors.New("empty keys are not allowed")
+		}
+	}
+	return entries, nil
+}
+
+func writeTableEntries(w io.Writer, format string, entries []tableEntry) error {
+	switch format {
+	case "json":
+		m := make(map[string][]string, len(entries))
+		for _, e := range entries {
+			m[e.Key] = e.Values
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(m)
+	case "csv":
+		wr := csv.NewWriter(w)
+		for _, e := range entries {
+			for _, v := range e.Values {
+				if err := wr.Write([]string{e.Key, v}); err != nil {
+					return err
+				}
+			}
+		}
+		wr.Flush()
+		return wr.Error()
+	}
+	return nil
+}
+
+func tableImport(tbl module.MutableTable, ctx *cli.Context, path string) error {
+	format, err := tableFormat(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	entries, err := readTableEntries(r, format)
+	if err != nil {
+		return fmt.Errorf("Error: malformed input: %w", err)
+	}
+
+	var stale []string
+	if ctx.Bool("replace") {
+		keys, err := tbl.Keys()
+		if err != nil {
+			return err
+		}
+		imported := make(map[string]struct{}, len(entries))
+		for _, e := range entries {
+			imported[e.Key] = struct{}{}
+		}
+		for _, k := range keys {
+			if _, ok := imported[k]; !ok {
+				stale = append(stale, k)
+			}
+		}
+
+		if len(stale) != 0 && !ctx.Bool("yes") {
+			fmt.Fprintf(os.Stderr, "%d entries not present in the imported data will be removed.\n", len(stale))
+			if !clitools2.Confirmation("Are you sure you want to continue?", false) {
+				return errors.New("Cancelled")
+			}
+		}
+	}
+
+	if batch, ok := tbl.(module.BatchMutableTable); ok {
+		changes := make(map[string][]string, len(entries)+len(stale))
+		for _, e := range entries {
+			changes[e.Key] = e.Values
+		}
+		for _, k := range stale {
+			changes[k] = nil
+		}
+		if err := batch.SetKeys(changes); err != nil {
+			return fmt.Errorf("Error: failed to update the table: %w", err)
+		}
+	} else {
+		for _, e := range entries {
+			if err := setTableValues(tbl, e.Key, e.Values); err != nil {
+				return fmt.Errorf("Error: failed to set %s: %w", e.Key, err)
+			}
+		}
+		for _, k := range stale {
+			if err := tbl.RemoveKey(k); err != nil {
+				return fmt.Errorf("Error: failed to remove %s: %w", k, err)
+			}
+		}
+	}
+
+	if !ctx.Bool("quiet") {
+		fmt.Fprintf(os.Stderr, "Imported %d entries, removed %d entries.\n", len(entries), len(stale))
+	}
+	return nil
+}
+
+// setTableValues replaces values of the key using SetKey. Tables that store
+// only one value for a key are detected by looking up the key afterwards.
+func setTableValues(tbl module.MutableTable, key string, vals []string) error {
+	current, err := lookupAll(tbl, key)
+	if err != nil {
+		return err
+	}
+	if reflect.DeepEqual(current, vals) {
+		return nil
+	}
+	if len(vals) == 1 && len(current) <= 1 {
+		return tbl.SetKey(key, vals[0])
+	}
+
+	// SetKey of sql_query adds a row if the key can have multiple values.
+	if len(current) != 0 {
+		if err := tbl.RemoveKey(key); err != nil {
+			return err
+		}
+	}
+	for _, v := range vals {
+		if err := tbl.SetKey(key, v); err != nil {
+			return err
+		}
+	}
+
+	stored, err := lookupAll(tbl, key)
+	if err != nil {
+		return err
+	}
+	sort.Strings(stored)
+	expected := append([]string(nil), vals...)
+	sort.Strings(expected)
+	if !reflect.DeepEqual(stored, expected) {
+		return fmt.Errorf("table cannot store multiple values for a key, stored %v", stored)
+	}
+	return nil
+}
+
+func tableExport(tbl module.MutableTable, ctx *cli.Context, path string) error {
+	format, err := tableFormat(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	keys, err := tbl.Keys()
+	if err != nil {
+		return err
+	}
+	sort.Strings(keys)
+
+	entries := make([]tableEntry, 0, len(keys))
+	for _, k := range keys {
+		vals, err := lookupAll(tbl, k)
+		if err != nil {
+			return fmt.Errorf("Error: failed to lookup %s: %w", k, err)
+		}
+		if len(vals) == 0 {
+			// Removed in the meantime.
+			continue
+		}
+		entries = append(entries, tableEntry{Key: k, Values: vals})
+	}
+
+	var w io.Writer = os.Stdout
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	return writeTableEntries(w, format, entries)
+}
@@ -0,0 +1,130 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ctl
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// multiTable stores multiple values for a key, SetKey adds a value like
+// table.sql_query without unique keys does.
+type multiTable struct {
+	m map[string][]string
+}
+
+func (t *multiTable) Name() string         { return "multi" }
+func (t *multiTable) InstanceName() string { return "multi" }
+
+func (t *multiTable) Lookup(_ context.Context, key string) (string, bool, error) {
+	vals := t.m[key]
+	if len(vals) == 0 {
+		return "", false, nil
+	}
+	return vals[0], true, nil
+}
+
+func (t *multiTable) LookupMulti(_ context.Context, key string) ([]string, error) {
+	return t.m[key], nil
+}
+
+func (t *multiTable) Keys() ([]string, error) {
+	res := make([]string, 0, len(t.m))
+	for k := range t.m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+func (t *multiTable) SetKey(k, v string) error {
+	t.m[k] = append(t.m[k], v)
+	return nil
+}
+
+func (t *multiTable) RemoveKey(k string) error {
+	delete(t.m, k)
+	return nil
+}
+
+// singleTable stores only one value for a key.
+type singleTable struct {
+	multiTable
+}
+
+func (t *singleTable) SetKey(k, v string) error {
+	t.m[k] = []string{v}
+	return nil
+}
+
+func TestTableEntries_RoundTrip(t *testing.T) {
+	entries := []tableEntry{
+		{Key: "a@example.org", Values: []string{"b@example.org"}},
+		{Key: "team@example.org", Values: []string{"c@example.org", "d@example.org"}},
+	}
+	for _, format := range []string{"csv", "json"} {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeTableEntries(&buf, format, entries); err != nil {
+				t.Fatal(err)
+			}
+			read, err := readTableEntries(&buf, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(read, entries) {
+				t.Errorf("Wrong entries: %+v", read)
+			}
+		})
+	}
+
+	// Single values are accepted in JSON.
+	read, err := readTableEntries(bytes.NewReader([]byte(`{"a": "b", "c": ["d", "e"]}`)), "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []tableEntry{{Key: "a", Values: []string{"b"}}, {Key: "c", Values: []string{"d", "e"}}}
+	if !reflect.DeepEqual(read, expected) {
+		t.Errorf("Wrong entries: %+v", read)
+	}
+}
+
+func TestSetTableValues(t *testing.T) {
+	tbl := &multiTable{m: map[string][]string{"a": {"x", "y"}}}
+	if err := setTableValues(tbl, "a", []string{"b", "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := setTableValues(tbl, "d", []string{"e"}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tbl.m, map[string][]string{"a": {"b", "c"}, "d": {"e"}}) {
+		t.Errorf("Wrong table content: %v", tbl.m)
+	}
+
+	single := &singleTable{multiTable{m: map[string][]string{}}}
+	if err := setTableValues(single, "a", []string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := setTableValues(single, "a", []string{"b", "c"}); err == nil {
+		t.Error("Expected an error for multiple values in a single-valued table")
+	}
+}
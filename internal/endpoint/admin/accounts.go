@@ -0,0 +1,275 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package admin
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+type specialUseUser interface {
+	CreateMailboxSpecial(name, specialUseAttr string) error
+}
+
+type mailboxInfo struct {
+	Name       string   `json:"name"`
+	Attributes []string `json:"attributes"`
+}
+
+func (e *Endpoint) userDB(block string) (module.PlainUserDB, error) {
+	mod, err := e.lookupModule(block)
+	if err != nil {
+		return nil, err
+	}
+	db, ok := mod.(module.PlainUserDB)
+	if !ok {
+		return nil, errStatus(http.StatusBadRequest, "config block %s is not a local credentials store", block)
+	}
+	return db, nil
+}
+
+func (e *Endpoint) storage(block string) (module.ManageableStorage, error) {
+	mod, err := e.lookupModule(block)
+	if err != nil {
+		return nil, err
+	}
+	st, ok := mod.(module.ManageableStorage)
+	if !ok {
+		return nil, errStatus(http.StatusBadRequest, "config block %s is not a manageable storage", block)
+	}
+	return st, nil
+}
+
+// handleUsers implements credentials management.
+//
+//	GET    /v1/users/BLOCK
+//	POST   /v1/users/BLOCK            {"username": "...", "password": "..."}
+//	PUT    /v1/users/BLOCK/USERNAME   {"password": "..."}
+//	DELETE /v1/users/BLOCK/USERNAME
+func (e *Endpoint) handleUsers(r *http.Request, block string, path []string) (interface{}, error) {
+	db, err := e.userDB(block)
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(path) {
+	case 0:
+		switch r.Method {
+		case http.MethodGet:
+			users, err := db.ListUsers()
+			if err != nil {
+				return nil, err
+			}
+			if users == nil {
+				users = []string{}
+			}
+			return users, nil
+		case http.MethodPost:
+			var req struct {
+				Username string `json:"username"`
+				Password string `json:"password"`
+			}
+			if err := readJSON(r, &req); err != nil {
+				return nil, err
+			}
+			if req.Username == "" || req.Password == "" {
+				return nil, errStatus(http.StatusBadRequest, "username and password are required")
+			}
+			if err := db.CreateUser(req.Username, req.Password); err != nil {
+				return nil, err
+			}
+			e.logger.Msg("credentials created", "block", block, "username", req.Username)
+			return nil, nil
+		}
+	case 1:
+		switch r.Method {
+		case http.MethodPut:
+			var req struct {
+				Password string `json:"password"`
+			}
+			if err := readJSON(r, &req); err != nil {
+				return nil, err
+			}
+			if req.Password == "" {
+				return nil, errStatus(http.StatusBadRequest, "password is required")
+			}
+			if err := db.SetUserPassword(path[0], req.Password); err != nil {
+				return nil, err
+			}
+			e.logger.Msg("password changed", "block", block, "username", path[0])
+			return nil, nil
+		case http.MethodDelete:
+			if err := db.DeleteUser(path[0]); err != nil {
+				return nil, err
+			}
+			e.logger.Msg("credentials removed", "block", block, "username", path[0])
+			return nil, nil
+		}
+	default:
+		return nil, notFound()
+	}
+
+	return nil, methodNotAllowed(r)
+}
+
+// handleAccounts implements storage accounts and mailboxes management.
+//
+//	GET    /v1/accounts/BLOCK
+//	POST   /v1/accounts/BLOCK                            {"username": "..."}
+//	DELETE /v1/accounts/BLOCK/USERNAME
+//	GET    /v1/accounts/BLOCK/USERNAME/mailboxes
+//	POST   /v1/accounts/BLOCK/USERNAME/mailboxes         {"name": "...", "special_use": "..."}
+//	DELETE /v1/accounts/BLOCK/USERNAME/mailboxes/NAME
+func (e *Endpoint) handleAccounts(r *http.Request, block string, path []string) (interface{}, error) {
+	st, err := e.storage(block)
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(path) {
+	case 0:
+		switch r.Method {
+		case http.MethodGet:
+			accts, err := st.ListIMAPAccts()
+			if err != nil {
+				return nil, err
+			}
+			if accts == nil {
+				accts = []string{}
+			}
+			return accts, nil
+		case http.MethodPost:
+			var req struct {
+				Username string `json:"username"`
+			}
+			if err := readJSON(r, &req); err != nil {
+				return nil, err
+			}
+			if req.Username == "" {
+				return nil, errStatus(http.StatusBadRequest, "username is required")
+			}
+			if err := st.CreateIMAPAcct(req.Username); err != nil {
+				return nil, err
+			}
+			e.logger.Msg("storage account created", "block", block, "username", req.Username)
+			return nil, nil
+		}
+	case 1:
+		if r.Method == http.MethodDelete {
+			if err := st.DeleteIMAPAcct(path[0]); err != nil {
+				return nil, err
+			}
+			e.logger.Msg("storage account removed", "block", block, "username", path[0])
+			return nil, nil
+		}
+	case 2, 3:
+		if path[1] != "mailboxes" {
+			return nil, notFound()
+		}
+		return e.handleMailboxes(r, st, block, path[0], path[2:])
+	default:
+		return nil, notFound()
+	}
+
+	return nil, methodNotAllowed(r)
+}
+
+func (e *Endpoint) handleMailboxes(r *http.Request, st module.ManageableStorage, block, username string, path []string) (interface{}, error) {
+	u, err := st.GetIMAPAcct(username)
+	if err != nil {
+		return nil, errStatus(http.StatusNotFound, "%v", err)
+	}
+	defer func() {
+		if err := u.Logout(); err != nil {
+			e.logger.Error("logout failed", err, "username", username)
+		}
+	}()
+
+	if len(path) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			mboxes, err := u.ListMailboxes(false)
+			if err != nil {
+				return nil, err
+			}
+			res := make([]mailboxInfo, 0, len(mboxes))
+			for _, info := range mboxes {
+				attrs := info.Attributes
+				if attrs == nil {
+					attrs = []string{}
+				}
+				res = append(res, mailboxInfo{Name: info.Name, Attributes: attrs})
+			}
+			return res, nil
+		case http.MethodPost:
+			var req struct {
+				Name       string `json:"name"`
+				SpecialUse string `json:"special_use"`
+			}
+			if err := readJSON(r, &req); err != nil {
+				return nil, err
+			}
+			if req.Name == "" {
+				return nil, errStatus(http.StatusBadRequest, "name is required")
+			}
+			if err := createMailbox(u, req.Name, req.SpecialUse); err != nil {
+				return nil, err
+			}
+			e.logger.Msg("mailbox created", "block", block, "username", username, "mailbox", req.Name)
+			return nil, nil
+		}
+		return nil, methodNotAllowed(r)
+	}
+
+	if r.Method != http.MethodDelete {
+		return nil, methodNotAllowed(r)
+	}
+	if strings.EqualFold(path[0], imap.InboxName) {
+		return nil, errStatus(http.StatusBadRequest, "INBOX can't be removed")
+	}
+	if err := u.DeleteMailbox(path[0]); err != nil {
+		return nil, err
+	}
+	e.logger.Msg("mailbox removed", "block", block, "username", username, "mailbox", path[0])
+	return nil, nil
+}
+
+func createMailbox(u imapbackend.User, name, specialUse string) error {
+	if specialUse == "" {
+		return u.CreateMailbox(name)
+	}
+
+	suu, ok := u.(specialUseUser)
+	if !ok {
+		return errStatus(http.StatusBadRequest, "storage backend does not support SPECIAL-USE IMAP extension")
+	}
+
+	switch specialUse {
+	case "all", "archive", "drafts", "flagged", "junk", "sent", "trash":
+	default:
+		return errStatus(http.StatusBadRequest, "unknown special-use attribute: %s", specialUse)
+	}
+	// strings.Title-like conversion, special-use attributes are ASCII-only.
+	attr := "\\" + strings.ToUpper(specialUse[:1]) + specialUse[1:]
+	return suu.CreateMailboxSpecial(name, attr)
+}
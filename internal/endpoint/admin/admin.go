@@ -0,0 +1,181 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package admin implements the HTTP+JSON API for the management of the
+// running server.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/netresource"
+)
+
+const modName = "admin"
+
+type Endpoint struct {
+	addrs  []string
+	logger log.Logger
+	token  string
+
+	healthTimeout time.Duration
+
+	// getInstance is replaced in tests.
+	getInstance   func(name string) (module.Module, error)
+	instanceNames func() []string
+	reload        func() error
+
+	listenersWg sync.WaitGroup
+	serv        http.Server
+}
+
+func New(_ string, args []string) (module.Module, error) {
+	return &Endpoint{
+		addrs:         args,
+		logger:        log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		getInstance:   module.GetInstance,
+		instanceNames: module.InstanceNames,
+		reload: func() error {
+			if module.Reload == nil {
+				return errStatus(http.StatusNotImplemented, "configuration reload is not supported")
+			}
+			return module.Reload()
+		},
+	}, nil
+}
+
+func (e *Endpoint) Init(cfg *config.Map) error {
+	var tokenFile string
+	cfg.Bool("debug", false, false, &e.logger.Debug)
+	cfg.String("token", false, false, "", &e.token)
+	cfg.String("token_file", false, false, "", &tokenFile)
+	cfg.Duration("health_timeout", false, false, 10*time.Second, &e.healthTimeout)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if tokenFile != "" {
+		if e.token != "" {
+			return fmt.Errorf("%s: token and token_file can't be used together", modName)
+		}
+		tokenBlob, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return fmt.Errorf("%s: %v", modName, err)
+		}
+		e.token = strings.TrimSpace(string(tokenBlob))
+		if e.token == "" {
+			return fmt.Errorf("%s: token file is empty", modName)
+		}
+	}
+
+	endpoints := make([]config.Endpoint, 0, len(e.addrs))
+	for _, a := range e.addrs {
+		endp, err := config.ParseEndpoint(a)
+		if err != nil {
+			return fmt.Errorf("%s: malformed endpoint: %v", modName, err)
+		}
+		if endp.IsTLS() {
+			return fmt.Errorf("%s: TLS is not supported yet", modName)
+		}
+		// Unix sockets are protected by the file system permissions,
+		// anything else requires authentication.
+		if endp.Scheme != "unix" && e.token == "" {
+			return fmt.Errorf("%s: token is required for non-unix endpoint %s", modName, a)
+		}
+		endpoints = append(endpoints, endp)
+	}
+
+	e.serv.Handler = e.authMiddleware(e.router())
+	if module.NoRun {
+		return nil
+	}
+
+	for _, endp := range endpoints {
+		endp := endp
+		l, err := netresource.Listen(endp.Network(), endp.Address())
+		if err != nil {
+			return fmt.Errorf("%s: %v", modName, err)
+		}
+
+		e.listenersWg.Add(1)
+		go func() {
+			e.logger.Println("listening on", endp.String())
+			err := e.serv.Serve(l)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+				e.logger.Error("serve failed", err, "endpoint", endp.String())
+			}
+			e.listenersWg.Done()
+		}()
+	}
+
+	return nil
+}
+
+func (e *Endpoint) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if e.token != "" {
+			authHdr := r.Header.Get("Authorization")
+			provided := strings.TrimPrefix(authHdr, "Bearer ")
+			if provided == authHdr || subtle.ConstantTimeCompare([]byte(provided), []byte(e.token)) != 1 {
+				e.logger.Msg("unauthorized request", "remote_addr", r.RemoteAddr, "path", r.URL.Path)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="maddy"`)
+				writeError(w, http.StatusUnauthorized, errors.New("invalid or missing token"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (e *Endpoint) Name() string {
+	return modName
+}
+
+func (e *Endpoint) InstanceName() string {
+	return ""
+}
+
+// Drain stops accepting new connections and waits for the running requests
+// to complete.
+func (e *Endpoint) Drain(ctx context.Context) error {
+	return e.serv.Shutdown(ctx)
+}
+
+func (e *Endpoint) Close() error {
+	if err := e.serv.Close(); err != nil {
+		return err
+	}
+	e.listenersWg.Wait()
+	return nil
+}
+
+func init() {
+	module.RegisterEndpoint(modName, New)
+}
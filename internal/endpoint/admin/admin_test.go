@@ -0,0 +1,522 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/auth/lockout"
+	"github.com/foxcpp/maddy/internal/target/queue"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type stubModule struct {
+	name string
+}
+
+func (s stubModule) Init(*config.Map) error { return nil }
+func (s stubModule) Name() string           { return s.name }
+func (s stubModule) InstanceName() string   { return s.name }
+
+type memUserDB struct {
+	stubModule
+	users map[string]string
+}
+
+func (db *memUserDB) AuthPlain(username, password string) error {
+	if db.users[username] != password {
+		return module.ErrUnknownCredentials
+	}
+	return nil
+}
+
+func (db *memUserDB) ListUsers() ([]string, error) {
+	res := make([]string, 0, len(db.users))
+	for u := range db.users {
+		res = append(res, u)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+func (db *memUserDB) CreateUser(username, password string) error {
+	if _, ok := db.users[username]; ok {
+		return fmt.Errorf("credentials for %s already exist", username)
+	}
+	db.users[username] = password
+	return nil
+}
+
+func (db *memUserDB) SetUserPassword(username, password string) error {
+	db.users[username] = password
+	return nil
+}
+
+func (db *memUserDB) DeleteUser(username string) error {
+	delete(db.users, username)
+	return nil
+}
+
+type memTable struct {
+	stubModule
+	m map[string]string
+}
+
+func (t *memTable) Lookup(_ context.Context, key string) (string, bool, error) {
+	v, ok := t.m[key]
+	return v, ok, nil
+}
+
+func (t *memTable) Keys() ([]string, error) {
+	res := make([]string, 0, len(t.m))
+	for k := range t.m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+func (t *memTable) SetKey(k, v string) error {
+	t.m[k] = v
+	return nil
+}
+
+func (t *memTable) RemoveKey(k string) error {
+	delete(t.m, k)
+	return nil
+}
+
+type stubQueue struct {
+	stubModule
+	msgs    map[string]queue.MsgInfo
+	flushed []string
+	removed []string
+}
+
+func (q *stubQueue) List() ([]queue.MsgInfo, error) {
+	res := make([]queue.MsgInfo, 0, len(q.msgs))
+	for _, info := range q.msgs {
+		res = append(res, info)
+	}
+	return res, nil
+}
+
+func (q *stubQueue) Inspect(id string) (queue.MsgInfo, error) {
+	info, ok := q.msgs[id]
+	if !ok {
+		return queue.MsgInfo{}, queue.ErrUnknownMsg
+	}
+	return info, nil
+}
+
+func (q *stubQueue) Flush(id string) error {
+	if id == "busy" {
+		return queue.ErrMsgBusy
+	}
+	if _, ok := q.msgs[id]; !ok {
+		return queue.ErrUnknownMsg
+	}
+	q.flushed = append(q.flushed, id)
+	return nil
+}
+
+func (q *stubQueue) FlushAll() int {
+	return len(q.msgs)
+}
+
+func (q *stubQueue) Remove(id string, bounce bool) error {
+	if _, ok := q.msgs[id]; !ok {
+		return queue.ErrUnknownMsg
+	}
+	delete(q.msgs, id)
+	q.removed = append(q.removed, fmt.Sprint(id, " ", bounce))
+	return nil
+}
+
+type unhealthyModule struct {
+	stubModule
+}
+
+func (unhealthyModule) CheckHealth(context.Context) error {
+	return errors.New("database is on fire")
+}
+
+func testEndpoint(t *testing.T, mods ...module.Module) (*Endpoint, *httptest.Server) {
+	t.Helper()
+
+	e := &Endpoint{
+		logger:        testutils.Logger(t, modName),
+		token:         "secret",
+		healthTimeout: time.Second,
+		getInstance: func(name string) (module.Module, error) {
+			for _, mod := range mods {
+				if mod.InstanceName() == name {
+					return mod, nil
+				}
+			}
+			return nil, fmt.Errorf("unknown config block: %s", name)
+		},
+		instanceNames: func() []string {
+			names := make([]string, 0, len(mods))
+			for _, mod := range mods {
+				names = append(names, mod.InstanceName())
+			}
+			return names
+		},
+	}
+	srv := httptest.NewServer(e.authMiddleware(e.router()))
+	t.Cleanup(srv.Close)
+	return e, srv
+}
+
+func doRequest(t *testing.T, srv *httptest.Server, method, path string, body interface{}, out interface{}) int {
+	t.Helper()
+
+	var bodyReader bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&bodyReader).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req, err := http.NewRequest(method, srv.URL+path, &bodyReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatal("decode:", err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAdmin_Auth(t *testing.T) {
+	_, srv := testEndpoint(t)
+
+	for _, hdr := range []string{"", "secret", "Bearer wrong", "Basic c2VjcmV0"} {
+		req, _ := http.NewRequest("GET", srv.URL+"/v1/modules", nil)
+		if hdr != "" {
+			req.Header.Set("Authorization", hdr)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%q: expected 401, got %d", hdr, resp.StatusCode)
+		}
+	}
+
+	if code := doRequest(t, srv, "GET", "/v1/modules", nil, nil); code != http.StatusOK {
+		t.Fatal("Expected 200, got", code)
+	}
+}
+
+func TestAdmin_Users(t *testing.T) {
+	db := &memUserDB{stubModule: stubModule{"local_authdb"}, users: map[string]string{}}
+	_, srv := testEndpoint(t, db, &memTable{stubModule: stubModule{"aliases"}})
+
+	if code := doRequest(t, srv, "POST", "/v1/users/local_authdb", map[string]string{
+		"username": "foxcpp@example.org",
+		"password": "1234",
+	}, nil); code != http.StatusNoContent {
+		t.Fatal("Create: unexpected status", code)
+	}
+	if code := doRequest(t, srv, "PUT", "/v1/users/local_authdb/foxcpp@example.org", map[string]string{
+		"password": "5678",
+	}, nil); code != http.StatusNoContent {
+		t.Fatal("Set password: unexpected status", code)
+	}
+	if err := db.AuthPlain("foxcpp@example.org", "5678"); err != nil {
+		t.Fatal("Password was not changed")
+	}
+
+	var users []string
+	if code := doRequest(t, srv, "GET", "/v1/users/local_authdb", nil, &users); code != http.StatusOK {
+		t.Fatal("List: unexpected status", code)
+	}
+	if len(users) != 1 || users[0] != "foxcpp@example.org" {
+		t.Fatal("Wrong users list:", users)
+	}
+
+	if code := doRequest(t, srv, "DELETE", "/v1/users/local_authdb/foxcpp@example.org", nil, nil); code != http.StatusNoContent {
+		t.Fatal("Delete: unexpected status", code)
+	}
+	if len(db.users) != 0 {
+		t.Fatal("User was not removed")
+	}
+
+	if code := doRequest(t, srv, "GET", "/v1/users/aliases", nil, nil); code != http.StatusBadRequest {
+		t.Fatal("Wrong module type: unexpected status", code)
+	}
+	if code := doRequest(t, srv, "GET", "/v1/users/nonexistent", nil, nil); code != http.StatusNotFound {
+		t.Fatal("Unknown block: unexpected status", code)
+	}
+	if code := doRequest(t, srv, "POST", "/v1/users/local_authdb", map[string]string{
+		"username": "foxcpp@example.org",
+	}, nil); code != http.StatusBadRequest {
+		t.Fatal("Missing password: unexpected status", code)
+	}
+}
+
+func TestAdmin_Tables(t *testing.T) {
+	tbl := &memTable{stubModule: stubModule{"aliases"}, m: map[string]string{
+		"a@example.org": "b@example.org",
+	}}
+	_, srv := testEndpoint(t, tbl)
+
+	var entry tableEntry
+	if code := doRequest(t, srv, "GET", "/v1/tables/aliases/a@example.org", nil, &entry); code != http.StatusOK {
+		t.Fatal("Get: unexpected status", code)
+	}
+	if entry.Value != "b@example.org" {
+		t.Fatal("Wrong value:", entry.Value)
+	}
+	if code := doRequest(t, srv, "GET", "/v1/tables/aliases/c@example.org", nil, nil); code != http.StatusNotFound {
+		t.Fatal("Get missing: unexpected status", code)
+	}
+
+	if code := doRequest(t, srv, "PUT", "/v1/tables/aliases/c%40example.org", map[string]string{
+		"value": "d@example.org",
+	}, nil); code != http.StatusNoContent {
+		t.Fatal("Set: unexpected status", code)
+	}
+	if tbl.m["c@example.org"] != "d@example.org" {
+		t.Fatal("Key was not set")
+	}
+
+	if code := doRequest(t, srv, "DELETE", "/v1/tables/aliases/a@example.org", nil, nil); code != http.StatusNoContent {
+		t.Fatal("Delete: unexpected status", code)
+	}
+
+	var keys []string
+	if code := doRequest(t, srv, "GET", "/v1/tables/aliases", nil, &keys); code != http.StatusOK {
+		t.Fatal("Keys: unexpected status", code)
+	}
+	if len(keys) != 1 || keys[0] != "c@example.org" {
+		t.Fatal("Wrong keys:", keys)
+	}
+}
+
+func TestAdmin_Queues(t *testing.T) {
+	q := &stubQueue{stubModule: stubModule{"remote_queue"}, msgs: map[string]queue.MsgInfo{
+		"aabbccdd": {
+			ID:   "aabbccdd",
+			From: "foxcpp@example.org",
+			To:   []string{"test@example.com"},
+		},
+	}}
+	_, srv := testEndpoint(t, q)
+
+	var msgs []queuedMsg
+	if code := doRequest(t, srv, "GET", "/v1/queues/remote_queue", nil, &msgs); code != http.StatusOK {
+		t.Fatal("List: unexpected status", code)
+	}
+	if len(msgs) != 1 || msgs[0].ID != "aabbccdd" || msgs[0].NextAttempt != nil {
+		t.Fatalf("Wrong list: %+v", msgs)
+	}
+
+	if code := doRequest(t, srv, "POST", "/v1/queues/remote_queue/aabbccdd/flush", nil, nil); code != http.StatusNoContent {
+		t.Fatal("Flush: unexpected status", code)
+	}
+	if code := doRequest(t, srv, "POST", "/v1/queues/remote_queue/busy/flush", nil, nil); code != http.StatusConflict {
+		t.Fatal("Flush busy: unexpected status", code)
+	}
+	if code := doRequest(t, srv, "GET", "/v1/queues/remote_queue/ffffffff", nil, nil); code != http.StatusNotFound {
+		t.Fatal("Inspect missing: unexpected status", code)
+	}
+	if code := doRequest(t, srv, "DELETE", "/v1/queues/remote_queue/aabbccdd?bounce=true", nil, nil); code != http.StatusNoContent {
+		t.Fatal("Remove: unexpected status", code)
+	}
+	if len(q.removed) != 1 || q.removed[0] != "aabbccdd true" {
+		t.Fatal("Wrong removed list:", q.removed)
+	}
+}
+
+func TestAdmin_Lockouts(t *testing.T) {
+	mod, err := lockout.New("auth.lockout", "local_lockout", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mod.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "username", Children: []config.Node{{Name: "max_failures", Args: []string{"1"}}}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := mod.(auth.AttemptTracker)
+	tracker.Record(context.Background(), auth.Attempt{
+		Username: "foxcpp@example.org",
+		RemoteIP: net.IPv4(127, 0, 0, 1),
+	}, errors.New("invalid credentials"))
+	_, srv := testEndpoint(t, mod)
+
+	var entries []lockoutEntry
+	if code := doRequest(t, srv, "GET", "/v1/lockouts/local_lockout", nil, &entries); code != http.StatusOK {
+		t.Fatal("List: unexpected status", code)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Wrong list: %+v", entries)
+	}
+	if entries[1].Key != "user:foxcpp@example.org" || !entries[1].Locked || entries[1].LockedUntil == nil {
+		t.Fatalf("Username is not locked: %+v", entries[1])
+	}
+	if entries[0].Key != "ip:127.0.0.1/32" || entries[0].Locked || entries[0].Failures != 1 {
+		t.Fatalf("Wrong address state: %+v", entries[0])
+	}
+
+	if code := doRequest(t, srv, "DELETE", "/v1/lockouts/local_lockout/user:foxcpp@example.org", nil, nil); code != http.StatusNoContent {
+		t.Fatal("Clear: unexpected status", code)
+	}
+	if code := doRequest(t, srv, "DELETE", "/v1/lockouts/local_lockout/user:foxcpp@example.org", nil, nil); code != http.StatusNotFound {
+		t.Fatal("Clear missing: unexpected status", code)
+	}
+	if code := doRequest(t, srv, "DELETE", "/v1/lockouts/local_lockout/ip:127.0.0.1", nil, nil); code != http.StatusNoContent {
+		t.Fatal("Clear address: unexpected status", code)
+	}
+	if code := doRequest(t, srv, "GET", "/v1/lockouts/local_lockout", nil, &entries); code != http.StatusOK {
+		t.Fatal("List: unexpected status", code)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("Entries left after clearing: %+v", entries)
+	}
+}
+
+func TestAdmin_Health(t *testing.T) {
+	_, srv := testEndpoint(t, stubModule{"a"})
+
+	var resp struct {
+		Status    string       `json:"status"`
+		Unhealthy []moduleInfo `json:"unhealthy"`
+	}
+	if code := doRequest(t, srv, "GET", "/v1/health", nil, &resp); code != http.StatusOK {
+		t.Fatal("Unexpected status", code)
+	}
+	if resp.Status != "ok" {
+		t.Fatal("Wrong status:", resp.Status)
+	}
+
+	_, srv = testEndpoint(t, stubModule{"a"}, unhealthyModule{stubModule{"b"}})
+	if code := doRequest(t, srv, "GET", "/v1/health", nil, &resp); code != http.StatusServiceUnavailable {
+		t.Fatal("Unexpected status", code)
+	}
+	if len(resp.Unhealthy) != 1 || resp.Unhealthy[0].Instance != "b" || resp.Unhealthy[0].Error != "database is on fire" {
+		t.Fatalf("Wrong unhealthy list: %+v", resp.Unhealthy)
+	}
+}
+
+func TestAdmin_Reload(t *testing.T) {
+	e, srv := testEndpoint(t)
+
+	reloads := 0
+	e.reload = func() error {
+		reloads++
+		if reloads == 2 {
+			return errors.New("syntax error")
+		}
+		return nil
+	}
+
+	if code := doRequest(t, srv, "GET", "/v1/reload", nil, nil); code != http.StatusMethodNotAllowed {
+		t.Fatal("Unexpected status", code)
+	}
+	if code := doRequest(t, srv, "POST", "/v1/reload", nil, nil); code != http.StatusNoContent {
+		t.Fatal("Unexpected status", code)
+	}
+
+	var resp struct {
+		Error string `json:"error"`
+	}
+	if code := doRequest(t, srv, "POST", "/v1/reload", nil, &resp); code != http.StatusConflict {
+		t.Fatal("Unexpected status", code)
+	}
+	if resp.Error != "reload failed: syntax error" {
+		t.Fatal("Wrong error:", resp.Error)
+	}
+	if reloads != 2 {
+		t.Fatal("Wrong reloads count:", reloads)
+	}
+}
+
+func TestAdmin_UnixSocket(t *testing.T) {
+	sockPath := filepath.Join(t.TempDir(), "admin.sock")
+
+	mod, err := New(modName, []string{"unix://" + sockPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := mod.(*Endpoint)
+	e.instanceNames = func() []string { return nil }
+	if err := e.Init(config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	client := http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", sockPath)
+			},
+		},
+	}
+	resp, err := client.Get("http://admin/v1/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("Unexpected status", resp.StatusCode)
+	}
+}
+
+func TestAdmin_TokenRequired(t *testing.T) {
+	mod, err := New(modName, []string{"tcp://127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.Init(config.NewMap(nil, config.Node{})); err == nil {
+		mod.(*Endpoint).Close()
+		t.Fatal("Expected an error for TCP endpoint without token")
+	}
+}
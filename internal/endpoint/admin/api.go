@@ -0,0 +1,153 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// httpError is returned by handlers to indicate the specific response status.
+type httpError struct {
+	status int
+	err    error
+}
+
+func (he httpError) Error() string {
+	return he.err.Error()
+}
+
+func errStatus(status int, format string, args ...interface{}) error {
+	return httpError{status: status, err: fmt.Errorf(format, args...)}
+}
+
+// handler is an API request handler.
+//
+// path contains unescaped path components following the resource name and
+// block name. Returned value is serialized as JSON, nil value results in
+// empty 204 response.
+type handler func(r *http.Request, block string, path []string) (interface{}, error)
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func readJSON(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(io.LimitReader(r.Body, 1024*1024))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return errStatus(http.StatusBadRequest, "malformed request body: %v", err)
+	}
+	return nil
+}
+
+func splitPath(escaped string) ([]string, error) {
+	escaped = strings.Trim(escaped, "/")
+	if escaped == "" {
+		return nil, nil
+	}
+	parts := strings.Split(escaped, "/")
+	for i, p := range parts {
+		var err error
+		parts[i], err = url.PathUnescape(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return parts, nil
+}
+
+func (e *Endpoint) router() http.Handler {
+	resources := map[string]handler{
+		"users":    e.handleUsers,
+		"accounts": e.handleAccounts,
+		"tables":   e.handleTables,
+		"queues":   e.handleQueues,
+		"lockouts": e.handleLockouts,
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, err := splitPath(strings.TrimPrefix(r.URL.EscapedPath(), "/v1"))
+		if err != nil || !strings.HasPrefix(r.URL.Path, "/v1/") || len(path) == 0 {
+			writeError(w, http.StatusNotFound, errors.New("unknown API endpoint"))
+			return
+		}
+
+		var (
+			resp interface{}
+			hErr error
+		)
+		switch path[0] {
+		case "modules":
+			resp, hErr = e.handleModules(r, path[1:])
+		case "health":
+			e.handleHealth(w, r, path[1:])
+			return
+		case "reload":
+			resp, hErr = e.handleReload(r, path[1:])
+		default:
+			h, ok := resources[path[0]]
+			if !ok || len(path) < 2 {
+				writeError(w, http.StatusNotFound, errors.New("unknown API endpoint"))
+				return
+			}
+			resp, hErr = h(r, path[1], path[2:])
+		}
+
+		if hErr != nil {
+			var he httpError
+			if errors.As(hErr, &he) {
+				writeError(w, he.status, he.err)
+				return
+			}
+			e.logger.Error("request failed", hErr, "method", r.Method, "path", r.URL.Path)
+			writeError(w, http.StatusInternalServerError, hErr)
+			return
+		}
+
+		e.logger.Debugf("%s %s", r.Method, r.URL.Path)
+
+		if resp == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+}
+
+func methodNotAllowed(r *http.Request) error {
+	return errStatus(http.StatusMethodNotAllowed, "method %s is not allowed", r.Method)
+}
+
+func notFound() error {
+	return errStatus(http.StatusNotFound, "unknown API endpoint")
+}
@@ -0,0 +1,117 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package admin
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/auth/lockout"
+)
+
+// lockoutManager is implemented by auth.lockout.
+type lockoutManager interface {
+	Entries() ([]lockout.Entry, error)
+	Clear(key string) error
+	ClearAll() (int, error)
+}
+
+type lockoutEntry struct {
+	Key         string     `json:"key"`
+	Failures    int        `json:"failures"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+	Locked      bool       `json:"locked"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+	Lockouts    int        `json:"lockouts"`
+}
+
+func lockoutEntryFromState(e lockout.Entry, now time.Time) lockoutEntry {
+	entry := lockoutEntry{
+		Key:      e.Key,
+		Failures: e.Failures,
+		Locked:   e.Locked(now),
+		Lockouts: e.Lockouts,
+	}
+	if !e.LastFailure.IsZero() {
+		last := e.LastFailure
+		entry.LastFailure = &last
+	}
+	if entry.Locked {
+		until := e.LockedUntil
+		entry.LockedUntil = &until
+	}
+	return entry
+}
+
+// handleLockouts implements authentication lockouts inspection and
+// management.
+//
+//	GET    /v1/lockouts/BLOCK
+//	DELETE /v1/lockouts/BLOCK
+//	DELETE /v1/lockouts/BLOCK/KEY
+//
+// KEY is "user:USERNAME" or "ip:ADDRESS".
+func (e *Endpoint) handleLockouts(r *http.Request, block string, path []string) (interface{}, error) {
+	mod, err := e.lookupModule(block)
+	if err != nil {
+		return nil, err
+	}
+	lm, ok := mod.(lockoutManager)
+	if !ok {
+		return nil, errStatus(http.StatusBadRequest, "config block %s is not an auth.lockout", block)
+	}
+
+	switch len(path) {
+	case 0:
+		switch r.Method {
+		case http.MethodGet:
+			entries, err := lm.Entries()
+			if err != nil {
+				return nil, err
+			}
+			now := time.Now()
+			res := make([]lockoutEntry, 0, len(entries))
+			for _, entry := range entries {
+				res = append(res, lockoutEntryFromState(entry, now))
+			}
+			return res, nil
+		case http.MethodDelete:
+			count, err := lm.ClearAll()
+			if err != nil {
+				return nil, err
+			}
+			return map[string]int{"cleared": count}, nil
+		}
+		return nil, methodNotAllowed(r)
+	case 1:
+		if r.Method != http.MethodDelete {
+			return nil, methodNotAllowed(r)
+		}
+		if err := lm.Clear(path[0]); err != nil {
+			if errors.Is(err, lockout.ErrUnknownKey) {
+				return nil, errStatus(http.StatusNotFound, "%v", err)
+			}
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	return nil, notFound()
+}
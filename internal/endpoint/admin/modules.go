@@ -0,0 +1,149 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package admin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+type moduleInfo struct {
+	Instance string `json:"instance"`
+	Module   string `json:"module"`
+	Healthy  bool   `json:"healthy"`
+	// Checked is false if module does not support health checks.
+	Checked bool   `json:"checked"`
+	Error   string `json:"error,omitempty"`
+}
+
+// lookupModule returns the configuration block with the specified name.
+func (e *Endpoint) lookupModule(name string) (module.Module, error) {
+	mod, err := e.getInstance(name)
+	if err != nil || mod == nil {
+		return nil, errStatus(http.StatusNotFound, "unknown config block: %s", name)
+	}
+	return mod, nil
+}
+
+func (e *Endpoint) moduleInfo(ctx context.Context, name string) moduleInfo {
+	info := moduleInfo{Instance: name, Healthy: true}
+
+	mod, err := e.getInstance(name)
+	if err != nil {
+		info.Healthy = false
+		info.Error = err.Error()
+		return info
+	}
+	info.Module = mod.Name()
+
+	hc, ok := mod.(module.HealthChecker)
+	if !ok {
+		return info
+	}
+	info.Checked = true
+
+	ctx, cancel := context.WithTimeout(ctx, e.healthTimeout)
+	defer cancel()
+	if err := hc.CheckHealth(ctx); err != nil {
+		info.Healthy = false
+		info.Error = err.Error()
+	}
+	return info
+}
+
+func (e *Endpoint) handleModules(r *http.Request, path []string) (interface{}, error) {
+	if r.Method != http.MethodGet {
+		return nil, methodNotAllowed(r)
+	}
+
+	switch len(path) {
+	case 0:
+		names := e.instanceNames()
+		res := make([]moduleInfo, 0, len(names))
+		for _, name := range names {
+			res = append(res, e.moduleInfo(r.Context(), name))
+		}
+		return res, nil
+	case 1:
+		if _, err := e.lookupModule(path[0]); err != nil {
+			return nil, err
+		}
+		return e.moduleInfo(r.Context(), path[0]), nil
+	default:
+		return nil, notFound()
+	}
+}
+
+// handleHealth reports the overall server status. Response code is 200 if
+// all modules are healthy and 503 otherwise so it can be used directly by
+// the monitoring systems.
+func (e *Endpoint) handleHealth(w http.ResponseWriter, r *http.Request, path []string) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, methodNotAllowed(r))
+		return
+	}
+	if len(path) != 0 {
+		writeError(w, http.StatusNotFound, notFound())
+		return
+	}
+
+	unhealthy := []moduleInfo{}
+	for _, name := range e.instanceNames() {
+		info := e.moduleInfo(r.Context(), name)
+		if !info.Healthy {
+			unhealthy = append(unhealthy, info)
+		}
+	}
+
+	if len(unhealthy) != 0 {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
+			"status":    "unhealthy",
+			"unhealthy": unhealthy,
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":    "ok",
+		"unhealthy": unhealthy,
+	})
+}
+
+// handleReload re-reads the server configuration and replaces changed
+// configuration blocks.
+func (e *Endpoint) handleReload(r *http.Request, path []string) (interface{}, error) {
+	if r.Method != http.MethodPost {
+		return nil, methodNotAllowed(r)
+	}
+	if len(path) != 0 {
+		return nil, notFound()
+	}
+
+	e.logger.Msg("configuration reload requested", "remote_addr", r.RemoteAddr)
+	if err := e.reload(); err != nil {
+		var he httpError
+		if errors.As(err, &he) {
+			return nil, err
+		}
+		return nil, errStatus(http.StatusConflict, "reload failed: %v", err)
+	}
+	return nil, nil
+}
@@ -0,0 +1,167 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package admin
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/target/queue"
+)
+
+// queueManager is implemented by target.queue.
+type queueManager interface {
+	List() ([]queue.MsgInfo, error)
+	Inspect(id string) (queue.MsgInfo, error)
+	Flush(id string) error
+	FlushAll() int
+	Remove(id string, bounce bool) error
+}
+
+type rcptError struct {
+	Code         int    `json:"code"`
+	EnhancedCode string `json:"enhanced_code"`
+	Message      string `json:"message"`
+}
+
+type queuedMsg struct {
+	ID                   string               `json:"id"`
+	From                 string               `json:"from"`
+	To                   []string             `json:"to"`
+	FailedRcpts          []string             `json:"failed_rcpts,omitempty"`
+	TemporaryFailedRcpts []string             `json:"temporary_failed_rcpts,omitempty"`
+	Errors               map[string]rcptError `json:"errors,omitempty"`
+	Tries                map[string]int       `json:"tries,omitempty"`
+	FirstAttempt         time.Time            `json:"first_attempt"`
+	LastAttempt          time.Time            `json:"last_attempt"`
+	// nil if the delivery attempt is in progress.
+	NextAttempt *time.Time `json:"next_attempt"`
+}
+
+func queuedMsgFromInfo(info queue.MsgInfo) queuedMsg {
+	msg := queuedMsg{
+		ID:                   info.ID,
+		From:                 info.From,
+		To:                   info.To,
+		FailedRcpts:          info.FailedRcpts,
+		TemporaryFailedRcpts: info.TemporaryFailedRcpts,
+		Tries:                info.TriesCount,
+		FirstAttempt:         info.FirstAttempt,
+		LastAttempt:          info.LastAttempt,
+	}
+	if !info.NextAttempt.IsZero() {
+		next := info.NextAttempt
+		msg.NextAttempt = &next
+	}
+	if len(info.RcptErrs) != 0 {
+		msg.Errors = make(map[string]rcptError, len(info.RcptErrs))
+		for rcpt, err := range info.RcptErrs {
+			if err == nil {
+				continue
+			}
+			msg.Errors[rcpt] = rcptError{
+				Code:         err.Code,
+				EnhancedCode: exterrors.EnhancedCode(err.EnhancedCode).FormatLog(),
+				Message:      err.Message,
+			}
+		}
+	}
+	return msg
+}
+
+func queueErr(err error) error {
+	switch {
+	case errors.Is(err, queue.ErrUnknownMsg):
+		return errStatus(http.StatusNotFound, "%v", err)
+	case errors.Is(err, queue.ErrMsgBusy):
+		return errStatus(http.StatusConflict, "%v", err)
+	}
+	return err
+}
+
+// handleQueues implements queue inspection and management.
+//
+//	GET    /v1/queues/BLOCK
+//	POST   /v1/queues/BLOCK/flush
+//	GET    /v1/queues/BLOCK/ID
+//	POST   /v1/queues/BLOCK/ID/flush
+//	DELETE /v1/queues/BLOCK/ID[?bounce=true]
+func (e *Endpoint) handleQueues(r *http.Request, block string, path []string) (interface{}, error) {
+	mod, err := e.lookupModule(block)
+	if err != nil {
+		return nil, err
+	}
+	q, ok := mod.(queueManager)
+	if !ok {
+		return nil, errStatus(http.StatusBadRequest, "config block %s is not a queue", block)
+	}
+
+	switch {
+	case len(path) == 0:
+		if r.Method != http.MethodGet {
+			return nil, methodNotAllowed(r)
+		}
+		list, err := q.List()
+		if err != nil {
+			return nil, err
+		}
+		res := make([]queuedMsg, 0, len(list))
+		for _, info := range list {
+			res = append(res, queuedMsgFromInfo(info))
+		}
+		return res, nil
+	case len(path) == 1 && path[0] == "flush":
+		if r.Method != http.MethodPost {
+			return nil, methodNotAllowed(r)
+		}
+		count := q.FlushAll()
+		e.logger.Msg("queue flushed", "block", block, "count", count)
+		return map[string]int{"flushed": count}, nil
+	case len(path) == 1:
+		switch r.Method {
+		case http.MethodGet:
+			info, err := q.Inspect(path[0])
+			if err != nil {
+				return nil, queueErr(err)
+			}
+			return queuedMsgFromInfo(info), nil
+		case http.MethodDelete:
+			bounce, _ := strconv.ParseBool(r.URL.Query().Get("bounce"))
+			if err := q.Remove(path[0], bounce); err != nil {
+				return nil, queueErr(err)
+			}
+			return nil, nil
+		}
+		return nil, methodNotAllowed(r)
+	case len(path) == 2 && path[1] == "flush":
+		if r.Method != http.MethodPost {
+			return nil, methodNotAllowed(r)
+		}
+		if err := q.Flush(path[0]); err != nil {
+			return nil, queueErr(err)
+		}
+		e.logger.Msg("message flushed", "block", block, "msg_id", path[0])
+		return nil, nil
+	}
+
+	return nil, notFound()
+}
@@ -0,0 +1,110 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package admin
+
+import (
+	"net/http"
+
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+type tableEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// handleTables implements table entries management.
+//
+//	GET    /v1/tables/BLOCK
+//	GET    /v1/tables/BLOCK/KEY
+//	PUT    /v1/tables/BLOCK/KEY  {"value": "..."}
+//	DELETE /v1/tables/BLOCK/KEY
+//
+// Lookups work for any table, other operations require it to be mutable.
+func (e *Endpoint) handleTables(r *http.Request, block string, path []string) (interface{}, error) {
+	mod, err := e.lookupModule(block)
+	if err != nil {
+		return nil, err
+	}
+	tbl, ok := mod.(module.Table)
+	if !ok {
+		return nil, errStatus(http.StatusBadRequest, "config block %s is not a table", block)
+	}
+	mtbl, mutable := tbl.(module.MutableTable)
+
+	if len(path) > 1 {
+		return nil, notFound()
+	}
+
+	if len(path) == 0 {
+		if r.Method != http.MethodGet {
+			return nil, methodNotAllowed(r)
+		}
+		if !mutable {
+			return nil, errStatus(http.StatusBadRequest, "table %s does not support listing", block)
+		}
+		keys, err := mtbl.Keys()
+		if err != nil {
+			return nil, err
+		}
+		if keys == nil {
+			keys = []string{}
+		}
+		return keys, nil
+	}
+
+	key := path[0]
+	if r.Method == http.MethodGet {
+		val, ok, err := tbl.Lookup(r.Context(), key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errStatus(http.StatusNotFound, "no such key: %s", key)
+		}
+		return tableEntry{Key: key, Value: val}, nil
+	}
+
+	if !mutable {
+		return nil, errStatus(http.StatusBadRequest, "table %s is read-only", block)
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		var req struct {
+			Value string `json:"value"`
+		}
+		if err := readJSON(r, &req); err != nil {
+			return nil, err
+		}
+		if err := mtbl.SetKey(key, req.Value); err != nil {
+			return nil, err
+		}
+		e.logger.Msg("table entry set", "block", block, "key", key)
+		return nil, nil
+	case http.MethodDelete:
+		if err := mtbl.RemoveKey(key); err != nil {
+			return nil, err
+		}
+		e.logger.Msg("table entry removed", "block", block, "key", key)
+		return nil, nil
+	}
+
+	return nil, methodNotAllowed(r)
+}
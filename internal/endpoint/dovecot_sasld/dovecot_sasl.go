@@ -31,6 +31,7 @@ import (
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/netresource"
 	"github.com/foxcpp/maddy/internal/auth"
 	"github.com/foxcpp/maddy/internal/authz"
 )
@@ -54,7 +55,8 @@ func New(_ string, addrs []string) (module.Module, error) {
 	return &Endpoint{
 		addrs: addrs,
 		saslAuth: auth.SASLAuth{
-			Log: log.Logger{Name: modName + "/saslauth"},
+			Log:          log.Logger{Name: modName + "/saslauth"},
+			EndpointName: modName,
 		},
 		log: log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
 	}, nil
@@ -72,6 +74,9 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 	cfg.Callback("auth", func(m *config.Map, node config.Node) error {
 		return endp.saslAuth.AddProvider(m, node)
 	})
+	cfg.Callback("auth_lockout", func(m *config.Map, node config.Node) error {
+		return endp.saslAuth.SetTracker(m, node)
+	})
 	config.EnumMapped(cfg, "auth_map_normalize", true, false, authz.NormalizeFuncs, authz.NormalizeAuto,
 		&endp.authNormalize)
 	modconfig.Table(cfg, "auth_map", true, false, nil, &endp.authMap)
@@ -101,8 +106,11 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 		if err != nil {
 			return fmt.Errorf("%s: %v", modName, err)
 		}
+		if module.NoRun {
+			continue
+		}
 
-		l, err := net.Listen(parsed.Network(), parsed.Address())
+		l, err := netresource.Listen(parsed.Network(), parsed.Address())
 		if err != nil {
 			return fmt.Errorf("%s: %v", modName, err)
 		}
@@ -0,0 +1,182 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/emersion/go-imap/utf7"
+)
+
+// ACLUser is implemented by storage accounts supporting access control lists
+// (RFC 4314).
+type ACLUser interface {
+	// GetACL returns rights for each identifier.
+	GetACL(mbox string) (map[string]string, error)
+	// SetACL changes rights of the identifier. rights can be prefixed with
+	// "+" or "-" to add or remove rights instead of replacing them.
+	SetACL(mbox, identifier, rights string) error
+	DeleteACL(mbox, identifier string) error
+	MyRights(mbox string) (string, error)
+	ListRights(mbox, identifier string) (required string, optional []string, err error)
+}
+
+// withObsoleteRights adds RFC 2086 rights to the rights string for
+// compatibility with older clients.
+func withObsoleteRights(rights string) string {
+	if strings.Contains(rights, "k") {
+		rights += "c"
+	}
+	if strings.ContainsAny(rights, "xte") {
+		rights += "d"
+	}
+	return rights
+}
+
+func parseMailboxName(f interface{}) (string, error) {
+	name, err := imap.ParseString(f)
+	if err != nil {
+		return "", err
+	}
+	name, err = utf7.Encoding.NewDecoder().String(name)
+	if err != nil {
+		return "", err
+	}
+	return imap.CanonicalMailboxName(name), nil
+}
+
+func formatMailboxName(name string) interface{} {
+	encoded, _ := utf7.Encoding.NewEncoder().String(name)
+	return imap.FormatMailboxName(encoded)
+}
+
+// aclCommand implements parsing of all ACL commands, arguments are the
+// mailbox name followed by the fixed amount of strings.
+type aclCommand struct {
+	name    string
+	argsNum int
+
+	mailbox string
+	args    []string
+}
+
+func (cmd *aclCommand) Parse(fields []interface{}) error {
+	if len(fields) != cmd.argsNum+1 {
+		return errors.New("Wrong amount of arguments")
+	}
+
+	var err error
+	cmd.mailbox, err = parseMailboxName(fields[0])
+	if err != nil {
+		return err
+	}
+	cmd.args = make([]string, 0, cmd.argsNum)
+	for _, f := range fields[1:] {
+		arg, err := imap.ParseString(f)
+		if err != nil {
+			return err
+		}
+		cmd.args = append(cmd.args, arg)
+	}
+	return nil
+}
+
+func (cmd *aclCommand) Handle(conn imapserver.Conn) error {
+	if conn.Context().User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+	u, ok := conn.Context().User.(ACLUser)
+	if !ok {
+		return errors.New("ACL is not supported")
+	}
+
+	switch cmd.name {
+	case "GETACL":
+		acl, err := u.GetACL(cmd.mailbox)
+		if err != nil {
+			return err
+		}
+		identifiers := make([]string, 0, len(acl))
+		for identifier := range acl {
+			identifiers = append(identifiers, identifier)
+		}
+		sort.Strings(identifiers)
+
+		fields := []interface{}{imap.RawString("ACL"), formatMailboxName(cmd.mailbox)}
+		for _, identifier := range identifiers {
+			fields = append(fields, identifier, withObsoleteRights(acl[identifier]))
+		}
+		return conn.WriteResp(imap.NewUntaggedResp(fields))
+	case "SETACL":
+		return u.SetACL(cmd.mailbox, cmd.args[0], cmd.args[1])
+	case "DELETEACL":
+		return u.DeleteACL(cmd.mailbox, cmd.args[0])
+	case "MYRIGHTS":
+		rights, err := u.MyRights(cmd.mailbox)
+		if err != nil {
+			return err
+		}
+		return conn.WriteResp(imap.NewUntaggedResp([]interface{}{
+			imap.RawString("MYRIGHTS"), formatMailboxName(cmd.mailbox), withObsoleteRights(rights),
+		}))
+	case "LISTRIGHTS":
+		required, optional, err := u.ListRights(cmd.mailbox, cmd.args[0])
+		if err != nil {
+			return err
+		}
+		fields := []interface{}{imap.RawString("LISTRIGHTS"), formatMailboxName(cmd.mailbox), cmd.args[0], required}
+		for _, rights := range optional {
+			fields = append(fields, rights)
+		}
+		return conn.WriteResp(imap.NewUntaggedResp(fields))
+	}
+	return errors.New("Unknown command")
+}
+
+// aclExtension implements ACL commands (RFC 4314).
+type aclExtension struct{}
+
+var aclCommands = map[string]int{
+	"GETACL":     0,
+	"SETACL":     2,
+	"DELETEACL":  1,
+	"MYRIGHTS":   0,
+	"LISTRIGHTS": 1,
+}
+
+func (ext aclExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState == 0 {
+		return nil
+	}
+	return []string{"ACL", "RIGHTS=texk"}
+}
+
+func (ext aclExtension) Command(name string) imapserver.HandlerFactory {
+	argsNum, ok := aclCommands[name]
+	if !ok {
+		return nil
+	}
+	return func() imapserver.Handler {
+		return &aclCommand{name: name, argsNum: argsNum}
+	}
+}
@@ -0,0 +1,1045 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// CondStoreMailbox is implemented by storage mailboxes that keep modification
+// sequences of messages (RFC 7162).
+type CondStoreMailbox interface {
+	backend.Mailbox
+
+	// HighestModSeq returns the highest modification sequence of the mailbox.
+	HighestModSeq() (uint64, error)
+	// ModSeqs returns modification sequences of messages with specified
+	// UIDs that were changed after changedSince. A nil set matches all
+	// messages.
+	ModSeqs(uids *imap.SeqSet, changedSince uint64) (map[uint32]uint64, error)
+	// Vanished returns UIDs from the set of messages that were expunged
+	// after the since modification sequence.
+	Vanished(uids *imap.SeqSet, since uint64) (*imap.SeqSet, error)
+	// UIDsAfter returns at most count UIDs assigned after uid, including
+	// UIDs of messages that were already expunged.
+	UIDsAfter(uid uint32, count int) ([]uint32, error)
+}
+
+const modSeqItem imap.FetchItem = "MODSEQ"
+
+func parseModSeq(f interface{}) (uint64, error) {
+	s, ok := f.(string)
+	if !ok {
+		return 0, errors.New("Modification sequence must be a number")
+	}
+	modSeq, err := strconv.ParseUint(s, 10, 63)
+	if err != nil {
+		return 0, errors.New("Invalid modification sequence")
+	}
+	return modSeq, nil
+}
+
+func formatModSeq(modSeq uint64) imap.RawString {
+	return imap.RawString(strconv.FormatUint(modSeq, 10))
+}
+
+func setModSeq(msg *imap.Message, modSeq uint64) {
+	msg.Items[modSeqItem] = []interface{}{formatModSeq(modSeq)}
+}
+
+func highestModSeqResp(modSeq uint64) *imap.StatusResp {
+	return &imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      "HIGHESTMODSEQ",
+		Arguments: []interface{}{formatModSeq(modSeq)},
+		Info:      "Highest",
+	}
+}
+
+func vanishedResp(earlier bool, uids *imap.SeqSet) imap.WriterTo {
+	fields := []interface{}{imap.RawString("VANISHED")}
+	if earlier {
+		fields = append(fields, []interface{}{imap.RawString("EARLIER")})
+	}
+	return imap.NewUntaggedResp(append(fields, uids))
+}
+
+type msgRef struct {
+	seq, uid uint32
+}
+
+// resolveSet returns sequence numbers and UIDs of existing messages in the
+// set.
+func resolveSet(mbox backend.Mailbox, uid bool, set *imap.SeqSet) ([]msgRef, error) {
+	// The backend resolves '*' in place, callers still need the original set.
+	set = &imap.SeqSet{Set: append([]imap.Seq(nil), set.Set...)}
+
+	ch := make(chan *imap.Message, 16)
+	done := make(chan error, 1)
+	go func() {
+		done <- mbox.ListMessages(uid, set, []imap.FetchItem{imap.FetchUid}, ch)
+	}()
+	var refs []msgRef
+	for msg := range ch {
+		refs = append(refs, msgRef{seq: msg.SeqNum, uid: msg.Uid})
+	}
+	return refs, <-done
+}
+
+// setsSeen reports whether fetching the items sets the \Seen flag.
+func setsSeen(items []imap.FetchItem) bool {
+	for _, item := range items {
+		if item == "RFC822" || item == "RFC822.TEXT" || strings.HasPrefix(string(item), "BODY[") {
+			return true
+		}
+	}
+	return false
+}
+
+// condStoreExtension implements CONDSTORE and QRESYNC extensions (RFC 7162)
+// for mailboxes implementing CondStoreMailbox and the ENABLE command (RFC
+// 5161) used to enable them.
+//
+// Commands taking modification sequences are reimplemented on top of the
+// go-imap handlers. Responses sent by go-imap on mailbox changes are
+// amended by condStoreConn.
+type condStoreExtension struct {
+	conns sync.Map // *imapserver.Context -> *condStoreConn
+}
+
+func (ext *condStoreExtension) Capabilities(imapserver.Conn) []string {
+	return []string{"ENABLE", "CONDSTORE", "QRESYNC"}
+}
+
+func (ext *condStoreExtension) Command(name string) imapserver.HandlerFactory {
+	switch name {
+	case "ENABLE":
+		return func() imapserver.Handler { return &enableCmd{ext: ext} }
+	case "SELECT", "EXAMINE":
+		return func() imapserver.Handler {
+			cmd := &selectCmd{ext: ext}
+			cmd.ReadOnly = name == "EXAMINE"
+			return cmd
+		}
+	case "FETCH":
+		return func() imapserver.Handler { return &fetchCmd{ext: ext} }
+	case "STORE":
+		return func() imapserver.Handler { return &storeCmd{ext: ext} }
+	case "SEARCH":
+		return func() imapserver.Handler { return &searchCmd{ext: ext} }
+	case "EXPUNGE":
+		return func() imapserver.Handler { return &expungeCmd{ext: ext} }
+	}
+	return nil
+}
+
+func (ext *condStoreExtension) NewConn(c imapserver.Conn) imapserver.Conn {
+	conn := &condStoreConn{Conn: c, ext: ext}
+	ext.conns.Store(c.Context(), conn)
+	return conn
+}
+
+// conn returns the state of the connection. Other extensions may wrap the
+// connection so it is looked up by the connection context.
+func (ext *condStoreExtension) conn(c imapserver.Conn) *condStoreConn {
+	conn, _ := ext.conns.Load(c.Context())
+	return conn.(*condStoreConn)
+}
+
+type condStoreConn struct {
+	imapserver.Conn
+	ext *condStoreExtension
+
+	lck       sync.Mutex
+	condStore bool
+	qresync   bool
+
+	// UIDs of messages in the selected mailbox in the order of sequence
+	// numbers, maintained once QRESYNC is enabled. go-imap reports
+	// expunged messages only using sequence numbers while QRESYNC requires
+	// VANISHED responses with UIDs. nil if the list is not known.
+	uids []uint32
+}
+
+func (c *condStoreConn) enabled() (condStore, qresync bool) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	return c.condStore, c.qresync
+}
+
+// enableCondStore enables CONDSTORE for the connection. As required by RFC
+// 7162, HIGHESTMODSEQ of the selected mailbox is sent if it was not enabled
+// before.
+func (c *condStoreConn) enableCondStore(conn imapserver.Conn) error {
+	c.lck.Lock()
+	enabled := c.condStore
+	c.condStore = true
+	c.lck.Unlock()
+	if enabled {
+		return nil
+	}
+
+	mbox, ok := conn.Context().Mailbox.(CondStoreMailbox)
+	if !ok {
+		return nil
+	}
+	modSeq, err := mbox.HighestModSeq()
+	if err != nil {
+		return err
+	}
+	return conn.WriteResp(highestModSeqResp(modSeq))
+}
+
+func (c *condStoreConn) enableQResync(conn imapserver.Conn) error {
+	if err := c.enableCondStore(conn); err != nil {
+		return err
+	}
+	c.lck.Lock()
+	enabled := c.qresync
+	c.qresync = true
+	c.lck.Unlock()
+	if enabled {
+		return nil
+	}
+	return c.resetUIDs(conn.Context().Mailbox)
+}
+
+// resetUIDs initializes the UIDs list for the newly selected mailbox.
+func (c *condStoreConn) resetUIDs(mbox backend.Mailbox) error {
+	uids := []uint32{}
+	if mbox != nil {
+		all, _ := imap.ParseSeqSet("1:*")
+		refs, err := resolveSet(mbox, true, all)
+		if err != nil {
+			return err
+		}
+		for _, ref := range refs {
+			for uint32(len(uids)) < ref.seq {
+				uids = append(uids, 0)
+			}
+			uids[ref.seq-1] = ref.uid
+		}
+	}
+
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	c.uids = uids
+	return nil
+}
+
+// expunged removes the message from the UIDs list and returns its UID.
+func (c *condStoreConn) expunged(seq uint32) (uint32, bool) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	if c.uids == nil || seq == 0 || int(seq) > len(c.uids) || c.uids[seq-1] == 0 {
+		return 0, false
+	}
+	uid := c.uids[seq-1]
+	c.uids = append(c.uids[:seq-1], c.uids[seq:]...)
+	return uid, true
+}
+
+// appended adds UIDs of new messages to the UIDs list.
+func (c *condStoreConn) appended(mbox CondStoreMailbox, count uint32) error {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	if c.uids == nil || int(count) <= len(c.uids) {
+		return nil
+	}
+	var last uint32
+	if len(c.uids) != 0 {
+		last = c.uids[len(c.uids)-1]
+	}
+	uids, err := mbox.UIDsAfter(last, int(count)-len(c.uids))
+	if err != nil {
+		// EXPUNGE responses will be sent until the next SELECT instead
+		// of VANISHED with wrong UIDs.
+		c.uids = nil
+		return err
+	}
+	c.uids = append(c.uids, uids...)
+	return nil
+}
+
+func (c *condStoreConn) SendUpdate(upd backend.Update) error {
+	condStore, qresync := c.enabled()
+	mbox, ok := c.Context().Mailbox.(CondStoreMailbox)
+	if !condStore || !ok {
+		return c.Conn.SendUpdate(upd)
+	}
+
+	switch upd := upd.(type) {
+	case *backend.MessageUpdate:
+		if upd.Message.Uid == 0 {
+			break
+		}
+		// The update is still sent without MODSEQ if it cannot be
+		// obtained, otherwise flags seen by the client will be wrong.
+		uids := &imap.SeqSet{}
+		uids.AddNum(upd.Message.Uid)
+		if modSeqs, err := mbox.ModSeqs(uids, 0); err == nil {
+			if modSeq, ok := modSeqs[upd.Message.Uid]; ok {
+				setModSeq(upd.Message, modSeq)
+			}
+		}
+	case *backend.ExpungeUpdate:
+		if !qresync {
+			break
+		}
+		// Fallback to EXPUNGE if the message is not known, this can
+		// happen only if the mailbox was changed during SELECT.
+		if uid, ok := c.expunged(upd.SeqNum); ok {
+			uids := &imap.SeqSet{}
+			uids.AddNum(uid)
+			return c.Conn.WriteResp(vanishedResp(false, uids))
+		}
+	case *backend.MailboxUpdate:
+		if !qresync {
+			break
+		}
+		if _, ok := upd.MailboxStatus.Items[imap.StatusMessages]; ok {
+			// Errors are not fatal, see appended.
+			_ = c.appended(mbox, upd.MailboxStatus.Messages)
+		}
+	}
+	return c.Conn.SendUpdate(upd)
+}
+
+func (c *condStoreConn) Close() error {
+	c.ext.conns.Delete(c.Context())
+	return c.Conn.Close()
+}
+
+// enableCmd implements the ENABLE command (RFC 5161).
+type enableCmd struct {
+	ext  *condStoreExtension
+	caps []string
+}
+
+func (cmd *enableCmd) Parse(fields []interface{}) error {
+	if len(fields) == 0 {
+		return errors.New("Missing capability names")
+	}
+	for _, f := range fields {
+		name, ok := f.(string)
+		if !ok {
+			return errors.New("Capability name must be an atom")
+		}
+		cmd.caps = append(cmd.caps, strings.ToUpper(name))
+	}
+	return nil
+}
+
+func (cmd *enableCmd) Handle(conn imapserver.Conn) error {
+	if conn.Context().User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+	c := cmd.ext.conn(conn)
+
+	fields := []interface{}{imap.RawString("ENABLED")}
+	for _, name := range cmd.caps {
+		switch name {
+		case "CONDSTORE":
+			if err := c.enableCondStore(conn); err != nil {
+				return err
+			}
+		case "QRESYNC":
+			if err := c.enableQResync(conn); err != nil {
+				return err
+			}
+		default:
+			// Unknown capabilities are ignored.
+			continue
+		}
+		fields = append(fields, imap.RawString(name))
+	}
+	return conn.WriteResp(imap.NewUntaggedResp(fields))
+}
+
+// selectCmd implements SELECT and EXAMINE with CONDSTORE and QRESYNC
+// parameters.
+type selectCmd struct {
+	imapserver.Select
+	ext *condStoreExtension
+
+	condStore bool
+	qresync   bool
+
+	uidValidity uint32
+	modSeq      uint64
+	knownUIDs   *imap.SeqSet
+}
+
+func (cmd *selectCmd) Parse(fields []interface{}) error {
+	if len(fields) > 2 {
+		return errors.New("Too many arguments")
+	}
+	if len(fields) == 2 {
+		params, ok := fields[1].([]interface{})
+		if !ok {
+			return errors.New("SELECT parameters must be a list")
+		}
+		if err := cmd.parseParams(params); err != nil {
+			return err
+		}
+		fields = fields[:1]
+	}
+	return cmd.Select.Parse(fields)
+}
+
+func (cmd *selectCmd) parseParams(params []interface{}) error {
+	for i := 0; i < len(params); i++ {
+		name, _ := params[i].(string)
+		switch strings.ToUpper(name) {
+		case "CONDSTORE":
+			cmd.condStore = true
+		case "QRESYNC":
+			if i+1 >= len(params) {
+				return errors.New("Missing QRESYNC parameters")
+			}
+			i++
+			args, ok := params[i].([]interface{})
+			if !ok || len(args) < 2 || len(args) > 4 {
+				return errors.New("Malformed QRESYNC parameters")
+			}
+			var err error
+			if cmd.uidValidity, err = imap.ParseNumber(args[0]); err != nil {
+				return err
+			}
+			if cmd.modSeq, err = parseModSeq(args[1]); err != nil {
+				return err
+			}
+			if len(args) > 2 {
+				if _, ok := args[2].([]interface{}); !ok {
+					set, _ := args[2].(string)
+					if cmd.knownUIDs, err = imap.ParseSeqSet(set); err != nil {
+						return err
+					}
+				}
+			}
+			// Sequence match data is an optimization for servers that
+			// do not keep UIDs of expunged messages so it is ignored.
+			cmd.qresync = true
+		default:
+			return errors.New("Unknown SELECT parameter")
+		}
+	}
+	return nil
+}
+
+func (cmd *selectCmd) Handle(conn imapserver.Conn) error {
+	c := cmd.ext.conn(conn)
+	_, qresync := c.enabled()
+	if cmd.qresync && !qresync {
+		return errors.New("QRESYNC is not enabled")
+	}
+	if cmd.condStore {
+		// The mailbox is not selected yet so HIGHESTMODSEQ is sent below.
+		c.lck.Lock()
+		c.condStore = true
+		c.lck.Unlock()
+	}
+
+	status := cmd.Select.Handle(conn)
+	if resp, ok := status.(*imap.ErrStatusResp); !ok || resp.Resp.Type != imap.StatusRespOk {
+		return status
+	}
+
+	mbox, ok := conn.Context().Mailbox.(CondStoreMailbox)
+	if !ok {
+		return status
+	}
+	modSeq, err := mbox.HighestModSeq()
+	if err != nil {
+		return err
+	}
+	if err := conn.WriteResp(highestModSeqResp(modSeq)); err != nil {
+		return err
+	}
+
+	if qresync {
+		if err := c.resetUIDs(mbox); err != nil {
+			return err
+		}
+	}
+	if cmd.qresync {
+		if err := cmd.resync(conn, mbox); err != nil {
+			return err
+		}
+	}
+	return status
+}
+
+// resync sends changes made since the modification sequence known to the
+// client.
+func (cmd *selectCmd) resync(conn imapserver.Conn, mbox CondStoreMailbox) error {
+	status, err := conn.Context().User.Status(mbox.Name(), []imap.StatusItem{imap.StatusUidValidity})
+	if err != nil {
+		return err
+	}
+	if status.UidValidity != cmd.uidValidity {
+		return nil
+	}
+
+	vanished, err := mbox.Vanished(cmd.knownUIDs, cmd.modSeq)
+	if err != nil {
+		return err
+	}
+	if !vanished.Empty() {
+		if err := conn.WriteResp(vanishedResp(true, vanished)); err != nil {
+			return err
+		}
+	}
+
+	modSeqs, err := mbox.ModSeqs(nil, cmd.modSeq)
+	if err != nil {
+		return err
+	}
+	changed := &imap.SeqSet{}
+	for uid := range modSeqs {
+		changed.AddNum(uid)
+	}
+	if changed.Empty() {
+		return nil
+	}
+	return fetchModSeqs(conn, mbox, changed, []imap.FetchItem{imap.FetchUid, imap.FetchFlags}, true, modSeqs)
+}
+
+// fetchModSeqs sends FETCH responses for messages with specified UIDs adding
+// MODSEQ items.
+func fetchModSeqs(conn imapserver.Conn, mbox backend.Mailbox, uids *imap.SeqSet, items []imap.FetchItem, withUID bool, modSeqs map[uint32]uint64) error {
+	in := make(chan *imap.Message)
+	out := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.WriteResp(&responses.Fetch{Messages: out})
+		// Make sure to drain the message channel.
+		for range out {
+		}
+	}()
+	go func() {
+		for msg := range in {
+			if modSeq, ok := modSeqs[msg.Uid]; ok {
+				setModSeq(msg, modSeq)
+			}
+			if !withUID {
+				delete(msg.Items, imap.FetchUid)
+			}
+			out <- msg
+		}
+		close(out)
+	}()
+
+	err := mbox.ListMessages(true, uids, items, in)
+	if writeErr := <-done; err == nil {
+		err = writeErr
+	}
+	return err
+}
+
+// fetchCmd implements FETCH with MODSEQ item and CHANGEDSINCE modifier.
+type fetchCmd struct {
+	imapserver.Fetch
+	ext *condStoreExtension
+
+	modSeq       bool
+	changedSince uint64
+	vanished     bool
+}
+
+func (cmd *fetchCmd) Parse(fields []interface{}) error {
+	if len(fields) > 3 {
+		return errors.New("Too many arguments")
+	}
+	if len(fields) == 3 {
+		mods, ok := fields[2].([]interface{})
+		if !ok {
+			return errors.New("FETCH modifiers must be a list")
+		}
+		for i := 0; i < len(mods); i++ {
+			name, _ := mods[i].(string)
+			switch strings.ToUpper(name) {
+			case "CHANGEDSINCE":
+				if i+1 >= len(mods) {
+					return errors.New("Missing CHANGEDSINCE value")
+				}
+				i++
+				var err error
+				if cmd.changedSince, err = parseModSeq(mods[i]); err != nil {
+					return err
+				}
+			case "VANISHED":
+				cmd.vanished = true
+			default:
+				return errors.New("Unknown FETCH modifier")
+			}
+		}
+		if cmd.vanished && cmd.changedSince == 0 {
+			return errors.New("VANISHED requires CHANGEDSINCE")
+		}
+		fields = fields[:2]
+	}
+	if err := cmd.Fetch.Parse(fields); err != nil {
+		return err
+	}
+
+	items := cmd.Items[:0]
+	for _, item := range cmd.Items {
+		if item == modSeqItem {
+			cmd.modSeq = true
+			continue
+		}
+		items = append(items, item)
+	}
+	cmd.Items = items
+	return nil
+}
+
+func (cmd *fetchCmd) Handle(conn imapserver.Conn) error {
+	return cmd.handle(false, conn)
+}
+
+func (cmd *fetchCmd) UidHandle(conn imapserver.Conn) error {
+	return cmd.handle(true, conn)
+}
+
+func (cmd *fetchCmd) handle(uid bool, conn imapserver.Conn) error {
+	c := cmd.ext.conn(conn)
+	if cmd.vanished {
+		if _, qresync := c.enabled(); !qresync || !uid {
+			return errors.New("VANISHED can be used only with UID FETCH and QRESYNC")
+		}
+	}
+	if cmd.modSeq || cmd.changedSince != 0 {
+		if err := c.enableCondStore(conn); err != nil {
+			return err
+		}
+	}
+
+	if conn.Context().Mailbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+	condStore, _ := c.enabled()
+	mbox, ok := conn.Context().Mailbox.(CondStoreMailbox)
+	if !ok || !condStore || !(cmd.modSeq || cmd.changedSince != 0 || hasItem(cmd.Items, imap.FetchFlags)) {
+		if cmd.modSeq || cmd.changedSince != 0 {
+			return errors.New("Modification sequences are not supported for the mailbox")
+		}
+		if uid {
+			return cmd.Fetch.UidHandle(conn)
+		}
+		return cmd.Fetch.Handle(conn)
+	}
+
+	refs, err := resolveSet(mbox, uid, cmd.SeqSet)
+	if err != nil {
+		return err
+	}
+	uids := &imap.SeqSet{}
+	for _, ref := range refs {
+		uids.AddNum(ref.uid)
+	}
+
+	if cmd.vanished {
+		vanished, err := mbox.Vanished(cmd.SeqSet, cmd.changedSince)
+		if err != nil {
+			return err
+		}
+		if !vanished.Empty() {
+			if err := conn.WriteResp(vanishedResp(true, vanished)); err != nil {
+				return err
+			}
+		}
+	}
+	if uids.Empty() {
+		return nil
+	}
+
+	modSeqs, err := mbox.ModSeqs(uids, cmd.changedSince)
+	if err != nil {
+		return err
+	}
+	if cmd.changedSince != 0 {
+		uids = &imap.SeqSet{}
+		for uid := range modSeqs {
+			uids.AddNum(uid)
+		}
+		if uids.Empty() {
+			return nil
+		}
+	}
+
+	items := cmd.Items
+	withUID := uid || hasItem(items, imap.FetchUid)
+	if !hasItem(items, imap.FetchUid) {
+		items = append(items, imap.FetchUid)
+	}
+	if err := fetchModSeqs(conn, mbox, uids, items, withUID, modSeqs); err != nil {
+		return err
+	}
+
+	if !setsSeen(items) || conn.Context().MailboxReadOnly {
+		return nil
+	}
+	// Setting \Seen changes modification sequences after they were sent,
+	// the client is informed about new values using separate responses.
+	updated, err := mbox.ModSeqs(uids, 0)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		modSeq, ok := updated[ref.uid]
+		if !ok || modSeq == modSeqs[ref.uid] {
+			continue
+		}
+		msg := imap.NewMessage(ref.seq, []imap.FetchItem{imap.FetchUid})
+		msg.Uid = ref.uid
+		setModSeq(msg, modSeq)
+		ch := make(chan *imap.Message, 1)
+		ch <- msg
+		close(ch)
+		if err := conn.WriteResp(&responses.Fetch{Messages: ch}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hasItem(items []imap.FetchItem, item imap.FetchItem) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
+// storeCmd implements STORE with UNCHANGEDSINCE modifier.
+type storeCmd struct {
+	imapserver.Store
+	ext *condStoreExtension
+
+	unchangedSince    uint64
+	hasUnchangedSince bool
+}
+
+func (cmd *storeCmd) Parse(fields []interface{}) error {
+	if len(fields) > 1 {
+		if mods, ok := fields[1].([]interface{}); ok {
+			if len(mods) != 2 {
+				return errors.New("Malformed STORE modifiers")
+			}
+			name, _ := mods[0].(string)
+			if !strings.EqualFold(name, "UNCHANGEDSINCE") {
+				return errors.New("Unknown STORE modifier")
+			}
+			var err error
+			if cmd.unchangedSince, err = parseModSeq(mods[1]); err != nil {
+				return err
+			}
+			cmd.hasUnchangedSince = true
+			fields = append([]interface{}{fields[0]}, fields[2:]...)
+		}
+	}
+	return cmd.Store.Parse(fields)
+}
+
+func (cmd *storeCmd) Handle(conn imapserver.Conn) error {
+	return cmd.handle(false, conn)
+}
+
+func (cmd *storeCmd) UidHandle(conn imapserver.Conn) error {
+	return cmd.handle(true, conn)
+}
+
+func (cmd *storeCmd) handle(uid bool, conn imapserver.Conn) error {
+	c := cmd.ext.conn(conn)
+	if cmd.hasUnchangedSince {
+		if err := c.enableCondStore(conn); err != nil {
+			return err
+		}
+	}
+
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+	condStore, _ := c.enabled()
+	mbox, ok := ctx.Mailbox.(CondStoreMailbox)
+	if !ok || !condStore {
+		if cmd.hasUnchangedSince {
+			return errors.New("Modification sequences are not supported for the mailbox")
+		}
+		if uid {
+			return cmd.Store.UidHandle(conn)
+		}
+		return cmd.Store.Handle(conn)
+	}
+	if ctx.MailboxReadOnly {
+		return imapserver.ErrMailboxReadOnly
+	}
+	_, silent, err := imap.ParseFlagsOp(cmd.Item)
+	if err != nil {
+		return err
+	}
+
+	refs, err := resolveSet(mbox, uid, cmd.SeqSet)
+	if err != nil {
+		return err
+	}
+	uids := &imap.SeqSet{}
+	for _, ref := range refs {
+		uids.AddNum(ref.uid)
+	}
+	if uids.Empty() {
+		return nil
+	}
+
+	// Messages changed between the check and the update are not detected,
+	// go-imap-sql has no way to make the update conditional.
+	var changed map[uint32]uint64
+	if cmd.hasUnchangedSince {
+		changed, err = mbox.ModSeqs(uids, cmd.unchangedSince)
+		if err != nil {
+			return err
+		}
+	}
+	// Sets use UIDs or sequence numbers depending on the command, the
+	// update of sequence numbers is not allowed to send EXPUNGE responses.
+	var (
+		passed, passedUIDs = &imap.SeqSet{}, &imap.SeqSet{}
+		modified           = &imap.SeqSet{}
+	)
+	for _, ref := range refs {
+		num := ref.seq
+		if uid {
+			num = ref.uid
+		}
+		if _, ok := changed[ref.uid]; ok {
+			modified.AddNum(num)
+			continue
+		}
+		passed.AddNum(num)
+		passedUIDs.AddNum(ref.uid)
+	}
+
+	if !passed.Empty() {
+		store := &imapserver.Store{Store: commands.Store{
+			SeqSet: passed,
+			Item:   cmd.Item,
+			Value:  cmd.Value,
+		}}
+		if uid {
+			err = store.UidHandle(conn)
+		} else {
+			err = store.Handle(conn)
+		}
+		if err != nil {
+			return err
+		}
+
+		// go-imap-sql does not report silent changes to the connection
+		// that made them, but new modification sequences are still
+		// needed.
+		if silent {
+			modSeqs, err := mbox.ModSeqs(passedUIDs, 0)
+			if err != nil {
+				return err
+			}
+			for _, ref := range refs {
+				modSeq, ok := modSeqs[ref.uid]
+				if !ok || !passedUIDs.Contains(ref.uid) {
+					continue
+				}
+				items := []imap.FetchItem{}
+				if uid {
+					items = append(items, imap.FetchUid)
+				}
+				msg := imap.NewMessage(ref.seq, items)
+				msg.Uid = ref.uid
+				setModSeq(msg, modSeq)
+				ch := make(chan *imap.Message, 1)
+				ch <- msg
+				close(ch)
+				if err := conn.WriteResp(&responses.Fetch{Messages: ch}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if !modified.Empty() {
+		return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+			Type:      imap.StatusRespOk,
+			Code:      "MODIFIED",
+			Arguments: []interface{}{imap.RawString(modified.String())},
+			Info:      "Conditional STORE failed",
+		}}
+	}
+	return nil
+}
+
+// searchCmd implements SEARCH with MODSEQ criteria. Only MODSEQ at the top
+// level of the search key is supported.
+type searchCmd struct {
+	imapserver.Search
+	ext *condStoreExtension
+
+	modSeq    uint64
+	hasModSeq bool
+}
+
+func (cmd *searchCmd) Parse(fields []interface{}) error {
+	res := make([]interface{}, 0, len(fields))
+	for i := 0; i < len(fields); i++ {
+		name, _ := fields[i].(string)
+		if !strings.EqualFold(name, "MODSEQ") {
+			res = append(res, fields[i])
+			continue
+		}
+		// MODSEQ [entry-name entry-type] value. Entries are not
+		// distinguished so the name and the type are skipped.
+		args := fields[i+1:]
+		if len(args) >= 3 {
+			if _, err := parseModSeq(args[0]); err != nil {
+				args = args[2:]
+				i += 2
+			}
+		}
+		if len(args) == 0 {
+			return errors.New("Missing MODSEQ value")
+		}
+		var err error
+		if cmd.modSeq, err = parseModSeq(args[0]); err != nil {
+			return err
+		}
+		cmd.hasModSeq = true
+		i++
+	}
+	if len(res) == 0 {
+		// Search for all messages.
+		res = append(res, "ALL")
+	}
+	return cmd.Search.Parse(res)
+}
+
+func (cmd *searchCmd) Handle(conn imapserver.Conn) error {
+	return cmd.handle(false, conn)
+}
+
+func (cmd *searchCmd) UidHandle(conn imapserver.Conn) error {
+	return cmd.handle(true, conn)
+}
+
+func (cmd *searchCmd) handle(uid bool, conn imapserver.Conn) error {
+	if !cmd.hasModSeq {
+		if uid {
+			return cmd.Search.UidHandle(conn)
+		}
+		return cmd.Search.Handle(conn)
+	}
+
+	if err := cmd.ext.conn(conn).enableCondStore(conn); err != nil {
+		return err
+	}
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+	mbox, ok := ctx.Mailbox.(CondStoreMailbox)
+	if !ok {
+		return errors.New("Modification sequences are not supported for the mailbox")
+	}
+
+	found, err := mbox.SearchMessages(true, cmd.Criteria)
+	if err != nil {
+		return err
+	}
+	uids := &imap.SeqSet{}
+	uids.AddNum(found...)
+
+	fields := []interface{}{imap.RawString("SEARCH")}
+	if !uids.Empty() {
+		var changedSince uint64
+		if cmd.modSeq > 0 {
+			changedSince = cmd.modSeq - 1
+		}
+		modSeqs, err := mbox.ModSeqs(uids, changedSince)
+		if err != nil {
+			return err
+		}
+
+		var highest uint64
+		matched := &imap.SeqSet{}
+		for uid, modSeq := range modSeqs {
+			matched.AddNum(uid)
+			if modSeq > highest {
+				highest = modSeq
+			}
+		}
+		if !matched.Empty() {
+			refs, err := resolveSet(mbox, true, matched)
+			if err != nil {
+				return err
+			}
+			for _, ref := range refs {
+				if uid {
+					fields = append(fields, ref.uid)
+				} else {
+					fields = append(fields, ref.seq)
+				}
+			}
+			fields = append(fields, []interface{}{imap.RawString("MODSEQ"), formatModSeq(highest)})
+		}
+	}
+	return conn.WriteResp(imap.NewUntaggedResp(fields))
+}
+
+// expungeCmd reports the new HIGHESTMODSEQ after EXPUNGE.
+type expungeCmd struct {
+	imapserver.Expunge
+	ext *condStoreExtension
+}
+
+func (cmd *expungeCmd) Handle(conn imapserver.Conn) error {
+	if err := cmd.Expunge.Handle(conn); err != nil {
+		return err
+	}
+	condStore, _ := cmd.ext.conn(conn).enabled()
+	mbox, ok := conn.Context().Mailbox.(CondStoreMailbox)
+	if !condStore || !ok {
+		return nil
+	}
+	modSeq, err := mbox.HighestModSeq()
+	if err != nil {
+		return err
+	}
+	resp := highestModSeqResp(modSeq)
+	resp.Info = "EXPUNGE completed"
+	return &imap.ErrStatusResp{Resp: resp}
+}
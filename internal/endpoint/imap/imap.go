@@ -26,6 +26,7 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/emersion/go-imap"
 	compress "github.com/emersion/go-imap-compress"
@@ -42,12 +43,14 @@ import (
 	tls2 "github.com/foxcpp/maddy/framework/config/tls"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/netresource"
 	"github.com/foxcpp/maddy/internal/auth"
 	"github.com/foxcpp/maddy/internal/authz"
 	"github.com/foxcpp/maddy/internal/updatepipe"
 )
 
 type Endpoint struct {
+	name      string
 	addrs     []string
 	serv      *imapserver.Server
 	listeners []net.Listener
@@ -68,10 +71,12 @@ type Endpoint struct {
 
 func New(modName string, addrs []string) (module.Module, error) {
 	endp := &Endpoint{
+		name:  modName,
 		addrs: addrs,
 		Log:   log.Logger{Name: modName},
 		saslAuth: auth.SASLAuth{
-			Log: log.Logger{Name: modName + "/sasl"},
+			Log:          log.Logger{Name: modName + "/sasl"},
+			EndpointName: modName,
 		},
 	}
 
@@ -88,6 +93,9 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 	cfg.Callback("auth", func(m *config.Map, node config.Node) error {
 		return endp.saslAuth.AddProvider(m, node)
 	})
+	cfg.Callback("auth_lockout", func(m *config.Map, node config.Node) error {
+		return endp.saslAuth.SetTracker(m, node)
+	})
 	cfg.Custom("storage", false, true, nil, modconfig.StorageDirective, &endp.Store)
 	cfg.Custom("tls", true, true, nil, tls2.TLSDirective, &endp.tlsConfig)
 	cfg.Bool("insecure_auth", false, false, &insecureAuth)
@@ -104,7 +112,7 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 		return err
 	}
 
-	if updBe, ok := endp.Store.(updatepipe.Backend); ok {
+	if updBe, ok := endp.Store.(updatepipe.Backend); ok && !module.NoRun {
 		if err := updBe.EnableUpdatePipe(updatepipe.ModeReplicate); err != nil {
 			endp.Log.Error("failed to initialize updates pipe", err)
 		}
@@ -119,6 +127,10 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 		addresses = append(addresses, saddr)
 	}
 
+	endp.tlsConfig = tls2.WithHandshakeHook(endp.tlsConfig, func(cs tls.ConnectionState) {
+		tlsConns.WithLabelValues(endp.name, tls2.VersionName(cs.Version), tls.CipherSuiteName(cs.CipherSuite)).Inc()
+	})
+
 	endp.serv = imapserver.New(endp)
 	endp.serv.AllowInsecureAuth = insecureAuth
 	endp.serv.TLSConfig = endp.tlsConfig
@@ -141,9 +153,9 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 	for _, mech := range endp.saslAuth.SASLMechanisms() {
 		mech := mech
 		endp.serv.EnableAuth(mech, func(c imapserver.Conn) sasl.Server {
-			return endp.saslAuth.CreateSASL(mech, c.Info().RemoteAddr, func(identity string) error {
+			return lockoutSASL{endp.saslAuth.CreateSASL(mech, c.Info().RemoteAddr, func(identity string) error {
 				return endp.openAccount(c, identity)
-			})
+			})}
 		})
 	}
 
@@ -152,18 +164,23 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 
 func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 	for _, addr := range addresses {
+		if addr.IsTLS() && endp.tlsConfig == nil {
+			return errors.New("imap: can't bind on IMAPS endpoint without TLS configuration")
+		}
+		if module.NoRun {
+			continue
+		}
+
 		var l net.Listener
 		var err error
-		l, err = net.Listen(addr.Network(), addr.Address())
+		l, err = netresource.Listen(addr.Network(), addr.Address())
 		if err != nil {
 			return fmt.Errorf("imap: %v", err)
 		}
 		endp.Log.Printf("listening on %v", addr)
 
+		l = tracedListener{l}
 		if addr.IsTLS() {
-			if endp.tlsConfig == nil {
-				return errors.New("imap: can't bind on IMAPS endpoint without TLS configuration")
-			}
 			l = tls.NewListener(l, endp.tlsConfig)
 		}
 
@@ -198,6 +215,32 @@ func (endp *Endpoint) InstanceName() string {
 	return "imap"
 }
 
+// Drain stops accepting new connections and waits for the existing ones to
+// be closed by clients.
+func (endp *Endpoint) Drain(ctx context.Context) error {
+	for _, l := range endp.listeners {
+		l.Close()
+	}
+
+	t := time.NewTicker(500 * time.Millisecond)
+	defer t.Stop()
+	for {
+		conns := 0
+		endp.serv.ForEachConn(func(imapserver.Conn) {
+			conns++
+		})
+		if conns == 0 {
+			return nil
+		}
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
 func (endp *Endpoint) Close() error {
 	for _, l := range endp.listeners {
 		l.Close()
@@ -275,11 +318,35 @@ func (endp *Endpoint) openAccount(c imapserver.Conn, identity string) error {
 	return nil
 }
 
+// errLockedOut is returned to clients instead of auth.ErrLockedOut.
+var errLockedOut = &imap.ErrStatusResp{Resp: &imap.StatusResp{
+	Type: imap.StatusRespNo,
+	Code: "UNAVAILABLE",
+	Info: "Temporary authentication failure, try again later",
+}}
+
+// lockoutSASL replaces the lockout error returned by SASL servers created by
+// auth.SASLAuth with the IMAP response used for LOGIN.
+type lockoutSASL struct {
+	sasl.Server
+}
+
+func (s lockoutSASL) Next(response []byte) ([]byte, bool, error) {
+	challenge, done, err := s.Server.Next(response)
+	if err == auth.ErrLockedOutResp {
+		return nil, false, errLockedOut
+	}
+	return challenge, done, err
+}
+
 func (endp *Endpoint) Login(connInfo *imap.ConnInfo, username, password string) (imapbackend.User, error) {
 	// saslAuth handles AuthMap calling.
-	err := endp.saslAuth.AuthPlain(username, password)
+	err := endp.saslAuth.AuthPlain(connInfo.RemoteAddr, username, password)
 	if err != nil {
 		endp.Log.Error("authentication failed", err, "username", username, "src_ip", connInfo.RemoteAddr)
+		if errors.Is(err, auth.ErrLockedOut) {
+			return nil, errLockedOut
+		}
 		return nil, imapbackend.ErrInvalidCredentials
 	}
 
@@ -311,6 +378,12 @@ func (endp *Endpoint) enableExtensions() error {
 			endp.serv.Enable(i18nlevel.NewExtension())
 		case "SORT":
 			endp.serv.Enable(sortthread.NewSortExtension())
+		case "ACL":
+			endp.serv.Enable(aclExtension{})
+		case "CONDSTORE":
+			endp.serv.Enable(&condStoreExtension{})
+		case "METADATA":
+			endp.serv.Enable(metadataExtension{})
 		}
 		if strings.HasPrefix(ext, "THREAD") {
 			endp.serv.Enable(sortthread.NewThreadExtension())
@@ -319,6 +392,7 @@ func (endp *Endpoint) enableExtensions() error {
 
 	endp.serv.Enable(compress.NewExtension())
 	endp.serv.Enable(namespace.NewExtension())
+	endp.serv.Enable(metricsExtension{module: endp.name})
 
 	return nil
 }
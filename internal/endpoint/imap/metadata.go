@@ -0,0 +1,271 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// MetadataUser is implemented by storage accounts supporting server and
+// mailbox annotations (RFC 5464). Empty mailbox name refers to server
+// annotations.
+type MetadataUser interface {
+	// GetMetadata returns existing entries matching the requested ones.
+	// Descendants of requested entries are returned up to depth levels
+	// below, -1 means any depth.
+	GetMetadata(mbox string, entries []string, depth int) (map[string]string, error)
+	// SetMetadata atomically changes values of entries. Entries with nil
+	// values are removed.
+	SetMetadata(mbox string, entries map[string]*string) error
+}
+
+// metadataValue returns the value in the form suitable for writing. Values
+// that cannot be sent as quoted strings are sent as literals.
+func metadataValue(value string) interface{} {
+	for i := 0; i < len(value); i++ {
+		if value[i] < 0x20 || value[i] >= 0x7f {
+			return imap.Literal(bytes.NewBufferString(value))
+		}
+	}
+	return value
+}
+
+type getMetadataCmd struct {
+	maxSize uint32
+	depth   int
+
+	mailbox string
+	entries []string
+}
+
+func (cmd *getMetadataCmd) Parse(fields []interface{}) error {
+	if len(fields) != 0 {
+		if opts, ok := fields[0].([]interface{}); ok {
+			if err := cmd.parseOptions(opts); err != nil {
+				return err
+			}
+			fields = fields[1:]
+		}
+	}
+	if len(fields) != 2 {
+		return errors.New("Wrong amount of arguments")
+	}
+
+	var err error
+	cmd.mailbox, err = parseMailboxName(fields[0])
+	if err != nil {
+		return err
+	}
+	if list, ok := fields[1].([]interface{}); ok {
+		cmd.entries, err = imap.ParseStringList(list)
+	} else {
+		var entry string
+		entry, err = imap.ParseString(fields[1])
+		cmd.entries = []string{entry}
+	}
+	if err != nil {
+		return err
+	}
+	if len(cmd.entries) == 0 {
+		return errors.New("No entries requested")
+	}
+	return nil
+}
+
+func (cmd *getMetadataCmd) parseOptions(opts []interface{}) error {
+	for i := 0; i < len(opts); i += 2 {
+		if i+1 >= len(opts) {
+			return errors.New("Missing GETMETADATA option value")
+		}
+		name, _ := opts[i].(string)
+		switch strings.ToUpper(name) {
+		case "MAXSIZE":
+			var err error
+			if cmd.maxSize, err = imap.ParseNumber(opts[i+1]); err != nil {
+				return err
+			}
+		case "DEPTH":
+			depth, _ := opts[i+1].(string)
+			switch strings.ToLower(depth) {
+			case "0":
+				cmd.depth = 0
+			case "1":
+				cmd.depth = 1
+			case "infinity":
+				cmd.depth = -1
+			default:
+				return errors.New("Malformed DEPTH value")
+			}
+		default:
+			return errors.New("Unknown GETMETADATA option")
+		}
+	}
+	return nil
+}
+
+func (cmd *getMetadataCmd) Handle(conn imapserver.Conn) error {
+	if conn.Context().User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+	u, ok := conn.Context().User.(MetadataUser)
+	if !ok {
+		return errors.New("METADATA is not supported")
+	}
+
+	values, err := u.GetMetadata(cmd.mailbox, cmd.entries, cmd.depth)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	// Requested entries that do not exist are reported with NIL values.
+	for _, entry := range cmd.entries {
+		entry = strings.ToLower(entry)
+		found := false
+		for name := range values {
+			if name == entry || strings.HasPrefix(name, entry+"/") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			names = append(names, entry)
+		}
+	}
+	sort.Strings(names)
+
+	var (
+		list        []interface{}
+		longEntries int
+	)
+	for _, name := range names {
+		value, ok := values[name]
+		if !ok {
+			list = append(list, name, nil)
+			continue
+		}
+		if cmd.maxSize != 0 && len(value) > int(cmd.maxSize) {
+			if len(value) > longEntries {
+				longEntries = len(value)
+			}
+			continue
+		}
+		list = append(list, name, metadataValue(value))
+	}
+
+	if len(list) != 0 {
+		err := conn.WriteResp(imap.NewUntaggedResp([]interface{}{
+			imap.RawString("METADATA"), formatMailboxName(cmd.mailbox), list,
+		}))
+		if err != nil {
+			return err
+		}
+	}
+	if longEntries != 0 {
+		return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+			Type:      imap.StatusRespOk,
+			Code:      "METADATA",
+			Arguments: []interface{}{imap.RawString("LONGENTRIES"), uint32(longEntries)},
+			Info:      "GETMETADATA completed",
+		}}
+	}
+	return nil
+}
+
+type setMetadataCmd struct {
+	mailbox string
+	entries map[string]*string
+}
+
+func (cmd *setMetadataCmd) Parse(fields []interface{}) error {
+	if len(fields) != 2 {
+		return errors.New("Wrong amount of arguments")
+	}
+
+	var err error
+	cmd.mailbox, err = parseMailboxName(fields[0])
+	if err != nil {
+		return err
+	}
+	list, ok := fields[1].([]interface{})
+	if !ok || len(list) == 0 || len(list)%2 != 0 {
+		return errors.New("Malformed SETMETADATA entries list")
+	}
+	cmd.entries = make(map[string]*string, len(list)/2)
+	for i := 0; i < len(list); i += 2 {
+		entry, err := imap.ParseString(list[i])
+		if err != nil {
+			return err
+		}
+		if list[i+1] == nil {
+			cmd.entries[entry] = nil
+			continue
+		}
+		value, err := imap.ParseString(list[i+1])
+		if err != nil {
+			return err
+		}
+		cmd.entries[entry] = &value
+	}
+	return nil
+}
+
+func (cmd *setMetadataCmd) Handle(conn imapserver.Conn) error {
+	if conn.Context().User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+	u, ok := conn.Context().User.(MetadataUser)
+	if !ok {
+		return errors.New("METADATA is not supported")
+	}
+	return u.SetMetadata(cmd.mailbox, cmd.entries)
+}
+
+// metadataExtension implements METADATA commands (RFC 5464).
+type metadataExtension struct{}
+
+func (ext metadataExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState == 0 {
+		return nil
+	}
+	return []string{"METADATA"}
+}
+
+func (ext metadataExtension) Command(name string) imapserver.HandlerFactory {
+	switch name {
+	case "GETMETADATA":
+		return func() imapserver.Handler {
+			return &getMetadataCmd{}
+		}
+	case "SETMETADATA":
+		return func() imapserver.Handler {
+			return &setMetadataCmd{}
+		}
+	}
+	return nil
+}
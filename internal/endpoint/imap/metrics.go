@@ -0,0 +1,137 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"sync"
+
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	sessions = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "maddy",
+			Subsystem: "imap",
+			Name:      "sessions",
+			Help:      "Amount of open IMAP sessions",
+		},
+		[]string{"module"},
+	)
+	idleSessions = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "maddy",
+			Subsystem: "imap",
+			Name:      "idle_sessions",
+			Help:      "Amount of IMAP sessions waiting for updates using the IDLE command",
+		},
+		[]string{"module"},
+	)
+	tlsConns = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "imap",
+			Name:      "tls_connections",
+			Help:      "Successful TLS handshakes (including STARTTLS) with specific protocol version and cipher suite",
+		},
+		[]string{"module", "version", "cipher"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(sessions)
+	prometheus.MustRegister(idleSessions)
+	prometheus.MustRegister(tlsConns)
+}
+
+// metricsExtension maintains sessions and idleSessions gauges.
+//
+// IDLE is a built-in command in go-imap and cannot be overridden by
+// extensions, so the wrapped connection detects it by looking at the
+// continuation request sent by the command handler and the following read
+// of the DONE line.
+type metricsExtension struct {
+	module string
+}
+
+type metricsConn struct {
+	imapserver.Conn
+	module string
+
+	lck    sync.Mutex
+	idle   bool
+	closed bool
+}
+
+func (ext metricsExtension) Capabilities(imapserver.Conn) []string {
+	return nil
+}
+
+func (ext metricsExtension) Command(string) imapserver.HandlerFactory {
+	return nil
+}
+
+func (ext metricsExtension) NewConn(c imapserver.Conn) imapserver.Conn {
+	sessions.WithLabelValues(ext.module).Inc()
+	return &metricsConn{Conn: c, module: ext.module}
+}
+
+func (c *metricsConn) setIdle(idle bool) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	if c.idle == idle || c.closed {
+		return
+	}
+	c.idle = idle
+	if idle {
+		idleSessions.WithLabelValues(c.module).Inc()
+	} else {
+		idleSessions.WithLabelValues(c.module).Dec()
+	}
+}
+
+func (c *metricsConn) WriteResp(res imap.WriterTo) error {
+	if cont, ok := res.(*imap.ContinuationReq); ok && cont.Info == "idling" {
+		c.setIdle(true)
+	}
+	return c.Conn.WriteResp(res)
+}
+
+func (c *metricsConn) Read(b []byte) (int, error) {
+	// The only direct reader of the connection is the IDLE handler
+	// waiting for DONE.
+	n, err := c.Conn.Read(b)
+	c.setIdle(false)
+	return n, err
+}
+
+func (c *metricsConn) Close() error {
+	c.setIdle(false)
+
+	c.lck.Lock()
+	if !c.closed {
+		c.closed = true
+		sessions.WithLabelValues(c.module).Dec()
+	}
+	c.lck.Unlock()
+
+	return c.Conn.Close()
+}
@@ -0,0 +1,61 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/foxcpp/maddy/framework/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracedListener creates a span for each accepted connection that ends
+// when the connection is closed.
+//
+// go-imap does not provide hooks for connection lifetime, so this is done
+// on the net.Listener level.
+type tracedListener struct {
+	net.Listener
+}
+
+type tracedConn struct {
+	net.Conn
+	span      trace.Span
+	closeOnce sync.Once
+}
+
+func (l tracedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	_, span := tracing.Start(context.Background(), "imap session",
+		attribute.String("client.address", conn.RemoteAddr().String()),
+	)
+	return &tracedConn{Conn: conn, span: span}, nil
+}
+
+func (c *tracedConn) Close() error {
+	c.closeOnce.Do(func() { c.span.End() })
+	return c.Conn.Close()
+}
@@ -19,6 +19,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package openmetrics
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
@@ -28,6 +29,7 @@ import (
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/netresource"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -68,7 +70,10 @@ func (e *Endpoint) Init(cfg *config.Map) error {
 		if endp.IsTLS() {
 			return fmt.Errorf("%s: TLS is not supported yet", modName)
 		}
-		l, err := net.Listen(endp.Network(), endp.Address())
+		if module.NoRun {
+			continue
+		}
+		l, err := netresource.Listen(endp.Network(), endp.Address())
 		if err != nil {
 			return fmt.Errorf("%s: %v", modName, err)
 		}
@@ -77,7 +82,7 @@ func (e *Endpoint) Init(cfg *config.Map) error {
 		go func() {
 			e.logger.Println("listening on", endp.String())
 			err := e.serv.Serve(l)
-			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			if err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
 				e.logger.Error("serve failed", err, "endpoint", a)
 			}
 			e.listenersWg.Done()
@@ -95,6 +100,12 @@ func (e *Endpoint) InstanceName() string {
 	return ""
 }
 
+// Drain stops accepting new connections and waits for the running requests
+// to complete.
+func (e *Endpoint) Drain(ctx context.Context) error {
+	return e.serv.Shutdown(ctx)
+}
+
 func (e *Endpoint) Close() error {
 	if err := e.serv.Close(); err != nil {
 		return err
@@ -58,23 +58,23 @@ var (
 		},
 		[]string{"module"},
 	)
-	failedLogins = prometheus.NewCounterVec(
+	failedCmds = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "maddy",
 			Subsystem: "smtp",
-			Name:      "failed_logins",
-			Help:      "AUTH command failures",
+			Name:      "failed_commands",
+			Help:      "Failed transaction commands (MAIL, RCPT, DATA)",
 		},
-		[]string{"module"},
+		[]string{"module", "command", "smtp_code", "smtp_enchcode"},
 	)
-	failedCmds = prometheus.NewCounterVec(
+	tlsConns = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "maddy",
 			Subsystem: "smtp",
-			Name:      "failed_commands",
-			Help:      "Failed transaction commands (MAIL, RCPT, DATA)",
+			Name:      "tls_connections",
+			Help:      "Successful TLS handshakes (including STARTTLS) with specific protocol version and cipher suite",
 		},
-		[]string{"module", "command", "smtp_code", "smtp_enchcode"},
+		[]string{"module", "version", "cipher"},
 	)
 )
 
@@ -84,4 +84,5 @@ func init() {
 	prometheus.MustRegister(abortedSMTPTransactions)
 	prometheus.MustRegister(ratelimitDefers)
 	prometheus.MustRegister(failedCmds)
+	prometheus.MustRegister(tlsConns)
 }
@@ -38,6 +38,10 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	oteltrace "go.opentelemetry.io/otel/trace"
 )
 
 func limitReader(r io.Reader, n int64, err error) *limitedReader {
@@ -74,6 +78,7 @@ type Session struct {
 	// Specific for this session.
 	// sessionCtx is not used for cancellation or timeouts, only for tracing.
 	sessionCtx       context.Context
+	sessionSpan      oteltrace.Span
 	cancelRDNS       func()
 	connState        module.ConnState
 	repeatedMailErrs int
@@ -87,6 +92,7 @@ type Session struct {
 	msgLock     sync.Mutex
 	msgCtx      context.Context
 	msgTask     *trace.Task
+	msgSpan     oteltrace.Span
 	mailFrom    string
 	opts        smtp.MailOptions
 	msgMeta     *module.MsgMetadata
@@ -128,6 +134,7 @@ func (s *Session) abort(ctx context.Context) {
 		s.endp.Log.Error("delivery abort failed", err)
 	}
 	s.log.Msg("aborted", "msg_id", s.msgMeta.ID)
+	s.msgSpan.SetStatus(codes.Error, "aborted")
 	abortedSMTPTransactions.WithLabelValues(s.endp.name).Inc()
 	s.cleanSession()
 }
@@ -142,6 +149,7 @@ func (s *Session) cleanSession() {
 	s.deliveryErr = nil
 	s.msgCtx = nil
 	s.msgTask.End()
+	s.msgSpan.End()
 }
 
 func (s *Session) AuthPlain(username, password string) error {
@@ -155,12 +163,10 @@ func (s *Session) AuthPlain(username, password string) error {
 	}
 
 	// saslAuth will handle AuthMap and AuthNormalize.
-	err := s.endp.saslAuth.AuthPlain(username, password)
+	err := s.endp.saslAuth.AuthPlain(s.connState.RemoteAddr, username, password)
 	if err != nil {
 		s.endp.Log.Error("authentication failed", err, "username", username, "src_ip", s.connState.RemoteAddr)
 
-		failedLogins.WithLabelValues(s.endp.name).Inc()
-
 		if exterrors.IsTemporary(err) {
 			return &smtp.SMTPError{
 				Code:         454,
@@ -255,6 +261,10 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 	}
 
 	s.msgCtx, s.msgTask = trace.NewTask(ctx, "Incoming Message")
+	s.msgCtx, s.msgSpan = tracing.Start(s.msgCtx, s.endp.name+" transaction",
+		attribute.String("maddy.msg_id", msgMeta.ID),
+	)
+	msgMeta.TraceParent = tracing.TraceParent(s.msgCtx)
 
 	mailCtx, mailTask := trace.NewTask(s.msgCtx, "MAIL FROM")
 	defer mailTask.End()
@@ -263,6 +273,7 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 	if err != nil {
 		s.msgCtx = nil
 		s.msgTask.End()
+		tracing.End(s.msgSpan, err)
 		s.endp.limits.ReleaseMsg(remoteIP.IP, domain)
 		return msgMeta.ID, err
 	}
@@ -415,6 +426,7 @@ func (s *Session) Logout() error {
 	}
 
 	s.endp.sessionCnt.Add(-1)
+	s.sessionSpan.End()
 
 	return nil
 }
@@ -459,6 +471,7 @@ func (s *Session) Data(r io.Reader) error {
 
 	wrapErr := func(err error) error {
 		s.log.Error("DATA error", err, "msg_id", s.msgMeta.ID)
+		tracing.RecordError(s.msgSpan, err)
 		return s.endp.wrapErr(s.msgMeta.ID, !s.opts.UTF8, "DATA", err)
 	}
 
@@ -491,7 +504,7 @@ func (s *Session) Data(r io.Reader) error {
 		return wrapErr(err)
 	}
 
-	s.log.Msg("accepted", "msg_id", s.msgMeta.ID)
+	s.log.Msg("accepted", "msg_id", s.msgMeta.ID, "message_id", header.Get("Message-Id"))
 
 	return nil
 }
@@ -514,6 +527,7 @@ func (s *Session) LMTPData(r io.Reader, sc smtp.StatusCollector) error {
 
 	wrapErr := func(err error) error {
 		s.log.Error("DATA error", err, "msg_id", s.msgMeta.ID)
+		tracing.RecordError(s.msgSpan, err)
 		return s.endp.wrapErr(s.msgMeta.ID, !s.opts.UTF8, "DATA", err)
 	}
 
@@ -546,7 +560,7 @@ func (s *Session) LMTPData(r io.Reader, sc smtp.StatusCollector) error {
 		return wrapErr(err)
 	}
 
-	s.log.Msg("accepted", "msg_id", s.msgMeta.ID)
+	s.log.Msg("accepted", "msg_id", s.msgMeta.ID, "message_id", header.Get("Message-Id"))
 
 	return nil
 }
@@ -22,6 +22,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
@@ -43,10 +44,13 @@ import (
 	"github.com/foxcpp/maddy/framework/future"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/netresource"
+	"github.com/foxcpp/maddy/framework/tracing"
 	"github.com/foxcpp/maddy/internal/auth"
 	"github.com/foxcpp/maddy/internal/authz"
 	"github.com/foxcpp/maddy/internal/limits"
 	"github.com/foxcpp/maddy/internal/msgpipeline"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/net/idna"
 )
 
@@ -98,7 +102,8 @@ func New(modName string, addrs []string) (module.Module, error) {
 		buffer:     buffer.BufferInMemory,
 		Log:        log.Logger{Name: modName},
 		saslAuth: auth.SASLAuth{
-			Log: log.Logger{Name: modName + "/sasl"},
+			Log:          log.Logger{Name: modName + "/sasl"},
+			EndpointName: modName,
 		},
 	}
 	return endp, nil
@@ -184,6 +189,15 @@ func autoBufferMode(maxSize int, dir string) func(io.Reader) (buffer.Buffer, err
 	}
 }
 
+// ensureBufferDir creates the directory used to spill message bodies to the
+// disk. It is no-op in dry-run mode.
+func ensureBufferDir(path string) error {
+	if module.DryRun {
+		return nil
+	}
+	return os.MkdirAll(path, 0o700)
+}
+
 func bufferModeDirective(_ *config.Map, node config.Node) (interface{}, error) {
 	if len(node.Args) < 1 {
 		return nil, config.NodeErr(node, "at least one argument required")
@@ -196,7 +210,7 @@ func bufferModeDirective(_ *config.Map, node config.Node) (interface{}, error) {
 		return buffer.BufferInMemory, nil
 	case "fs":
 		path := filepath.Join(config.StateDirectory, "buffer")
-		if err := os.MkdirAll(path, 0o700); err != nil {
+		if err := ensureBufferDir(path); err != nil {
 			return nil, err
 		}
 		switch len(node.Args) {
@@ -212,7 +226,7 @@ func bufferModeDirective(_ *config.Map, node config.Node) (interface{}, error) {
 		}
 	case "auto":
 		path := filepath.Join(config.StateDirectory, "buffer")
-		if err := os.MkdirAll(path, 0o700); err != nil {
+		if err := ensureBufferDir(path); err != nil {
 			return nil, err
 		}
 
@@ -248,6 +262,9 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 	cfg.Callback("auth", func(m *config.Map, node config.Node) error {
 		return endp.saslAuth.AddProvider(m, node)
 	})
+	cfg.Callback("auth_lockout", func(m *config.Map, node config.Node) error {
+		return endp.saslAuth.SetTracker(m, node)
+	})
 	cfg.String("hostname", true, true, "", &hostname)
 	config.EnumMapped(cfg, "auth_map_normalize", true, false, authz.NormalizeFuncs, authz.NormalizeAuto,
 		&endp.authNormalize)
@@ -260,7 +277,7 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 	cfg.Int("max_received", false, false, 50, &endp.maxReceived)
 	cfg.Custom("buffer", false, false, func() (interface{}, error) {
 		path := filepath.Join(config.StateDirectory, "buffer")
-		if err := os.MkdirAll(path, 0o700); err != nil {
+		if err := ensureBufferDir(path); err != nil {
 			return nil, err
 		}
 		return autoBufferMode(1*1024*1024 /* 1 MiB */, path), nil
@@ -287,6 +304,10 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 		return err
 	}
 
+	endp.serv.TLSConfig = tls2.WithHandshakeHook(endp.serv.TLSConfig, func(cs tls.ConnectionState) {
+		tlsConns.WithLabelValues(endp.name, tls2.VersionName(cs.Version), tls.CipherSuiteName(cs.CipherSuite)).Inc()
+	})
+
 	// INTERNATIONALIZATION: See RFC 6531 Section 3.3.
 	endp.serv.Domain, err = idna.ToASCII(hostname)
 	if err != nil {
@@ -340,16 +361,20 @@ func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 	for _, addr := range addresses {
 		var l net.Listener
 		var err error
-		l, err = net.Listen(addr.Network(), addr.Address())
+		if addr.IsTLS() && endp.serv.TLSConfig == nil {
+			return fmt.Errorf("%s: can't bind on SMTPS endpoint without TLS configuration", endp.name)
+		}
+		if module.NoRun {
+			continue
+		}
+
+		l, err = netresource.Listen(addr.Network(), addr.Address())
 		if err != nil {
 			return fmt.Errorf("%s: %w", endp.name, err)
 		}
 		endp.Log.Printf("listening on %v", addr)
 
 		if addr.IsTLS() {
-			if endp.serv.TLSConfig == nil {
-				return fmt.Errorf("%s: can't bind on SMTPS endpoint without TLS configuration", endp.name)
-			}
 			l = tls.NewListener(l, endp.serv.TLSConfig)
 		}
 
@@ -358,7 +383,7 @@ func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 		endp.listenersWg.Add(1)
 		addr := addr
 		go func() {
-			if err := endp.serv.Serve(l); err != nil {
+			if err := endp.serv.Serve(l); err != nil && !errors.Is(err, net.ErrClosed) {
 				endp.Log.Printf("failed to serve %s: %s", addr, err)
 			}
 			endp.listenersWg.Done()
@@ -411,10 +436,10 @@ func (endp *Endpoint) NewSession(conn *smtp.Conn) (smtp.Session, error) {
 
 func (endp *Endpoint) newSession(conn *smtp.Conn) *Session {
 	s := &Session{
-		endp:       endp,
-		log:        endp.Log,
-		sessionCtx: context.Background(),
+		endp: endp,
+		log:  endp.Log,
 	}
+	s.sessionCtx, s.sessionSpan = tracing.Start(context.Background(), endp.name+" session")
 
 	// Used in tests.
 	if conn == nil {
@@ -442,6 +467,11 @@ func (endp *Endpoint) newSession(conn *smtp.Conn) *Session {
 		}
 	}
 
+	s.sessionSpan.SetAttributes(
+		attribute.String("client.address", s.connState.RemoteAddr.String()),
+		attribute.String("maddy.proto", s.connState.Proto),
+	)
+
 	if endp.resolver != nil {
 		rdnsCtx, cancelRDNS := context.WithCancel(s.sessionCtx)
 		s.connState.RDNSName = future.New()
@@ -456,6 +486,19 @@ func (endp *Endpoint) ConnectionCount() int {
 	return int(endp.sessionCnt.Load())
 }
 
+// Pipeline returns the message pipeline used by the endpoint for received
+// messages.
+func (endp *Endpoint) Pipeline() *msgpipeline.MsgPipeline {
+	return endp.pipeline
+}
+
+// Drain stops accepting new connections and waits for the existing ones to
+// finish. Connections that are still open when ctx expires are not closed by
+// Close, they are subject to the usual I/O timeouts instead.
+func (endp *Endpoint) Drain(ctx context.Context) error {
+	return endp.serv.Shutdown(ctx)
+}
+
 func (endp *Endpoint) Close() error {
 	endp.serv.Close()
 	endp.listenersWg.Wait()
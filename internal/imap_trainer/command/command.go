@@ -0,0 +1,137 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package command
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const modName = "imap.trainer.command"
+
+var placeholderRe = regexp.MustCompile(`{[a-zA-Z0-9_]+?}`)
+
+type Trainer struct {
+	instName string
+	log      log.Logger
+
+	cmd     string
+	cmdArgs []string
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	t := &Trainer{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}
+
+	if len(inlineArgs) == 0 {
+		return nil, errors.New("command: at least one argument is required (command name)")
+	}
+
+	t.cmd = inlineArgs[0]
+	t.cmdArgs = inlineArgs[1:]
+
+	return t, nil
+}
+
+func (t *Trainer) Name() string {
+	return modName
+}
+
+func (t *Trainer) InstanceName() string {
+	return t.instName
+}
+
+func (t *Trainer) Init(cfg *config.Map) error {
+	// Check whether the inline argument command is usable.
+	if _, err := exec.LookPath(t.cmd); err != nil {
+		return fmt.Errorf("command: %w", err)
+	}
+
+	_, err := cfg.Process()
+	return err
+}
+
+func (t *Trainer) expandCommand(accountName string, spam bool, hdr textproto.Header) (string, []string) {
+	expArgs := make([]string, len(t.cmdArgs))
+
+	for i, arg := range t.cmdArgs {
+		expArgs[i] = placeholderRe.ReplaceAllStringFunc(arg, func(placeholder string) string {
+			switch placeholder {
+			case "{account_name}":
+				return accountName
+			case "{action}":
+				if spam {
+					return "spam"
+				}
+				return "ham"
+			case "{message_id}":
+				return strings.TrimSpace(hdr.Get("Message-Id"))
+			case "{subject}":
+				return hdr.Get("Subject")
+			}
+			return placeholder
+		})
+	}
+
+	return t.cmd, expArgs
+}
+
+func (t *Trainer) Train(ctx context.Context, accountName string, spam bool, hdr textproto.Header, body buffer.Buffer) error {
+	cmdName, args := t.expandCommand(accountName, spam, hdr)
+
+	var buf bytes.Buffer
+	_ = textproto.WriteHeader(&buf, hdr)
+	bR, err := body.Open()
+	if err != nil {
+		return err
+	}
+	defer bR.Close()
+
+	t.log.Debugln("running", cmdName, args)
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, cmdName, args...)
+	cmd.Stdin = io.MultiReader(bytes.NewReader(buf.Bytes()), bR)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if stderr.Len() != 0 {
+			return fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return err
+	}
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,93 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package command
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testTrainer(t *testing.T, args ...string) *Trainer {
+	return &Trainer{
+		log:     testutils.Logger(t, modName),
+		cmd:     "/bin/sh",
+		cmdArgs: append([]string{"-c"}, args...),
+	}
+}
+
+func TestTrain(t *testing.T) {
+	dir := testutils.Dir(t)
+	defer os.RemoveAll(dir)
+
+	tr := testTrainer(t, `cat > "$0/msg" && echo "$1 $2 $3 $4" > "$0/args"`, dir,
+		"{action}", "{account_name}", "{message_id}", "{subject}")
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Buy")
+	hdr.Add("Message-Id", "<1@example.org>")
+
+	err := tr.Train(context.Background(), "test@example.org", true, hdr, buffer.MemoryBuffer{Slice: []byte("Cheap!\r\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := os.ReadFile(filepath.Join(dir, "msg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "Message-Id: <1@example.org>\r\nSubject: Buy\r\n\r\nCheap!\r\n" {
+		t.Errorf("Wrong message: %q", msg)
+	}
+	args, err := os.ReadFile(filepath.Join(dir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(args) != "spam test@example.org <1@example.org> Buy\n" {
+		t.Errorf("Wrong command arguments: %q", args)
+	}
+
+	err = tr.Train(context.Background(), "test@example.org", false, hdr, buffer.MemoryBuffer{Slice: []byte("Cheap!\r\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args, err = os.ReadFile(filepath.Join(dir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(args), "ham ") {
+		t.Errorf("Wrong command arguments: %q", args)
+	}
+}
+
+func TestTrain_Failure(t *testing.T) {
+	tr := testTrainer(t, `cat > /dev/null; echo "not learned" >&2; exit 1`)
+
+	err := tr.Train(context.Background(), "test@example.org", true, textproto.Header{}, buffer.MemoryBuffer{Slice: []byte("Cheap!\r\n")})
+	if err == nil {
+		t.Fatal("Expected an error for non-zero exit code")
+	}
+	if !strings.Contains(err.Error(), "not learned") {
+		t.Errorf("Error does not contain the command output: %v", err)
+	}
+}
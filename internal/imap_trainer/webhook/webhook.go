@@ -0,0 +1,171 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package webhook implements imap.trainer.webhook module that sends
+// messages marked as spam or ham by users to an HTTP endpoint.
+//
+// Interfaces implemented:
+// - module.SpamTrainer
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	tls2 "github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const modName = "imap.trainer.webhook"
+
+type Trainer struct {
+	instName string
+	log      log.Logger
+
+	endpoint string
+	headers  http.Header
+	client   *http.Client
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	t := &Trainer{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+		headers:  http.Header{},
+	}
+
+	switch len(inlineArgs) {
+	case 0:
+	case 1:
+		t.endpoint = inlineArgs[0]
+	default:
+		return nil, fmt.Errorf("%s: at most one argument is expected (endpoint URL)", modName)
+	}
+
+	return t, nil
+}
+
+func (t *Trainer) Init(cfg *config.Map) error {
+	var (
+		timeout   time.Duration
+		tlsConfig tls.Config
+	)
+	cfg.Bool("debug", true, false, &t.log.Debug)
+	cfg.String("endpoint", false, false, t.endpoint, &t.endpoint)
+	cfg.Duration("timeout", false, false, 1*time.Minute, &timeout)
+	cfg.Callback("header", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) != 2 {
+			return config.NodeErr(node, "exactly two arguments are required: <name> <value>")
+		}
+		t.headers.Add(node.Args[0], node.Args[1])
+		return nil
+	})
+	cfg.Custom("tls_client", true, false, func() (interface{}, error) {
+		return tls.Config{}, nil
+	}, tls2.TLSClientBlock, &tlsConfig)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if t.endpoint == "" {
+		return fmt.Errorf("%s: endpoint URL is required", modName)
+	}
+	endpURL, err := url.Parse(t.endpoint)
+	if err != nil {
+		return fmt.Errorf("%s: malformed endpoint URL: %w", modName, err)
+	}
+	if endpURL.Scheme != "http" && endpURL.Scheme != "https" {
+		return fmt.Errorf("%s: endpoint should be a http:// or https:// URL", modName)
+	}
+
+	t.client = &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tlsConfig,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return nil
+}
+
+func (t *Trainer) Name() string {
+	return modName
+}
+
+func (t *Trainer) InstanceName() string {
+	return t.instName
+}
+
+func (t *Trainer) Train(ctx context.Context, accountName string, spam bool, hdr textproto.Header, body buffer.Buffer) error {
+	var buf bytes.Buffer
+	if err := textproto.WriteHeader(&buf, hdr); err != nil {
+		return err
+	}
+	bodyR, err := body.Open()
+	if err != nil {
+		return err
+	}
+	defer bodyR.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, io.MultiReader(&buf, bodyR))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(buf.Len() + body.Len())
+	for k, v := range t.headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "message/rfc822")
+	req.Header.Set("X-Maddy-Account", accountName)
+	if spam {
+		req.Header.Set("X-Maddy-Training", "spam")
+	} else {
+		req.Header.Set("X-Maddy-Training", "ham")
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: HTTP %d", modName, resp.StatusCode)
+	}
+	t.log.DebugMsg("message submitted", "account", accountName, "spam", spam)
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,85 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package webhook
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestTrain(t *testing.T) {
+	var (
+		header http.Header
+		body   []byte
+		status = http.StatusNoContent
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		body, err = io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		header = r.Header
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	tr := &Trainer{
+		log:      testutils.Logger(t, modName),
+		endpoint: srv.URL,
+		headers:  http.Header{"Authorization": []string{"Bearer secret"}},
+		client:   http.DefaultClient,
+	}
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Buy now")
+
+	err := tr.Train(context.Background(), "test@example.org", true, hdr, buffer.MemoryBuffer{Slice: []byte("Cheap!\r\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "Subject: Buy now\r\n\r\nCheap!\r\n" {
+		t.Errorf("Wrong body: %q", body)
+	}
+	for name, expected := range map[string]string{
+		"Content-Type":     "message/rfc822",
+		"Authorization":    "Bearer secret",
+		"X-Maddy-Account":  "test@example.org",
+		"X-Maddy-Training": "spam",
+	} {
+		if v := header.Get(name); v != expected {
+			t.Errorf("Wrong %s: %v", name, v)
+		}
+	}
+
+	status = http.StatusInternalServerError
+	err = tr.Train(context.Background(), "test@example.org", false, hdr, buffer.MemoryBuffer{Slice: []byte("Cheap!\r\n")})
+	if err == nil {
+		t.Error("Expected an error for HTTP 500")
+	}
+	if v := header.Get("X-Maddy-Training"); v != "ham" {
+		t.Errorf("Wrong X-Maddy-Training: %v", v)
+	}
+}
@@ -0,0 +1,201 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package mailarchive
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Each mailbox is stored in a directory (Parent/Child for nested mailboxes)
+// with messages saved as NNNNNN.eml files. Flags and internal dates are
+// stored in the index.jsonl file in the same directory. Files not listed in
+// the index are imported without flags, using the modification time as the
+// internal date.
+
+const (
+	emlExt       = ".eml"
+	emlIndexFile = "index.jsonl"
+)
+
+type emlIndexEntry struct {
+	File  string    `json:"file"`
+	Flags []string  `json:"flags"`
+	Date  time.Time `json:"date"`
+}
+
+type emlReader struct {
+	root string
+}
+
+func (r *emlReader) Mailboxes() ([]Mailbox, error) {
+	var mboxes []Mailbox
+	err := filepath.WalkDir(r.root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || path == r.root {
+			return nil
+		}
+		rel, err := filepath.Rel(r.root, path)
+		if err != nil {
+			return err
+		}
+		mboxes = append(mboxes, Mailbox{Path: strings.Split(rel, string(filepath.Separator))})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return applyMetadata(r.root, mboxes)
+}
+
+func readEMLIndex(dir string) (map[string]emlIndexEntry, error) {
+	index := make(map[string]emlIndexEntry)
+	f, err := os.Open(filepath.Join(dir, emlIndexFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return index, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	scnr := bufio.NewScanner(f)
+	for scnr.Scan() {
+		if strings.TrimSpace(scnr.Text()) == "" {
+			continue
+		}
+		var entry emlIndexEntry
+		if err := json.Unmarshal(scnr.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("mailarchive: malformed %s: %w", filepath.Join(dir, emlIndexFile), err)
+		}
+		index[entry.File] = entry
+	}
+	return index, scnr.Err()
+}
+
+func (r *emlReader) Messages(path []string, fn func(Message) error) error {
+	rel, err := fsPath(path)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(r.root, rel)
+
+	index, err := readEMLIndex(dir)
+	if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasSuffix(entry.Name(), emlExt) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		body, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		msg := Message{Flags: []string{}, Body: toCRLF(body)}
+		if entry, ok := index[name]; ok {
+			if entry.Flags != nil {
+				msg.Flags = entry.Flags
+			}
+			msg.Date = entry.Date
+		} else {
+			info, err := os.Stat(filepath.Join(dir, name))
+			if err != nil {
+				return err
+			}
+			msg.Date = info.ModTime()
+		}
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type emlWriter struct {
+	metaWriter
+	counters map[string]int
+}
+
+func (w *emlWriter) CreateMailbox(mbox Mailbox) error {
+	rel, err := fsPath(mbox.Path)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(w.root, rel), 0o700); err != nil {
+		return err
+	}
+	w.addMailbox(mbox)
+	return nil
+}
+
+func (w *emlWriter) AppendMessage(path []string, msg Message) error {
+	rel, err := fsPath(path)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(w.root, rel)
+
+	key := pathKey(path)
+	w.counters[key]++
+	name := fmt.Sprintf("%06d%s", w.counters[key], emlExt)
+
+	if err := os.WriteFile(filepath.Join(dir, name), msg.Body, 0o600); err != nil {
+		return err
+	}
+	if err := os.Chtimes(filepath.Join(dir, name), time.Now(), msg.Date); err != nil {
+		return err
+	}
+
+	entry, err := json.Marshal(emlIndexEntry{File: name, Flags: msg.Flags, Date: msg.Date})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, emlIndexFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(entry, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (w *emlWriter) Close() error {
+	return w.close()
+}
@@ -0,0 +1,276 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package mailarchive implements reading and writing of mailboxes in formats
+// commonly used to move mail between servers: Maildir, mbox and directories
+// of .eml files.
+//
+// Formats differ in what metadata they can represent natively. Mailbox
+// attributes that have no native representation (SPECIAL-USE and
+// subscription state) are kept in a maddy-mailboxes.json file at the root of
+// the archive. If that file is missing (e.g. the archive was produced by
+// another server), SPECIAL-USE attributes are guessed from common folder
+// names.
+package mailarchive
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// Mailbox describes a mailbox stored in the archive.
+type Mailbox struct {
+	// Path is the mailbox name split into hierarchy components.
+	Path       []string `json:"path"`
+	SpecialUse string   `json:"special_use,omitempty"`
+	Subscribed bool     `json:"subscribed"`
+}
+
+// Message is a single message stored in the archive.
+type Message struct {
+	Flags []string
+	Date  time.Time
+	// Body is the full message with CRLF line endings.
+	Body []byte
+}
+
+type Reader interface {
+	// Mailboxes returns the list of mailboxes in the archive. Parent
+	// mailboxes are listed before their children.
+	Mailboxes() ([]Mailbox, error)
+
+	// Messages calls fn for each message stored in the mailbox in the order
+	// they were added.
+	Messages(path []string, fn func(Message) error) error
+}
+
+type Writer interface {
+	// CreateMailbox should be called for each mailbox before messages
+	// are added to it.
+	CreateMailbox(mbox Mailbox) error
+	AppendMessage(path []string, msg Message) error
+	// Close flushes archive metadata to disk.
+	Close() error
+}
+
+var Formats = []string{"maildir", "mbox", "eml-dir"}
+
+// Open opens an existing archive for reading.
+func Open(format, root string) (Reader, error) {
+	if _, err := os.Stat(root); err != nil {
+		return nil, err
+	}
+	switch format {
+	case "maildir":
+		return &maildirReader{root: root}, nil
+	case "mbox":
+		return &mboxReader{root: root}, nil
+	case "eml-dir":
+		return &emlReader{root: root}, nil
+	default:
+		return nil, fmt.Errorf("mailarchive: unknown format: %s", format)
+	}
+}
+
+// Create creates a new archive. root should be either non-existent or an
+// empty directory.
+func Create(format, root string) (Writer, error) {
+	switch format {
+	case "maildir", "mbox", "eml-dir":
+	default:
+		return nil, fmt.Errorf("mailarchive: unknown format: %s", format)
+	}
+
+	f, err := os.Open(root)
+	if err == nil {
+		_, err = f.Readdirnames(1)
+		f.Close()
+		if err == nil {
+			return nil, fmt.Errorf("mailarchive: %s is not empty", root)
+		}
+		if !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return nil, err
+	}
+
+	meta := metaWriter{root: root}
+	switch format {
+	case "maildir":
+		return &maildirWriter{metaWriter: meta, keywords: map[string][]string{}}, nil
+	case "mbox":
+		return &mboxWriter{metaWriter: meta, files: map[string]*os.File{}}, nil
+	default:
+		return &emlWriter{metaWriter: meta, counters: map[string]int{}}, nil
+	}
+}
+
+const metadataFile = "maddy-mailboxes.json"
+
+func pathKey(path []string) string {
+	return strings.Join(path, "\x00")
+}
+
+func isInbox(path []string) bool {
+	return len(path) == 1 && strings.EqualFold(path[0], "INBOX")
+}
+
+var specialUseNames = map[string]string{
+	"archive":       imap.ArchiveAttr,
+	"archives":      imap.ArchiveAttr,
+	"drafts":        imap.DraftsAttr,
+	"junk":          imap.JunkAttr,
+	"spam":          imap.JunkAttr,
+	"junk e-mail":   imap.JunkAttr,
+	"sent":          imap.SentAttr,
+	"sent items":    imap.SentAttr,
+	"sent messages": imap.SentAttr,
+	"sent mail":     imap.SentAttr,
+	"trash":         imap.TrashAttr,
+	"deleted items": imap.TrashAttr,
+	"deleted":       imap.TrashAttr,
+}
+
+func guessSpecialUse(path []string) string {
+	if len(path) != 1 {
+		return ""
+	}
+	return specialUseNames[strings.ToLower(path[0])]
+}
+
+// applyMetadata sorts mailboxes and fills attributes using the metadata file,
+// if any.
+func applyMetadata(root string, mboxes []Mailbox) ([]Mailbox, error) {
+	sort.Slice(mboxes, func(i, j int) bool {
+		if isInbox(mboxes[i].Path) != isInbox(mboxes[j].Path) {
+			return isInbox(mboxes[i].Path)
+		}
+		return pathKey(mboxes[i].Path) < pathKey(mboxes[j].Path)
+	})
+
+	var meta []Mailbox
+	blob, err := os.ReadFile(filepath.Join(root, metadataFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		for i := range mboxes {
+			mboxes[i].SpecialUse = guessSpecialUse(mboxes[i].Path)
+			mboxes[i].Subscribed = true
+		}
+		return mboxes, nil
+	}
+	if err := json.Unmarshal(blob, &meta); err != nil {
+		return nil, fmt.Errorf("mailarchive: malformed %s: %w", metadataFile, err)
+	}
+
+	byPath := make(map[string]Mailbox, len(meta))
+	for _, m := range meta {
+		byPath[pathKey(m.Path)] = m
+	}
+	for i := range mboxes {
+		if m, ok := byPath[pathKey(mboxes[i].Path)]; ok {
+			mboxes[i].SpecialUse = m.SpecialUse
+			mboxes[i].Subscribed = m.Subscribed
+		}
+	}
+	return mboxes, nil
+}
+
+type metaWriter struct {
+	root   string
+	mboxes []Mailbox
+}
+
+func (w *metaWriter) addMailbox(mbox Mailbox) {
+	w.mboxes = append(w.mboxes, mbox)
+}
+
+func (w *metaWriter) close() error {
+	blob, err := json.MarshalIndent(w.mboxes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(w.root, metadataFile), blob, 0o600)
+}
+
+// fsPath converts the mailbox path into a file system path relative to the
+// archive root.
+func fsPath(path []string) (string, error) {
+	for _, comp := range path {
+		if comp == "" || comp == "." || comp == ".." || strings.ContainsAny(comp, `/\`) {
+			return "", fmt.Errorf("mailarchive: mailbox name cannot be stored in the file system: %q", strings.Join(path, "/"))
+		}
+	}
+	return filepath.Join(path...), nil
+}
+
+// splitHeader splits the message into the header (including the line break
+// after the last field) and the rest, starting with the empty line.
+func splitHeader(body []byte) (hdr, rest []byte) {
+	end := -1
+	for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+		if i := bytes.Index(body, []byte(sep)); i != -1 && (end == -1 || i+len(sep)/2 < end) {
+			end = i + len(sep)/2
+		}
+	}
+	if end == -1 {
+		return body, nil
+	}
+	return body[:end], body[end:]
+}
+
+func toCRLF(b []byte) []byte {
+	res := make([]byte, 0, len(b)+len(b)/32)
+	for i, c := range b {
+		if c == '\n' && (i == 0 || b[i-1] != '\r') {
+			res = append(res, '\r')
+		}
+		res = append(res, c)
+	}
+	return res
+}
+
+func toLF(b []byte) []byte {
+	res := make([]byte, 0, len(b))
+	for i, c := range b {
+		if c == '\r' && i+1 < len(b) && b[i+1] == '\n' {
+			continue
+		}
+		res = append(res, c)
+	}
+	return res
+}
+
+func isSystemFlag(flag string) bool {
+	return strings.HasPrefix(flag, "\\")
+}
@@ -0,0 +1,246 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package mailarchive
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+var testMessages = []Message{
+	{
+		Flags: []string{imap.SeenFlag, imap.AnsweredFlag, "$Label1"},
+		Date:  time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Body:  []byte("From: a@example.org\r\nSubject: one\r\n\r\nHello!\r\nFrom the other side.\r\n>From quoted\r\n"),
+	},
+	{
+		Flags: []string{},
+		Date:  time.Date(2021, 6, 7, 8, 9, 10, 0, time.UTC),
+		Body:  []byte("From: b@example.org\r\nSubject: two\r\n\r\nBody\r\n"),
+	},
+	{
+		Flags: []string{imap.FlaggedFlag, imap.DeletedFlag, imap.DraftFlag},
+		Date:  time.Date(2022, 11, 12, 13, 14, 15, 0, time.UTC),
+		Body:  []byte("From: c@example.org\r\nSubject: three\r\n\r\n"),
+	},
+}
+
+var testMailboxes = []Mailbox{
+	{Path: []string{"INBOX"}, Subscribed: true},
+	{Path: []string{"Archive"}, SpecialUse: imap.ArchiveAttr, Subscribed: true},
+	{Path: []string{"Archive", "2020"}, Subscribed: false},
+	{Path: []string{"Отправленные"}, SpecialUse: imap.SentAttr, Subscribed: true},
+}
+
+func readAll(t *testing.T, r Reader, path []string) []Message {
+	t.Helper()
+	var msgs []Message
+	if err := r.Messages(path, func(msg Message) error {
+		msgs = append(msgs, msg)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return msgs
+}
+
+func checkMessages(t *testing.T, actual []Message) {
+	t.Helper()
+	if len(actual) != len(testMessages) {
+		t.Fatalf("expected %d messages, got %d", len(testMessages), len(actual))
+	}
+	for i, msg := range actual {
+		expected := testMessages[i]
+		if string(msg.Body) != string(expected.Body) {
+			t.Errorf("message %d: wrong body: %q", i, msg.Body)
+		}
+		if !msg.Date.Equal(expected.Date) {
+			t.Errorf("message %d: wrong date: %v", i, msg.Date)
+		}
+		sort.Strings(msg.Flags)
+		sort.Strings(expected.Flags)
+		if !reflect.DeepEqual(msg.Flags, expected.Flags) {
+			t.Errorf("message %d: wrong flags: %v", i, msg.Flags)
+		}
+	}
+}
+
+func TestRoundtrip(t *testing.T) {
+	for _, format := range Formats {
+		format := format
+		t.Run(format, func(t *testing.T) {
+			root := filepath.Join(t.TempDir(), "archive")
+			w, err := Create(format, root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, mbox := range testMailboxes {
+				if err := w.CreateMailbox(mbox); err != nil {
+					t.Fatal(err)
+				}
+				for _, msg := range testMessages {
+					if err := w.AppendMessage(mbox.Path, msg); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := Create(format, root); err == nil {
+				t.Error("Create should fail for non-empty directory")
+			}
+
+			r, err := Open(format, root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mboxes, err := r.Mailboxes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := append([]Mailbox(nil), testMailboxes...)
+			sort.Slice(expected[1:], func(i, j int) bool {
+				return pathKey(expected[1+i].Path) < pathKey(expected[1+j].Path)
+			})
+			if !reflect.DeepEqual(mboxes, expected) {
+				t.Fatalf("wrong mailboxes:\n%+v\nexpected:\n%+v", mboxes, expected)
+			}
+			for _, mbox := range mboxes {
+				checkMessages(t, readAll(t, r, mbox.Path))
+			}
+		})
+	}
+}
+
+func TestMaildir_Foreign(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"", ".Sent", ".Work.Projects"} {
+		for _, sub := range []string{"cur", "new", "tmp"} {
+			if err := os.MkdirAll(filepath.Join(root, dir, sub), 0o700); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	files := map[string]string{
+		"new/1600000000.M1P1.host":                  "Subject: new\n\nBody\n",
+		"cur/1500000000.M1P1.host,S=20:2,Sa":        "Subject: seen\n\nBody\n",
+		".Sent/cur/1500000001.M1P1.host,S=20:2,RST": "Subject: sent\n\nBody\n",
+	}
+	for name, body := range files {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, maildirKeywordsFile), []byte("0 $Important\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Open("maildir", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mboxes, err := r.Mailboxes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Mailbox{
+		{Path: []string{"INBOX"}, Subscribed: true},
+		{Path: []string{"Sent"}, SpecialUse: imap.SentAttr, Subscribed: true},
+		{Path: []string{"Work", "Projects"}, Subscribed: true},
+	}
+	if !reflect.DeepEqual(mboxes, expected) {
+		t.Fatalf("wrong mailboxes: %+v", mboxes)
+	}
+
+	msgs := readAll(t, r, []string{"INBOX"})
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(msgs))
+	}
+	if string(msgs[0].Body) != "Subject: seen\r\n\r\nBody\r\n" {
+		t.Errorf("wrong body: %q", msgs[0].Body)
+	}
+	if !reflect.DeepEqual(msgs[0].Flags, []string{imap.SeenFlag, "$Important"}) {
+		t.Errorf("wrong flags: %v", msgs[0].Flags)
+	}
+	if len(msgs[1].Flags) != 0 {
+		t.Errorf("wrong flags: %v", msgs[1].Flags)
+	}
+
+	msgs = readAll(t, r, []string{"Sent"})
+	if len(msgs) != 1 || !reflect.DeepEqual(msgs[0].Flags, []string{imap.AnsweredFlag, imap.SeenFlag, imap.DeletedFlag}) {
+		t.Errorf("wrong messages: %+v", msgs)
+	}
+}
+
+func TestMbox_SingleFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "Sent.mbox")
+	err := os.WriteFile(file, []byte(`From alice@example.org Thu Jan  2 03:04:05 2020
+Subject: one
+Status: RO
+X-Status: F
+
+>From here
+>>From there
+
+From bob@example.org Sat Jun  5 01:02:03 2021
+Subject: two
+
+Body
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Open("mbox", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mboxes, err := r.Mailboxes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mboxes, []Mailbox{{Path: []string{"Sent"}, SpecialUse: imap.SentAttr, Subscribed: true}}) {
+		t.Fatalf("wrong mailboxes: %+v", mboxes)
+	}
+
+	msgs := readAll(t, r, mboxes[0].Path)
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(msgs))
+	}
+	if string(msgs[0].Body) != "Subject: one\r\n\r\nFrom here\r\n>From there\r\n" {
+		t.Errorf("wrong body: %q", msgs[0].Body)
+	}
+	if !reflect.DeepEqual(msgs[0].Flags, []string{imap.SeenFlag, imap.FlaggedFlag}) {
+		t.Errorf("wrong flags: %v", msgs[0].Flags)
+	}
+	if !msgs[0].Date.Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("wrong date: %v", msgs[0].Date)
+	}
+	if string(msgs[1].Body) != "Subject: two\r\n\r\nBody\r\n" || len(msgs[1].Flags) != 0 {
+		t.Errorf("wrong message: %+v", msgs[1])
+	}
+}
@@ -0,0 +1,291 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package mailarchive
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/utf7"
+)
+
+// Maildir++ layout is used: INBOX is stored in the root directory, other
+// mailboxes are stored in .Name.Subname subdirectories with names encoded
+// using modified UTF-7. Keywords are stored using Dovecot conventions
+// (dovecot-keywords file in each mailbox directory).
+
+var maildirFlags = []struct {
+	letter byte
+	flag   string
+}{
+	// Must be sorted by letter.
+	{'D', imap.DraftFlag},
+	{'F', imap.FlaggedFlag},
+	{'P', "$Forwarded"},
+	{'R', imap.AnsweredFlag},
+	{'S', imap.SeenFlag},
+	{'T', imap.DeletedFlag},
+}
+
+const (
+	maildirKeywordsFile = "dovecot-keywords"
+	maildirMaxKeywords  = 26
+)
+
+func maildirDir(root string, path []string) string {
+	if isInbox(path) {
+		return root
+	}
+	enc := make([]string, len(path))
+	for i, comp := range path {
+		encComp, err := utf7.Encoding.NewEncoder().String(comp)
+		if err != nil {
+			encComp = comp
+		}
+		enc[i] = encComp
+	}
+	return filepath.Join(root, "."+strings.Join(enc, "."))
+}
+
+func isMaildir(dir string) bool {
+	info, err := os.Stat(filepath.Join(dir, "cur"))
+	return err == nil && info.IsDir()
+}
+
+type maildirReader struct {
+	root string
+}
+
+func (r *maildirReader) Mailboxes() ([]Mailbox, error) {
+	var mboxes []Mailbox
+	if isMaildir(r.root) {
+		mboxes = append(mboxes, Mailbox{Path: []string{"INBOX"}})
+	}
+
+	entries, err := os.ReadDir(r.root)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || !strings.HasPrefix(name, ".") || name == "." || name == ".." {
+			continue
+		}
+		if !isMaildir(filepath.Join(r.root, name)) {
+			continue
+		}
+		path := strings.Split(name[1:], ".")
+		for i, comp := range path {
+			decComp, err := utf7.Encoding.NewDecoder().String(comp)
+			if err == nil {
+				path[i] = decComp
+			}
+		}
+		mboxes = append(mboxes, Mailbox{Path: path})
+	}
+
+	return applyMetadata(r.root, mboxes)
+}
+
+func readMaildirKeywords(dir string) ([]string, error) {
+	keywords := make([]string, maildirMaxKeywords)
+	f, err := os.Open(filepath.Join(dir, maildirKeywordsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return keywords, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	scnr := bufio.NewScanner(f)
+	for scnr.Scan() {
+		parts := strings.SplitN(scnr.Text(), " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		indx, err := strconv.Atoi(parts[0])
+		if err != nil || indx < 0 || indx >= maildirMaxKeywords {
+			continue
+		}
+		keywords[indx] = parts[1]
+	}
+	return keywords, scnr.Err()
+}
+
+func parseMaildirFlags(name string, keywords []string) []string {
+	flags := []string{}
+	i := strings.LastIndex(name, ":2,")
+	if i == -1 {
+		return flags
+	}
+	for _, letter := range name[i+3:] {
+		if letter >= 'a' && letter <= 'z' {
+			if kw := keywords[letter-'a']; kw != "" {
+				flags = append(flags, kw)
+			}
+			continue
+		}
+		for _, f := range maildirFlags {
+			if byte(letter) == f.letter {
+				flags = append(flags, f.flag)
+			}
+		}
+	}
+	return flags
+}
+
+func (r *maildirReader) Messages(path []string, fn func(Message) error) error {
+	dir := maildirDir(r.root, path)
+	keywords, err := readMaildirKeywords(dir)
+	if err != nil {
+		return err
+	}
+
+	type file struct {
+		path, name string
+	}
+	var files []file
+	for _, sub := range []string{"new", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			files = append(files, file{filepath.Join(dir, sub, entry.Name()), entry.Name()})
+		}
+	}
+	// Unique names start with the delivery timestamp.
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+
+	for _, f := range files {
+		info, err := os.Stat(f.path)
+		if err != nil {
+			return err
+		}
+		body, err := os.ReadFile(f.path)
+		if err != nil {
+			return err
+		}
+		if err := fn(Message{
+			Flags: parseMaildirFlags(f.name, keywords),
+			Date:  info.ModTime(),
+			Body:  toCRLF(body),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type maildirWriter struct {
+	metaWriter
+	keywords map[string][]string
+	counter  int
+}
+
+func (w *maildirWriter) CreateMailbox(mbox Mailbox) error {
+	dir := maildirDir(w.root, mbox.Path)
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+			return err
+		}
+	}
+	w.addMailbox(mbox)
+	return nil
+}
+
+func (w *maildirWriter) flagsSuffix(dir string, flags []string) string {
+	var sysLetters, kwLetters []byte
+	for _, flag := range flags {
+		known := false
+		for _, f := range maildirFlags {
+			if strings.EqualFold(flag, f.flag) {
+				sysLetters = append(sysLetters, f.letter)
+				known = true
+			}
+		}
+		if known || isSystemFlag(flag) {
+			continue
+		}
+
+		kws := w.keywords[dir]
+		indx := -1
+		for i, kw := range kws {
+			if kw == flag {
+				indx = i
+			}
+		}
+		if indx == -1 {
+			if len(kws) == maildirMaxKeywords {
+				// No more letters available, the keyword is lost.
+				continue
+			}
+			indx = len(kws)
+			w.keywords[dir] = append(kws, flag)
+		}
+		kwLetters = append(kwLetters, byte('a'+indx))
+	}
+	sort.Slice(sysLetters, func(i, j int) bool { return sysLetters[i] < sysLetters[j] })
+	sort.Slice(kwLetters, func(i, j int) bool { return kwLetters[i] < kwLetters[j] })
+	return ":2," + string(sysLetters) + string(kwLetters)
+}
+
+func (w *maildirWriter) AppendMessage(path []string, msg Message) error {
+	dir := maildirDir(w.root, path)
+	body := toLF(msg.Body)
+
+	w.counter++
+	name := fmt.Sprintf("%d.M%dP%dQ%d.maddy,S=%d", msg.Date.Unix(), msg.Date.Nanosecond()/1000, os.Getpid(), w.counter, len(body))
+
+	tmpPath := filepath.Join(dir, "tmp", name)
+	if err := os.WriteFile(tmpPath, body, 0o600); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmpPath, time.Now(), msg.Date); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(dir, "cur", name+w.flagsSuffix(dir, msg.Flags)))
+}
+
+func (w *maildirWriter) Close() error {
+	for dir, kws := range w.keywords {
+		var sb strings.Builder
+		for i, kw := range kws {
+			fmt.Fprintf(&sb, "%d %s\n", i, kw)
+		}
+		if err := os.WriteFile(filepath.Join(dir, maildirKeywordsFile), []byte(sb.String()), 0o600); err != nil {
+			return err
+		}
+	}
+	return w.close()
+}
@@ -0,0 +1,341 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package mailarchive
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// mboxrd variant of mbox is used. Each mailbox is stored in a separate
+// Name.mbox file, hierarchy is represented using directories
+// (Parent.mbox, Parent/Child.mbox). Flags are stored in Status, X-Status and
+// X-Keywords header fields, internal date is stored in the "From " line.
+
+const mboxExt = ".mbox"
+
+var mboxStatusFlags = []struct {
+	letter byte
+	flag   string
+}{
+	{'A', imap.AnsweredFlag},
+	{'F', imap.FlaggedFlag},
+	{'T', imap.DraftFlag},
+	{'D', imap.DeletedFlag},
+}
+
+var mboxDateLayouts = []string{
+	time.ANSIC,
+	"Mon Jan _2 15:04:05 2006 -0700",
+	"Mon Jan _2 15:04:05 MST 2006",
+}
+
+type mboxReader struct {
+	root string
+}
+
+func (r *mboxReader) singleFile() (bool, error) {
+	info, err := os.Stat(r.root)
+	if err != nil {
+		return false, err
+	}
+	return !info.IsDir(), nil
+}
+
+func (r *mboxReader) Mailboxes() ([]Mailbox, error) {
+	single, err := r.singleFile()
+	if err != nil {
+		return nil, err
+	}
+	if single {
+		name := strings.TrimSuffix(filepath.Base(r.root), mboxExt)
+		if strings.EqualFold(name, "INBOX") {
+			name = "INBOX"
+		}
+		return []Mailbox{{
+			Path:       []string{name},
+			SpecialUse: guessSpecialUse([]string{name}),
+			Subscribed: true,
+		}}, nil
+	}
+
+	var mboxes []Mailbox
+	err = filepath.WalkDir(r.root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || !strings.HasSuffix(d.Name(), mboxExt) {
+			return nil
+		}
+		rel, err := filepath.Rel(r.root, strings.TrimSuffix(path, mboxExt))
+		if err != nil {
+			return err
+		}
+		mboxes = append(mboxes, Mailbox{Path: strings.Split(rel, string(filepath.Separator))})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return applyMetadata(r.root, mboxes)
+}
+
+func (r *mboxReader) Messages(path []string, fn func(Message) error) error {
+	file := r.root
+	single, err := r.singleFile()
+	if err != nil {
+		return err
+	}
+	if !single {
+		rel, err := fsPath(path)
+		if err != nil {
+			return err
+		}
+		file = filepath.Join(r.root, rel+mboxExt)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var (
+		rd      = bufio.NewReader(f)
+		started bool
+		date    time.Time
+		buf     bytes.Buffer
+	)
+	flush := func() error {
+		if !started {
+			return nil
+		}
+		body := buf.Bytes()
+		// Strip the empty line separating messages.
+		if bytes.HasSuffix(body, []byte("\r\n\r\n")) {
+			body = body[:len(body)-2]
+		} else if bytes.HasSuffix(body, []byte("\n\n")) {
+			body = body[:len(body)-1]
+		}
+		msg := parseMboxMessage(body)
+		msg.Date = date
+		buf.Reset()
+		return fn(msg)
+	}
+	for {
+		line, err := rd.ReadBytes('\n')
+		if len(line) != 0 {
+			if bytes.HasPrefix(line, []byte("From ")) {
+				if err := flush(); err != nil {
+					return err
+				}
+				started = true
+				date = parseMboxDate(string(bytes.TrimRight(line, "\r\n")))
+			} else if started {
+				if unquoted := bytes.TrimLeft(line, ">"); len(unquoted) != len(line) && bytes.HasPrefix(unquoted, []byte("From ")) {
+					line = line[1:]
+				}
+				buf.Write(line)
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+	}
+	return flush()
+}
+
+func parseMboxDate(fromLine string) time.Time {
+	// From SENDER DATE
+	fields := strings.Fields(fromLine)
+	if len(fields) < 3 {
+		return time.Time{}
+	}
+	dateStr := strings.Join(fields[2:], " ")
+	for _, layout := range mboxDateLayouts {
+		if t, err := time.Parse(layout, dateStr); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func mboxHeaderField(line []byte) string {
+	colon := bytes.IndexByte(line, ':')
+	if colon == -1 {
+		return ""
+	}
+	return strings.ToLower(string(bytes.TrimSpace(line[:colon])))
+}
+
+func parseMboxMessage(body []byte) Message {
+	hdr, rest := splitHeader(body)
+
+	var (
+		flags    []string
+		cleanHdr bytes.Buffer
+		skip     bool
+	)
+	for _, line := range bytes.SplitAfter(hdr, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if !skip {
+				cleanHdr.Write(line)
+			}
+			continue
+		}
+		skip = false
+		value := string(bytes.TrimSpace(line[bytes.IndexByte(line, ':')+1:]))
+		switch mboxHeaderField(line) {
+		case "status":
+			if strings.Contains(value, "R") {
+				flags = append(flags, imap.SeenFlag)
+			}
+			skip = true
+		case "x-status":
+			for _, f := range mboxStatusFlags {
+				if strings.IndexByte(value, f.letter) != -1 {
+					flags = append(flags, f.flag)
+				}
+			}
+			skip = true
+		case "x-keywords":
+			flags = append(flags, strings.Fields(value)...)
+			skip = true
+		}
+		if !skip {
+			cleanHdr.Write(line)
+		}
+	}
+	if flags == nil {
+		flags = []string{}
+	}
+
+	cleanHdr.Write(rest)
+	return Message{
+		Flags: flags,
+		Body:  toCRLF(cleanHdr.Bytes()),
+	}
+}
+
+type mboxWriter struct {
+	metaWriter
+	files map[string]*os.File
+}
+
+func (w *mboxWriter) CreateMailbox(mbox Mailbox) error {
+	rel, err := fsPath(mbox.Path)
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(w.root, rel+mboxExt)
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	w.files[pathKey(mbox.Path)] = f
+	w.addMailbox(mbox)
+	return nil
+}
+
+func (w *mboxWriter) AppendMessage(path []string, msg Message) error {
+	f, ok := w.files[pathKey(path)]
+	if !ok {
+		return os.ErrNotExist
+	}
+
+	var (
+		status   = "O"
+		xStatus  []byte
+		keywords []string
+	)
+	for _, flag := range msg.Flags {
+		if strings.EqualFold(flag, imap.SeenFlag) {
+			status = "RO"
+			continue
+		}
+		known := false
+		for _, f := range mboxStatusFlags {
+			if strings.EqualFold(flag, f.flag) {
+				xStatus = append(xStatus, f.letter)
+				known = true
+			}
+		}
+		if !known && !isSystemFlag(flag) {
+			keywords = append(keywords, flag)
+		}
+	}
+
+	var out bytes.Buffer
+	out.WriteString("From MAILER-DAEMON " + msg.Date.UTC().Format(time.ANSIC) + "\n")
+
+	// Drop existing status fields, they would conflict with ours.
+	cleaned := parseMboxMessage(msg.Body).Body
+	hdr, rest := splitHeader(toLF(cleaned))
+	out.Write(hdr)
+	out.WriteString("Status: " + status + "\n")
+	if len(xStatus) != 0 {
+		out.WriteString("X-Status: " + string(xStatus) + "\n")
+	}
+	if len(keywords) != 0 {
+		out.WriteString("X-Keywords: " + strings.Join(keywords, " ") + "\n")
+	}
+
+	for _, line := range bytes.SplitAfter(rest, []byte("\n")) {
+		if unquoted := bytes.TrimLeft(line, ">"); bytes.HasPrefix(unquoted, []byte("From ")) {
+			out.WriteByte('>')
+		}
+		out.Write(line)
+	}
+	if !bytes.HasSuffix(out.Bytes(), []byte("\n")) {
+		out.WriteByte('\n')
+	}
+	out.WriteByte('\n')
+
+	_, err := f.Write(out.Bytes())
+	return err
+}
+
+func (w *mboxWriter) Close() error {
+	var lastErr error
+	for _, f := range w.files {
+		if err := f.Close(); err != nil {
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return lastErr
+	}
+	return w.close()
+}
@@ -24,6 +24,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"path/filepath"
 	"runtime/trace"
 	"strings"
@@ -193,6 +194,14 @@ func (m *Modifier) Init(cfg *config.Map) error {
 		keyValues := strings.NewReplacer("{domain}", domain, "{selector}", m.selector)
 		keyPath := keyValues.Replace(keyPathTemplate)
 
+		if module.DryRun {
+			// Keys are generated on the first start, don't do that while
+			// checking the configuration.
+			if _, err := os.Stat(keyPath); os.IsNotExist(err) {
+				continue
+			}
+		}
+
 		signer, newKey, err := m.loadOrGenerateKey(keyPath, newKeyAlgo)
 		if err != nil {
 			return err
@@ -20,12 +20,16 @@ package modify
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type (
@@ -40,6 +44,7 @@ type (
 
 	groupState struct {
 		states []module.ModifierState
+		names  []string
 	}
 )
 
@@ -76,14 +81,34 @@ func (g Group) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata)
 			return nil, err
 		}
 		gs.states = append(gs.states, state)
+		gs.names = append(gs.names, modifierName(modifier))
 	}
 	return gs, nil
 }
 
+func modifierName(modifier module.Modifier) string {
+	mod, ok := modifier.(module.Module)
+	if !ok {
+		return fmt.Sprintf("%T", modifier)
+	}
+	if mod.InstanceName() == "" {
+		return mod.Name()
+	}
+	return mod.Name() + ":" + mod.InstanceName()
+}
+
+func (gs groupState) startSpan(ctx context.Context, i int, stage string) (context.Context, trace.Span) {
+	return tracing.Start(ctx, gs.names[i],
+		attribute.String("maddy.modify.stage", stage),
+	)
+}
+
 func (gs groupState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
 	var err error
-	for _, state := range gs.states {
-		mailFrom, err = state.RewriteSender(ctx, mailFrom)
+	for i, state := range gs.states {
+		modCtx, span := gs.startSpan(ctx, i, "sender")
+		mailFrom, err = state.RewriteSender(modCtx, mailFrom)
+		tracing.End(span, err)
 		if err != nil {
 			return "", err
 		}
@@ -94,24 +119,30 @@ func (gs groupState) RewriteSender(ctx context.Context, mailFrom string) (string
 func (gs groupState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
 	var err error
 	var result = []string{rcptTo}
-	for _, state := range gs.states {
+	for i, state := range gs.states {
+		modCtx, span := gs.startSpan(ctx, i, "recipient")
 		var intermediateResult = []string{}
 		for _, partResult := range result {
 			var partResult_multi []string
-			partResult_multi, err = state.RewriteRcpt(ctx, partResult)
+			partResult_multi, err = state.RewriteRcpt(modCtx, partResult)
 			if err != nil {
+				tracing.End(span, err)
 				return []string{""}, err
 			}
 			intermediateResult = append(intermediateResult, partResult_multi...)
 		}
+		span.End()
 		result = intermediateResult
 	}
 	return result, nil
 }
 
 func (gs groupState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
-	for _, state := range gs.states {
-		if err := state.RewriteBody(ctx, h, body); err != nil {
+	for i, state := range gs.states {
+		modCtx, span := gs.startSpan(ctx, i, "body")
+		err := state.RewriteBody(modCtx, h, body)
+		tracing.End(span, err)
+		if err != nil {
 			return err
 		}
 	}
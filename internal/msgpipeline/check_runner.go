@@ -30,7 +30,10 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/tracing"
 	"github.com/foxcpp/maddy/internal/dmarc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // checkRunner runs groups of checks, collects and merges results.
@@ -49,9 +52,12 @@ type checkRunner struct {
 	didDMARCFetch bool
 	dmarcVerify   *dmarc.Verifier
 
-	log log.Logger
+	log   log.Logger
+	trace *tracer
 
 	states map[module.Check]module.CheckState
+	// Names of checks the states belong to, used for tracing.
+	stateNames map[module.CheckState]string
 
 	mergedRes module.CheckResult
 }
@@ -64,6 +70,7 @@ func newCheckRunner(msgMeta *module.MsgMetadata, log log.Logger, r dns.Resolver)
 		resolver:             r,
 		dmarcVerify:          dmarc.NewVerifier(r),
 		states:               make(map[module.Check]module.CheckState),
+		stateNames:           make(map[module.CheckState]string),
 	}
 }
 
@@ -93,6 +100,7 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 		states = append(states, state)
 		newStates = append(newStates, state)
 		newStatesMap[check] = state
+		cr.stateNames[state] = objectName(check)
 	}
 
 	if len(newStates) == 0 {
@@ -105,7 +113,7 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 	// Done outside of check loop above to make sure we can run these for multiple
 	// checks in parallel.
 	if cr.mailFromReceived {
-		err := cr.runAndMergeResults(newStates, func(s module.CheckState) module.CheckResult {
+		err := cr.runAndMergeResults(ctx, "connection", newStates, func(ctx context.Context, s module.CheckState) module.CheckResult {
 			res := s.CheckConnection(ctx)
 			return res
 		})
@@ -113,7 +121,7 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 			closeStates()
 			return nil, err
 		}
-		err = cr.runAndMergeResults(newStates, func(s module.CheckState) module.CheckResult {
+		err = cr.runAndMergeResults(ctx, "sender", newStates, func(ctx context.Context, s module.CheckState) module.CheckResult {
 			res := s.CheckSender(ctx, cr.mailFrom)
 			return res
 		})
@@ -126,7 +134,7 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 	if len(cr.checkedRcpts) != 0 {
 		for _, rcpt := range cr.checkedRcpts {
 			rcpt := rcpt
-			err := cr.runAndMergeResults(states, func(s module.CheckState) module.CheckResult {
+			err := cr.runAndMergeResults(ctx, "recipient "+rcpt, states, func(ctx context.Context, s module.CheckState) module.CheckResult {
 				// Avoid calling CheckRcpt for the same recipient for the same check
 				// multiple times, even if requested.
 				cr.checkedRcptsLock.Lock()
@@ -159,7 +167,7 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 	return states, nil
 }
 
-func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner func(module.CheckState) module.CheckResult) error {
+func (cr *checkRunner) runAndMergeResults(ctx context.Context, stage string, states []module.CheckState, runner func(context.Context, module.CheckState) module.CheckResult) error {
 	data := struct {
 		authResLock sync.Mutex
 		headerLock  sync.Mutex
@@ -187,7 +195,13 @@ func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner fun
 				}
 			}()
 
-			subCheckRes := runner(state)
+			checkCtx, span := tracing.Start(ctx, cr.stateNames[state],
+				attribute.String("maddy.check.stage", stage),
+			)
+			subCheckRes := runner(checkCtx, state)
+			cr.traceResult(stage, state, subCheckRes)
+			cr.countResult(state, subCheckRes)
+			endCheckSpan(span, subCheckRes)
 
 			// We check the length because we don't want to take locks
 			// when it is not necessary.
@@ -238,6 +252,50 @@ func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner fun
 	return nil
 }
 
+func endCheckSpan(span trace.Span, res module.CheckResult) {
+	switch {
+	case res.Quarantine:
+		span.SetAttributes(attribute.String("maddy.check.action", "quarantine"))
+	case res.Reject:
+		span.SetAttributes(attribute.String("maddy.check.action", "reject"))
+	}
+	tracing.End(span, res.Reason)
+}
+
+func (cr *checkRunner) countResult(state module.CheckState, res module.CheckResult) {
+	name := cr.stateNames[state]
+	switch {
+	case res.Quarantine:
+		checkQuarantined.WithLabelValues(name).Inc()
+		checkVerdicts.WithLabelValues(name, "quarantine").Inc()
+	case res.Reject:
+		checkReject.WithLabelValues(name).Inc()
+		checkVerdicts.WithLabelValues(name, "reject").Inc()
+	case res.Reason != nil:
+		checkVerdicts.WithLabelValues(name, "ignore").Inc()
+	default:
+		checkVerdicts.WithLabelValues(name, "accept").Inc()
+	}
+}
+
+func (cr *checkRunner) traceResult(stage string, state module.CheckState, res module.CheckResult) {
+	if cr.trace == nil {
+		return
+	}
+
+	name := cr.stateNames[state]
+	switch {
+	case res.Quarantine:
+		cr.trace.printf("check %s (%s): quarantine: %v", name, stage, res.Reason)
+	case res.Reject:
+		cr.trace.printf("check %s (%s): reject: %v", name, stage, res.Reason)
+	case res.Reason != nil:
+		cr.trace.printf("check %s (%s): no action: %v", name, stage, res.Reason)
+	default:
+		cr.trace.printf("check %s (%s): ok", name, stage)
+	}
+}
+
 func (cr *checkRunner) checkConnSender(ctx context.Context, checks []module.Check, mailFrom string) error {
 	cr.mailFrom = mailFrom
 	cr.mailFromReceived = true
@@ -253,7 +311,7 @@ func (cr *checkRunner) checkRcpt(ctx context.Context, checks []module.Check, rcp
 		return err
 	}
 
-	err = cr.runAndMergeResults(states, func(s module.CheckState) module.CheckResult {
+	err = cr.runAndMergeResults(ctx, "recipient "+rcptTo, states, func(ctx context.Context, s module.CheckState) module.CheckResult {
 		cr.checkedRcptsLock.Lock()
 		if _, ok := cr.checkedRcptsPerCheck[s][rcptTo]; ok {
 			cr.checkedRcptsLock.Unlock()
@@ -284,7 +342,7 @@ func (cr *checkRunner) checkBody(ctx context.Context, checks []module.Check, hea
 		cr.didDMARCFetch = true
 	}
 
-	return cr.runAndMergeResults(states, func(s module.CheckState) module.CheckResult {
+	return cr.runAndMergeResults(ctx, "body", states, func(ctx context.Context, s module.CheckState) module.CheckResult {
 		res := s.CheckBody(ctx, header, body)
 		return res
 	})
@@ -293,11 +351,13 @@ func (cr *checkRunner) checkBody(ctx context.Context, checks []module.Check, hea
 func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) error {
 	if cr.mergedRes.Quarantine {
 		cr.msgMeta.Quarantine = true
+		cr.trace.printf("message quarantined")
 	}
 
 	if cr.doDMARC {
 		dmarcRes, policy := cr.dmarcVerify.Apply(cr.mergedRes.AuthResult)
 		cr.mergedRes.AuthResult = append(cr.mergedRes.AuthResult, &dmarcRes.Authres)
+		cr.trace.printf("dmarc: %s, policy: %s", dmarcRes.Authres.Value, policy)
 		switch policy {
 		case dmarc.PolicyReject:
 			code := 550
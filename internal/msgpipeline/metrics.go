@@ -39,9 +39,19 @@ var (
 		},
 		[]string{"check"},
 	)
+	checkVerdicts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "check",
+			Name:      "verdicts",
+			Help:      "Results returned by checks, action is one of 'accept', 'reject', 'quarantine' or 'ignore' (check failed but no action is configured)",
+		},
+		[]string{"check", "action"},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(checkReject)
 	prometheus.MustRegister(checkQuarantined)
+	prometheus.MustRegister(checkVerdicts)
 }
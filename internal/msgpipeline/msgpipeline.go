@@ -20,6 +20,7 @@ package msgpipeline
 
 import (
 	"context"
+	"strings"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-smtp"
@@ -30,8 +31,10 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/tracing"
 	"github.com/foxcpp/maddy/internal/modify"
 	"github.com/foxcpp/maddy/internal/target"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -124,9 +127,11 @@ func (d *MsgPipeline) Start(ctx context.Context, msgMeta *module.MsgMetadata, ma
 		deliveries:         make(map[module.DeliveryTarget]*delivery),
 		msgMeta:            msgMeta,
 		log:                target.DeliveryLogger(d.Log, msgMeta),
+		trace:              tracerFrom(ctx),
 	}
 	dd.checkRunner = newCheckRunner(msgMeta, dd.log, d.Resolver)
 	dd.checkRunner.doDMARC = d.doDMARC
+	dd.checkRunner.trace = dd.trace
 
 	if msgMeta.OriginalRcpts == nil {
 		msgMeta.OriginalRcpts = map[string]string{}
@@ -147,9 +152,13 @@ func (dd *msgpipelineDelivery) start(ctx context.Context, msgMeta *module.MsgMet
 		return err
 	}
 
+	originalFrom := mailFrom
 	if mailFrom, err = dd.initRunGlobalModifiers(ctx, msgMeta, mailFrom); err != nil {
 		return err
 	}
+	if mailFrom != originalFrom {
+		dd.trace.printf("sender rewritten by global modifiers: %s => %s", originalFrom, mailFrom)
+	}
 
 	sourceBlock, err := dd.srcBlockForAddr(ctx, mailFrom)
 	if err != nil {
@@ -169,10 +178,14 @@ func (dd *msgpipelineDelivery) start(ctx context.Context, msgMeta *module.MsgMet
 	if err != nil {
 		return err
 	}
+	originalFrom = mailFrom
 	mailFrom, err = sourceModifiersState.RewriteSender(ctx, mailFrom)
 	if err != nil {
 		return err
 	}
+	if mailFrom != originalFrom {
+		dd.trace.printf("sender rewritten by source modifiers: %s => %s", originalFrom, mailFrom)
+	}
 	dd.sourceModifiersState = sourceModifiersState
 
 	dd.sourceAddr = mailFrom
@@ -217,6 +230,7 @@ func (dd *msgpipelineDelivery) srcBlockForAddr(ctx context.Context, mailFrom str
 		if !ok {
 			continue
 		}
+		dd.trace.printf("sender %s matched by source_in %s", mailFrom, objectName(srcIn.t))
 		return srcIn.block, nil
 	}
 
@@ -245,21 +259,58 @@ func (dd *msgpipelineDelivery) srcBlockForAddr(ctx context.Context, mailFrom str
 			// Fallback to the default source block.
 			srcBlock = dd.d.defaultSource
 			dd.log.Debugf("sender %s matched by default rule", mailFrom)
+			dd.trace.printf("sender %s matched by default source rule", mailFrom)
 		} else {
 			dd.log.Debugf("sender %s matched by domain rule '%s'", mailFrom, domain)
+			dd.trace.printf("sender %s matched by source rule '%s'", mailFrom, domain)
 		}
 	} else {
 		dd.log.Debugf("sender %s matched by address rule '%s'", mailFrom, cleanFrom)
+		dd.trace.printf("sender %s matched by source rule '%s'", mailFrom, cleanFrom)
 	}
 	return srcBlock, nil
 }
 
 type delivery struct {
 	module.Delivery
+	// Target name, used for tracing spans.
+	name string
 	// Recipient addresses this delivery object is used for, original values (not modified by RewriteRcpt).
 	recipients []string
 }
 
+func (d *delivery) startSpan(ctx context.Context, op string) (context.Context, trace.Span) {
+	return tracing.Start(ctx, "target "+d.name+" "+op)
+}
+
+func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, opts smtp.RcptOptions) error {
+	ctx, span := d.startSpan(ctx, "AddRcpt")
+	err := d.Delivery.AddRcpt(ctx, rcptTo, opts)
+	tracing.End(span, err)
+	return err
+}
+
+func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	ctx, span := d.startSpan(ctx, "Body")
+	err := d.Delivery.Body(ctx, header, body)
+	tracing.End(span, err)
+	return err
+}
+
+func (d *delivery) Commit(ctx context.Context) error {
+	ctx, span := d.startSpan(ctx, "Commit")
+	err := d.Delivery.Commit(ctx)
+	tracing.End(span, err)
+	return err
+}
+
+func (d *delivery) Abort(ctx context.Context) error {
+	ctx, span := d.startSpan(ctx, "Abort")
+	err := d.Delivery.Abort(ctx)
+	tracing.End(span, err)
+	return err
+}
+
 type msgpipelineDelivery struct {
 	d *MsgPipeline
 
@@ -272,6 +323,8 @@ type msgpipelineDelivery struct {
 	sourceAddr  string
 	sourceBlock sourceBlock
 
+	trace *tracer
+
 	deliveries  map[module.DeliveryTarget]*delivery
 	msgMeta     *module.MsgMetadata
 	checkRunner *checkRunner
@@ -292,6 +345,7 @@ func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string, opts smtp
 		return err
 	}
 	dd.log.Debugln("global rcpt modifiers:", to, "=>", newTo)
+	dd.traceRcptRewrite("global", to, newTo)
 	resultTo := newTo
 	newTo = []string{}
 
@@ -301,6 +355,7 @@ func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string, opts smtp
 		if err != nil {
 			return err
 		}
+		dd.traceRcptRewrite("source", to, tempTo)
 		newTo = append(newTo, tempTo...)
 	}
 	dd.log.Debugln("per-source rcpt modifiers:", to, "=>", newTo)
@@ -337,6 +392,7 @@ func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string, opts smtp
 			return wrapErr(err)
 		}
 		dd.log.Debugln("per-rcpt modifiers:", to, "=>", newTo)
+		dd.traceRcptRewrite("destination", to, newTo)
 
 		for _, to = range newTo {
 			wrapErr = func(err error) error {
@@ -355,10 +411,19 @@ func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string, opts smtp
 				// its own rewriting - we do not want to hide it from the admin in
 				// error messages.
 				wrapErr := wrapErr
-				if _, ok := tgt.(*MsgPipeline); ok {
+				_, isPipeline := tgt.(*MsgPipeline)
+				if isPipeline {
 					wrapErr = func(err error) error { return err }
 				}
 
+				if dd.trace != nil {
+					if !isPipeline {
+						dd.trace.printf("recipient %s: deliver to %s", to, objectName(tgt))
+						continue
+					}
+					dd.trace.printf("recipient %s: reroute", to)
+				}
+
 				delivery, err := dd.getDelivery(ctx, tgt)
 				if err != nil {
 					return wrapErr(err)
@@ -376,6 +441,11 @@ func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string, opts smtp
 }
 
 func (dd *msgpipelineDelivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	var originalHeader textproto.Header
+	if dd.trace != nil {
+		originalHeader = header.Copy()
+	}
+
 	if err := dd.checkRunner.checkBody(ctx, dd.d.globalChecks, header, body); err != nil {
 		return err
 	}
@@ -418,6 +488,8 @@ func (dd *msgpipelineDelivery) Body(ctx context.Context, header textproto.Header
 		}
 	}
 
+	dd.traceHeaderChanges(originalHeader, header)
+
 	for _, delivery := range dd.deliveries {
 		if err := delivery.Body(ctx, header, body); err != nil {
 			return err
@@ -449,6 +521,11 @@ func (sc statusCollector) SetStatus(rcptTo string, err error) {
 }
 
 func (dd *msgpipelineDelivery) BodyNonAtomic(ctx context.Context, c module.StatusCollector, header textproto.Header, body buffer.Buffer) {
+	var originalHeader textproto.Header
+	if dd.trace != nil {
+		originalHeader = header.Copy()
+	}
+
 	setStatusAll := func(err error) {
 		for _, delivery := range dd.deliveries {
 			for _, rcpt := range delivery.recipients {
@@ -483,13 +560,17 @@ func (dd *msgpipelineDelivery) BodyNonAtomic(ctx context.Context, c module.Statu
 		}
 	}
 
+	dd.traceHeaderChanges(originalHeader, header)
+
 	for _, delivery := range dd.deliveries {
 		partDelivery, ok := delivery.Delivery.(module.PartialDelivery)
 		if ok {
-			partDelivery.BodyNonAtomic(ctx, statusCollector{
+			bodyCtx, span := delivery.startSpan(ctx, "BodyNonAtomic")
+			partDelivery.BodyNonAtomic(bodyCtx, statusCollector{
 				originalRcpts: dd.msgMeta.OriginalRcpts,
 				wrapped:       c,
 			}, header, body)
+			span.End()
 			continue
 		}
 
@@ -561,6 +642,7 @@ func (dd *msgpipelineDelivery) rcptBlockForAddr(ctx context.Context, rcptTo stri
 		if !ok {
 			continue
 		}
+		dd.trace.printf("recipient %s matched by destination_in %s", rcptTo, objectName(rcptIn.t))
 		return rcptIn.block, nil
 	}
 
@@ -586,15 +668,61 @@ func (dd *msgpipelineDelivery) rcptBlockForAddr(ctx context.Context, rcptTo stri
 			// Fallback to the default source block.
 			rcptBlock = dd.sourceBlock.defaultRcpt
 			dd.log.Debugf("recipient %s matched by default rule (clean = %s)", rcptTo, cleanRcpt)
+			dd.trace.printf("recipient %s matched by default destination rule", rcptTo)
 		} else {
 			dd.log.Debugf("recipient %s matched by domain rule '%s'", rcptTo, domain)
+			dd.trace.printf("recipient %s matched by destination rule '%s'", rcptTo, domain)
 		}
 	} else {
 		dd.log.Debugf("recipient %s matched by address rule '%s'", rcptTo, cleanRcpt)
+		dd.trace.printf("recipient %s matched by destination rule '%s'", rcptTo, cleanRcpt)
 	}
 	return rcptBlock, nil
 }
 
+func (dd *msgpipelineDelivery) traceRcptRewrite(stage, rcpt string, newRcpts []string) {
+	if len(newRcpts) == 1 && newRcpts[0] == rcpt {
+		return
+	}
+	dd.trace.printf("recipient rewritten by %s modifiers: %s => %v", stage, rcpt, newRcpts)
+}
+
+// traceHeaderChanges reports header fields added and removed by checks
+// and modifiers.
+func (dd *msgpipelineDelivery) traceHeaderChanges(original, header textproto.Header) {
+	if dd.trace == nil {
+		return
+	}
+
+	formatField := func(fields textproto.HeaderFields) string {
+		raw, err := fields.Raw()
+		if err != nil {
+			return fields.Key() + ": " + fields.Value()
+		}
+		return strings.ReplaceAll(strings.TrimRight(string(raw), "\r\n"), "\r\n", "\n")
+	}
+
+	remaining := make(map[string]int)
+	for fields := original.Fields(); fields.Next(); {
+		remaining[formatField(fields)]++
+	}
+	for fields := header.Fields(); fields.Next(); {
+		field := formatField(fields)
+		if remaining[field] > 0 {
+			remaining[field]--
+			continue
+		}
+		dd.trace.printf("header field added: %s", field)
+	}
+	for fields := original.Fields(); fields.Next(); {
+		field := formatField(fields)
+		if remaining[field] > 0 {
+			remaining[field]--
+			dd.trace.printf("header field removed: %s", field)
+		}
+	}
+}
+
 func (dd *msgpipelineDelivery) getRcptModifiers(ctx context.Context, rcptBlock *rcptBlock, rcptTo string) (module.ModifierState, error) {
 	rcptModifiersState, ok := dd.rcptModifiersState[rcptBlock]
 	if ok {
@@ -622,14 +750,17 @@ func (dd *msgpipelineDelivery) getDelivery(ctx context.Context, tgt module.Deliv
 		return delivery_, nil
 	}
 
-	deliveryObj, err := tgt.Start(ctx, dd.msgMeta, dd.sourceAddr)
+	name := objectName(tgt)
+	startCtx, span := tracing.Start(dd.trace.nested(ctx), "target "+name+" Start")
+	deliveryObj, err := tgt.Start(startCtx, dd.msgMeta, dd.sourceAddr)
+	tracing.End(span, err)
 	if err != nil {
-		dd.log.Debugf("tgt.Start(%s) failure, target = %s: %v", dd.sourceAddr, objectName(tgt), err)
+		dd.log.Debugf("tgt.Start(%s) failure, target = %s: %v", dd.sourceAddr, name, err)
 		return nil, err
 	}
-	delivery_ = &delivery{Delivery: deliveryObj}
+	delivery_ = &delivery{Delivery: deliveryObj, name: name}
 
-	dd.log.Debugf("tgt.Start(%s) ok, target = %s", dd.sourceAddr, objectName(tgt))
+	dd.log.Debugf("tgt.Start(%s) ok, target = %s", dd.sourceAddr, name)
 
 	dd.deliveries[tgt] = delivery_
 	return delivery_, nil
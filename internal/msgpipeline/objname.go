@@ -29,6 +29,9 @@ import (
 func objectName(x interface{}) string {
 	mod, ok := x.(module.Module)
 	if ok {
+		if mod.InstanceName() == "" {
+			return mod.Name()
+		}
 		return mod.Name() + ":" + mod.InstanceName()
 	}
 
@@ -0,0 +1,80 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+type tracerKey struct{}
+
+type tracer struct {
+	f      func(string)
+	lock   *sync.Mutex
+	indent string
+}
+
+// WithTracer returns a copy of ctx that makes MsgPipeline describe every
+// decision it makes (matched source and destination blocks, check results,
+// address rewrites) by calling f.
+//
+// Additionally, delivery targets are not used when the message is handled
+// using such context, MsgPipeline only reports which targets would receive it.
+// Nested pipelines ('reroute' directive) are executed as usual and their
+// decisions are reported with additional indentation.
+//
+// It is meant for use by configuration debugging tools. f is never called
+// concurrently.
+func WithTracer(ctx context.Context, f func(string)) context.Context {
+	return context.WithValue(ctx, tracerKey{}, &tracer{
+		f:    f,
+		lock: new(sync.Mutex),
+	})
+}
+
+func tracerFrom(ctx context.Context) *tracer {
+	t, _ := ctx.Value(tracerKey{}).(*tracer)
+	return t
+}
+
+// printf reports the message to the tracer. It is no-op for a nil tracer.
+func (t *tracer) printf(format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.f(t.indent + fmt.Sprintf(format, args...))
+}
+
+// nested returns the context to be used for nested pipelines.
+func (t *tracer) nested(ctx context.Context) context.Context {
+	if t == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, tracerKey{}, &tracer{
+		f:      t.f,
+		lock:   t.lock,
+		indent: t.indent + "  ",
+	})
+}
@@ -0,0 +1,129 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/modify"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestMsgPipeline_Trace(t *testing.T) {
+	orgTarget, rerouteTarget := testutils.Target{InstName: "orgTarget"}, testutils.Target{InstName: "rerouteTarget"}
+	check := testutils.Check{
+		InstName: "test_check",
+		BodyRes: module.CheckResult{
+			Header: func() textproto.Header {
+				h := textproto.Header{}
+				h.Add("X-Check", "1")
+				return h
+			}(),
+		},
+	}
+	mod := testutils.Modifier{
+		InstName: "test_modifier",
+		RcptTo: map[string][]string{
+			"rcpt@example.com": {"rcpt@example.org"},
+		},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&check},
+			globalModifiers: modify.Group{
+				Modifiers: []module.Modifier{mod},
+			},
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{
+					"example.org": {
+						targets: []module.DeliveryTarget{&orgTarget},
+					},
+				},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&MsgPipeline{
+						msgpipelineCfg: msgpipelineCfg{
+							perSource: map[string]sourceBlock{},
+							defaultSource: sourceBlock{
+								perRcpt: map[string]*rcptBlock{},
+								defaultRcpt: &rcptBlock{
+									targets: []module.DeliveryTarget{&rerouteTarget},
+								},
+							},
+						},
+						Log: testutils.Logger(t, "msgpipeline"),
+					}},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	var lines []string
+	ctx := WithTracer(context.Background(), func(s string) {
+		lines = append(lines, s)
+	})
+
+	delivery, err := d.Start(ctx, &module.MsgMetadata{ID: "test"}, "sender@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range []string{"rcpt@example.com", "rcpt@example.net"} {
+		if err := delivery.AddRcpt(ctx, rcpt, smtp.RcptOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := delivery.Body(ctx, textproto.Header{}, buffer.MemoryBuffer{Slice: []byte("foobar\r\n")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.Abort(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"check test_check:test_check (connection): ok",
+		"check test_check:test_check (sender): ok",
+		"sender sender@example.com matched by default source rule",
+		"check test_check:test_check (recipient rcpt@example.com): ok",
+		"recipient rewritten by global modifiers: rcpt@example.com => [rcpt@example.org]",
+		"recipient rcpt@example.org matched by destination rule 'example.org'",
+		"recipient rcpt@example.org: deliver to test_target:orgTarget",
+		"check test_check:test_check (recipient rcpt@example.net): ok",
+		"recipient rcpt@example.net matched by default destination rule",
+		"recipient rcpt@example.net: reroute",
+		"  sender sender@example.com matched by default source rule",
+		"  recipient rcpt@example.net matched by default destination rule",
+		"  recipient rcpt@example.net: deliver to test_target:rerouteTarget",
+		"check test_check:test_check (body): ok",
+		"header field added: X-Check: 1",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("wrong trace:\nwant %q\ngot  %q", want, lines)
+	}
+
+	if len(orgTarget.Messages) != 0 || len(rerouteTarget.Messages) != 0 {
+		t.Fatal("targets should not be used when tracing")
+	}
+}
@@ -0,0 +1,183 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package encrypted implements the storage.blob.encrypted module that
+// encrypts blobs before passing them to another blob store.
+package encrypted
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const modName = "storage.blob.encrypted"
+
+type Store struct {
+	instName string
+	log      log.Logger
+
+	backend          module.BlobStore
+	keys             *keyring
+	activeKey        string
+	allowUnencrypted bool
+}
+
+func New(_, instName string, _, _ []string) (module.Module, error) {
+	return &Store{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+		keys:     &keyring{keys: make(map[string][]byte)},
+	}, nil
+}
+
+func (s *Store) Name() string {
+	return modName
+}
+
+func (s *Store) InstanceName() string {
+	return s.instName
+}
+
+func (s *Store) Init(cfg *config.Map) error {
+	var keyFile string
+	cfg.Custom("backend", false, true, nil, func(m *config.Map, node config.Node) (interface{}, error) {
+		var store module.BlobStore
+		err := modconfig.ModuleFromNode("storage.blob", node.Args, node, m.Globals, &store)
+		return store, err
+	}, &s.backend)
+	cfg.String("key_file", false, false, "", &keyFile)
+	cfg.StringList("key_command", false, false, nil, &s.keys.command)
+	cfg.String("active_key", false, false, "", &s.activeKey)
+	cfg.Bool("allow_unencrypted", false, false, &s.allowUnencrypted)
+	cfg.Bool("debug", true, false, &s.log.Debug)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if keyFile == "" && len(s.keys.command) == 0 {
+		return config.NodeErr(cfg.Block, "key_file or key_command is required")
+	}
+	if s.activeKey != "" && !validKeyID(s.activeKey) {
+		return config.NodeErr(cfg.Block, "invalid active_key: %s", s.activeKey)
+	}
+	if module.DryRun {
+		return nil
+	}
+
+	if keyFile != "" {
+		if err := s.keys.loadFile(keyFile); err != nil {
+			return config.NodeErr(cfg.Block, "%v", err)
+		}
+	}
+	if s.activeKey == "" {
+		if s.keys.lastFileKey == "" {
+			return config.NodeErr(cfg.Block, "active_key is required if there are no keys in key_file")
+		}
+		s.activeKey = s.keys.lastFileKey
+	}
+	// Make sure new blobs can be stored.
+	if _, err := s.keys.Key(context.Background(), s.activeKey); err != nil {
+		return config.NodeErr(cfg.Block, "%v", err)
+	}
+	s.log.DebugMsg("using key for new blobs", "key_id", s.activeKey)
+
+	return nil
+}
+
+func (s *Store) Create(ctx context.Context, key string, blobSize int64) (module.Blob, error) {
+	masterKey, err := s.keys.Key(ctx, s.activeKey)
+	if err != nil {
+		return nil, err
+	}
+
+	size := module.UnknownBlobSize
+	if blobSize >= 0 {
+		size = encryptedSize(s.activeKey, blobSize)
+	}
+	blob, err := s.backend.Create(ctx, key, size)
+	if err != nil {
+		return nil, err
+	}
+	encBlob, err := newEncryptingBlob(blob, masterKey, s.activeKey, blobSize)
+	if err != nil {
+		blob.Close()
+		return nil, err
+	}
+	return encBlob, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (s *Store) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	rc, err := s.backend.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReaderSize(rc, chunkSize+tagSize+1)
+	hdr, keyID, salt, err := readHeader(br)
+	if err != nil {
+		if errors.Is(err, ErrNotEncrypted) && s.allowUnencrypted {
+			return readCloser{Reader: br, Closer: rc}, nil
+		}
+		rc.Close()
+		return nil, err
+	}
+
+	masterKey, err := s.keys.Key(ctx, keyID)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	aead, err := newAEAD(masterKey, salt)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return newDecryptingReader(br, rc, aead, hdr), nil
+}
+
+func (s *Store) Delete(ctx context.Context, keys []string) error {
+	return s.backend.Delete(ctx, keys)
+}
+
+// List lists blobs in the backend store. Reported sizes are sizes of the
+// encrypted blobs.
+func (s *Store) List(ctx context.Context, fn func(module.BlobInfo) error) error {
+	l, ok := s.backend.(module.ListableBlobStore)
+	if !ok {
+		return fmt.Errorf("%s: backend does not support listing", modName)
+	}
+	return l.List(ctx, fn)
+}
+
+func init() {
+	var _ module.ListableBlobStore = &Store{}
+	module.Register(modName, New)
+}
@@ -0,0 +1,410 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package encrypted
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/storage/blob"
+	_ "github.com/foxcpp/maddy/internal/storage/blob/fs"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+const (
+	testKey1 = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	testKey2 = "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=" // base64
+)
+
+type memStore struct {
+	lck   sync.Mutex
+	blobs map[string][]byte
+	sizes map[string]int64
+}
+
+type memBlob struct {
+	s    *memStore
+	key  string
+	buf  bytes.Buffer
+	size int64
+}
+
+func (b *memBlob) Write(p []byte) (int, error) { return b.buf.Write(p) }
+func (b *memBlob) Close() error                { return nil }
+func (b *memBlob) Sync() error {
+	b.s.lck.Lock()
+	defer b.s.lck.Unlock()
+	b.s.blobs[b.key] = b.buf.Bytes()
+	b.s.sizes[b.key] = b.size
+	return nil
+}
+
+func (s *memStore) Create(_ context.Context, key string, blobSize int64) (module.Blob, error) {
+	return &memBlob{s: s, key: key, size: blobSize}, nil
+}
+
+func (s *memStore) Open(_ context.Context, key string) (io.ReadCloser, error) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	b, ok := s.blobs[key]
+	if !ok {
+		return nil, module.ErrNoSuchBlob
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (s *memStore) Delete(_ context.Context, keys []string) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	for _, k := range keys {
+		delete(s.blobs, k)
+	}
+	return nil
+}
+
+func newMemStore() *memStore {
+	return &memStore{blobs: map[string][]byte{}, sizes: map[string]int64{}}
+}
+
+func testStore(t *testing.T, backend module.BlobStore, keyFile, activeKey string) *Store {
+	t.Helper()
+	path := filepath.Join(testutils.Dir(t), "keys")
+	if err := os.WriteFile(path, []byte(keyFile), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	mod, err := New(modName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := mod.(*Store)
+	s.log = testutils.Logger(t, modName)
+	s.backend = backend
+	if err := s.keys.loadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	s.activeKey = activeKey
+	return s
+}
+
+func writeBlob(t *testing.T, s *Store, key string, data []byte, knownSize bool) {
+	t.Helper()
+	size := module.UnknownBlobSize
+	if knownSize {
+		size = int64(len(data))
+	}
+	b, err := s.Create(context.Background(), key, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if _, err := b.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readBlob(s *Store, key string) ([]byte, error) {
+	r, err := s.Open(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func TestRoundtrip(t *testing.T) {
+	backend := newMemStore()
+	s := testStore(t, backend, "key1 "+testKey1, "key1")
+
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3 * chunkSize, 3*chunkSize + 100} {
+		for _, knownSize := range []bool{true, false} {
+			data := make([]byte, size)
+			rand.New(rand.NewSource(int64(size))).Read(data)
+
+			writeBlob(t, s, "blob", data, knownSize)
+
+			stored := backend.blobs["blob"]
+			if int64(len(stored)) != encryptedSize("key1", int64(size)) {
+				t.Errorf("size %d: wrong encrypted size: %d", size, len(stored))
+			}
+			if knownSize && backend.sizes["blob"] != int64(len(stored)) {
+				t.Errorf("size %d: wrong size passed to backend: %d", size, backend.sizes["blob"])
+			}
+			if size > 100 && bytes.Contains(stored, data[:100]) {
+				t.Errorf("size %d: plaintext is stored", size)
+			}
+
+			read, err := readBlob(s, "blob")
+			if err != nil {
+				t.Fatalf("size %d: %v", size, err)
+			}
+			if !bytes.Equal(read, data) {
+				t.Fatalf("size %d: data mismatch", size)
+			}
+		}
+	}
+}
+
+func TestWrongSize(t *testing.T) {
+	s := testStore(t, newMemStore(), "key1 "+testKey1, "key1")
+
+	b, err := s.Create(context.Background(), "blob", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Write([]byte("123456")); err == nil {
+		t.Error("no error for blob larger than declared")
+	}
+	if _, err := b.Write([]byte("1234")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Sync(); err == nil {
+		t.Error("no error for blob smaller than declared")
+	}
+}
+
+func TestTampering(t *testing.T) {
+	backend := newMemStore()
+	s := testStore(t, backend, "key1 "+testKey1, "key1")
+
+	data := make([]byte, 2*chunkSize+10)
+	rand.New(rand.NewSource(1)).Read(data)
+	writeBlob(t, s, "blob", data, true)
+	orig := backend.blobs["blob"]
+	hdrLen := int(headerSize("key1"))
+	chunkLen := chunkSize + tagSize
+
+	check := func(name string, modified []byte) {
+		t.Helper()
+		backend.blobs["blob"] = modified
+		_, err := readBlob(s, "blob")
+		if !errors.Is(err, ErrCorrupted) {
+			t.Errorf("%s: expected ErrCorrupted, got %v", name, err)
+		}
+	}
+
+	flipped := append([]byte(nil), orig...)
+	flipped[hdrLen+chunkLen+5] ^= 1
+	check("modified chunk", flipped)
+
+	flipped = append([]byte(nil), orig...)
+	flipped[hdrLen-1] ^= 1
+	check("modified salt", flipped)
+
+	check("truncated final chunk", orig[:hdrLen+2*chunkLen])
+	check("truncated chunk", orig[:len(orig)-1])
+	check("truncated header", orig[:hdrLen-1])
+
+	swapped := append([]byte(nil), orig[:hdrLen]...)
+	swapped = append(swapped, orig[hdrLen+chunkLen:hdrLen+2*chunkLen]...)
+	swapped = append(swapped, orig[hdrLen:hdrLen+chunkLen]...)
+	swapped = append(swapped, orig[hdrLen+2*chunkLen:]...)
+	check("reordered chunks", swapped)
+
+	check("extended", append(append([]byte(nil), orig...), orig[hdrLen:hdrLen+chunkLen]...))
+}
+
+func TestKeyRotation(t *testing.T) {
+	backend := newMemStore()
+	s1 := testStore(t, backend, "key1 "+testKey1, "key1")
+	writeBlob(t, s1, "old", []byte("old message"), true)
+
+	s2 := testStore(t, backend, "key1 "+testKey1+"\n# new key\nkey2 "+testKey2+"\n", "key2")
+	writeBlob(t, s2, "new", []byte("new message"), true)
+	if !bytes.Contains(backend.blobs["new"], []byte("key2")) {
+		t.Error("new blob does not use the active key")
+	}
+
+	for key, data := range map[string]string{"old": "old message", "new": "new message"} {
+		read, err := readBlob(s2, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(read) != data {
+			t.Errorf("wrong data for %s: %s", key, read)
+		}
+	}
+
+	if _, err := readBlob(s1, "new"); err == nil || !strings.Contains(err.Error(), "unknown key ID") {
+		t.Error("expected unknown key error, got", err)
+	}
+}
+
+func TestKeyCommand(t *testing.T) {
+	dir := testutils.Dir(t)
+	script := filepath.Join(dir, "key.sh")
+	err := os.WriteFile(script, []byte(`#!/bin/sh
+case "$1" in
+	key1) echo `+testKey1+` ;;
+	*) echo "no such key" >&2; exit 1 ;;
+esac
+`), 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := newMemStore()
+	s := testStore(t, backend, "", "key1")
+	s.keys.command = []string{script}
+	writeBlob(t, s, "blob", []byte("message"), true)
+	read, err := readBlob(s, "blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(read) != "message" {
+		t.Error("wrong data:", string(read))
+	}
+
+	if _, err := s.keys.Key(context.Background(), "key2"); err == nil || !strings.Contains(err.Error(), "no such key") {
+		t.Error("expected command error, got", err)
+	}
+}
+
+func TestKeyCommand_Concurrent(t *testing.T) {
+	dir := testutils.Dir(t)
+	script := filepath.Join(dir, "key.sh")
+	calls := filepath.Join(dir, "calls")
+	err := os.WriteFile(script, []byte(`#!/bin/sh
+echo "$1" >> `+calls+`
+case "$1" in
+	key1) sleep 0.2; echo `+testKey1+` ;;
+	slow) sleep 1; echo `+testKey2+` ;;
+	*) echo "no such key" >&2; exit 1 ;;
+esac
+`), 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := &keyring{keys: map[string][]byte{"file": make([]byte, keySize)}, command: []string{script}}
+	countCalls := func(id string) int {
+		t.Helper()
+		data, err := os.ReadFile(calls)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		cnt := 0
+		for _, line := range strings.Split(string(data), "\n") {
+			if line == id {
+				cnt++
+			}
+		}
+		return cnt
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := k.Key(context.Background(), "key1"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if cnt := countCalls("key1"); cnt != 1 {
+		t.Errorf("key command executed %d times for concurrent requests", cnt)
+	}
+
+	// Failures are cached.
+	for i := 0; i < 3; i++ {
+		if _, err := k.Key(context.Background(), "key2"); err == nil || !strings.Contains(err.Error(), "no such key") {
+			t.Error("expected command error, got", err)
+		}
+	}
+	if cnt := countCalls("key2"); cnt != 1 {
+		t.Errorf("key command executed %d times for the missing key", cnt)
+	}
+
+	// Known keys are available while the command is running.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := k.Key(context.Background(), "slow"); err != nil {
+			t.Error(err)
+		}
+	}()
+	for countCalls("slow") == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	start := time.Now()
+	if _, err := k.Key(context.Background(), "file"); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Error("Key blocked by the running key command")
+	}
+	<-done
+}
+
+func TestUnencrypted(t *testing.T) {
+	backend := newMemStore()
+	backend.blobs["plain"] = []byte("Subject: hello\r\n\r\nplaintext")
+	s := testStore(t, backend, "key1 "+testKey1, "key1")
+
+	if _, err := readBlob(s, "plain"); !errors.Is(err, ErrNotEncrypted) {
+		t.Error("expected ErrNotEncrypted, got", err)
+	}
+	s.allowUnencrypted = true
+	read, err := readBlob(s, "plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(read) != "Subject: hello\r\n\r\nplaintext" {
+		t.Error("wrong data:", string(read))
+	}
+}
+
+func TestStore(t *testing.T) {
+	keyFile := filepath.Join(testutils.Dir(t), "keys")
+	if err := os.WriteFile(keyFile, []byte("key1 "+testKey1), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	blob.TestStore(t, func() module.BlobStore {
+		mod, err := New(modName, "", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = mod.Init(config.NewMap(nil, config.Node{
+			Children: []config.Node{
+				{Name: "backend", Args: []string{"fs", testutils.Dir(t)}},
+				{Name: "key_file", Args: []string{keyFile}},
+			},
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mod.(*Store)
+	}, func(module.BlobStore) {})
+}
@@ -0,0 +1,211 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package encrypted
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	keyCommandTimeout = 30 * time.Second
+
+	// keyFailureTTL is the time key command failures are cached for, so
+	// reading many blobs with a missing key does not run the command for
+	// each of them.
+	keyFailureTTL = 30 * time.Second
+)
+
+// keyring provides master keys by their IDs.
+//
+// Keys are loaded from the key file and, if they are not found there,
+// requested from the key command. Keys obtained from the command are cached
+// for the lifetime of the module, failures are cached for keyFailureTTL.
+type keyring struct {
+	// lck protects keys and failures. It is not held while the key command
+	// is running, concurrent requests for the same key share a single
+	// command execution instead.
+	lck      sync.Mutex
+	keys     map[string][]byte
+	failures map[string]keyFailure
+	command  []string
+	cmdGroup singleflight.Group
+
+	// lastFileKey is the ID of the last key in the key file.
+	lastFileKey string
+}
+
+func validKeyID(id string) bool {
+	if len(id) == 0 || len(id) > 255 {
+		return false
+	}
+	for _, ch := range id {
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9':
+		case ch == '-', ch == '_', ch == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// parseKey decodes the 256-bit key from hex or base64 encoding.
+func parseKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if key, err := hex.DecodeString(s); err == nil && len(key) == keySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == keySize {
+		return key, nil
+	}
+	return nil, fmt.Errorf("key should be %d bytes encoded using hex or base64", keySize)
+}
+
+// loadFile reads keys from the file. Each line of the file contains the key
+// ID and the key separated by whitespace, empty lines and lines starting
+// with # are ignored.
+func (k *keyring) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scnr := bufio.NewScanner(f)
+	lineNum := 0
+	for scnr.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scnr.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expected key ID and key", path, lineNum)
+		}
+		if !validKeyID(fields[0]) {
+			return fmt.Errorf("%s:%d: invalid key ID: %s", path, lineNum, fields[0])
+		}
+		key, err := parseKey(fields[1])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, lineNum, err)
+		}
+		if _, ok := k.keys[fields[0]]; ok {
+			return fmt.Errorf("%s:%d: duplicate key ID: %s", path, lineNum, fields[0])
+		}
+		k.keys[fields[0]] = key
+		k.lastFileKey = fields[0]
+	}
+	return scnr.Err()
+}
+
+type keyFailure struct {
+	err   error
+	until time.Time
+}
+
+// Key returns the master key with the specified ID.
+func (k *keyring) Key(ctx context.Context, id string) ([]byte, error) {
+	k.lck.Lock()
+	key, ok := k.keys[id]
+	failure, failed := k.failures[id]
+	k.lck.Unlock()
+
+	if ok {
+		return key, nil
+	}
+	if failed && time.Now().Before(failure.until) {
+		return nil, failure.err
+	}
+	if len(k.command) == 0 {
+		return nil, fmt.Errorf("storage.blob.encrypted: unknown key ID: %s", id)
+	}
+	if !validKeyID(id) {
+		return nil, fmt.Errorf("storage.blob.encrypted: invalid key ID: %q", id)
+	}
+
+	res, err, _ := k.cmdGroup.Do(id, func() (interface{}, error) {
+		key, err := k.runCommand(ctx, id)
+
+		k.lck.Lock()
+		defer k.lck.Unlock()
+		if err != nil {
+			err = fmt.Errorf("storage.blob.encrypted: failed to get key %s: %w", id, err)
+			// Do not cache failures caused by the cancellation of the
+			// request.
+			if ctx.Err() == nil {
+				k.addFailure(id, err)
+			}
+			return nil, err
+		}
+		delete(k.failures, id)
+		k.keys[id] = key
+		return key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.([]byte), nil
+}
+
+// addFailure caches the key command error and removes expired ones. k.lck
+// should be held.
+func (k *keyring) addFailure(id string, err error) {
+	now := time.Now()
+	if k.failures == nil {
+		k.failures = make(map[string]keyFailure)
+	}
+	for failedID, failure := range k.failures {
+		if !now.Before(failure.until) {
+			delete(k.failures, failedID)
+		}
+	}
+	k.failures[id] = keyFailure{err: err, until: now.Add(keyFailureTTL)}
+}
+
+// runCommand executes the key command with the key ID as the last argument.
+// The command should write the key to stdout.
+func (k *keyring) runCommand(ctx context.Context, id string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, keyCommandTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, k.command[0], append(k.command[1:], id)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if stderr.Len() != 0 {
+			return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return nil, err
+	}
+	return parseKey(stdout.String())
+}
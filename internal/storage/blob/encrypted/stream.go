@@ -0,0 +1,313 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package encrypted
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Encrypted blob layout:
+//
+//	magic (7 bytes) | version (1 byte) | key ID length (1 byte) | key ID | salt (32 bytes)
+//	chunk 0 | chunk 1 | ... | final chunk
+//
+// The header is used as additional authenticated data for all chunks. Each
+// chunk contains up to chunkSize bytes of plaintext sealed using AES-256-GCM
+// with the key derived from the master key and the salt. Nonces are built
+// from the chunk index and the flag marking the final chunk so reordering,
+// truncation and extension of the blob are detected.
+const (
+	formatVersion = 1
+	chunkSize     = 64 * 1024
+	tagSize       = 16
+	saltSize      = 32
+	keySize       = 32
+)
+
+var (
+	magic = []byte("\x89MDYENC")
+
+	hkdfInfo = []byte("maddy blob encryption v1")
+
+	ErrNotEncrypted   = errors.New("storage.blob.encrypted: blob is not encrypted")
+	ErrCorrupted      = errors.New("storage.blob.encrypted: blob is corrupted or was modified")
+	ErrUnknownVersion = errors.New("storage.blob.encrypted: unknown blob format version")
+)
+
+// headerSize returns the size of the header for the key ID.
+func headerSize(keyID string) int64 {
+	return int64(len(magic) + 2 + len(keyID) + saltSize)
+}
+
+// encryptedSize returns the size of the encrypted blob for the plaintext
+// size.
+func encryptedSize(keyID string, size int64) int64 {
+	chunks := (size + chunkSize - 1) / chunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return headerSize(keyID) + size + chunks*tagSize
+}
+
+func newHeader(keyID string) ([]byte, error) {
+	hdr := make([]byte, 0, headerSize(keyID))
+	hdr = append(hdr, magic...)
+	hdr = append(hdr, formatVersion, byte(len(keyID)))
+	hdr = append(hdr, keyID...)
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	return append(hdr, salt...), nil
+}
+
+// readHeader reads the header from r and returns it along with the key ID
+// and salt.
+func readHeader(r *bufio.Reader) (hdr []byte, keyID string, salt []byte, err error) {
+	prefix, err := r.Peek(len(magic) + 2)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, "", nil, ErrNotEncrypted
+		}
+		return nil, "", nil, err
+	}
+	if !bytes.Equal(prefix[:len(magic)], magic) {
+		return nil, "", nil, ErrNotEncrypted
+	}
+	if prefix[len(magic)] != formatVersion {
+		return nil, "", nil, ErrUnknownVersion
+	}
+
+	hdr = make([]byte, len(magic)+2+int(prefix[len(magic)+1])+saltSize)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, "", nil, ErrCorrupted
+		}
+		return nil, "", nil, err
+	}
+	keyID = string(hdr[len(magic)+2 : len(hdr)-saltSize])
+	salt = hdr[len(hdr)-saltSize:]
+	return hdr, keyID, salt, nil
+}
+
+func newAEAD(masterKey, salt []byte) (cipher.AEAD, error) {
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, masterKey, salt, hkdfInfo), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(nonce []byte, index uint64, final bool) {
+	for i := range nonce {
+		nonce[i] = 0
+	}
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:len(nonce)-1], index)
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+}
+
+// encryptingBlob encrypts data written to it and writes it to the
+// underlying blob.
+//
+// Data is buffered until the full chunk is available. The chunk is sealed
+// only once more data is written or Sync is called, so the final chunk is
+// always known.
+type encryptingBlob struct {
+	w    module.Blob
+	aead cipher.AEAD
+	hdr  []byte
+
+	buf   []byte
+	out   []byte
+	nonce []byte
+	index uint64
+
+	size    int64
+	written int64
+	err     error
+}
+
+func newEncryptingBlob(w module.Blob, masterKey []byte, keyID string, size int64) (*encryptingBlob, error) {
+	hdr, err := newHeader(keyID)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(masterKey, hdr[len(hdr)-saltSize:])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+	return &encryptingBlob{
+		w:     w,
+		aead:  aead,
+		hdr:   hdr,
+		buf:   make([]byte, 0, chunkSize),
+		out:   make([]byte, 0, chunkSize+tagSize),
+		nonce: make([]byte, aead.NonceSize()),
+		size:  size,
+	}, nil
+}
+
+func (b *encryptingBlob) sealChunk(final bool) error {
+	chunkNonce(b.nonce, b.index, final)
+	b.out = b.aead.Seal(b.out[:0], b.nonce, b.buf, b.hdr)
+	b.index++
+	b.buf = b.buf[:0]
+	_, err := b.w.Write(b.out)
+	return err
+}
+
+func (b *encryptingBlob) Write(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.size >= 0 && b.written+int64(len(p)) > b.size {
+		return 0, fmt.Errorf("storage.blob.encrypted: blob is larger than declared (%d bytes)", b.size)
+	}
+
+	n := 0
+	for len(p) != 0 {
+		if len(b.buf) == chunkSize {
+			if err := b.sealChunk(false); err != nil {
+				b.err = err
+				return n, err
+			}
+		}
+		copied := copy(b.buf[len(b.buf):chunkSize], p)
+		b.buf = b.buf[:len(b.buf)+copied]
+		p = p[copied:]
+		n += copied
+	}
+	b.written += int64(n)
+	return n, nil
+}
+
+func (b *encryptingBlob) Sync() error {
+	if b.err != nil {
+		return b.err
+	}
+	if b.size >= 0 && b.written != b.size {
+		return fmt.Errorf("storage.blob.encrypted: blob is smaller than declared (%d of %d bytes)", b.written, b.size)
+	}
+	if err := b.sealChunk(true); err != nil {
+		b.err = err
+		return err
+	}
+	// Nothing can be written after the final chunk.
+	b.err = errors.New("storage.blob.encrypted: blob is already synced")
+	return b.w.Sync()
+}
+
+func (b *encryptingBlob) Close() error {
+	return b.w.Close()
+}
+
+// decryptingReader reads chunks from the underlying reader and verifies and
+// decrypts them.
+type decryptingReader struct {
+	r    *bufio.Reader
+	c    io.Closer
+	aead cipher.AEAD
+	hdr  []byte
+
+	chunk []byte
+	buf   []byte
+	nonce []byte
+	index uint64
+	done  bool
+}
+
+func newDecryptingReader(r *bufio.Reader, c io.Closer, aead cipher.AEAD, hdr []byte) *decryptingReader {
+	return &decryptingReader{
+		r:     r,
+		c:     c,
+		aead:  aead,
+		hdr:   hdr,
+		chunk: make([]byte, chunkSize+tagSize),
+		nonce: make([]byte, aead.NonceSize()),
+	}
+}
+
+func (d *decryptingReader) readChunk() error {
+	n, err := io.ReadFull(d.r, d.chunk)
+	final := false
+	switch {
+	case err == nil:
+		if _, err := d.r.Peek(1); err != nil {
+			if !errors.Is(err, io.EOF) {
+				return err
+			}
+			final = true
+		}
+	case errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF):
+		final = true
+	default:
+		return err
+	}
+	if n < tagSize {
+		return ErrCorrupted
+	}
+
+	chunkNonce(d.nonce, d.index, final)
+	d.buf, err = d.aead.Open(d.chunk[:0], d.nonce, d.chunk[:n], d.hdr)
+	if err != nil {
+		return ErrCorrupted
+	}
+	d.index++
+	d.done = final
+	return nil
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func (d *decryptingReader) Close() error {
+	return d.c.Close()
+}
@@ -46,6 +46,9 @@ func (s *FSStore) Init(cfg *config.Map) error {
 		return config.NodeErr(cfg.Block, "storage.blob.fs: directory not set")
 	}
 
+	if module.DryRun {
+		return nil
+	}
 	if err := os.MkdirAll(s.root, os.ModeDir|os.ModePerm); err != nil {
 		return err
 	}
@@ -89,7 +92,34 @@ func (s *FSStore) Delete(_ context.Context, keys []string) error {
 	return nil
 }
 
+func (s *FSStore) List(_ context.Context, fn func(module.BlobInfo) error) error {
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if err := fn(module.BlobInfo{
+			Key:     entry.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func init() {
-	var _ module.BlobStore = &FSStore{}
+	var _ module.ListableBlobStore = &FSStore{}
 	module.Register(FSStore{}.Name(), New)
 }
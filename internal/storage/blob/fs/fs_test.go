@@ -17,3 +17,7 @@ func TestFS(t *testing.T) {
 		os.RemoveAll(store.(*FSStore).root)
 	})
 }
+
+func TestFSList(t *testing.T) {
+	blob.TestList(t, &FSStore{instName: "test", root: testutils.Dir(t)})
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/log"
@@ -190,7 +191,31 @@ func (s *Store) Delete(ctx context.Context, keys []string) error {
 	return lastErr
 }
 
+func (s *Store) List(ctx context.Context, fn func(module.BlobInfo) error) error {
+	// Stops the listing goroutine if fn fails.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	objs := s.cl.ListObjects(ctx, s.bucketName, minio.ListObjectsOptions{
+		Prefix:    s.objectPrefix,
+		Recursive: true,
+	})
+	for obj := range objs {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		if err := fn(module.BlobInfo{
+			Key:     strings.TrimPrefix(obj.Key, s.objectPrefix),
+			Size:    obj.Size,
+			ModTime: obj.LastModified,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func init() {
-	var _ module.BlobStore = &Store{}
+	var _ module.ListableBlobStore = &Store{}
 	module.Register(modName, New)
 }
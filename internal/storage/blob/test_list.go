@@ -0,0 +1,59 @@
+package blob
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+func TestList(t *testing.T, store module.ListableBlobStore) {
+	ctx := context.Background()
+	blobs := map[string]string{
+		"a": "removed",
+		"b": "hello",
+		"c": "hello world",
+	}
+	for key, body := range blobs {
+		w, err := store.Create(ctx, key, int64(len(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Delete(ctx, []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var listed []module.BlobInfo
+	err := store.List(ctx, func(info module.BlobInfo) error {
+		listed = append(listed, info)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(listed, func(i, j int) bool { return listed[i].Key < listed[j].Key })
+
+	if len(listed) != 2 || listed[0].Key != "b" || listed[1].Key != "c" {
+		t.Fatalf("wrong blobs listed: %+v", listed)
+	}
+	for _, info := range listed {
+		if info.Size != int64(len(blobs[info.Key])) {
+			t.Errorf("wrong size for %s: %d", info.Key, info.Size)
+		}
+		if time.Since(info.ModTime) > time.Hour || time.Until(info.ModTime) > time.Hour {
+			t.Errorf("wrong mod time for %s: %v", info.Key, info.ModTime)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// Rights defined by RFC 4314, in the canonical order.
+const aclAllRights = "lrswipkxtea"
+
+const (
+	// ACLAnyone is the identifier matching any authenticated account.
+	ACLAnyone = "anyone"
+	// ACLGroupPrefix is the prefix of identifiers referring to groups
+	// defined by acl_groups table.
+	ACLGroupPrefix = "$"
+)
+
+var ErrPermissionDenied = errors.New("Permission denied")
+
+// canonicalRights returns the set of rights in the canonical order without
+// duplicates.
+func canonicalRights(rights string) string {
+	var b strings.Builder
+	for _, r := range aclAllRights {
+		if strings.ContainsRune(rights, r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// hasRights reports whether all rights in need are present in rights.
+func hasRights(rights, need string) bool {
+	for _, r := range need {
+		if !strings.ContainsRune(rights, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// expandRights validates the rights string and converts obsolete RFC 2086
+// rights to RFC 4314 ones ("c" is "k", "d" is "xte").
+func expandRights(rights string) (string, error) {
+	var b strings.Builder
+	for _, r := range rights {
+		switch {
+		case r == 'c':
+			b.WriteString("k")
+		case r == 'd':
+			b.WriteString("xte")
+		case strings.ContainsRune(aclAllRights, r):
+			b.WriteRune(r)
+		default:
+			return "", fmt.Errorf("imapsql: unknown right: %q", r)
+		}
+	}
+	return canonicalRights(b.String()), nil
+}
+
+// applyRights applies the SETACL rights modification to the current rights.
+// Rights prefixed with "+" are added, rights prefixed with "-" are removed,
+// otherwise current rights are replaced.
+func applyRights(current, mod string) (string, error) {
+	switch {
+	case strings.HasPrefix(mod, "+"):
+		add, err := expandRights(mod[1:])
+		if err != nil {
+			return "", err
+		}
+		return canonicalRights(current + add), nil
+	case strings.HasPrefix(mod, "-"):
+		remove, err := expandRights(mod[1:])
+		if err != nil {
+			return "", err
+		}
+		var b strings.Builder
+		for _, r := range current {
+			if !strings.ContainsRune(remove, r) {
+				b.WriteRune(r)
+			}
+		}
+		return b.String(), nil
+	default:
+		return expandRights(mod)
+	}
+}
+
+func normalizeIdentifier(identifier string) (string, error) {
+	if identifier == "" {
+		return "", errors.New("imapsql: empty ACL identifier")
+	}
+	if strings.HasPrefix(identifier, "-") {
+		return "", errors.New("imapsql: negative rights are not supported")
+	}
+	return strings.ToLower(identifier), nil
+}
+
+func (store *Storage) initACL() error {
+	_, err := store.Back.DB.Exec(`CREATE TABLE IF NOT EXISTS mboxACL (
+		mboxId BIGINT NOT NULL REFERENCES mboxes(id) ON DELETE CASCADE,
+		identifier VARCHAR(255) NOT NULL,
+		rights VARCHAR(32) NOT NULL,
+		PRIMARY KEY (mboxId, identifier)
+	)`)
+	if err != nil {
+		return fmt.Errorf("imapsql: failed to create ACL table: %w", err)
+	}
+	return nil
+}
+
+// mboxID returns the ID of the mailbox. backend.ErrNoSuchMailbox is
+// returned if it does not exist.
+func (store *Storage) mboxID(ctx context.Context, username, mbox string) (int64, error) {
+	if strings.EqualFold(mbox, imap.InboxName) {
+		mbox = imap.InboxName
+	}
+
+	var id int64
+	err := store.Back.DB.QueryRowContext(ctx, store.rebind(`
+		SELECT mboxes.id FROM mboxes
+		INNER JOIN users ON users.id = mboxes.uid
+		WHERE users.username = ? AND mboxes.name = ?`), strings.ToLower(username), mbox).Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, backend.ErrNoSuchMailbox
+		}
+		return 0, fmt.Errorf("imapsql: %w", err)
+	}
+	return id, nil
+}
+
+func (store *Storage) mailboxACL(ctx context.Context, mboxID int64) (map[string]string, error) {
+	rows, err := store.Back.DB.QueryContext(ctx, store.rebind(`
+		SELECT identifier, rights FROM mboxACL WHERE mboxId = ?`), mboxID)
+	if err != nil {
+		return nil, fmt.Errorf("imapsql: %w", err)
+	}
+	defer rows.Close()
+
+	acl := make(map[string]string)
+	for rows.Next() {
+		var identifier, rights string
+		if err := rows.Scan(&identifier, &rights); err != nil {
+			return nil, fmt.Errorf("imapsql: %w", err)
+		}
+		acl[identifier] = rights
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("imapsql: %w", err)
+	}
+	return acl, nil
+}
+
+func (store *Storage) setMailboxACL(ctx context.Context, mboxID int64, identifier, rights string) error {
+	identifier, err := normalizeIdentifier(identifier)
+	if err != nil {
+		return err
+	}
+
+	tx, err := store.Back.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("imapsql: %w", err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	var current string
+	err = tx.QueryRowContext(ctx, store.rebind(`
+		SELECT rights FROM mboxACL WHERE mboxId = ? AND identifier = ?`), mboxID, identifier).Scan(&current)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("imapsql: %w", err)
+	}
+
+	newRights, err := applyRights(current, rights)
+	if err != nil {
+		return err
+	}
+	if newRights == "" {
+		_, err = tx.ExecContext(ctx, store.rebind(`
+			DELETE FROM mboxACL WHERE mboxId = ? AND identifier = ?`), mboxID, identifier)
+	} else {
+		_, err = tx.ExecContext(ctx, store.rebind(`
+			INSERT INTO mboxACL(mboxId, identifier, rights) VALUES (?, ?, ?)
+			ON CONFLICT (mboxId, identifier) DO UPDATE SET rights = excluded.rights`), mboxID, identifier, newRights)
+	}
+	if err != nil {
+		return fmt.Errorf("imapsql: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("imapsql: %w", err)
+	}
+	return nil
+}
+
+func (store *Storage) deleteMailboxACL(ctx context.Context, mboxID int64, identifier string) error {
+	identifier, err := normalizeIdentifier(identifier)
+	if err != nil {
+		return err
+	}
+	_, err = store.Back.DB.ExecContext(ctx, store.rebind(`
+		DELETE FROM mboxACL WHERE mboxId = ? AND identifier = ?`), mboxID, identifier)
+	if err != nil {
+		return fmt.Errorf("imapsql: %w", err)
+	}
+	return nil
+}
+
+// aclIdentifiers returns the list of ACL identifiers that apply to the
+// account.
+func (store *Storage) aclIdentifiers(ctx context.Context, username string) ([]string, error) {
+	ids := []string{strings.ToLower(username), ACLAnyone}
+	if store.aclGroups == nil {
+		return ids, nil
+	}
+
+	var groups []string
+	if multi, ok := store.aclGroups.(module.MultiTable); ok {
+		var err error
+		groups, err = multi.LookupMulti(ctx, username)
+		if err != nil {
+			return nil, fmt.Errorf("imapsql: acl_groups: %w", err)
+		}
+	} else {
+		group, ok, err := store.aclGroups.Lookup(ctx, username)
+		if err != nil {
+			return nil, fmt.Errorf("imapsql: acl_groups: %w", err)
+		}
+		if ok {
+			groups = []string{group}
+		}
+	}
+	for _, group := range groups {
+		ids = append(ids, ACLGroupPrefix+strings.ToLower(group))
+	}
+	return ids, nil
+}
+
+type sharedMailbox struct {
+	owner string
+	id    int64
+	// Mailbox name in the owner account.
+	name   string
+	rights string
+}
+
+// sharedMailboxes returns mailboxes of other accounts the account has any
+// rights for, sorted by owner and name.
+func (store *Storage) sharedMailboxes(ctx context.Context, username string) ([]sharedMailbox, error) {
+	ids, err := store.aclIdentifiers(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]interface{}, 0, len(ids)+1)
+	args = append(args, strings.ToLower(username))
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	rows, err := store.Back.DB.QueryContext(ctx, store.rebind(`
+		SELECT users.username, mboxes.id, mboxes.name, mboxACL.rights
+		FROM mboxACL
+		INNER JOIN mboxes ON mboxes.id = mboxACL.mboxId
+		INNER JOIN users ON users.id = mboxes.uid
+		WHERE users.username <> ? AND mboxACL.identifier IN (?`+strings.Repeat(", ?", len(ids)-1)+`)
+		ORDER BY users.username, mboxes.name`), args...)
+	if err != nil {
+		return nil, fmt.Errorf("imapsql: %w", err)
+	}
+	defer rows.Close()
+
+	var res []sharedMailbox
+	for rows.Next() {
+		var mbox sharedMailbox
+		if err := rows.Scan(&mbox.owner, &mbox.id, &mbox.name, &mbox.rights); err != nil {
+			return nil, fmt.Errorf("imapsql: %w", err)
+		}
+		// Rights granted via multiple identifiers are combined.
+		if len(res) != 0 && res[len(res)-1].id == mbox.id {
+			res[len(res)-1].rights = canonicalRights(res[len(res)-1].rights + mbox.rights)
+			continue
+		}
+		res = append(res, mbox)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("imapsql: %w", err)
+	}
+	return res, nil
+}
+
+// GetACL returns the access control list of the mailbox. The mailbox owner
+// is not included, it always has all rights.
+func (store *Storage) GetACL(username, mbox string) (map[string]string, error) {
+	id, err := store.mboxID(context.TODO(), username, mbox)
+	if err != nil {
+		return nil, err
+	}
+	return store.mailboxACL(context.TODO(), id)
+}
+
+// SetACL changes rights of the identifier for the mailbox. rights can be
+// prefixed with "+" or "-" to add or remove rights instead of replacing
+// them.
+func (store *Storage) SetACL(username, mbox, identifier, rights string) error {
+	if strings.EqualFold(identifier, username) {
+		return errors.New("imapsql: rights of the mailbox owner cannot be changed")
+	}
+	id, err := store.mboxID(context.TODO(), username, mbox)
+	if err != nil {
+		return err
+	}
+	return store.setMailboxACL(context.TODO(), id, identifier, rights)
+}
+
+// DeleteACL removes all rights of the identifier for the mailbox.
+func (store *Storage) DeleteACL(username, mbox, identifier string) error {
+	id, err := store.mboxID(context.TODO(), username, mbox)
+	if err != nil {
+		return err
+	}
+	return store.deleteMailboxACL(context.TODO(), id, identifier)
+}
@@ -0,0 +1,228 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestApplyRights(t *testing.T) {
+	for _, c := range []struct {
+		current, mod, res string
+		fail              bool
+	}{
+		{"", "rl", "lr", false},
+		{"lr", "+ws", "lrsw", false},
+		{"lrsw", "-sr", "lw", false},
+		{"lr", "-lr", "", false},
+		{"", "lrcd", "lrkxte", false},
+		{"lr", "lr?", "", true},
+	} {
+		res, err := applyRights(c.current, c.mod)
+		if c.fail {
+			if err == nil {
+				t.Errorf("%q %q: no error", c.current, c.mod)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q %q: %v", c.current, c.mod, err)
+			continue
+		}
+		if res != c.res {
+			t.Errorf("%q %q: expected %q, got %q", c.current, c.mod, c.res, res)
+		}
+	}
+}
+
+func addTestMessage(t *testing.T, store *Storage, username, mbox string) {
+	t.Helper()
+	u, err := store.GetIMAPAcct(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := bytes.NewReader([]byte("Subject: test\r\n\r\nHello!\r\n"))
+	if err := u.CreateMessage(mbox, nil, time.Now(), body, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkMessages(t *testing.T, u backend.User, mbox string, count uint32) {
+	t.Helper()
+	status, err := u.Status(mbox, []imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(mbox, err)
+	}
+	if status.Messages != count {
+		t.Errorf("%s: expected %d messages, got %d", mbox, count, status.Messages)
+	}
+}
+
+func TestSharedMailbox(t *testing.T) {
+	store, _ := createTestStorage(t)
+	store.aclGroups = testutils.Table{M: map[string]string{
+		"carol@example.org": "support",
+	}}
+
+	for _, name := range []string{"alice@example.org", "bob@example.org", "carol@example.org", "dave@example.org"} {
+		if err := store.CreateIMAPAcct(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice, err := store.GetIMAPAcct("alice@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.CreateMailbox("Support"); err != nil {
+		t.Fatal(err)
+	}
+	addTestMessage(t, store, "alice@example.org", "Support")
+
+	if err := store.SetACL("alice@example.org", "Support", "bob@example.org", "lrs"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetACL("alice@example.org", "Support", "$support", "lr"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetACL("alice@example.org", "Support", "alice@example.org", "lr"); err == nil {
+		t.Error("owner rights changed")
+	}
+
+	bob, err := store.GetOrCreateIMAPAcct("bob@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	carol, err := store.GetOrCreateIMAPAcct("carol@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dave, err := store.GetOrCreateIMAPAcct("dave@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const shared = "Shared.alice@example.org.Support"
+
+	mboxes, err := bob.ListMailboxes(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string][]string)
+	for _, info := range mboxes {
+		names[info.Name] = info.Attributes
+	}
+	for _, name := range []string{"INBOX", "Shared", "Shared.alice@example.org", shared} {
+		if _, ok := names[name]; !ok {
+			t.Errorf("%s is not listed: %v", name, names)
+		}
+	}
+	if attrs := names["Shared.alice@example.org"]; len(attrs) == 0 || attrs[0] != imap.NoSelectAttr {
+		t.Errorf("owner node is not \\Noselect: %v", attrs)
+	}
+
+	checkMessages(t, bob, shared, 1)
+	checkMessages(t, carol, shared, 1)
+	if _, err := dave.Status(shared, []imap.StatusItem{imap.StatusMessages}); !errors.Is(err, backend.ErrNoSuchMailbox) {
+		t.Error("dave has access to the shared mailbox:", err)
+	}
+
+	// Inserting messages requires 'i' right.
+	body := bytes.NewReader([]byte("Subject: test\r\n\r\nHello!\r\n"))
+	if err := bob.CreateMessage(shared, nil, time.Now(), body, nil); !errors.Is(err, ErrPermissionDenied) {
+		t.Error("message created without 'i' right:", err)
+	}
+	if err := store.SetACL("alice@example.org", "Support", "bob@example.org", "+i"); err != nil {
+		t.Fatal(err)
+	}
+	body = bytes.NewReader([]byte("Subject: test\r\n\r\nHello!\r\n"))
+	if err := bob.CreateMessage(shared, []string{imap.DeletedFlag}, time.Now(), body, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkMessages(t, alice, "Support", 2)
+
+	// Messages are copied between accounts, but flags are not changed
+	// without rights.
+	_, mbox, err := bob.GetMailbox(shared, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, _ := imap.ParseSeqSet("1:*")
+	if err := mbox.CopyMessages(true, seq, "INBOX"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mbox.UpdateMessagesFlags(true, seq, imap.AddFlags, true, []string{imap.DeletedFlag}); !errors.Is(err, ErrPermissionDenied) {
+		t.Error("flags changed without 't' right:", err)
+	}
+	if err := mbox.Expunge(); !errors.Is(err, ErrPermissionDenied) {
+		t.Error("expunge without 'e' right:", err)
+	}
+	mbox.Close()
+	checkMessages(t, bob, "INBOX", 2)
+	checkMessages(t, alice, "INBOX", 0)
+
+	// ACL can be managed only with 'a' right.
+	aclBob := bob.(*aclUser)
+	if _, err := aclBob.GetACL(shared); !errors.Is(err, ErrPermissionDenied) {
+		t.Error("GETACL without 'a' right:", err)
+	}
+	rights, err := aclBob.MyRights(shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rights != "lrsi" {
+		t.Errorf("wrong rights: %s", rights)
+	}
+	if err := store.SetACL("alice@example.org", "Support", "bob@example.org", "+ka"); err != nil {
+		t.Fatal(err)
+	}
+	if err := aclBob.SetACL(shared, "dave@example.org", "lr"); err != nil {
+		t.Fatal(err)
+	}
+	checkMessages(t, dave, shared, 2)
+
+	// Child mailboxes inherit ACL of the parent.
+	if err := bob.CreateMailbox(shared + ".Archive"); err != nil {
+		t.Fatal(err)
+	}
+	checkMessages(t, dave, shared+".Archive", 0)
+	acl, err := store.GetACL("alice@example.org", "Support.Archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acl["bob@example.org"] != "lrsika" || acl["dave@example.org"] != "lr" || acl["$support"] != "lr" {
+		t.Errorf("wrong inherited ACL: %v", acl)
+	}
+
+	if err := alice.DeleteMailbox("Support"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Status(shared, []imap.StatusItem{imap.StatusMessages}); !errors.Is(err, backend.ErrNoSuchMailbox) {
+		t.Error("removed mailbox is still accessible:", err)
+	}
+}
@@ -0,0 +1,872 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	namespace "github.com/foxcpp/go-imap-namespace"
+	imapsql "github.com/foxcpp/go-imap-sql"
+)
+
+// aclUser wraps go-imap-sql account to provide access to mailboxes of other
+// accounts shared using ACLs (RFC 4314).
+//
+// Shared mailboxes are visible under the shared namespace as
+// "<shared_namespace>.<owner>.<mailbox>".
+type aclUser struct {
+	*imapsql.User
+	store *Storage
+}
+
+// mailboxRef is the result of the mailbox name resolution.
+type mailboxRef struct {
+	// Name visible to the client.
+	clientName string
+	// Owner account and the name of the mailbox in it. owner is empty for
+	// mailboxes of the account itself.
+	owner string
+	name  string
+	// Rights of the account for the mailbox. Empty if the mailbox does not
+	// exist.
+	rights string
+}
+
+func (r mailboxRef) shared() bool {
+	return r.owner != ""
+}
+
+// check returns the error if the required rights are not granted. Mailboxes
+// without the lookup right are reported as not existing.
+func (r mailboxRef) check(need string) error {
+	if hasRights(r.rights, need) {
+		return nil
+	}
+	if !hasRights(r.rights, "l") {
+		return backend.ErrNoSuchMailbox
+	}
+	return ErrPermissionDenied
+}
+
+func (u *aclUser) sharedPrefix() string {
+	return u.store.sharedNamespace + imapsql.MailboxPathSep
+}
+
+func (u *aclUser) resolve(name string) (mailboxRef, error) {
+	if !strings.HasPrefix(name, u.sharedPrefix()) {
+		return mailboxRef{clientName: name, name: name, rights: aclAllRights}, nil
+	}
+
+	shared, err := u.store.sharedMailboxes(context.TODO(), u.Username())
+	if err != nil {
+		return mailboxRef{}, err
+	}
+
+	// Account names usually contain the hierarchy delimiter so the owner
+	// can be found only by matching the name against accounts that shared
+	// something.
+	rest := strings.TrimPrefix(name, u.sharedPrefix())
+	ref := mailboxRef{clientName: name}
+	for _, mbox := range shared {
+		if len(mbox.owner) > len(ref.owner) && strings.HasPrefix(rest, mbox.owner+imapsql.MailboxPathSep) {
+			ref.owner = mbox.owner
+		}
+	}
+	if ref.owner == "" {
+		return mailboxRef{}, backend.ErrNoSuchMailbox
+	}
+	ref.name = strings.TrimPrefix(rest, ref.owner+imapsql.MailboxPathSep)
+	for _, mbox := range shared {
+		if mbox.owner == ref.owner && mbox.name == ref.name {
+			ref.rights = mbox.rights
+		}
+	}
+	return ref, nil
+}
+
+// resolveParent returns the reference to the parent of the mailbox that is
+// going to be created.
+func (u *aclUser) resolveParent(ref mailboxRef) (mailboxRef, error) {
+	idx := strings.LastIndex(ref.name, imapsql.MailboxPathSep)
+	if idx == -1 {
+		// Creating top-level mailboxes in other accounts is not allowed.
+		return mailboxRef{}, ErrPermissionDenied
+	}
+	return u.resolve(u.sharedPrefix() + ref.owner + imapsql.MailboxPathSep + ref.name[:idx])
+}
+
+func (u *aclUser) owner(ref mailboxRef) (*imapsql.User, error) {
+	if !ref.shared() {
+		return u.User, nil
+	}
+	owner, err := u.store.Back.GetUser(ref.owner)
+	if err != nil {
+		return nil, err
+	}
+	return owner.(*imapsql.User), nil
+}
+
+// ownerName returns the name of the account that owns the mailbox.
+func (u *aclUser) ownerName(ref mailboxRef) string {
+	if !ref.shared() {
+		return u.Username()
+	}
+	return ref.owner
+}
+
+func (u *aclUser) ListMailboxes(subscribed bool) ([]imap.MailboxInfo, error) {
+	mboxes, err := u.User.ListMailboxes(subscribed)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := u.store.sharedMailboxes(context.TODO(), u.Username())
+	if err != nil {
+		return nil, err
+	}
+
+	// Shared mailboxes cannot be subscribed separately, they are always
+	// listed. Parents of shared mailboxes are listed as \Noselect.
+	var (
+		visible     = make(map[string]bool)
+		hasChildren = make(map[string]bool)
+	)
+	addParent := func(name string) {
+		if _, ok := visible[name]; !ok {
+			visible[name] = false
+		}
+		hasChildren[name] = true
+	}
+	for _, mbox := range shared {
+		if !hasRights(mbox.rights, "l") {
+			continue
+		}
+		ownerNode := u.sharedPrefix() + mbox.owner
+		name := ownerNode + imapsql.MailboxPathSep + mbox.name
+		visible[name] = true
+
+		for parent := mbox.name; ; {
+			idx := strings.LastIndex(parent, imapsql.MailboxPathSep)
+			if idx == -1 {
+				break
+			}
+			parent = parent[:idx]
+			addParent(ownerNode + imapsql.MailboxPathSep + parent)
+		}
+		addParent(ownerNode)
+		addParent(u.store.sharedNamespace)
+	}
+	names := make([]string, 0, len(visible))
+	for name := range visible {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		info := imap.MailboxInfo{
+			Delimiter: imapsql.MailboxPathSep,
+			Name:      name,
+		}
+		if !visible[name] {
+			info.Attributes = append(info.Attributes, imap.NoSelectAttr)
+		}
+		if hasChildren[name] {
+			info.Attributes = append(info.Attributes, imap.HasChildrenAttr)
+		} else {
+			info.Attributes = append(info.Attributes, imap.HasNoChildrenAttr)
+		}
+		mboxes = append(mboxes, info)
+	}
+
+	return mboxes, nil
+}
+
+func (u *aclUser) GetMailbox(name string, readOnly bool, conn backend.Conn) (*imap.MailboxStatus, backend.Mailbox, error) {
+	ref, err := u.resolve(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := ref.check("r"); err != nil {
+		return nil, nil, err
+	}
+	owner, err := u.owner(ref)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Without the 's' right, FETCH should not set \Seen implicitly.
+	status, mbox, err := owner.GetMailbox(ref.name, readOnly || !hasRights(ref.rights, "s"), conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	if status != nil && ref.shared() {
+		status.Name = name
+		if !strings.ContainsAny(ref.rights, "swtei") {
+			status.ReadOnly = true
+		}
+	}
+
+	// Modification sequences are stored by mailbox ID.
+	id, err := u.store.mboxID(context.TODO(), owner.Username(), ref.name)
+	if err != nil {
+		mbox.Close()
+		return nil, nil, err
+	}
+
+	return status, &aclMailbox{
+		Mailbox: mbox.(*imapsql.Mailbox),
+		user:    u,
+		ref:     ref,
+		id:      id,
+	}, nil
+}
+
+func (u *aclUser) Status(name string, items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	ref, err := u.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if ref.shared() {
+		if err := ref.check("r"); err != nil {
+			return nil, err
+		}
+	}
+	owner, err := u.owner(ref)
+	if err != nil {
+		return nil, err
+	}
+	status, err := owner.Status(ref.name, items)
+	if err != nil {
+		return nil, err
+	}
+	status.Name = name
+
+	if u.store.modSeq && hasModSeqItem(items) {
+		ctx := context.TODO()
+		id, err := u.store.mboxID(ctx, owner.Username(), ref.name)
+		if err != nil {
+			return nil, err
+		}
+		modSeq, err := u.store.highestModSeq(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		status.Items[modSeqStatusItem] = imap.RawString(strconv.FormatUint(modSeq, 10))
+	}
+	return status, nil
+}
+
+func (u *aclUser) SetSubscribed(name string, subscribed bool) error {
+	ref, err := u.resolve(name)
+	if err != nil {
+		return err
+	}
+	if !ref.shared() {
+		return u.User.SetSubscribed(name, subscribed)
+	}
+	return ref.check("l")
+}
+
+// allowedFlags filters out flags the account has no rights to set.
+func allowedFlags(rights string, flags []string) []string {
+	res := make([]string, 0, len(flags))
+	for _, flag := range flags {
+		if hasRights(rights, flagRight(flag)) {
+			res = append(res, flag)
+		}
+	}
+	return res
+}
+
+func flagRight(flag string) string {
+	switch flag {
+	case imap.SeenFlag:
+		return "s"
+	case imap.DeletedFlag:
+		return "t"
+	default:
+		return "w"
+	}
+}
+
+func (u *aclUser) CreateMessage(name string, flags []string, date time.Time, body imap.Literal, selected backend.Mailbox) error {
+	ref, err := u.resolve(name)
+	if err != nil {
+		return err
+	}
+	if ref.shared() {
+		if err := ref.check("i"); err != nil {
+			return err
+		}
+	}
+
+	// Messages appended to the junk mailbox are submitted as spam.
+	var pending *pendingTraining
+	if u.store.training != nil {
+		junk, _, err := u.store.trainingMailbox(context.TODO(), u.ownerName(ref), ref.name)
+		if err != nil {
+			u.store.Log.Error("failed to check the mailbox for training", err, "account", u.ownerName(ref), "mbox", ref.name)
+		}
+		if junk {
+			pending = u.store.startTraining(context.TODO(), u.ownerName(ref), ref.name, true, 1)
+		}
+	}
+
+	if !ref.shared() {
+		err = u.User.CreateMessage(name, flags, date, body, selected)
+	} else {
+		var owner *imapsql.User
+		owner, err = u.owner(ref)
+		if err != nil {
+			return err
+		}
+		err = owner.CreateMessage(ref.name, allowedFlags(ref.rights, flags), date, body, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	u.store.finishTraining(context.TODO(), pending)
+	return nil
+}
+
+func (u *aclUser) CreateMailbox(name string) error {
+	ref, err := u.resolve(name)
+	if err != nil {
+		return err
+	}
+	if !ref.shared() {
+		return u.User.CreateMailbox(name)
+	}
+	if ref.rights != "" {
+		return backend.ErrMailboxAlreadyExists
+	}
+	parent, err := u.resolveParent(ref)
+	if err != nil {
+		return err
+	}
+	if err := parent.check("k"); err != nil {
+		return err
+	}
+	owner, err := u.owner(ref)
+	if err != nil {
+		return err
+	}
+	if err := owner.CreateMailbox(ref.name); err != nil {
+		return err
+	}
+
+	// New mailbox inherits the ACL of the parent, otherwise it would not
+	// be accessible to the account that created it.
+	ctx := context.TODO()
+	parentID, err := u.store.mboxID(ctx, parent.owner, parent.name)
+	if err != nil {
+		return err
+	}
+	id, err := u.store.mboxID(ctx, ref.owner, ref.name)
+	if err != nil {
+		return err
+	}
+	acl, err := u.store.mailboxACL(ctx, parentID)
+	if err != nil {
+		return err
+	}
+	for identifier, rights := range acl {
+		if err := u.store.setMailboxACL(ctx, id, identifier, rights); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *aclUser) CreateMailboxSpecial(name, specialUseAttr string) error {
+	if strings.HasPrefix(name, u.sharedPrefix()) {
+		return ErrPermissionDenied
+	}
+	return u.User.CreateMailboxSpecial(name, specialUseAttr)
+}
+
+func (u *aclUser) DeleteMailbox(name string) error {
+	ref, err := u.resolve(name)
+	if err != nil {
+		return err
+	}
+	if !ref.shared() {
+		return u.User.DeleteMailbox(name)
+	}
+	if err := ref.check("x"); err != nil {
+		return err
+	}
+	owner, err := u.owner(ref)
+	if err != nil {
+		return err
+	}
+	return owner.DeleteMailbox(ref.name)
+}
+
+func (u *aclUser) RenameMailbox(existingName, newName string) error {
+	src, err := u.resolve(existingName)
+	if err != nil {
+		return err
+	}
+	dst, err := u.resolve(newName)
+	if err != nil {
+		if errors.Is(err, backend.ErrNoSuchMailbox) {
+			return ErrPermissionDenied
+		}
+		return err
+	}
+	if !src.shared() && !dst.shared() {
+		return u.User.RenameMailbox(existingName, newName)
+	}
+	if src.owner != dst.owner {
+		return errors.New("Mailboxes cannot be moved between accounts")
+	}
+
+	if err := src.check("x"); err != nil {
+		return err
+	}
+	if dst.rights != "" {
+		return backend.ErrMailboxAlreadyExists
+	}
+	parent, err := u.resolveParent(dst)
+	if err != nil {
+		return err
+	}
+	if err := parent.check("k"); err != nil {
+		return err
+	}
+	owner, err := u.owner(src)
+	if err != nil {
+		return err
+	}
+	return owner.RenameMailbox(src.name, dst.name)
+}
+
+func (u *aclUser) Namespaces() (personal, other, shared []namespace.Namespace, err error) {
+	personal, other, _, err = u.User.Namespaces()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return personal, other, []namespace.Namespace{
+		{
+			Prefix:    u.sharedPrefix(),
+			Delimiter: imapsql.MailboxPathSep,
+		},
+	}, nil
+}
+
+// aclMailbox returns the ACL-related information about the mailbox.
+// Personal mailboxes have the account as the owner.
+func (u *aclUser) aclMailbox(name string) (mailboxRef, int64, error) {
+	ref, err := u.resolve(name)
+	if err != nil {
+		return mailboxRef{}, 0, err
+	}
+	owner := ref.owner
+	if !ref.shared() {
+		owner = u.Username()
+	}
+	id, err := u.store.mboxID(context.TODO(), owner, ref.name)
+	if err != nil {
+		return mailboxRef{}, 0, err
+	}
+	ref.owner = owner
+	return ref, id, nil
+}
+
+// GetACL implements the GETACL command.
+func (u *aclUser) GetACL(name string) (map[string]string, error) {
+	ref, id, err := u.aclMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := ref.check("a"); err != nil {
+		return nil, err
+	}
+	acl, err := u.store.mailboxACL(context.TODO(), id)
+	if err != nil {
+		return nil, err
+	}
+	acl[ref.owner] = aclAllRights
+	return acl, nil
+}
+
+// SetACL implements the SETACL command.
+func (u *aclUser) SetACL(name, identifier, rights string) error {
+	ref, id, err := u.aclMailbox(name)
+	if err != nil {
+		return err
+	}
+	if err := ref.check("a"); err != nil {
+		return err
+	}
+	if strings.EqualFold(identifier, ref.owner) {
+		return errors.New("Rights of the mailbox owner cannot be changed")
+	}
+	return u.store.setMailboxACL(context.TODO(), id, identifier, rights)
+}
+
+// DeleteACL implements the DELETEACL command.
+func (u *aclUser) DeleteACL(name, identifier string) error {
+	ref, id, err := u.aclMailbox(name)
+	if err != nil {
+		return err
+	}
+	if err := ref.check("a"); err != nil {
+		return err
+	}
+	if strings.EqualFold(identifier, ref.owner) {
+		return errors.New("Rights of the mailbox owner cannot be changed")
+	}
+	return u.store.deleteMailboxACL(context.TODO(), id, identifier)
+}
+
+// MyRights implements the MYRIGHTS command.
+func (u *aclUser) MyRights(name string) (string, error) {
+	ref, _, err := u.aclMailbox(name)
+	if err != nil {
+		return "", err
+	}
+	if ref.rights == "" {
+		return "", backend.ErrNoSuchMailbox
+	}
+	return ref.rights, nil
+}
+
+// ListRights implements the LISTRIGHTS command.
+func (u *aclUser) ListRights(name, identifier string) (required string, optional []string, err error) {
+	ref, _, err := u.aclMailbox(name)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := ref.check("a"); err != nil {
+		return "", nil, err
+	}
+	if strings.EqualFold(identifier, ref.owner) {
+		return aclAllRights, nil, nil
+	}
+	for _, r := range aclAllRights {
+		optional = append(optional, string(r))
+	}
+	return "", optional, nil
+}
+
+// metadataScope returns annotations visible to the account for the mailbox,
+// empty name refers to server annotations.
+func (u *aclUser) metadataScope(name string) (metadataScope, mailboxRef, error) {
+	self := int64(u.ID())
+	if name == "" {
+		return metadataScope{privateUser: self, sharedUser: self}, mailboxRef{rights: aclAllRights}, nil
+	}
+
+	ref, id, err := u.aclMailbox(name)
+	if err != nil {
+		return metadataScope{}, mailboxRef{}, err
+	}
+	scope := metadataScope{mboxID: id, privateUser: self, sharedUser: self}
+	if ref.owner != u.Username() {
+		owner, err := u.store.Back.GetUser(ref.owner)
+		if err != nil {
+			return metadataScope{}, mailboxRef{}, err
+		}
+		scope.sharedUser = int64(owner.(*imapsql.User).ID())
+	}
+	return scope, ref, nil
+}
+
+// GetMetadata implements the GETMETADATA command (RFC 5464). Only existing
+// entries are returned.
+func (u *aclUser) GetMetadata(name string, entries []string, depth int) (map[string]string, error) {
+	scope, ref, err := u.metadataScope(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := ref.check("lr"); err != nil {
+		return nil, err
+	}
+	return u.store.getMetadata(context.TODO(), scope, entries, depth)
+}
+
+// SetMetadata implements the SETMETADATA command (RFC 5464). Entries with nil
+// values are removed.
+func (u *aclUser) SetMetadata(name string, entries map[string]*string) error {
+	scope, ref, err := u.metadataScope(name)
+	if err != nil {
+		return err
+	}
+	need := "lr"
+	for entry := range entries {
+		if strings.HasPrefix(strings.ToLower(entry), metadataShared) {
+			need = "lrw"
+		}
+	}
+	if err := ref.check(need); err != nil {
+		return err
+	}
+	return u.store.setMetadata(context.TODO(), scope, entries)
+}
+
+// aclMailbox enforces the account rights for the selected mailbox and
+// handles copying of messages between mailboxes of different accounts.
+type aclMailbox struct {
+	*imapsql.Mailbox
+	user *aclUser
+	ref  mailboxRef
+	id   int64
+}
+
+func (m *aclMailbox) Name() string {
+	return m.ref.clientName
+}
+
+func (m *aclMailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, op imap.FlagsOp, silent bool, flags []string) error {
+	if op == imap.SetFlags {
+		// FLAGS replaces all flags so all kinds of flags can be changed.
+		if !hasRights(m.ref.rights, "swt") {
+			return ErrPermissionDenied
+		}
+	}
+	for _, flag := range flags {
+		if !hasRights(m.ref.rights, flagRight(flag)) {
+			return ErrPermissionDenied
+		}
+	}
+	return m.Mailbox.UpdateMessagesFlags(uid, seqset, op, silent, flags)
+}
+
+func (m *aclMailbox) Expunge() error {
+	if !hasRights(m.ref.rights, "e") {
+		return ErrPermissionDenied
+	}
+	return m.Mailbox.Expunge()
+}
+
+func (m *aclMailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	destRef, err := m.user.resolve(dest)
+	if err != nil {
+		return err
+	}
+	if err := destRef.check("i"); err != nil {
+		return err
+	}
+	pending := m.startTraining(uid, seqset, destRef)
+	if destRef.owner == m.ref.owner {
+		err = m.Mailbox.CopyMessages(uid, seqset, destRef.name)
+	} else {
+		err = m.copyToAccount(uid, seqset, destRef)
+	}
+	if err != nil {
+		return err
+	}
+	m.user.store.finishTraining(context.TODO(), pending)
+	return nil
+}
+
+func (m *aclMailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	if !hasRights(m.ref.rights, "te") {
+		return ErrPermissionDenied
+	}
+	destRef, err := m.user.resolve(dest)
+	if err != nil {
+		return err
+	}
+	if err := destRef.check("i"); err != nil {
+		return err
+	}
+	pending := m.startTraining(uid, seqset, destRef)
+	if destRef.owner == m.ref.owner {
+		if err := m.Mailbox.MoveMessages(uid, seqset, destRef.name); err != nil {
+			return err
+		}
+		m.user.store.finishTraining(context.TODO(), pending)
+		return nil
+	}
+
+	if err := m.copyToAccount(uid, seqset, destRef); err != nil {
+		return err
+	}
+	m.user.store.finishTraining(context.TODO(), pending)
+	if err := m.Mailbox.DelMessages(uid, seqset); err != nil {
+		return err
+	}
+	return m.Mailbox.Poll(true)
+}
+
+// startTraining records the state of dest before messages are copied to
+// it if they should be submitted to the trainer.
+//
+// Errors are only logged since they should not prevent messages from being
+// copied.
+func (m *aclMailbox) startTraining(uid bool, seqset *imap.SeqSet, dest mailboxRef) *pendingTraining {
+	store := m.user.store
+	if store.training == nil {
+		return nil
+	}
+
+	username := m.user.ownerName(dest)
+	spam, ok, err := store.trainingAction(context.TODO(), m.user.ownerName(m.ref), m.ref.name, username, dest.name)
+	if err != nil {
+		store.Log.Error("failed to check mailboxes for training", err, "account", username, "mbox", dest.name)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+
+	uids, err := m.messageUIDs(uid, seqset)
+	if err != nil {
+		store.Log.Error("failed to list messages for training", err, "account", username, "mbox", m.ref.name)
+		return nil
+	}
+	if len(uids) == 0 {
+		return nil
+	}
+	return store.startTraining(context.TODO(), username, dest.name, spam, len(uids))
+}
+
+// copyToAccount copies messages to the mailbox of another account.
+//
+// go-imap-sql keeps blob reference counters per account so messages are
+// stored as new ones instead of being copied on SQL level. Messages are
+// read and stored one at a time so only one message is kept in memory.
+func (m *aclMailbox) copyToAccount(uid bool, seqset *imap.SeqSet, dest mailboxRef) error {
+	owner, err := m.user.owner(dest)
+	if err != nil {
+		return err
+	}
+	uids, err := m.messageUIDs(uid, seqset)
+	if err != nil {
+		return err
+	}
+	for _, msgUID := range uids {
+		msg, err := fetchMessage(m.Mailbox, msgUID)
+		if err != nil {
+			return err
+		}
+		if msg == nil {
+			// Expunged in the meantime.
+			continue
+		}
+		err = owner.CreateMessage(dest.name, allowedFlags(dest.rights, msg.flags), msg.date, bytes.NewReader(msg.body), nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// messageUIDs returns UIDs of messages in the set.
+func (m *aclMailbox) messageUIDs(uid bool, seqset *imap.SeqSet) ([]uint32, error) {
+	ch := make(chan *imap.Message, 10)
+	listErr := make(chan error, 1)
+	go func() {
+		listErr <- m.Mailbox.ListMessages(uid, seqset, []imap.FetchItem{imap.FetchUid}, ch)
+	}()
+	var uids []uint32
+	for msg := range ch {
+		uids = append(uids, msg.Uid)
+	}
+	if err := <-listErr; err != nil {
+		return nil, err
+	}
+	return uids, nil
+}
+
+type fetchedMessage struct {
+	flags []string
+	date  time.Time
+	body  []byte
+}
+
+// fetchMessage reads flags, internal date and contents of the message in
+// mbox with the specified UID. nil is returned if there is no such message.
+//
+// The fetch is completed before the function returns so the database can be
+// modified using the message.
+func fetchMessage(mbox *imapsql.Mailbox, uid uint32) (*fetchedMessage, error) {
+	var seqset imap.SeqSet
+	seqset.AddNum(uid)
+
+	ch := make(chan *imap.Message, 1)
+	listErr := make(chan error, 1)
+	go func() {
+		listErr <- mbox.ListMessages(true, &seqset, []imap.FetchItem{imap.FetchFlags, imap.FetchInternalDate, "BODY.PEEK[]"}, ch)
+	}()
+	var (
+		res     *fetchedMessage
+		readErr error
+	)
+	for msg := range ch {
+		for _, v := range msg.Body {
+			body, err := io.ReadAll(v)
+			if err != nil {
+				readErr = err
+				continue
+			}
+			flags := make([]string, 0, len(msg.Flags))
+			for _, flag := range msg.Flags {
+				if flag != imap.RecentFlag {
+					flags = append(flags, flag)
+				}
+			}
+			res = &fetchedMessage{flags: flags, date: msg.InternalDate, body: body}
+		}
+	}
+	if err := <-listErr; err != nil {
+		return nil, err
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	return res, nil
+}
+
+// HighestModSeq returns the highest modification sequence of the mailbox
+// (RFC 7162).
+func (m *aclMailbox) HighestModSeq() (uint64, error) {
+	return m.user.store.highestModSeq(context.TODO(), m.id)
+}
+
+// ModSeqs returns modification sequences of messages with specified UIDs
+// that were changed after changedSince.
+func (m *aclMailbox) ModSeqs(uids *imap.SeqSet, changedSince uint64) (map[uint32]uint64, error) {
+	return m.user.store.modSeqs(context.TODO(), m.id, uids, changedSince)
+}
+
+// Vanished returns UIDs from the set of messages that were expunged after
+// the since modification sequence.
+func (m *aclMailbox) Vanished(uids *imap.SeqSet, since uint64) (*imap.SeqSet, error) {
+	return m.user.store.vanished(context.TODO(), m.id, uids, since)
+}
+
+// UIDsAfter returns at most count UIDs assigned after uid, including UIDs
+// of messages that were already expunged.
+func (m *aclMailbox) UIDsAfter(uid uint32, count int) ([]uint32, error) {
+	return m.user.store.uidsAfter(context.TODO(), m.id, uid, count)
+}
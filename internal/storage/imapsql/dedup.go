@@ -0,0 +1,204 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+// Delivered messages are remembered for the dedup window by the key derived
+// from the Message-ID and the body. A message delivered again to the same
+// mailbox of the account within the window is dropped or flagged.
+//
+// Keys are claimed when the message body is received, before the message is
+// stored, so only one of concurrent deliveries of the message gets them.
+// Claimed keys are removed if the delivery fails or is aborted.
+
+// dedupFlag is the keyword added to duplicates if they are not dropped.
+const dedupFlag = "$Duplicate"
+
+// dedupSweepInterval is the interval between removals of expired keys.
+const dedupSweepInterval = time.Hour
+
+type dedupPolicy struct {
+	window time.Duration
+	// flag is set if duplicates should be delivered with dedupFlag instead
+	// of being dropped.
+	flag bool
+}
+
+func parseDedup(m *config.Map, node config.Node) (interface{}, error) {
+	var (
+		policy = &dedupPolicy{}
+		action string
+	)
+	child := config.NewMap(m.Globals, node)
+	child.Duration("window", false, false, 24*time.Hour, &policy.window)
+	child.Enum("action", false, false, []string{"drop", "flag"}, "drop", &action)
+	if _, err := child.Process(); err != nil {
+		return nil, err
+	}
+
+	if policy.window <= 0 {
+		return nil, config.NodeErr(node, "window should be positive")
+	}
+	policy.flag = action == "flag"
+	return policy, nil
+}
+
+func (store *Storage) initDedup() error {
+	for _, stmt := range []string{
+		`CREATE TABLE IF NOT EXISTS deliveryDedup (
+			username VARCHAR(255) NOT NULL,
+			mboxName VARCHAR(255) NOT NULL,
+			msgKey CHAR(64) NOT NULL,
+			seenAt BIGINT NOT NULL,
+			PRIMARY KEY (username, mboxName, msgKey)
+		)`,
+		`CREATE INDEX IF NOT EXISTS deliveryDedup_seenAt ON deliveryDedup(seenAt)`,
+	} {
+		if _, err := store.Back.DB.Exec(stmt); err != nil {
+			return fmt.Errorf("imapsql: failed to create dedup table: %w", err)
+		}
+	}
+	return nil
+}
+
+// dedupKey returns the key identifying the message. Empty key is returned
+// for messages without Message-ID, these are never considered duplicates.
+func dedupKey(header textproto.Header, body buffer.Buffer) (string, error) {
+	msgID := strings.TrimSpace(header.Get("Message-Id"))
+	if msgID == "" {
+		return "", nil
+	}
+
+	r, err := body.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	h.Write([]byte(msgID))
+	h.Write([]byte{0})
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// dedupTarget is the account and the mailbox the message is delivered to.
+type dedupTarget struct {
+	username string
+	mbox     string
+}
+
+func newDedupTarget(username, mbox string) dedupTarget {
+	if strings.EqualFold(mbox, imap.InboxName) {
+		mbox = imap.InboxName
+	}
+	return dedupTarget{username: username, mbox: mbox}
+}
+
+// claimDelivery records that the message is delivered to the target. False
+// is returned if the message was already delivered to it within the dedup
+// window.
+func (store *Storage) claimDelivery(ctx context.Context, target dedupTarget, key string, now int64) (bool, error) {
+	// Expired keys may be not removed yet.
+	cutoff := now - int64(store.dedup.window/time.Second)
+	_, err := store.Back.DB.ExecContext(ctx, store.rebind(`
+		DELETE FROM deliveryDedup
+		WHERE username = ? AND mboxName = ? AND msgKey = ? AND seenAt <= ?`),
+		target.username, target.mbox, key, cutoff)
+	if err != nil {
+		return false, fmt.Errorf("imapsql: %w", err)
+	}
+
+	res, err := store.Back.DB.ExecContext(ctx, store.rebind(`
+		INSERT INTO deliveryDedup (username, mboxName, msgKey, seenAt) VALUES (?, ?, ?, ?)
+		ON CONFLICT (username, mboxName, msgKey) DO NOTHING`),
+		target.username, target.mbox, key, now)
+	if err != nil {
+		return false, fmt.Errorf("imapsql: %w", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("imapsql: %w", err)
+	}
+	return affected != 0, nil
+}
+
+// releaseDelivery removes keys claimed by the delivery that was not
+// completed.
+func (store *Storage) releaseDelivery(ctx context.Context, key string, seenAt int64, targets []dedupTarget) error {
+	for _, target := range targets {
+		_, err := store.Back.DB.ExecContext(ctx, store.rebind(`
+			DELETE FROM deliveryDedup
+			WHERE username = ? AND mboxName = ? AND msgKey = ? AND seenAt = ?`),
+			target.username, target.mbox, key, seenAt)
+		if err != nil {
+			return fmt.Errorf("imapsql: %w", err)
+		}
+	}
+	return nil
+}
+
+// expireDedup removes keys of messages delivered before the dedup window.
+func (store *Storage) expireDedup(ctx context.Context) (int64, error) {
+	cutoff := time.Now().Add(-store.dedup.window).Unix()
+	res, err := store.Back.DB.ExecContext(ctx, store.rebind(`
+		DELETE FROM deliveryDedup WHERE seenAt < ?`), cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("imapsql: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+func (store *Storage) dedupSweeper() {
+	defer store.bgWorkers.Done()
+
+	ticker := time.NewTicker(dedupSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-store.bgStop:
+			return
+		case <-ticker.C:
+		}
+
+		removed, err := store.expireDedup(context.Background())
+		if err != nil {
+			store.Log.Error("dedup keys expiration failed", err)
+			continue
+		}
+		store.Log.Debugln("removed", removed, "expired dedup keys")
+	}
+}
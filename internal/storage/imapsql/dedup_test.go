@@ -0,0 +1,201 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+func deliverTestMessage(t *testing.T, store *Storage, msgID, body string, rcpts ...string) {
+	t.Helper()
+	ctx := context.Background()
+	d, err := store.Start(ctx, &module.MsgMetadata{ID: "test"}, "sender@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range rcpts {
+		if err := d.AddRcpt(ctx, rcpt, smtp.RcptOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "test")
+	if msgID != "" {
+		hdr.Add("Message-Id", msgID)
+	}
+	if err := d.Body(ctx, hdr, buffer.MemoryBuffer{Slice: []byte(body)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeliveryDedup(t *testing.T) {
+	store, _ := createTestStorage(t)
+	store.deliveryNormalize = func(_ context.Context, s string) (string, error) {
+		return s, nil
+	}
+	store.dedup = &dedupPolicy{window: time.Hour}
+	if err := store.initDedup(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"alice@example.org", "bob@example.org"} {
+		if err := store.CreateIMAPAcct(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice, err := store.GetIMAPAcct("alice@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := store.GetIMAPAcct("bob@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deliverTestMessage(t, store, "<1@example.org>", "Hello!\r\n", "alice@example.org")
+	checkMessages(t, alice, "INBOX", 1)
+	deliverTestMessage(t, store, "<1@example.org>", "Hello!\r\n", "alice@example.org")
+	checkMessages(t, alice, "INBOX", 1)
+	deliverTestMessage(t, store, "<1@example.org>", "Hello!\r\n", "alice@example.org", "bob@example.org")
+	checkMessages(t, alice, "INBOX", 1)
+	checkMessages(t, bob, "INBOX", 1)
+
+	// Different body or missing Message-ID.
+	deliverTestMessage(t, store, "<1@example.org>", "Hello again!\r\n", "alice@example.org")
+	checkMessages(t, alice, "INBOX", 2)
+	deliverTestMessage(t, store, "", "Hello!\r\n", "alice@example.org")
+	deliverTestMessage(t, store, "", "Hello!\r\n", "alice@example.org")
+	checkMessages(t, alice, "INBOX", 4)
+
+	store.dedup.flag = true
+	deliverTestMessage(t, store, "<1@example.org>", "Hello!\r\n", "bob@example.org")
+	checkMessages(t, bob, "INBOX", 2)
+	_, mbox, err := bob.GetMailbox("INBOX", true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, _ := imap.ParseSeqSet("2")
+	ch := make(chan *imap.Message, 1)
+	if err := mbox.ListMessages(false, seq, []imap.FetchItem{imap.FetchFlags}, ch); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-ch
+	flagged := false
+	for _, flag := range msg.Flags {
+		flagged = flagged || flag == dedupFlag
+	}
+	if !flagged {
+		t.Errorf("duplicate is not flagged: %v", msg.Flags)
+	}
+	if err := mbox.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Back.DB.Exec(`UPDATE deliveryDedup SET seenAt = seenAt - 7200`); err != nil {
+		t.Fatal(err)
+	}
+	removed, err := store.expireDedup(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 3 {
+		t.Errorf("expected 3 expired keys, got %d", removed)
+	}
+	store.dedup.flag = false
+	deliverTestMessage(t, store, "<1@example.org>", "Hello!\r\n", "alice@example.org")
+	checkMessages(t, alice, "INBOX", 5)
+}
+
+func TestDeliveryDedup_Claim(t *testing.T) {
+	store, _ := createTestStorage(t)
+	store.deliveryNormalize = func(_ context.Context, s string) (string, error) {
+		return s, nil
+	}
+	store.dedup = &dedupPolicy{window: time.Hour}
+	if err := store.initDedup(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateIMAPAcct("alice@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	alice, err := store.GetIMAPAcct("alice@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	hdr := textproto.Header{}
+	hdr.Add("Message-Id", "<1@example.org>")
+	body := buffer.MemoryBuffer{Slice: []byte("Hello!\r\n")}
+
+	// Only one of concurrent deliveries gets the key.
+	target := newDedupTarget("alice@example.org", "INBOX")
+	now := time.Now().Unix()
+	if claimed, err := store.claimDelivery(ctx, target, "key", now); err != nil || !claimed {
+		t.Fatalf("key is not claimed: %v", err)
+	}
+	if claimed, err := store.claimDelivery(ctx, target, "key", now); err != nil || claimed {
+		t.Fatalf("key is claimed twice: %v", err)
+	}
+	if err := store.releaseDelivery(ctx, "key", now, []dedupTarget{target}); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := store.claimDelivery(ctx, target, "key", now); err != nil || !claimed {
+		t.Fatalf("released key is not claimed: %v", err)
+	}
+
+	d, err := store.Start(ctx, &module.MsgMetadata{ID: "test"}, "sender@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddRcpt(ctx, "alice@example.org", smtp.RcptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Body(ctx, hdr, body); err != nil {
+		t.Fatal(err)
+	}
+	// Aborted delivery releases the key.
+	if err := d.Abort(ctx); err != nil {
+		t.Fatal(err)
+	}
+	deliverTestMessage(t, store, "<1@example.org>", "Hello!\r\n", "alice@example.org")
+	checkMessages(t, alice, "INBOX", 1)
+
+	// Expired keys are replaced even if they are not removed yet.
+	if _, err := store.Back.DB.Exec(`UPDATE deliveryDedup SET seenAt = seenAt - 7200`); err != nil {
+		t.Fatal(err)
+	}
+	deliverTestMessage(t, store, "<1@example.org>", "Hello!\r\n", "alice@example.org")
+	checkMessages(t, alice, "INBOX", 2)
+	deliverTestMessage(t, store, "<1@example.org>", "Hello!\r\n", "alice@example.org")
+	checkMessages(t, alice, "INBOX", 2)
+}
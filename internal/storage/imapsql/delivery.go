@@ -21,6 +21,7 @@ package imapsql
 import (
 	"context"
 	"runtime/trace"
+	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
@@ -43,6 +44,12 @@ type delivery struct {
 	mailFrom string
 
 	addedRcpts map[string]addedRcpt
+
+	// Set if the message is subject to deduplication. dedupTargets are
+	// claimed with dedupAt time.
+	dedupKey     string
+	dedupAt      int64
+	dedupTargets []dedupTarget
 }
 
 func (d *delivery) String() string {
@@ -59,6 +66,15 @@ func userDoesNotExist(actual error) error {
 	}
 }
 
+// rcptHeader returns the header that is added to the message only for
+// that recipient. go-imap-sql does certain optimizations to store the message
+// with small amount of per-recipient data in a efficient way.
+func rcptHeader(accountName string) textproto.Header {
+	userHeader := textproto.Header{}
+	userHeader.Add("Delivered-To", accountName)
+	return userHeader
+}
+
 func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOptions) error {
 	defer trace.StartRegion(ctx, "sql/AddRcpt").End()
 
@@ -71,13 +87,7 @@ func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOption
 		return nil
 	}
 
-	// This header is added to the message only for that recipient.
-	// go-imap-sql does certain optimizations to store the message
-	// with small amount of per-recipient data in a efficient way.
-	userHeader := textproto.Header{}
-	userHeader.Add("Delivered-To", accountName)
-
-	if err := d.d.AddRcpt(accountName, userHeader); err != nil {
+	if err := d.d.AddRcpt(accountName, rcptHeader(accountName)); err != nil {
 		if err == imapsql.ErrUserDoesntExists || err == backend.ErrNoSuchMailbox {
 			return userDoesNotExist(err)
 		}
@@ -102,6 +112,19 @@ func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOption
 func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
 	defer trace.StartRegion(ctx, "sql/Body").End()
 
+	err := d.body(ctx, header, body)
+	if err != nil && len(d.dedupTargets) != 0 {
+		// The message is not stored for any recipient, so claimed keys
+		// are released.
+		if abortErr := d.Abort(ctx); abortErr != nil {
+			d.store.Log.Error("failed to abort delivery", abortErr, "msg_id", d.msgMeta.ID)
+		}
+	}
+	return err
+}
+
+func (d *delivery) body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	overrides := make(map[string]mboxOverride)
 	if !d.msgMeta.Quarantine && d.store.filters != nil {
 		for rcpt, rcptData := range d.addedRcpts {
 			folder, flags, err := d.store.filters.IMAPFilter(rcpt, rcptData.rcptTo, d.msgMeta, header, body)
@@ -109,9 +132,21 @@ func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffe
 				d.store.Log.Error("IMAPFilter failed", err, "rcpt", rcpt)
 				continue
 			}
-			d.d.UserMailbox(rcpt, folder, flags)
+			overrides[rcpt] = mboxOverride{folder: folder, flags: flags}
+		}
+	}
+
+	if d.store.dedup != nil {
+		if err := d.dedup(ctx, header, body, overrides); err != nil {
+			return err
+		}
+		if len(d.addedRcpts) == 0 {
+			return nil
 		}
 	}
+	for rcpt, override := range overrides {
+		d.d.UserMailbox(rcpt, override.folder, override.flags)
+	}
 
 	if d.msgMeta.Quarantine {
 		if err := d.d.SpecialMailbox(imap.JunkAttr, d.store.junkMbox); err != nil {
@@ -143,16 +178,103 @@ func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffe
 	return err
 }
 
+// mboxOverride is the mailbox and flags the message is delivered with to
+// the recipient, as set by IMAP filters.
+type mboxOverride struct {
+	folder string
+	flags  []string
+}
+
+// dedup excludes recipients that already received the message or flags the
+// message for them.
+func (d *delivery) dedup(ctx context.Context, header textproto.Header, body buffer.Buffer, overrides map[string]mboxOverride) error {
+	key, err := dedupKey(header, body)
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		return nil
+	}
+	d.dedupKey = key
+	d.dedupAt = time.Now().Unix()
+
+	dropped := false
+	for rcpt := range d.addedRcpts {
+		mbox := overrides[rcpt].folder
+		if mbox == "" {
+			mbox = imap.InboxName
+			if d.msgMeta.Quarantine {
+				mbox = d.store.junkMbox
+			}
+		}
+		target := newDedupTarget(rcpt, mbox)
+
+		claimed, err := d.store.claimDelivery(ctx, target, key, d.dedupAt)
+		if err != nil {
+			return err
+		}
+		if claimed {
+			d.dedupTargets = append(d.dedupTargets, target)
+			continue
+		}
+
+		d.store.Log.Msg("duplicate message", "rcpt", rcpt, "mailbox", mbox, "msg_id", d.msgMeta.ID)
+		if d.store.dedup.flag {
+			override := overrides[rcpt]
+			override.flags = append(override.flags, dedupFlag)
+			overrides[rcpt] = override
+			continue
+		}
+		delete(d.addedRcpts, rcpt)
+		dropped = true
+	}
+	if !dropped {
+		return nil
+	}
+
+	// go-imap-sql does not allow to remove recipients so the delivery is
+	// started again with the remaining ones.
+	if err := d.d.Abort(); err != nil {
+		return err
+	}
+	d.d = d.store.Back.NewDelivery()
+	for rcpt := range d.addedRcpts {
+		if err := d.d.AddRcpt(rcpt, rcptHeader(rcpt)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (d *delivery) Abort(ctx context.Context) error {
 	defer trace.StartRegion(ctx, "sql/Abort").End()
 
-	return d.d.Abort()
+	err := d.d.Abort()
+	d.releaseDedup(ctx)
+	return err
 }
 
 func (d *delivery) Commit(ctx context.Context) error {
 	defer trace.StartRegion(ctx, "sql/Commit").End()
 
-	return d.d.Commit()
+	if err := d.d.Commit(); err != nil {
+		d.releaseDedup(ctx)
+		return err
+	}
+	d.dedupTargets = nil
+	return nil
+}
+
+// releaseDedup removes dedup keys claimed by the delivery so the message
+// can be delivered again.
+func (d *delivery) releaseDedup(ctx context.Context) {
+	if len(d.dedupTargets) == 0 {
+		return
+	}
+	if err := d.store.releaseDelivery(ctx, d.dedupKey, d.dedupAt, d.dedupTargets); err != nil {
+		d.store.Log.Error("failed to remove dedup keys", err, "msg_id", d.msgMeta.ID)
+	}
+	d.dedupTargets = nil
 }
 
 func (store *Storage) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
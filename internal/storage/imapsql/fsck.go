@@ -0,0 +1,232 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// DefaultFsckGracePeriod is the minimal age of an unreferenced blob before it
+// can be removed. Blobs are written before the message row is committed, so
+// a recently created blob may be legitimately unreferenced.
+const DefaultFsckGracePeriod = 24 * time.Hour
+
+type FsckOptions struct {
+	// RemoveOrphans enables removal of blobs not referenced by any message.
+	RemoveOrphans bool
+
+	// GracePeriod is the minimal age of the orphaned blob for it to be
+	// removed. Zero value means DefaultFsckGracePeriod.
+	GracePeriod time.Duration
+}
+
+// MissingBlob describes a message that refers to a non-existent blob.
+type MissingBlob struct {
+	Key      string `json:"key"`
+	Username string `json:"username"`
+	Mailbox  string `json:"mailbox"`
+	UID      uint32 `json:"uid"`
+}
+
+type FsckReport struct {
+	// Number of blobs referenced by messages.
+	Referenced int `json:"referenced"`
+	// Number of blobs found in the blob store.
+	Stored int `json:"stored"`
+
+	Missing  []MissingBlob     `json:"missing"`
+	Orphaned []module.BlobInfo `json:"orphaned"`
+	// Keys of orphaned blobs that were removed.
+	Removed []string `json:"removed"`
+}
+
+// rebind converts query placeholders for the used driver.
+func (store *Storage) rebind(query string) string {
+	if store.driver != "postgres" {
+		return query
+	}
+	res := make([]byte, 0, len(query))
+	n := 1
+	for i := 0; i < len(query); i++ {
+		if query[i] == '?' {
+			res = append(res, fmt.Sprintf("$%d", n)...)
+			n++
+			continue
+		}
+		res = append(res, query[i])
+	}
+	return string(res)
+}
+
+func (store *Storage) isReferenced(ctx context.Context, q interface {
+	QueryRowContext(context.Context, string, ...interface{}) *sql.Row
+}, key string) (bool, error) {
+	var one int
+	err := q.QueryRowContext(ctx, store.rebind(`SELECT 1 FROM msgs WHERE extBodyKey = ? LIMIT 1`), key).Scan(&one)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// CheckBlobs cross-references messages stored in the database against
+// the blob store contents and reports blobs missing for existing messages and
+// blobs not referenced by any message.
+//
+// The check does not require the server to be stopped. Message references
+// are read before the blob store is listed so messages delivered during the
+// check are not reported as missing. Orphaned blobs are checked again right
+// before removal.
+func (store *Storage) CheckBlobs(ctx context.Context, opts FsckOptions) (*FsckReport, error) {
+	lister, ok := store.blobStore.(module.ListableBlobStore)
+	if !ok {
+		return nil, fmt.Errorf("imapsql: blob store does not support listing")
+	}
+	if opts.GracePeriod == 0 {
+		opts.GracePeriod = DefaultFsckGracePeriod
+	}
+
+	db := store.Back.DB
+
+	referenced := make(map[string][]MissingBlob)
+	rows, err := db.QueryContext(ctx, `
+		SELECT msgs.extBodyKey, users.username, mboxes.name, msgs.msgId
+		FROM msgs
+		INNER JOIN mboxes ON mboxes.id = msgs.mboxId
+		INNER JOIN users ON users.id = mboxes.uid
+		WHERE msgs.extBodyKey IS NOT NULL`)
+	if err != nil {
+		return nil, fmt.Errorf("imapsql: fsck: %w", err)
+	}
+	for rows.Next() {
+		var ref MissingBlob
+		if err := rows.Scan(&ref.Key, &ref.Username, &ref.Mailbox, &ref.UID); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("imapsql: fsck: %w", err)
+		}
+		referenced[ref.Key] = append(referenced[ref.Key], ref)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, fmt.Errorf("imapsql: fsck: %w", err)
+	}
+	rows.Close()
+
+	report := &FsckReport{Referenced: len(referenced)}
+
+	found := make(map[string]struct{}, len(referenced))
+	var orphaned []module.BlobInfo
+	err = lister.List(ctx, func(info module.BlobInfo) error {
+		report.Stored++
+		found[info.Key] = struct{}{}
+		if _, ok := referenced[info.Key]; !ok {
+			orphaned = append(orphaned, info)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("imapsql: fsck: list blobs: %w", err)
+	}
+
+	for key, refs := range referenced {
+		if _, ok := found[key]; ok {
+			continue
+		}
+		// Message might have been removed along with its blob
+		// while the store was being listed.
+		stillUsed, err := store.isReferenced(ctx, db, key)
+		if err != nil {
+			return nil, fmt.Errorf("imapsql: fsck: %w", err)
+		}
+		if stillUsed {
+			report.Missing = append(report.Missing, refs...)
+		}
+	}
+
+	// Blob might have been created just before the message row was
+	// committed.
+	for _, info := range orphaned {
+		used, err := store.isReferenced(ctx, db, info.Key)
+		if err != nil {
+			return nil, fmt.Errorf("imapsql: fsck: %w", err)
+		}
+		if !used {
+			report.Orphaned = append(report.Orphaned, info)
+		}
+	}
+
+	if !opts.RemoveOrphans {
+		return report, nil
+	}
+
+	deadline := time.Now().Add(-opts.GracePeriod)
+	for _, info := range report.Orphaned {
+		if info.ModTime.After(deadline) {
+			continue
+		}
+		removed, err := store.removeOrphan(ctx, info.Key)
+		if err != nil {
+			return report, fmt.Errorf("imapsql: fsck: remove %s: %w", info.Key, err)
+		}
+		if removed {
+			report.Removed = append(report.Removed, info.Key)
+		}
+	}
+
+	return report, nil
+}
+
+// removeOrphan removes the blob and the corresponding extKeys row, unless
+// the blob became referenced by a message.
+func (store *Storage) removeOrphan(ctx context.Context, key string) (bool, error) {
+	tx, err := store.Back.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	used, err := store.isReferenced(ctx, tx, key)
+	if err != nil {
+		return false, err
+	}
+	if used {
+		return false, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, store.rebind(`DELETE FROM extKeys WHERE id = ?`), key); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	if err := store.blobStore.Delete(ctx, []string{key}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
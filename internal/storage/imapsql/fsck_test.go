@@ -0,0 +1,158 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/storage/blob/fs"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func createTestStorage(t *testing.T) (*Storage, string) {
+	dir := testutils.Dir(t)
+	blobDir := filepath.Join(dir, "messages")
+	if err := os.Mkdir(blobDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	blobStore, err := fs.New("storage.blob.fs", "", nil, []string{blobDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	back, err := imapsql.New("sqlite3", filepath.Join(dir, "imapsql.db"),
+		ExtBlobStore{Base: blobStore.(module.BlobStore)}, imapsql.Opts{
+			// Default PRNG is seeded using the current time in seconds,
+			// that would make UIDVALIDITY values in different storages
+			// equal.
+			PRNG: rand.New(rand.NewSource(time.Now().UnixNano())),
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { back.Close() })
+
+	store := &Storage{
+		Back:            back,
+		driver:          "sqlite3",
+		blobStore:       blobStore.(module.BlobStore),
+		sharedNamespace: "Shared",
+		metadataMaxSize: 64,
+		metadataLimit:   256,
+		authNormalize: func(_ context.Context, s string) (string, error) {
+			return s, nil
+		},
+	}
+	if err := store.initACL(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.initModSeq(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.initMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	return store, blobDir
+}
+
+func TestCheckBlobs(t *testing.T) {
+	store, blobDir := createTestStorage(t)
+
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	u, err := store.GetIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		body := bytes.NewBufferString("Subject: test\r\n\r\nHello!\r\n")
+		if err := u.CreateMessage("INBOX", nil, time.Now(), body, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := os.ReadDir(blobDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 blobs, got %d", len(entries))
+	}
+	missingKey := entries[0].Name()
+	if err := os.Remove(filepath.Join(blobDir, missingKey)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"old-orphan", "new-orphan"} {
+		if err := os.WriteFile(filepath.Join(blobDir, key), []byte("orphan"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(filepath.Join(blobDir, "old-orphan"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := store.CheckBlobs(context.Background(), FsckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Referenced != 2 || report.Stored != 3 {
+		t.Errorf("wrong counts: %+v", report)
+	}
+	if len(report.Missing) != 1 || report.Missing[0].Key != missingKey ||
+		report.Missing[0].Username != "test@example.org" || report.Missing[0].Mailbox != "INBOX" {
+		t.Errorf("wrong missing blobs: %+v", report.Missing)
+	}
+	if len(report.Orphaned) != 2 {
+		t.Errorf("wrong orphaned blobs: %+v", report.Orphaned)
+	}
+	if len(report.Removed) != 0 {
+		t.Errorf("blobs removed without RemoveOrphans: %v", report.Removed)
+	}
+
+	report, err = store.CheckBlobs(context.Background(), FsckOptions{
+		RemoveOrphans: true,
+		GracePeriod:   time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Removed) != 1 || report.Removed[0] != "old-orphan" {
+		t.Errorf("wrong removed blobs: %v", report.Removed)
+	}
+	if _, err := os.Stat(filepath.Join(blobDir, "old-orphan")); !os.IsNotExist(err) {
+		t.Error("old-orphan is not removed:", err)
+	}
+	if _, err := os.Stat(filepath.Join(blobDir, "new-orphan")); err != nil {
+		t.Error("new-orphan is removed:", err)
+	}
+}
@@ -35,6 +35,7 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/emersion/go-imap"
 	sortthread "github.com/emersion/go-imap-sortthread"
@@ -61,8 +62,9 @@ type Storage struct {
 
 	junkMbox string
 
-	driver string
-	dsn    []string
+	driver    string
+	dsn       []string
+	blobStore module.BlobStore
 
 	resolver dns.Resolver
 
@@ -72,6 +74,24 @@ type Storage struct {
 
 	filters module.IMAPFilter
 
+	retention *retentionPolicy
+	dedup     *dedupPolicy
+	training  *trainingPolicy
+
+	// Background goroutines: expunged messages, retention and dedup sweepers,
+	// training workers.
+	bgStop    chan struct{}
+	bgWorkers sync.WaitGroup
+
+	aclGroups       module.Table
+	sharedNamespace string
+
+	// modSeq is set if modification sequences are tracked, see modseq.go.
+	modSeq bool
+
+	metadataMaxSize int64
+	metadataLimit   int64
+
 	deliveryMap       module.Table
 	deliveryNormalize func(context.Context, string) (string, error)
 	authMap           module.Table
@@ -156,11 +176,28 @@ func (store *Storage) Init(cfg *config.Map) error {
 		return nil, nil
 	}, modconfig.TableDirective, &store.deliveryMap)
 	cfg.String("delivery_normalize", false, false, "precis_casefold_email", &deliveryNormalize)
+	cfg.Custom("retention", false, false, func() (interface{}, error) {
+		return (*retentionPolicy)(nil), nil
+	}, parseRetention, &store.retention)
+	cfg.Custom("delivery_dedup", false, false, func() (interface{}, error) {
+		return (*dedupPolicy)(nil), nil
+	}, parseDedup, &store.dedup)
+	cfg.Custom("training", false, false, func() (interface{}, error) {
+		return (*trainingPolicy)(nil), nil
+	}, parseTraining, &store.training)
+	modconfig.Table(cfg, "acl_groups", false, false, nil, &store.aclGroups)
+	cfg.String("shared_namespace", false, false, "Shared", &store.sharedNamespace)
+	cfg.DataSize("metadata_max_size", false, false, 64*1024, &store.metadataMaxSize)
+	cfg.DataSize("metadata_limit", false, false, 1024*1024, &store.metadataLimit)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
 
+	if store.training != nil && len(store.training.junk) == 0 {
+		store.training.junk = []string{store.junkMbox}
+	}
+
 	if dsn == nil {
 		return errors.New("imapsql: dsn is required")
 	}
@@ -264,6 +301,13 @@ func (store *Storage) Init(cfg *config.Map) error {
 		}
 	}
 
+	store.driver = driver
+	store.dsn = dsn
+	store.blobStore = blobStore
+	if module.DryRun {
+		return nil
+	}
+
 	store.Back, err = imapsql.New(driver, dsnStr, ExtBlobStore{Base: blobStore}, opts)
 	if err != nil {
 		return fmt.Errorf("imapsql: %s", err)
@@ -271,8 +315,42 @@ func (store *Storage) Init(cfg *config.Map) error {
 
 	store.Log.Debugln("go-imap-sql version", imapsql.VersionStr)
 
-	store.driver = driver
-	store.dsn = dsn
+	if err := store.initACL(); err != nil {
+		return err
+	}
+	if err := store.initModSeq(); err != nil {
+		return err
+	}
+	if err := store.initMetadata(); err != nil {
+		return err
+	}
+	if store.dedup != nil {
+		if err := store.initDedup(); err != nil {
+			return err
+		}
+	}
+
+	if (store.modSeq || store.retention != nil || store.dedup != nil || store.training != nil) && !module.NoRun {
+		store.bgStop = make(chan struct{})
+		if store.modSeq {
+			store.bgWorkers.Add(1)
+			go store.vanishedSweeper()
+		}
+		if store.retention != nil {
+			store.bgWorkers.Add(1)
+			go store.retentionSweeper()
+		}
+		if store.dedup != nil {
+			store.bgWorkers.Add(1)
+			go store.dedupSweeper()
+		}
+		if store.training != nil {
+			for i := 0; i < store.training.workers; i++ {
+				store.bgWorkers.Add(1)
+				go store.trainingWorker()
+			}
+		}
+	}
 
 	return nil
 }
@@ -371,7 +449,11 @@ func (store *Storage) I18NLevel() int {
 }
 
 func (store *Storage) IMAPExtensions() []string {
-	return []string{"APPENDLIMIT", "MOVE", "CHILDREN", "SPECIAL-USE", "I18NLEVEL=1", "SORT", "THREAD=ORDEREDSUBJECT"}
+	exts := []string{"APPENDLIMIT", "MOVE", "CHILDREN", "SPECIAL-USE", "I18NLEVEL=1", "SORT", "THREAD=ORDEREDSUBJECT", "ACL", "METADATA"}
+	if store.modSeq {
+		exts = append(exts, "CONDSTORE", "QRESYNC")
+	}
+	return exts
 }
 
 func (store *Storage) CreateMessageLimit() *uint32 {
@@ -384,7 +466,11 @@ func (store *Storage) GetOrCreateIMAPAcct(username string) (backend.User, error)
 		return nil, backend.ErrInvalidCredentials
 	}
 
-	return store.Back.GetOrCreateUser(accountName)
+	u, err := store.Back.GetOrCreateUser(accountName)
+	if err != nil {
+		return nil, err
+	}
+	return &aclUser{User: u.(*imapsql.User), store: store}, nil
 }
 
 func (store *Storage) Lookup(ctx context.Context, key string) (string, bool, error) {
@@ -407,7 +493,26 @@ func (store *Storage) Lookup(ctx context.Context, key string) (string, bool, err
 	return "", true, nil
 }
 
+// CheckHealth verifies that the database is reachable.
+func (store *Storage) CheckHealth(ctx context.Context) error {
+	return store.Back.DB.PingContext(ctx)
+}
+
+// Exclusive marks the storage as not reloadable since IMAP sessions keep using
+// the update notifications of the old instance.
+func (store *Storage) Exclusive() {}
+
 func (store *Storage) Close() error {
+	if store.Back == nil {
+		return nil
+	}
+
+	if store.bgStop != nil {
+		close(store.bgStop)
+		store.bgWorkers.Wait()
+		store.bgStop = nil
+	}
+
 	// Stop backend from generating new updates.
 	store.Back.Close()
 
@@ -0,0 +1,301 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// Server and mailbox annotations (RFC 5464) are stored per account in
+// serverMetadata and mboxMetadata tables. Entries under /private/ belong to
+// the account that set them, entries under /shared/ of a mailbox belong to
+// its owner and are visible to all accounts with access to it. Server
+// annotations have no owner other than the account itself, so /shared/
+// server entries are not visible to other accounts.
+
+var metadataTables = []string{
+	`CREATE TABLE IF NOT EXISTS serverMetadata (
+		userId BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		name VARCHAR(255) NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (userId, name)
+	)`,
+	`CREATE TABLE IF NOT EXISTS mboxMetadata (
+		mboxId BIGINT NOT NULL REFERENCES mboxes(id) ON DELETE CASCADE,
+		userId BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		name VARCHAR(255) NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (mboxId, userId, name)
+	)`,
+}
+
+const (
+	metadataPrivate = "/private"
+	metadataShared  = "/shared"
+
+	// metadataDepthInfinity is the depth value matching all descendants of
+	// the entry.
+	metadataDepthInfinity = -1
+)
+
+func (store *Storage) initMetadata() error {
+	for _, stmt := range metadataTables {
+		if _, err := store.Back.DB.Exec(stmt); err != nil {
+			return fmt.Errorf("imapsql: failed to create metadata tables: %w", err)
+		}
+	}
+	return nil
+}
+
+// normalizeMetadataEntry validates the entry name and converts it to lower
+// case. Top-level /private and /shared names are accepted only if
+// allowRoot is set.
+func normalizeMetadataEntry(entry string, allowRoot bool) (string, error) {
+	entry = strings.ToLower(entry)
+	if !allowRoot && (entry == metadataPrivate || entry == metadataShared) {
+		return "", fmt.Errorf("imapsql: metadata entry name is too short: %s", entry)
+	}
+	if entry != metadataPrivate && entry != metadataShared &&
+		!strings.HasPrefix(entry, metadataPrivate+"/") && !strings.HasPrefix(entry, metadataShared+"/") {
+		return "", fmt.Errorf("imapsql: metadata entry should start with /private or /shared: %s", entry)
+	}
+	if len(entry) > 255 || strings.HasSuffix(entry, "/") || strings.Contains(entry, "//") {
+		return "", fmt.Errorf("imapsql: malformed metadata entry name: %s", entry)
+	}
+	for _, c := range entry {
+		if c < 0x20 || c >= 0x7f || c == '*' || c == '%' {
+			return "", fmt.Errorf("imapsql: malformed metadata entry name: %s", entry)
+		}
+	}
+	return entry, nil
+}
+
+// matchMetadataEntry reports whether the entry name is the requested entry
+// or its descendant within depth.
+func matchMetadataEntry(name, requested string, depth int) bool {
+	if name == requested {
+		return true
+	}
+	prefix := requested + "/"
+	if depth == 0 || !strings.HasPrefix(name, prefix) {
+		return false
+	}
+	return depth == metadataDepthInfinity || !strings.Contains(name[len(prefix):], "/")
+}
+
+func metadataErr(code imap.StatusRespCode, info string, args ...interface{}) error {
+	return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+		Type:      imap.StatusRespNo,
+		Code:      code,
+		Arguments: args,
+		Info:      info,
+	}}
+}
+
+// metadataScope identifies the set of annotations visible to the account.
+type metadataScope struct {
+	// mboxID is zero for server annotations.
+	mboxID int64
+	// Accounts owning /private and /shared entries.
+	privateUser int64
+	sharedUser  int64
+}
+
+func (s metadataScope) owner(entry string) int64 {
+	if strings.HasPrefix(entry, metadataShared+"/") {
+		return s.sharedUser
+	}
+	return s.privateUser
+}
+
+// table returns the table name and the WHERE condition prefix selecting
+// rows of the scope along with its arguments.
+func (s metadataScope) table() (string, string, []interface{}) {
+	if s.mboxID == 0 {
+		return "serverMetadata", "", nil
+	}
+	return "mboxMetadata", "mboxId = ? AND ", []interface{}{s.mboxID}
+}
+
+func (store *Storage) metadata(ctx context.Context, s metadataScope) (map[string]string, error) {
+	table, cond, args := s.table()
+	rows, err := store.Back.DB.QueryContext(ctx, store.rebind(`
+		SELECT userId, name, value FROM `+table+`
+		WHERE `+cond+`userId IN (?, ?)`), append(args, s.privateUser, s.sharedUser)...)
+	if err != nil {
+		return nil, fmt.Errorf("imapsql: %w", err)
+	}
+	defer rows.Close()
+
+	entries := make(map[string]string)
+	for rows.Next() {
+		var (
+			userID      int64
+			name, value string
+		)
+		if err := rows.Scan(&userID, &name, &value); err != nil {
+			return nil, fmt.Errorf("imapsql: %w", err)
+		}
+		if s.owner(name) == userID {
+			entries[name] = value
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("imapsql: %w", err)
+	}
+	return entries, nil
+}
+
+// getMetadata returns values of existing entries matching any of the
+// requested ones.
+func (store *Storage) getMetadata(ctx context.Context, s metadataScope, requested []string, depth int) (map[string]string, error) {
+	normalized := make([]string, 0, len(requested))
+	for _, entry := range requested {
+		entry, err := normalizeMetadataEntry(entry, true)
+		if err != nil {
+			return nil, err
+		}
+		normalized = append(normalized, entry)
+	}
+
+	all, err := store.metadata(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]string)
+	for name, value := range all {
+		for _, entry := range normalized {
+			if matchMetadataEntry(name, entry, depth) {
+				res[name] = value
+				break
+			}
+		}
+	}
+	return res, nil
+}
+
+// setMetadata atomically changes values of entries, entries with nil values
+// are removed.
+func (store *Storage) setMetadata(ctx context.Context, s metadataScope, entries map[string]*string) error {
+	tx, err := store.Back.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("imapsql: %w", err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	table, cond, args := s.table()
+	keyCols, keyVals := "userId, name", "?, ?"
+	if s.mboxID != 0 {
+		keyCols, keyVals = "mboxId, userId, name", "?, ?, ?"
+	}
+
+	owners := make(map[int64]struct{})
+	for entry, value := range entries {
+		name, err := normalizeMetadataEntry(entry, false)
+		if err != nil {
+			return err
+		}
+		owner := s.owner(name)
+		key := append(append([]interface{}{}, args...), owner, name)
+
+		if value == nil {
+			_, err = tx.ExecContext(ctx, store.rebind(`
+				DELETE FROM `+table+` WHERE `+cond+`userId = ? AND name = ?`), key...)
+			if err != nil {
+				return fmt.Errorf("imapsql: %w", err)
+			}
+			continue
+		}
+
+		if int64(len(*value)) > store.metadataMaxSize {
+			return metadataErr("METADATA", "Metadata entry value is too big",
+				imap.RawString("MAXSIZE"), imap.RawString(fmt.Sprint(store.metadataMaxSize)))
+		}
+		_, err = tx.ExecContext(ctx, store.rebind(`
+			INSERT INTO `+table+` (`+keyCols+`, value) VALUES (`+keyVals+`, ?)
+			ON CONFLICT (`+keyCols+`) DO UPDATE SET value = excluded.value`), append(key, *value)...)
+		if err != nil {
+			return fmt.Errorf("imapsql: %w", err)
+		}
+		owners[owner] = struct{}{}
+	}
+
+	for owner := range owners {
+		used, err := store.metadataUsage(ctx, tx, owner)
+		if err != nil {
+			return err
+		}
+		if used > store.metadataLimit {
+			return metadataErr("OVERQUOTA", "Metadata storage limit exceeded")
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("imapsql: %w", err)
+	}
+	return nil
+}
+
+// metadataUsage returns the size of all annotations owned by the account.
+func (store *Storage) metadataUsage(ctx context.Context, tx *sql.Tx, userID int64) (int64, error) {
+	var used int64
+	err := tx.QueryRowContext(ctx, store.rebind(`
+		SELECT COALESCE(SUM(LENGTH(name) + LENGTH(value)), 0) FROM (
+			SELECT name, value FROM serverMetadata WHERE userId = ?
+			UNION ALL
+			SELECT name, value FROM mboxMetadata WHERE userId = ?
+		) AS entries`), userID, userID).Scan(&used)
+	if err != nil {
+		return 0, fmt.Errorf("imapsql: %w", err)
+	}
+	return used, nil
+}
+
+// AccountMetadata returns the value of the server annotation set by the
+// account. It allows other modules to use per-account settings managed by
+// IMAP clients.
+func (store *Storage) AccountMetadata(ctx context.Context, username, entry string) (string, bool, error) {
+	accountName, err := store.authNormalize(ctx, username)
+	if err != nil {
+		return "", false, fmt.Errorf("imapsql: %w", err)
+	}
+	entry, err = normalizeMetadataEntry(entry, false)
+	if err != nil {
+		return "", false, err
+	}
+
+	var value string
+	err = store.Back.DB.QueryRowContext(ctx, store.rebind(`
+		SELECT value FROM serverMetadata
+		INNER JOIN users ON users.id = serverMetadata.userId
+		WHERE users.username = ? AND serverMetadata.name = ?`), strings.ToLower(accountName), entry).Scan(&value)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("imapsql: %w", err)
+	}
+	return value, true, nil
+}
@@ -0,0 +1,192 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestNormalizeMetadataEntry(t *testing.T) {
+	for _, c := range []struct {
+		entry     string
+		allowRoot bool
+		res       string
+	}{
+		{"/private/Comment", false, "/private/comment"},
+		{"/shared/vendor/maddy/x", false, "/shared/vendor/maddy/x"},
+		{"/private", true, "/private"},
+		{"/private", false, ""},
+		{"/public/comment", false, ""},
+		{"/private/comment/", false, ""},
+		{"/private//comment", false, ""},
+		{"/private/*", false, ""},
+		{"/private/comment\n", false, ""},
+	} {
+		res, err := normalizeMetadataEntry(c.entry, c.allowRoot)
+		if c.res == "" {
+			if err == nil {
+				t.Errorf("%q: no error", c.entry)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", c.entry, err)
+			continue
+		}
+		if res != c.res {
+			t.Errorf("%q: expected %q, got %q", c.entry, c.res, res)
+		}
+	}
+}
+
+func checkMetadata(t *testing.T, u *aclUser, mbox string, entries []string, depth int, expected map[string]string) {
+	t.Helper()
+	values, err := u.GetMetadata(mbox, entries, depth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != len(expected) {
+		t.Errorf("%s %v: expected %v, got %v", mbox, entries, expected, values)
+		return
+	}
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("%s %v: expected %v, got %v", mbox, entries, expected, values)
+			return
+		}
+	}
+}
+
+func checkMetadataCode(t *testing.T, err error, code imap.StatusRespCode) {
+	t.Helper()
+	var statusErr *imap.ErrStatusResp
+	if !errors.As(err, &statusErr) || statusErr.Resp.Code != code {
+		t.Errorf("expected %s error, got %v", code, err)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	store, _ := createTestStorage(t)
+	getUser := func(name string) *aclUser {
+		u, err := store.GetOrCreateIMAPAcct(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.(*aclUser)
+	}
+	alice := getUser("alice@example.org")
+	bob := getUser("bob@example.org")
+	str := func(s string) *string { return &s }
+
+	err := alice.SetMetadata("", map[string]*string{
+		"/private/vendor/maddy/spam-threshold": str("5"),
+		"/private/Comment":                     str("Test"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, ok, err := store.AccountMetadata(context.Background(), "alice@example.org", "/private/vendor/maddy/spam-threshold")
+	if err != nil || !ok || value != "5" {
+		t.Errorf("AccountMetadata: %v %v %v", value, ok, err)
+	}
+	if _, ok, _ := store.AccountMetadata(context.Background(), "bob@example.org", "/private/comment"); ok {
+		t.Error("server entries of other accounts are visible")
+	}
+
+	normalize := store.authNormalize
+	store.authNormalize = func(context.Context, string) (string, error) {
+		return "", errors.New("normalization failed")
+	}
+	if _, _, err := store.AccountMetadata(context.Background(), "alice@example.org", "/private/comment"); err == nil {
+		t.Error("AccountMetadata: expected an error for a failed normalization")
+	}
+	store.authNormalize = normalize
+
+	checkMetadata(t, alice, "", []string{"/private/vendor"}, 1, map[string]string{})
+	checkMetadata(t, alice, "", []string{"/private/vendor"}, metadataDepthInfinity, map[string]string{
+		"/private/vendor/maddy/spam-threshold": "5",
+	})
+	checkMetadata(t, alice, "", []string{"/private"}, 1, map[string]string{
+		"/private/comment": "Test",
+	})
+
+	err = alice.SetMetadata("", map[string]*string{"/private/big": str(strings.Repeat("a", 65))})
+	checkMetadataCode(t, err, "METADATA")
+	big := make(map[string]*string)
+	for _, name := range []string{"/private/a", "/private/b", "/private/c", "/private/d", "/private/e"} {
+		big[name] = str(strings.Repeat("a", 60))
+	}
+	checkMetadataCode(t, alice.SetMetadata("", big), "OVERQUOTA")
+	checkMetadata(t, alice, "", []string{"/private/a"}, 0, map[string]string{})
+
+	if err := alice.SetMetadata("", map[string]*string{"/private/comment": nil}); err != nil {
+		t.Fatal(err)
+	}
+	checkMetadata(t, alice, "", []string{"/private/comment"}, 0, map[string]string{})
+
+	if err := alice.CreateMailbox("Support"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetACL("alice@example.org", "Support", "bob@example.org", "lr"); err != nil {
+		t.Fatal(err)
+	}
+	err = alice.SetMetadata("Support", map[string]*string{
+		"/shared/comment":  str("Support requests"),
+		"/private/comment": str("Alice's note"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const shared = "Shared.alice@example.org.Support"
+	checkMetadata(t, bob, shared, []string{"/shared", "/private"}, 1, map[string]string{
+		"/shared/comment": "Support requests",
+	})
+	if err := bob.SetMetadata(shared, map[string]*string{"/shared/comment": str("x")}); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("shared entry changed without the w right: %v", err)
+	}
+	if err := bob.SetMetadata(shared, map[string]*string{"/private/comment": str("Bob's note")}); err != nil {
+		t.Fatal(err)
+	}
+	checkMetadata(t, alice, "Support", []string{"/private/comment"}, 0, map[string]string{
+		"/private/comment": "Alice's note",
+	})
+	checkMetadata(t, bob, shared, []string{"/private/comment"}, 0, map[string]string{
+		"/private/comment": "Bob's note",
+	})
+
+	if err := alice.DeleteMailbox("Support"); err != nil {
+		t.Fatal(err)
+	}
+	var rows int
+	if err := store.Back.DB.QueryRow(`SELECT COUNT(*) FROM mboxMetadata`).Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 0 {
+		t.Errorf("annotations of the removed mailbox are not removed: %d rows", rows)
+	}
+}
@@ -0,0 +1,1065 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// MigrateOptions controls the behavior of Migrate.
+type MigrateOptions struct {
+	// Users limits the migration to the specified accounts. All accounts
+	// are migrated if empty.
+	Users []string
+
+	// OnMailbox is called after each mailbox is synchronized.
+	OnMailbox func(MailboxMigration)
+}
+
+// MailboxMigration describes changes made to a single mailbox.
+type MailboxMigration struct {
+	Username string
+	Mailbox  string
+	// Messages copied from the source.
+	Copied int
+	// Messages with changed flags.
+	Updated int
+	// Messages removed from the destination because they no longer
+	// exist in the source.
+	Removed int
+	// Mailbox was removed from the destination because it no longer exists
+	// in the source.
+	MailboxRemoved bool
+}
+
+type MigrateStats struct {
+	Users     int
+	Mailboxes int
+	Copied    int
+	Updated   int
+	Removed   int
+	// Blobs copied between blob stores.
+	BlobsCopied int
+	// Messages copied without a blob because it is missing in the source
+	// blob store.
+	MissingBlobs int
+}
+
+const migrateBatchSize = 100
+
+type migration struct {
+	ctx      context.Context
+	src, dst *Storage
+	opts     MigrateOptions
+	stats    MigrateStats
+
+	// Blob stores are the same instance, blobs are not copied.
+	sharedBlobs bool
+	// Sizes of blobs in the source and destination stores, nil if the store
+	// cannot be listed.
+	srcBlobs, dstBlobs map[string]int64
+
+	// Synchronized mailboxes. Mailbox annotations are copied after all
+	// accounts since they can be owned by any of them.
+	mboxes []migratedMailbox
+	// IDs of destination accounts by username.
+	dstUserIDs map[string]int64
+}
+
+type migratedMailbox struct {
+	username string
+	name     string
+	srcID    int64
+	dstID    int64
+}
+
+// Migrate copies accounts, mailboxes (along with access control lists),
+// messages and METADATA annotations from src to dst, preserving UIDVALIDITY, UID values and
+// modification sequences so that clients do not need to resynchronize after
+// switching to dst. Message blobs are copied between blob stores.
+//
+// The destination is made to mirror the source: messages and mailboxes
+// removed from the source since the previous run are removed from the
+// destination too, flag, access control list and annotation changes are
+// applied.
+// Accounts not present in the source are left untouched. Migrate can be
+// interrupted and restarted, only the missing data is copied on subsequent
+// runs, so it can be run several times while the source is in use, followed
+// by a final run after stopping the server.
+//
+// If both stores refer to the same storage location (e.g. only the database
+// is being migrated), blobs that exist in the destination with the same size
+// are not copied.
+func Migrate(ctx context.Context, src, dst *Storage, opts MigrateOptions) (*MigrateStats, error) {
+	if src == dst {
+		return nil, errors.New("imapsql: migrate: source and destination are the same")
+	}
+
+	m := &migration{
+		ctx:         ctx,
+		src:         src,
+		dst:         dst,
+		opts:        opts,
+		sharedBlobs: src.blobStore == dst.blobStore,
+	}
+	if !m.sharedBlobs {
+		var err error
+		m.srcBlobs, err = listBlobSizes(ctx, src.blobStore)
+		if err != nil {
+			return nil, fmt.Errorf("imapsql: migrate: list source blobs: %w", err)
+		}
+		m.dstBlobs, err = listBlobSizes(ctx, dst.blobStore)
+		if err != nil {
+			return nil, fmt.Errorf("imapsql: migrate: list destination blobs: %w", err)
+		}
+	}
+
+	type user struct {
+		id           int64
+		name         string
+		msgSizeLimit sql.NullInt64
+		inboxID      int64
+	}
+	rows, err := src.Back.DB.QueryContext(ctx, `SELECT id, username, msgsizelimit, inboxId FROM users ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("imapsql: migrate: %w", err)
+	}
+	var users []user
+	for rows.Next() {
+		var u user
+		var inboxID sql.NullInt64
+		if err := rows.Scan(&u.id, &u.name, &u.msgSizeLimit, &inboxID); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("imapsql: migrate: %w", err)
+		}
+		u.inboxID = inboxID.Int64
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, fmt.Errorf("imapsql: migrate: %w", err)
+	}
+	rows.Close()
+
+	if len(opts.Users) != 0 {
+		filtered := users[:0]
+		for _, u := range users {
+			for _, name := range opts.Users {
+				if u.name == name {
+					filtered = append(filtered, u)
+				}
+			}
+		}
+		users = filtered
+	}
+
+	for _, u := range users {
+		if err := m.migrateUser(u.id, u.name, u.msgSizeLimit, u.inboxID); err != nil {
+			return &m.stats, fmt.Errorf("imapsql: migrate: %s: %w", u.name, err)
+		}
+		m.stats.Users++
+	}
+
+	for _, mbox := range m.mboxes {
+		if err := m.syncMboxMetadata(mbox.srcID, mbox.dstID); err != nil {
+			return &m.stats, fmt.Errorf("imapsql: migrate: %s: %s: %w", mbox.username, mbox.name, err)
+		}
+	}
+
+	return &m.stats, nil
+}
+
+func listBlobSizes(ctx context.Context, store module.BlobStore) (map[string]int64, error) {
+	l, ok := store.(module.ListableBlobStore)
+	if !ok {
+		return nil, nil
+	}
+	sizes := make(map[string]int64)
+	err := l.List(ctx, func(info module.BlobInfo) error {
+		sizes[info.Key] = info.Size
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sizes, nil
+}
+
+type srcMailbox struct {
+	id           int64
+	name         string
+	sub          int
+	msgSizeLimit sql.NullInt64
+	uidNext      int64
+	uidValidity  int64
+	specialUse   sql.NullString
+}
+
+type dstMailbox struct {
+	id          int64
+	name        string
+	uidValidity int64
+}
+
+type dstMessage struct {
+	msgID int64
+	key   sql.NullString
+}
+
+func (m *migration) migrateUser(srcUID int64, username string, msgSizeLimit sql.NullInt64, srcInboxID int64) error {
+	dstDB := m.dst.Back.DB
+
+	var dstUID int64
+	err := dstDB.QueryRowContext(m.ctx, m.dst.rebind(`SELECT id FROM users WHERE username = ?`), username).Scan(&dstUID)
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, err := dstDB.ExecContext(m.ctx, m.dst.rebind(`INSERT INTO users(username, msgsizelimit) VALUES (?, ?)`),
+			username, msgSizeLimit); err != nil {
+			return err
+		}
+		err = dstDB.QueryRowContext(m.ctx, m.dst.rebind(`SELECT id FROM users WHERE username = ?`), username).Scan(&dstUID)
+	} else if err == nil {
+		_, err = dstDB.ExecContext(m.ctx, m.dst.rebind(`UPDATE users SET msgsizelimit = ? WHERE id = ?`), msgSizeLimit, dstUID)
+	}
+	if err != nil {
+		return err
+	}
+
+	rows, err := m.src.Back.DB.QueryContext(m.ctx, m.src.rebind(`
+		SELECT id, name, sub, msgsizelimit, uidnext, uidvalidity, specialuse
+		FROM mboxes WHERE uid = ? ORDER BY id`), srcUID)
+	if err != nil {
+		return err
+	}
+	var srcMboxes []srcMailbox
+	for rows.Next() {
+		var mbox srcMailbox
+		if err := rows.Scan(&mbox.id, &mbox.name, &mbox.sub, &mbox.msgSizeLimit, &mbox.uidNext, &mbox.uidValidity, &mbox.specialUse); err != nil {
+			rows.Close()
+			return err
+		}
+		srcMboxes = append(srcMboxes, mbox)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	rows.Close()
+
+	rows, err = dstDB.QueryContext(m.ctx, m.dst.rebind(`SELECT id, name, uidvalidity FROM mboxes WHERE uid = ?`), dstUID)
+	if err != nil {
+		return err
+	}
+	dstMboxes := make(map[string]dstMailbox)
+	for rows.Next() {
+		var mbox dstMailbox
+		if err := rows.Scan(&mbox.id, &mbox.name, &mbox.uidValidity); err != nil {
+			rows.Close()
+			return err
+		}
+		dstMboxes[mbox.name] = mbox
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	rows.Close()
+
+	var dstInboxID int64
+	for _, srcMbox := range srcMboxes {
+		res := MailboxMigration{Username: username, Mailbox: srcMbox.name}
+
+		dstMbox, ok := dstMboxes[srcMbox.name]
+		var existing *dstMailbox
+		if ok {
+			existing = &dstMbox
+		}
+		delete(dstMboxes, srcMbox.name)
+
+		dstID, err := m.syncMailbox(dstUID, srcMbox, existing, &res)
+		if err != nil {
+			return fmt.Errorf("%s: %w", srcMbox.name, err)
+		}
+		if srcMbox.id == srcInboxID {
+			dstInboxID = dstID
+		}
+		if err := m.syncACL(srcMbox.id, dstID); err != nil {
+			return fmt.Errorf("%s: %w", srcMbox.name, err)
+		}
+		m.mboxes = append(m.mboxes, migratedMailbox{username: username, name: srcMbox.name, srcID: srcMbox.id, dstID: dstID})
+		if err := m.syncMessages(srcMbox, dstID, dstUID, &res); err != nil {
+			return fmt.Errorf("%s: %w", srcMbox.name, err)
+		}
+		if err := m.syncModSeq(srcMbox.id, dstID); err != nil {
+			return fmt.Errorf("%s: %w", srcMbox.name, err)
+		}
+
+		m.stats.Mailboxes++
+		m.report(res)
+	}
+
+	// Mailboxes that were removed or renamed in the source.
+	for _, dstMbox := range dstMboxes {
+		res := MailboxMigration{Username: username, Mailbox: dstMbox.name, MailboxRemoved: true}
+		removed, err := m.removeAllMessages(dstMbox.id)
+		if err != nil {
+			return fmt.Errorf("%s: %w", dstMbox.name, err)
+		}
+		res.Removed = removed
+		if _, err := dstDB.ExecContext(m.ctx, m.dst.rebind(`DELETE FROM mboxes WHERE id = ?`), dstMbox.id); err != nil {
+			return fmt.Errorf("%s: %w", dstMbox.name, err)
+		}
+		m.report(res)
+	}
+
+	if dstInboxID != 0 {
+		if _, err := dstDB.ExecContext(m.ctx, m.dst.rebind(`UPDATE users SET inboxId = ? WHERE id = ?`), dstInboxID, dstUID); err != nil {
+			return err
+		}
+	}
+	return m.syncServerMetadata(srcUID, dstUID)
+}
+
+func (m *migration) report(res MailboxMigration) {
+	m.stats.Copied += res.Copied
+	m.stats.Updated += res.Updated
+	m.stats.Removed += res.Removed
+	if m.opts.OnMailbox != nil {
+		m.opts.OnMailbox(res)
+	}
+}
+
+// syncMailbox creates the mailbox in the destination or updates its
+// attributes and returns its ID.
+func (m *migration) syncMailbox(dstUID int64, srcMbox srcMailbox, existing *dstMailbox, res *MailboxMigration) (int64, error) {
+	dstDB := m.dst.Back.DB
+
+	if existing == nil {
+		_, err := dstDB.ExecContext(m.ctx, m.dst.rebind(`
+			INSERT INTO mboxes(uid, name, sub, msgsizelimit, uidnext, uidvalidity, specialuse)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`),
+			dstUID, srcMbox.name, srcMbox.sub, srcMbox.msgSizeLimit, srcMbox.uidNext, srcMbox.uidValidity, srcMbox.specialUse)
+		if err != nil {
+			return 0, err
+		}
+		var id int64
+		err = dstDB.QueryRowContext(m.ctx, m.dst.rebind(`SELECT id FROM mboxes WHERE uid = ? AND name = ?`), dstUID, srcMbox.name).Scan(&id)
+		return id, err
+	}
+
+	if existing.uidValidity != srcMbox.uidValidity {
+		// Mailbox was created in the destination independently (e.g. INBOX
+		// created along with the account). UIDs in it are not related to
+		// the source ones.
+		removed, err := m.removeAllMessages(existing.id)
+		if err != nil {
+			return 0, err
+		}
+		res.Removed += removed
+	}
+
+	_, err := dstDB.ExecContext(m.ctx, m.dst.rebind(`
+		UPDATE mboxes SET sub = ?, msgsizelimit = ?, uidvalidity = ?, specialuse = ?
+		WHERE id = ?`),
+		srcMbox.sub, srcMbox.msgSizeLimit, srcMbox.uidValidity, srcMbox.specialUse, existing.id)
+	return existing.id, err
+}
+
+// syncACL makes the access control list of the destination mailbox match the
+// source one. Identifiers are account names, so they are used as is.
+func (m *migration) syncACL(srcMboxID, dstMboxID int64) error {
+	srcACL, err := m.src.mailboxACL(m.ctx, srcMboxID)
+	if err != nil {
+		return err
+	}
+	dstACL, err := m.dst.mailboxACL(m.ctx, dstMboxID)
+	if err != nil {
+		return err
+	}
+
+	var changed, removed []string
+	for identifier, rights := range srcACL {
+		if dstRights, ok := dstACL[identifier]; !ok || dstRights != rights {
+			changed = append(changed, identifier)
+		}
+	}
+	for identifier := range dstACL {
+		if _, ok := srcACL[identifier]; !ok {
+			removed = append(removed, identifier)
+		}
+	}
+	if len(changed) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	tx, err := m.dst.Back.DB.BeginTx(m.ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	for _, identifier := range changed {
+		if _, err := tx.ExecContext(m.ctx, m.dst.rebind(`
+			INSERT INTO mboxACL(mboxId, identifier, rights) VALUES (?, ?, ?)
+			ON CONFLICT (mboxId, identifier) DO UPDATE SET rights = excluded.rights`),
+			dstMboxID, identifier, srcACL[identifier]); err != nil {
+			return err
+		}
+	}
+	for _, identifier := range removed {
+		if _, err := tx.ExecContext(m.ctx, m.dst.rebind(`DELETE FROM mboxACL WHERE mboxId = ? AND identifier = ?`),
+			dstMboxID, identifier); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (m *migration) serverMetadata(store *Storage, userID int64) (map[string]string, error) {
+	rows, err := store.Back.DB.QueryContext(m.ctx, store.rebind(`SELECT name, value FROM serverMetadata WHERE userId = ?`), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make(map[string]string)
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		entries[name] = value
+	}
+	return entries, rows.Err()
+}
+
+// syncServerMetadata makes server annotations of the destination account
+// match the source ones.
+func (m *migration) syncServerMetadata(srcUID, dstUID int64) error {
+	srcEntries, err := m.serverMetadata(m.src, srcUID)
+	if err != nil {
+		return err
+	}
+	dstEntries, err := m.serverMetadata(m.dst, dstUID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := m.dst.Back.DB.BeginTx(m.ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	for name, value := range srcEntries {
+		if dstValue, ok := dstEntries[name]; ok && dstValue == value {
+			continue
+		}
+		if _, err := tx.ExecContext(m.ctx, m.dst.rebind(`
+			INSERT INTO serverMetadata(userId, name, value) VALUES (?, ?, ?)
+			ON CONFLICT (userId, name) DO UPDATE SET value = excluded.value`),
+			dstUID, name, value); err != nil {
+			return err
+		}
+	}
+	for name := range dstEntries {
+		if _, ok := srcEntries[name]; ok {
+			continue
+		}
+		if _, err := tx.ExecContext(m.ctx, m.dst.rebind(`DELETE FROM serverMetadata WHERE userId = ? AND name = ?`),
+			dstUID, name); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// metadataKey identifies the mailbox annotation. Annotations refer to
+// accounts by ID, usernames are used instead to match them between stores.
+type metadataKey struct {
+	username string
+	name     string
+}
+
+func (m *migration) mboxMetadata(store *Storage, mboxID int64) (map[metadataKey]string, error) {
+	rows, err := store.Back.DB.QueryContext(m.ctx, store.rebind(`
+		SELECT users.username, mboxMetadata.name, mboxMetadata.value FROM mboxMetadata
+		INNER JOIN users ON users.id = mboxMetadata.userId
+		WHERE mboxMetadata.mboxId = ?`), mboxID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make(map[metadataKey]string)
+	for rows.Next() {
+		var (
+			key   metadataKey
+			value string
+		)
+		if err := rows.Scan(&key.username, &key.name, &value); err != nil {
+			return nil, err
+		}
+		entries[key] = value
+	}
+	return entries, rows.Err()
+}
+
+// dstUserID returns the ID of the destination account or zero if it does
+// not exist.
+func (m *migration) dstUserID(username string) (int64, error) {
+	if id, ok := m.dstUserIDs[username]; ok {
+		return id, nil
+	}
+	var id int64
+	err := m.dst.Back.DB.QueryRowContext(m.ctx, m.dst.rebind(`SELECT id FROM users WHERE username = ?`), username).Scan(&id)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+	if m.dstUserIDs == nil {
+		m.dstUserIDs = make(map[string]int64)
+	}
+	m.dstUserIDs[username] = id
+	return id, nil
+}
+
+// syncMboxMetadata makes annotations of the destination mailbox match the
+// source ones. Private annotations of accounts that were not migrated are
+// skipped.
+func (m *migration) syncMboxMetadata(srcMboxID, dstMboxID int64) error {
+	srcEntries, err := m.mboxMetadata(m.src, srcMboxID)
+	if err != nil {
+		return err
+	}
+	dstEntries, err := m.mboxMetadata(m.dst, dstMboxID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := m.dst.Back.DB.BeginTx(m.ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	for key, value := range srcEntries {
+		if dstValue, ok := dstEntries[key]; ok && dstValue == value {
+			continue
+		}
+		userID, err := m.dstUserID(key.username)
+		if err != nil {
+			return err
+		}
+		if userID == 0 {
+			continue
+		}
+		if _, err := tx.ExecContext(m.ctx, m.dst.rebind(`
+			INSERT INTO mboxMetadata(mboxId, userId, name, value) VALUES (?, ?, ?, ?)
+			ON CONFLICT (mboxId, userId, name) DO UPDATE SET value = excluded.value`),
+			dstMboxID, userID, key.name, value); err != nil {
+			return err
+		}
+	}
+	for key := range dstEntries {
+		if _, ok := srcEntries[key]; ok {
+			continue
+		}
+		userID, err := m.dstUserID(key.username)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(m.ctx, m.dst.rebind(`DELETE FROM mboxMetadata WHERE mboxId = ? AND userId = ? AND name = ?`),
+			dstMboxID, userID, key.name); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (m *migration) flags(store *Storage, mboxID int64) (map[int64][]string, error) {
+	rows, err := store.Back.DB.QueryContext(m.ctx, store.rebind(`SELECT msgId, flag FROM flags WHERE mboxId = ?`), mboxID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	flags := make(map[int64][]string)
+	for rows.Next() {
+		var (
+			msgID int64
+			flag  string
+		)
+		if err := rows.Scan(&msgID, &flag); err != nil {
+			return nil, err
+		}
+		flags[msgID] = append(flags[msgID], flag)
+	}
+	for _, f := range flags {
+		sort.Strings(f)
+	}
+	return flags, rows.Err()
+}
+
+func (m *migration) dstMessages(mboxID int64) (map[int64]dstMessage, error) {
+	rows, err := m.dst.Back.DB.QueryContext(m.ctx, m.dst.rebind(`SELECT msgId, extBodyKey FROM msgs WHERE mboxId = ?`), mboxID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	msgs := make(map[int64]dstMessage)
+	for rows.Next() {
+		var msg dstMessage
+		if err := rows.Scan(&msg.msgID, &msg.key); err != nil {
+			return nil, err
+		}
+		msgs[msg.msgID] = msg
+	}
+	return msgs, rows.Err()
+}
+
+func (m *migration) syncMessages(srcMbox srcMailbox, dstMboxID, dstUID int64, res *MailboxMigration) error {
+	rows, err := m.src.Back.DB.QueryContext(m.ctx, m.src.rebind(`SELECT msgId FROM msgs WHERE mboxId = ? ORDER BY msgId`), srcMbox.id)
+	if err != nil {
+		return err
+	}
+	var srcIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		srcIDs = append(srcIDs, id)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	rows.Close()
+
+	srcFlags, err := m.flags(m.src, srcMbox.id)
+	if err != nil {
+		return err
+	}
+	dstMsgs, err := m.dstMessages(dstMboxID)
+	if err != nil {
+		return err
+	}
+	dstFlags, err := m.flags(m.dst, dstMboxID)
+	if err != nil {
+		return err
+	}
+
+	var newIDs, updatedIDs []int64
+	for _, id := range srcIDs {
+		if _, ok := dstMsgs[id]; !ok {
+			newIDs = append(newIDs, id)
+			continue
+		}
+		delete(dstMsgs, id)
+		if strings.Join(srcFlags[id], " ") != strings.Join(dstFlags[id], " ") {
+			updatedIDs = append(updatedIDs, id)
+		}
+	}
+
+	// What remains in dstMsgs was expunged in the source.
+	if len(dstMsgs) != 0 {
+		removed := make([]dstMessage, 0, len(dstMsgs))
+		for _, msg := range dstMsgs {
+			removed = append(removed, msg)
+		}
+		if err := m.removeMessages(dstMboxID, removed); err != nil {
+			return err
+		}
+		res.Removed += len(removed)
+	}
+
+	if len(updatedIDs) != 0 {
+		if err := m.updateFlags(dstMboxID, updatedIDs, srcFlags); err != nil {
+			return err
+		}
+		res.Updated += len(updatedIDs)
+	}
+
+	for len(newIDs) != 0 {
+		batch := newIDs
+		if len(batch) > migrateBatchSize {
+			batch = batch[:migrateBatchSize]
+		}
+		newIDs = newIDs[len(batch):]
+
+		if err := m.copyMessages(srcMbox.id, dstMboxID, dstUID, batch, srcFlags); err != nil {
+			return err
+		}
+		res.Copied += len(batch)
+	}
+
+	_, err = m.dst.Back.DB.ExecContext(m.ctx, m.dst.rebind(`
+		UPDATE mboxes
+		SET uidnext = ?, msgsCount = (SELECT COUNT(*) FROM msgs WHERE mboxId = ?)
+		WHERE id = ?`), srcMbox.uidNext, dstMboxID, dstMboxID)
+	return err
+}
+
+type msgModSeq struct {
+	modSeq   int64
+	expunged int
+}
+
+func (m *migration) msgModSeqs(store *Storage, mboxID int64) (map[int64]msgModSeq, error) {
+	rows, err := store.Back.DB.QueryContext(m.ctx, store.rebind(`SELECT msgId, modSeq, expunged FROM msgModSeq WHERE mboxId = ?`), mboxID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	modSeqs := make(map[int64]msgModSeq)
+	for rows.Next() {
+		var (
+			msgID int64
+			ms    msgModSeq
+		)
+		if err := rows.Scan(&msgID, &ms.modSeq, &ms.expunged); err != nil {
+			return nil, err
+		}
+		modSeqs[msgID] = ms
+	}
+	return modSeqs, rows.Err()
+}
+
+// mboxModSeq returns the value from the per-mailbox modification sequence
+// table or zero if there is no row for the mailbox.
+func (m *migration) mboxModSeq(store *Storage, table string, mboxID int64) (int64, error) {
+	var modSeq int64
+	err := store.Back.DB.QueryRowContext(m.ctx, store.rebind(`SELECT modSeq FROM `+table+` WHERE mboxId = ?`), mboxID).Scan(&modSeq)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return modSeq, err
+}
+
+// syncModSeq copies modification sequences of the messages from the source
+// mailbox, replacing the ones assigned in the destination while copying, so
+// CONDSTORE and QRESYNC clients do not need to resynchronize.
+//
+// HIGHESTMODSEQ and the vanished floor of the destination mailbox are raised
+// to the source values, they are never lowered since the destination might
+// have assigned larger values already.
+func (m *migration) syncModSeq(srcMboxID, dstMboxID int64) error {
+	if !m.src.modSeq || !m.dst.modSeq {
+		return nil
+	}
+
+	srcModSeqs, err := m.msgModSeqs(m.src, srcMboxID)
+	if err != nil {
+		return err
+	}
+	srcHighest, err := m.mboxModSeq(m.src, "mboxModSeq", srcMboxID)
+	if err != nil {
+		return err
+	}
+	srcVanished, err := m.mboxModSeq(m.src, "vanishedModSeq", srcMboxID)
+	if err != nil {
+		return err
+	}
+	dstModSeqs, err := m.msgModSeqs(m.dst, dstMboxID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := m.dst.Back.DB.BeginTx(m.ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	for msgID, ms := range srcModSeqs {
+		if dstMs, ok := dstModSeqs[msgID]; ok && dstMs == ms {
+			continue
+		}
+		if _, err := tx.ExecContext(m.ctx, m.dst.rebind(`
+			INSERT INTO msgModSeq(mboxId, msgId, modSeq, expunged) VALUES (?, ?, ?, ?)
+			ON CONFLICT (mboxId, msgId) DO UPDATE SET modSeq = excluded.modSeq, expunged = excluded.expunged`),
+			dstMboxID, msgID, ms.modSeq, ms.expunged); err != nil {
+			return err
+		}
+	}
+	for msgID := range dstModSeqs {
+		if _, ok := srcModSeqs[msgID]; ok {
+			continue
+		}
+		if _, err := tx.ExecContext(m.ctx, m.dst.rebind(`DELETE FROM msgModSeq WHERE mboxId = ? AND msgId = ?`),
+			dstMboxID, msgID); err != nil {
+			return err
+		}
+	}
+
+	for _, v := range []struct {
+		table  string
+		modSeq int64
+	}{{"mboxModSeq", srcHighest}, {"vanishedModSeq", srcVanished}} {
+		if v.modSeq == 0 {
+			continue
+		}
+		if _, err := tx.ExecContext(m.ctx, m.dst.rebind(`
+			INSERT INTO `+v.table+`(mboxId, modSeq) VALUES (?, ?)
+			ON CONFLICT (mboxId) DO UPDATE SET modSeq = CASE
+				WHEN `+v.table+`.modSeq > excluded.modSeq THEN `+v.table+`.modSeq
+				ELSE excluded.modSeq
+			END`), dstMboxID, v.modSeq); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (m *migration) insertFlags(tx *sql.Tx, mboxID, msgID int64, flags []string) error {
+	for _, flag := range flags {
+		if _, err := tx.ExecContext(m.ctx, m.dst.rebind(`INSERT INTO flags(mboxId, msgId, flag) VALUES (?, ?, ?)`),
+			mboxID, msgID, flag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isSeen(flags []string) int {
+	for _, f := range flags {
+		if f == `\Seen` {
+			return 1
+		}
+	}
+	return 0
+}
+
+func (m *migration) updateFlags(dstMboxID int64, ids []int64, srcFlags map[int64][]string) error {
+	tx, err := m.dst.Back.DB.BeginTx(m.ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	for _, id := range ids {
+		if _, err := tx.ExecContext(m.ctx, m.dst.rebind(`DELETE FROM flags WHERE mboxId = ? AND msgId = ?`), dstMboxID, id); err != nil {
+			return err
+		}
+		if err := m.insertFlags(tx, dstMboxID, id, srcFlags[id]); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(m.ctx, m.dst.rebind(`UPDATE msgs SET seen = ? WHERE mboxId = ? AND msgId = ?`),
+			isSeen(srcFlags[id]), dstMboxID, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (m *migration) copyMessages(srcMboxID, dstMboxID, dstUID int64, ids []int64, srcFlags map[int64][]string) error {
+	tx, err := m.dst.Back.DB.BeginTx(m.ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	for _, id := range ids {
+		var (
+			date, bodyLen            int64
+			bodyStructure, cachedHdr []byte
+			key, compressAlgo        sql.NullString
+			seen, recent             int
+		)
+		err := m.src.Back.DB.QueryRowContext(m.ctx, m.src.rebind(`
+			SELECT date, bodyLen, bodyStructure, cachedHeader, extBodyKey, seen, compressAlgo, recent
+			FROM msgs WHERE mboxId = ? AND msgId = ?`), srcMboxID, id).Scan(
+			&date, &bodyLen, &bodyStructure, &cachedHdr, &key, &seen, &compressAlgo, &recent)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				// Expunged while we were working.
+				continue
+			}
+			return err
+		}
+
+		if key.Valid {
+			if err := m.copyBlob(key.String); err != nil {
+				return fmt.Errorf("copy blob %s: %w", key.String, err)
+			}
+			if err := m.addBlobRef(tx, key.String, dstUID); err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.ExecContext(m.ctx, m.dst.rebind(`
+			INSERT INTO msgs(mboxId, msgId, date, bodyLen, bodyStructure, cachedHeader, extBodyKey, seen, compressAlgo, recent)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+			dstMboxID, id, date, bodyLen, string(bodyStructure), string(cachedHdr), key, seen, compressAlgo, recent)
+		if err != nil {
+			return err
+		}
+		if err := m.insertFlags(tx, dstMboxID, id, srcFlags[id]); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (m *migration) addBlobRef(tx *sql.Tx, key string, dstUID int64) error {
+	var refs int
+	err := tx.QueryRowContext(m.ctx, m.dst.rebind(`SELECT refs FROM extKeys WHERE id = ?`), key).Scan(&refs)
+	if errors.Is(err, sql.ErrNoRows) {
+		_, err = tx.ExecContext(m.ctx, m.dst.rebind(`INSERT INTO extKeys(id, uid, refs) VALUES (?, ?, 1)`), key, dstUID)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(m.ctx, m.dst.rebind(`UPDATE extKeys SET refs = refs + 1 WHERE id = ?`), key)
+	return err
+}
+
+func (m *migration) copyBlob(key string) error {
+	if m.sharedBlobs {
+		return nil
+	}
+	if dstSize, ok := m.dstBlobs[key]; ok {
+		// Either copied by the previous run or both stores refer to the
+		// same location. Copying in the latter case would destroy the blob.
+		srcSize, srcKnown := m.srcBlobs[key]
+		if !srcKnown || srcSize == dstSize {
+			return nil
+		}
+	}
+
+	r, err := m.src.blobStore.Open(m.ctx, key)
+	if err != nil {
+		if errors.Is(err, module.ErrNoSuchBlob) {
+			m.stats.MissingBlobs++
+			return nil
+		}
+		return err
+	}
+	defer r.Close()
+
+	w, err := m.dst.blobStore.Create(m.ctx, key, module.UnknownBlobSize)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Sync(); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	if m.dstBlobs == nil {
+		m.dstBlobs = make(map[string]int64)
+	}
+	m.dstBlobs[key] = m.srcBlobs[key]
+	m.stats.BlobsCopied++
+	return nil
+}
+
+func (m *migration) removeAllMessages(dstMboxID int64) (int, error) {
+	msgs, err := m.dstMessages(dstMboxID)
+	if err != nil {
+		return 0, err
+	}
+	list := make([]dstMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		list = append(list, msg)
+	}
+	return len(list), m.removeMessages(dstMboxID, list)
+}
+
+// removeMessages removes messages from the destination along with blobs that
+// are no longer referenced.
+func (m *migration) removeMessages(dstMboxID int64, msgs []dstMessage) error {
+	tx, err := m.dst.Back.DB.BeginTx(m.ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	var unrefKeys []string
+	for _, msg := range msgs {
+		if _, err := tx.ExecContext(m.ctx, m.dst.rebind(`DELETE FROM flags WHERE mboxId = ? AND msgId = ?`), dstMboxID, msg.msgID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(m.ctx, m.dst.rebind(`DELETE FROM msgs WHERE mboxId = ? AND msgId = ?`), dstMboxID, msg.msgID); err != nil {
+			return err
+		}
+		if !msg.key.Valid {
+			continue
+		}
+		if _, err := tx.ExecContext(m.ctx, m.dst.rebind(`UPDATE extKeys SET refs = refs - 1 WHERE id = ?`), msg.key.String); err != nil {
+			return err
+		}
+		var refs int
+		if err := tx.QueryRowContext(m.ctx, m.dst.rebind(`SELECT refs FROM extKeys WHERE id = ?`), msg.key.String).Scan(&refs); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			return err
+		}
+		if refs <= 0 {
+			if _, err := tx.ExecContext(m.ctx, m.dst.rebind(`DELETE FROM extKeys WHERE id = ?`), msg.key.String); err != nil {
+				return err
+			}
+			unrefKeys = append(unrefKeys, msg.key.String)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if m.sharedBlobs {
+		return nil
+	}
+	var toDelete []string
+	for _, key := range unrefKeys {
+		// Destination store might refer to the same location as the source
+		// one, do not remove blobs still used there.
+		used, err := m.src.isReferenced(m.ctx, m.src.Back.DB, key)
+		if err != nil {
+			return err
+		}
+		if !used {
+			toDelete = append(toDelete, key)
+			delete(m.dstBlobs, key)
+		}
+	}
+	if len(toDelete) == 0 {
+		return nil
+	}
+	return m.dst.blobStore.Delete(m.ctx, toDelete)
+}
@@ -0,0 +1,434 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+type testMsg struct {
+	UID   uint32
+	Flags []string
+	Body  string
+}
+
+type testMbox struct {
+	UidValidity uint32
+	UidNext     uint32
+	Msgs        []testMsg
+}
+
+func dumpAcct(t *testing.T, store *Storage, username string) map[string]testMbox {
+	t.Helper()
+	u, err := store.GetIMAPAcct(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, err := u.ListMailboxes(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := make(map[string]testMbox)
+	for _, info := range infos {
+		status, err := u.Status(info.Name, []imap.StatusItem{imap.StatusUidValidity, imap.StatusUidNext})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, mbox, err := u.GetMailbox(info.Name, true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dump := testMbox{UidValidity: status.UidValidity, UidNext: status.UidNext}
+
+		seq, _ := imap.ParseSeqSet("1:*")
+		ch := make(chan *imap.Message, 10)
+		go func() {
+			err = mbox.ListMessages(true, seq, []imap.FetchItem{imap.FetchUid, imap.FetchFlags, "BODY.PEEK[]"}, ch)
+		}()
+		for msg := range ch {
+			var flags []string
+			for _, f := range msg.Flags {
+				if f != imap.RecentFlag {
+					flags = append(flags, f)
+				}
+			}
+			sort.Strings(flags)
+			var body []byte
+			for _, v := range msg.Body {
+				body, _ = io.ReadAll(v)
+			}
+			dump.Msgs = append(dump.Msgs, testMsg{UID: msg.Uid, Flags: flags, Body: string(body)})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		mbox.Close()
+		res[info.Name] = dump
+	}
+	return res
+}
+
+func addTestMsg(t *testing.T, u backend.User, mbox, text string, flags ...string) {
+	t.Helper()
+	body := bytes.NewBufferString("Subject: " + text + "\r\n\r\n" + text + "\r\n")
+	if err := u.CreateMessage(mbox, flags, time.Now(), body, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func migrateAndCompare(t *testing.T, src, dst *Storage) *MigrateStats {
+	t.Helper()
+	stats, err := Migrate(context.Background(), src, dst, MigrateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcDump, dstDump := dumpAcct(t, src, "test@example.org"), dumpAcct(t, dst, "test@example.org")
+	if !reflect.DeepEqual(srcDump, dstDump) {
+		t.Fatalf("destination does not match the source:\n%+v\n%+v", srcDump, dstDump)
+	}
+	return stats
+}
+
+func countFiles(t *testing.T, dir string) int {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestMigrate(t *testing.T) {
+	src, srcBlobs := createTestStorage(t)
+	dst, dstBlobs := createTestStorage(t)
+
+	if err := src.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	u, err := src.GetIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.CreateMailbox("Archive"); err != nil {
+		t.Fatal(err)
+	}
+	addTestMsg(t, u, "INBOX", "one", imap.SeenFlag)
+	addTestMsg(t, u, "INBOX", "two", "$Label1")
+	addTestMsg(t, u, "INBOX", "three")
+	_, inbox, err := u.GetMailbox("INBOX", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inbox.Close()
+	seq, _ := imap.ParseSeqSet("1")
+	// Shares the blob with the original message.
+	if err := inbox.CopyMessages(true, seq, "Archive"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Account with unrelated INBOX in the destination.
+	if err := dst.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	dstU, err := dst.GetIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestMsg(t, dstU, "INBOX", "unrelated")
+
+	stats := migrateAndCompare(t, src, dst)
+	if stats.Copied != 4 || stats.BlobsCopied != 3 || stats.Removed != 1 {
+		t.Errorf("wrong stats for the first run: %+v", stats)
+	}
+	if countFiles(t, dstBlobs) != 3 {
+		t.Errorf("wrong amount of blobs in the destination: %d", countFiles(t, dstBlobs))
+	}
+
+	stats = migrateAndCompare(t, src, dst)
+	if stats.Copied != 0 || stats.Updated != 0 || stats.Removed != 0 || stats.BlobsCopied != 0 {
+		t.Errorf("changes made by the repeated run: %+v", stats)
+	}
+
+	seq, _ = imap.ParseSeqSet("2")
+	if err := inbox.UpdateMessagesFlags(true, seq, imap.AddFlags, true, []string{imap.FlaggedFlag}); err != nil {
+		t.Fatal(err)
+	}
+	seq, _ = imap.ParseSeqSet("3")
+	if err := inbox.UpdateMessagesFlags(true, seq, imap.AddFlags, true, []string{imap.DeletedFlag}); err != nil {
+		t.Fatal(err)
+	}
+	if err := inbox.Expunge(); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.DeleteMailbox("Archive"); err != nil {
+		t.Fatal(err)
+	}
+	addTestMsg(t, u, "INBOX", "four")
+
+	stats = migrateAndCompare(t, src, dst)
+	if stats.Copied != 1 || stats.Updated != 1 || stats.Removed != 2 {
+		t.Errorf("wrong stats for the catch-up run: %+v", stats)
+	}
+	if countFiles(t, dstBlobs) != countFiles(t, srcBlobs) {
+		t.Errorf("blob count mismatch: %d != %d", countFiles(t, dstBlobs), countFiles(t, srcBlobs))
+	}
+}
+
+func checkACL(t *testing.T, src, dst *Storage, username, mbox string) {
+	t.Helper()
+	srcACL, err := src.GetACL(username, mbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstACL, err := dst.GetACL(username, mbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(srcACL, dstACL) {
+		t.Fatalf("destination ACL does not match the source:\n%v\n%v", srcACL, dstACL)
+	}
+}
+
+func TestMigrate_SharedMailbox(t *testing.T) {
+	src, _ := createTestStorage(t)
+	dst, _ := createTestStorage(t)
+
+	for _, name := range []string{"test@example.org", "other@example.org"} {
+		if err := src.CreateIMAPAcct(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	u, err := src.GetIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.CreateMailbox("Support"); err != nil {
+		t.Fatal(err)
+	}
+	addTestMsg(t, u, "Support", "one")
+	if err := src.SetACL("test@example.org", "Support", "other@example.org", "lrs"); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.SetACL("test@example.org", "Support", "anyone", "l"); err != nil {
+		t.Fatal(err)
+	}
+
+	migrateAndCompare(t, src, dst)
+	checkACL(t, src, dst, "test@example.org", "Support")
+
+	// Shared mailbox is visible to the other account in the destination.
+	other, err := dst.GetOrCreateIMAPAcct("other@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, mbox, err := other.GetMailbox("Shared.test@example.org.Support", true, nil); err != nil {
+		t.Fatal(err)
+	} else {
+		mbox.Close()
+	}
+
+	if err := src.SetACL("test@example.org", "Support", "other@example.org", "+w"); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.DeleteACL("test@example.org", "Support", "anyone"); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.SetACL("test@example.org", "INBOX", "other@example.org", "lr"); err != nil {
+		t.Fatal(err)
+	}
+
+	migrateAndCompare(t, src, dst)
+	checkACL(t, src, dst, "test@example.org", "Support")
+	checkACL(t, src, dst, "test@example.org", "INBOX")
+}
+
+type modSeqState struct {
+	Highest, Vanished int64
+	Msgs              map[int64]msgModSeq
+}
+
+func dumpModSeq(t *testing.T, store *Storage, username, mbox string) modSeqState {
+	t.Helper()
+	m := &migration{ctx: context.Background()}
+	id, err := store.mboxID(m.ctx, username, mbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state modSeqState
+	if state.Highest, err = m.mboxModSeq(store, "mboxModSeq", id); err != nil {
+		t.Fatal(err)
+	}
+	if state.Vanished, err = m.mboxModSeq(store, "vanishedModSeq", id); err != nil {
+		t.Fatal(err)
+	}
+	if state.Msgs, err = m.msgModSeqs(store, id); err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func migrateAndCompareModSeq(t *testing.T, src, dst *Storage) {
+	t.Helper()
+	migrateAndCompare(t, src, dst)
+	srcState := dumpModSeq(t, src, "test@example.org", "INBOX")
+	dstState := dumpModSeq(t, dst, "test@example.org", "INBOX")
+	if !reflect.DeepEqual(srcState.Msgs, dstState.Msgs) {
+		t.Fatalf("message modification sequences do not match:\n%v\n%v", srcState.Msgs, dstState.Msgs)
+	}
+	if dstState.Highest < srcState.Highest {
+		t.Errorf("HIGHESTMODSEQ is lower in the destination: %d < %d", dstState.Highest, srcState.Highest)
+	}
+	if dstState.Vanished < srcState.Vanished {
+		t.Errorf("vanished floor is lower in the destination: %d < %d", dstState.Vanished, srcState.Vanished)
+	}
+}
+
+func TestMigrate_ModSeq(t *testing.T) {
+	src, _ := createTestStorage(t)
+	dst, _ := createTestStorage(t)
+
+	if err := src.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	u, err := src.GetOrCreateIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range []string{"one", "two", "three", "four"} {
+		addTestMsg(t, u, "INBOX", text)
+	}
+	_, inbox, err := u.GetMailbox("INBOX", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inbox.Close()
+	seq, _ := imap.ParseSeqSet("2")
+	if err := inbox.UpdateMessagesFlags(true, seq, imap.AddFlags, true, []string{imap.FlaggedFlag}); err != nil {
+		t.Fatal(err)
+	}
+	seq, _ = imap.ParseSeqSet("3:4")
+	if err := inbox.UpdateMessagesFlags(true, seq, imap.AddFlags, true, []string{imap.DeletedFlag}); err != nil {
+		t.Fatal(err)
+	}
+	if err := inbox.Expunge(); err != nil {
+		t.Fatal(err)
+	}
+
+	migrateAndCompareModSeq(t, src, dst)
+
+	// Changes after the first run and forgotten expunges.
+	seq, _ = imap.ParseSeqSet("1")
+	if err := inbox.UpdateMessagesFlags(true, seq, imap.AddFlags, true, []string{imap.SeenFlag}); err != nil {
+		t.Fatal(err)
+	}
+	addTestMsg(t, u, "INBOX", "five")
+	if _, err := src.pruneVanished(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if dumpModSeq(t, src, "test@example.org", "INBOX").Vanished == 0 {
+		t.Fatal("vanished floor is not set by pruning")
+	}
+
+	migrateAndCompareModSeq(t, src, dst)
+}
+
+func TestMigrate_Metadata(t *testing.T) {
+	src, _ := createTestStorage(t)
+	dst, _ := createTestStorage(t)
+	str := func(s string) *string { return &s }
+
+	// Account IDs differ between stores.
+	if err := dst.CreateIMAPAcct("unrelated@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	getUser := func(store *Storage, name string) *aclUser {
+		t.Helper()
+		u, err := store.GetOrCreateIMAPAcct(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.(*aclUser)
+	}
+	owner := getUser(src, "test@example.org")
+	other := getUser(src, "other@example.org")
+	if err := src.SetACL("test@example.org", "INBOX", "other@example.org", "lr"); err != nil {
+		t.Fatal(err)
+	}
+
+	set := func(u *aclUser, mbox string, entries map[string]*string) {
+		t.Helper()
+		if err := u.SetMetadata(mbox, entries); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set(owner, "", map[string]*string{"/private/comment": str("server"), "/private/vendor/maddy/spam-threshold": str("5")})
+	set(owner, "INBOX", map[string]*string{"/private/comment": str("mine"), "/shared/comment": str("shared")})
+	set(other, "Shared.test@example.org.INBOX", map[string]*string{"/private/comment": str("other's")})
+	set(other, "", map[string]*string{"/private/comment": str("other server")})
+
+	compare := func() {
+		t.Helper()
+		for _, c := range []struct{ user, mbox string }{
+			{"test@example.org", ""},
+			{"test@example.org", "INBOX"},
+			{"other@example.org", ""},
+			{"other@example.org", "Shared.test@example.org.INBOX"},
+		} {
+			srcEntries, err := getUser(src, c.user).GetMetadata(c.mbox, []string{"/private", "/shared"}, metadataDepthInfinity)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dstEntries, err := getUser(dst, c.user).GetMetadata(c.mbox, []string{"/private", "/shared"}, metadataDepthInfinity)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(srcEntries) == 0 || !reflect.DeepEqual(srcEntries, dstEntries) {
+				t.Fatalf("%s %q: destination annotations do not match the source:\n%v\n%v", c.user, c.mbox, srcEntries, dstEntries)
+			}
+		}
+	}
+
+	migrateAndCompare(t, src, dst)
+	compare()
+
+	set(owner, "", map[string]*string{"/private/comment": nil})
+	set(other, "Shared.test@example.org.INBOX", map[string]*string{"/private/comment": str("changed")})
+	set(owner, "INBOX", map[string]*string{"/private/comment": nil})
+
+	migrateAndCompare(t, src, dst)
+	compare()
+	value, ok, err := dst.AccountMetadata(context.Background(), "test@example.org", "/private/vendor/maddy/spam-threshold")
+	if err != nil || !ok || value != "5" {
+		t.Errorf("AccountMetadata: %v %v %v", value, ok, err)
+	}
+}
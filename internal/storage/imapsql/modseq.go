@@ -0,0 +1,472 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// Modification sequences (RFC 7162) are not known to go-imap-sql so they are
+// maintained by triggers on its tables. This way all changes are accounted
+// for, including the ones made outside of IMAP sessions (message delivery,
+// retention policies, imap-* commands).
+//
+// mboxModSeq contains the highest modification sequence of each mailbox,
+// msgModSeq contains the modification sequence of each message. Rows of
+// expunged messages are kept with expunged = 1 so VANISHED responses can be
+// generated. Messages and mailboxes without rows (created before
+// modification sequences were introduced) have the modification sequence
+// of 1.
+//
+// Only the last vanishedKeep rows of expunged messages are kept in each
+// mailbox, older ones are removed by the sweeper and vanishedModSeq is set
+// to the highest modification sequence among them. Clients resynchronizing
+// from an older modification sequence get all UIDs that do not exist in the
+// mailbox, as permitted by RFC 7162.
+
+// vanishedKeep is the number of expunged messages remembered in each
+// mailbox.
+const vanishedKeep = 1000
+
+// vanishedSweepInterval is the interval between removals of old expunged
+// messages.
+const vanishedSweepInterval = time.Hour
+
+var modSeqTables = []string{
+	`CREATE TABLE IF NOT EXISTS mboxModSeq (
+		mboxId BIGINT NOT NULL PRIMARY KEY REFERENCES mboxes(id) ON DELETE CASCADE,
+		modSeq BIGINT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS msgModSeq (
+		mboxId BIGINT NOT NULL REFERENCES mboxes(id) ON DELETE CASCADE,
+		msgId BIGINT NOT NULL,
+		modSeq BIGINT NOT NULL,
+		expunged INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (mboxId, msgId)
+	)`,
+	`CREATE INDEX IF NOT EXISTS msgModSeq_modSeq ON msgModSeq(mboxId, modSeq)`,
+	`CREATE TABLE IF NOT EXISTS vanishedModSeq (
+		mboxId BIGINT NOT NULL PRIMARY KEY REFERENCES mboxes(id) ON DELETE CASCADE,
+		modSeq BIGINT NOT NULL
+	)`,
+}
+
+// bumpModSeq returns statements that assign the next modification sequence
+// of the mailbox to the message.
+func bumpModSeq(mboxID, msgID, expunged string) string {
+	return `
+		INSERT INTO mboxModSeq(mboxId, modSeq) VALUES (` + mboxID + `, 2)
+		ON CONFLICT (mboxId) DO UPDATE SET modSeq = mboxModSeq.modSeq + 1;
+		INSERT INTO msgModSeq(mboxId, msgId, modSeq, expunged)
+		SELECT mboxId, ` + msgID + `, modSeq, ` + expunged + ` FROM mboxModSeq WHERE mboxId = ` + mboxID + `
+		ON CONFLICT (mboxId, msgId) DO UPDATE SET modSeq = excluded.modSeq, expunged = excluded.expunged;`
+}
+
+// Rows removed by cascading deletes of mailboxes and messages are ignored
+// using WHEN conditions, the parent row is already gone at that point.
+var sqliteModSeqTriggers = []string{
+	`CREATE TRIGGER IF NOT EXISTS msgs_insert_modseq AFTER INSERT ON msgs
+	BEGIN` + bumpModSeq("NEW.mboxId", "NEW.msgId", "0") + `
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS msgs_delete_modseq AFTER DELETE ON msgs
+	WHEN EXISTS (SELECT 1 FROM mboxes WHERE id = OLD.mboxId)
+	BEGIN` + bumpModSeq("OLD.mboxId", "OLD.msgId", "1") + `
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS flags_insert_modseq AFTER INSERT ON flags
+	BEGIN` + bumpModSeq("NEW.mboxId", "NEW.msgId", "0") + `
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS flags_delete_modseq AFTER DELETE ON flags
+	WHEN EXISTS (SELECT 1 FROM msgs WHERE mboxId = OLD.mboxId AND msgId = OLD.msgId)
+	BEGIN` + bumpModSeq("OLD.mboxId", "OLD.msgId", "0") + `
+	END`,
+}
+
+var postgresModSeqTriggers = []string{
+	`CREATE OR REPLACE FUNCTION msgs_modseq() RETURNS trigger AS $$
+	BEGIN
+		IF TG_OP = 'INSERT' THEN` + bumpModSeq("NEW.mboxId", "NEW.msgId", "0") + `
+		ELSIF EXISTS (SELECT 1 FROM mboxes WHERE id = OLD.mboxId) THEN` + bumpModSeq("OLD.mboxId", "OLD.msgId", "1") + `
+		END IF;
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql`,
+	`CREATE OR REPLACE FUNCTION flags_modseq() RETURNS trigger AS $$
+	BEGIN
+		IF TG_OP = 'INSERT' THEN` + bumpModSeq("NEW.mboxId", "NEW.msgId", "0") + `
+		ELSIF EXISTS (SELECT 1 FROM msgs WHERE mboxId = OLD.mboxId AND msgId = OLD.msgId) THEN` + bumpModSeq("OLD.mboxId", "OLD.msgId", "0") + `
+		END IF;
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql`,
+	`DROP TRIGGER IF EXISTS msgs_modseq ON msgs`,
+	`CREATE TRIGGER msgs_modseq AFTER INSERT OR DELETE ON msgs
+	FOR EACH ROW EXECUTE PROCEDURE msgs_modseq()`,
+	`DROP TRIGGER IF EXISTS flags_modseq ON flags`,
+	`CREATE TRIGGER flags_modseq AFTER INSERT OR DELETE ON flags
+	FOR EACH ROW EXECUTE PROCEDURE flags_modseq()`,
+}
+
+// initModSeq creates tables and triggers used to track modification
+// sequences. If the database does not support them, CONDSTORE and QRESYNC
+// extensions are disabled.
+func (store *Storage) initModSeq() error {
+	var triggers []string
+	switch store.driver {
+	case "sqlite3", "sqlite":
+		triggers = sqliteModSeqTriggers
+	case "postgres":
+		triggers = postgresModSeqTriggers
+	default:
+		store.Log.Msg("modification sequences are not supported for the driver, CONDSTORE is disabled", "driver", store.driver)
+		return nil
+	}
+
+	tx, err := store.Back.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("imapsql: %w", err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	for _, stmt := range modSeqTables {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("imapsql: failed to create modification sequence tables: %w", err)
+		}
+	}
+	for _, stmt := range triggers {
+		if _, err := tx.Exec(stmt); err != nil {
+			// CockroachDB and some older servers do not support triggers,
+			// the storage is still usable without CONDSTORE.
+			store.Log.Error("failed to create modification sequence triggers, CONDSTORE is disabled", err)
+			return nil
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("imapsql: %w", err)
+	}
+
+	store.modSeq = true
+	return nil
+}
+
+// uidRanges returns the UID ranges of the set suitable for use with BETWEEN.
+func uidRanges(uids *imap.SeqSet) [][2]uint32 {
+	if uids == nil {
+		return [][2]uint32{{1, math.MaxUint32}}
+	}
+	res := make([][2]uint32, 0, len(uids.Set))
+	for _, seq := range uids.Set {
+		start, stop := seq.Start, seq.Stop
+		if start == 0 {
+			start = math.MaxUint32
+		}
+		if stop == 0 {
+			stop = math.MaxUint32
+		}
+		if start > stop {
+			start, stop = stop, start
+		}
+		res = append(res, [2]uint32{start, stop})
+	}
+	return res
+}
+
+func (store *Storage) highestModSeq(ctx context.Context, mboxID int64) (uint64, error) {
+	var modSeq uint64
+	err := store.Back.DB.QueryRowContext(ctx, store.rebind(`
+		SELECT modSeq FROM mboxModSeq WHERE mboxId = ?`), mboxID).Scan(&modSeq)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 1, nil
+		}
+		return 0, fmt.Errorf("imapsql: %w", err)
+	}
+	return modSeq, nil
+}
+
+// modSeqs returns modification sequences of messages with specified UIDs
+// that were changed after changedSince. A nil set matches all messages.
+func (store *Storage) modSeqs(ctx context.Context, mboxID int64, uids *imap.SeqSet, changedSince uint64) (map[uint32]uint64, error) {
+	res := make(map[uint32]uint64)
+	for _, r := range uidRanges(uids) {
+		rows, err := store.Back.DB.QueryContext(ctx, store.rebind(`
+			SELECT msgs.msgId, COALESCE(msgModSeq.modSeq, 1) FROM msgs
+			LEFT JOIN msgModSeq ON msgModSeq.mboxId = msgs.mboxId AND msgModSeq.msgId = msgs.msgId
+			WHERE msgs.mboxId = ? AND msgs.msgId BETWEEN ? AND ?
+			AND COALESCE(msgModSeq.modSeq, 1) > ?`), mboxID, r[0], r[1], changedSince)
+		if err != nil {
+			return nil, fmt.Errorf("imapsql: %w", err)
+		}
+		for rows.Next() {
+			var (
+				uid    uint32
+				modSeq uint64
+			)
+			if err := rows.Scan(&uid, &modSeq); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("imapsql: %w", err)
+			}
+			res[uid] = modSeq
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("imapsql: %w", err)
+		}
+	}
+	return res, nil
+}
+
+// vanished returns UIDs from the set of messages that were expunged after
+// the since modification sequence. If expunged messages from that period
+// were already forgotten, all UIDs from the set that do not exist in the
+// mailbox are returned.
+func (store *Storage) vanished(ctx context.Context, mboxID int64, uids *imap.SeqSet, since uint64) (*imap.SeqSet, error) {
+	var floor uint64
+	err := store.Back.DB.QueryRowContext(ctx, store.rebind(`
+		SELECT modSeq FROM vanishedModSeq WHERE mboxId = ?`), mboxID).Scan(&floor)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("imapsql: %w", err)
+	}
+	if since < floor {
+		return store.missingUIDs(ctx, mboxID, uids)
+	}
+
+	res := &imap.SeqSet{}
+	for _, r := range uidRanges(uids) {
+		rows, err := store.Back.DB.QueryContext(ctx, store.rebind(`
+			SELECT msgId FROM msgModSeq
+			WHERE mboxId = ? AND expunged = 1 AND msgId BETWEEN ? AND ? AND modSeq > ?`),
+			mboxID, r[0], r[1], since)
+		if err != nil {
+			return nil, fmt.Errorf("imapsql: %w", err)
+		}
+		for rows.Next() {
+			var uid uint32
+			if err := rows.Scan(&uid); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("imapsql: %w", err)
+			}
+			res.AddNum(uid)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("imapsql: %w", err)
+		}
+	}
+	return res, nil
+}
+
+// missingUIDs returns UIDs from the set that were assigned in the mailbox
+// but do not belong to any message now.
+func (store *Storage) missingUIDs(ctx context.Context, mboxID int64, uids *imap.SeqSet) (*imap.SeqSet, error) {
+	var uidNext uint32
+	err := store.Back.DB.QueryRowContext(ctx, store.rebind(`
+		SELECT uidnext FROM mboxes WHERE id = ?`), mboxID).Scan(&uidNext)
+	if err != nil {
+		return nil, fmt.Errorf("imapsql: %w", err)
+	}
+
+	res := &imap.SeqSet{}
+	if uidNext <= 1 {
+		return res, nil
+	}
+	for _, r := range uidRanges(uids) {
+		start, stop := r[0], r[1]
+		if stop >= uidNext {
+			stop = uidNext - 1
+		}
+		if start > stop {
+			continue
+		}
+
+		rows, err := store.Back.DB.QueryContext(ctx, store.rebind(`
+			SELECT msgId FROM msgs WHERE mboxId = ? AND msgId BETWEEN ? AND ?
+			ORDER BY msgId`), mboxID, start, stop)
+		if err != nil {
+			return nil, fmt.Errorf("imapsql: %w", err)
+		}
+		next := start
+		for rows.Next() {
+			var uid uint32
+			if err := rows.Scan(&uid); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("imapsql: %w", err)
+			}
+			if uid > next {
+				res.AddRange(next, uid-1)
+			}
+			next = uid + 1
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("imapsql: %w", err)
+		}
+		if next <= stop && next != 0 {
+			res.AddRange(next, stop)
+		}
+	}
+	return res, nil
+}
+
+// pruneVanished removes all but the last vanishedKeep expunged messages of
+// each mailbox and raises the vanishedModSeq of these mailboxes.
+func (store *Storage) pruneVanished(ctx context.Context, keep int) (int64, error) {
+	rows, err := store.Back.DB.QueryContext(ctx, store.rebind(`
+		SELECT mboxId FROM msgModSeq WHERE expunged = 1
+		GROUP BY mboxId HAVING COUNT(*) > ?`), keep)
+	if err != nil {
+		return 0, fmt.Errorf("imapsql: %w", err)
+	}
+	var mboxIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("imapsql: %w", err)
+		}
+		mboxIDs = append(mboxIDs, id)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return 0, fmt.Errorf("imapsql: %w", err)
+	}
+
+	var removed int64
+	for _, id := range mboxIDs {
+		n, err := store.pruneMboxVanished(ctx, id, keep)
+		if err != nil {
+			return removed, err
+		}
+		removed += n
+	}
+	return removed, nil
+}
+
+func (store *Storage) pruneMboxVanished(ctx context.Context, mboxID int64, keep int) (int64, error) {
+	tx, err := store.Back.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("imapsql: %w", err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	var cutoff uint64
+	err = tx.QueryRowContext(ctx, store.rebind(`
+		SELECT modSeq FROM msgModSeq WHERE mboxId = ? AND expunged = 1
+		ORDER BY modSeq DESC LIMIT 1 OFFSET ?`), mboxID, keep).Scan(&cutoff)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("imapsql: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, store.rebind(`
+		INSERT INTO vanishedModSeq(mboxId, modSeq) VALUES (?, ?)
+		ON CONFLICT (mboxId) DO UPDATE SET modSeq = excluded.modSeq
+		WHERE vanishedModSeq.modSeq < excluded.modSeq`), mboxID, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("imapsql: %w", err)
+	}
+	res, err := tx.ExecContext(ctx, store.rebind(`
+		DELETE FROM msgModSeq WHERE mboxId = ? AND expunged = 1 AND modSeq <= ?`), mboxID, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("imapsql: %w", err)
+	}
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("imapsql: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("imapsql: %w", err)
+	}
+	return removed, nil
+}
+
+func (store *Storage) vanishedSweeper() {
+	defer store.bgWorkers.Done()
+
+	ticker := time.NewTicker(vanishedSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-store.bgStop:
+			return
+		case <-ticker.C:
+		}
+
+		removed, err := store.pruneVanished(context.Background(), vanishedKeep)
+		if err != nil {
+			store.Log.Error("expunged messages removal failed", err)
+			continue
+		}
+		store.Log.Debugln("removed", removed, "old expunged messages")
+	}
+}
+
+// uidsAfter returns at most count UIDs assigned after uid, including UIDs of
+// messages that were already expunged.
+func (store *Storage) uidsAfter(ctx context.Context, mboxID int64, uid uint32, count int) ([]uint32, error) {
+	rows, err := store.Back.DB.QueryContext(ctx, store.rebind(`
+		SELECT msgId FROM msgs WHERE mboxId = ? AND msgId > ?
+		UNION
+		SELECT msgId FROM msgModSeq WHERE mboxId = ? AND msgId > ? AND expunged = 1
+		ORDER BY msgId
+		LIMIT ?`), mboxID, uid, mboxID, uid, count)
+	if err != nil {
+		return nil, fmt.Errorf("imapsql: %w", err)
+	}
+	defer rows.Close()
+
+	res := make([]uint32, 0, count)
+	for rows.Next() {
+		var uid uint32
+		if err := rows.Scan(&uid); err != nil {
+			return nil, fmt.Errorf("imapsql: %w", err)
+		}
+		res = append(res, uid)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("imapsql: %w", err)
+	}
+	return res, nil
+}
+
+// modSeqStatusItem is the STATUS item defined by RFC 7162.
+const modSeqStatusItem imap.StatusItem = "HIGHESTMODSEQ"
+
+func hasModSeqItem(items []imap.StatusItem) bool {
+	for _, item := range items {
+		if strings.EqualFold(string(item), string(modSeqStatusItem)) {
+			return true
+		}
+	}
+	return false
+}
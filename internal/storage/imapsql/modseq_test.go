@@ -0,0 +1,206 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestModSeq(t *testing.T) {
+	store, _ := createTestStorage(t)
+	if !store.modSeq {
+		t.Fatal("modification sequences are not enabled")
+	}
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	u, err := store.GetOrCreateIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		addTestMessage(t, store, "test@example.org", "INBOX")
+	}
+
+	_, m, err := u.GetMailbox("INBOX", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	mbox := m.(*aclMailbox)
+
+	initial, err := mbox.HighestModSeq()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if initial < 4 {
+		t.Errorf("new messages did not change HIGHESTMODSEQ: %d", initial)
+	}
+
+	seq, _ := imap.ParseSeqSet("2")
+	if err := mbox.UpdateMessagesFlags(true, seq, imap.AddFlags, true, []string{imap.FlaggedFlag}); err != nil {
+		t.Fatal(err)
+	}
+	highest, err := mbox.HighestModSeq()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if highest <= initial {
+		t.Fatalf("flags change did not change HIGHESTMODSEQ: %d", highest)
+	}
+	changed, err := mbox.ModSeqs(nil, initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 1 || changed[2] != highest {
+		t.Errorf("wrong changed messages: %v", changed)
+	}
+
+	// Adding a flag that is already set is not a change.
+	if err := mbox.UpdateMessagesFlags(true, seq, imap.AddFlags, true, []string{imap.FlaggedFlag}); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := mbox.HighestModSeq(); again != highest {
+		t.Errorf("no-op flags change changed HIGHESTMODSEQ: %d", again)
+	}
+
+	seq, _ = imap.ParseSeqSet("1")
+	if err := mbox.DelMessages(true, seq); err != nil {
+		t.Fatal(err)
+	}
+	vanished, err := mbox.Vanished(nil, highest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vanished.String() != "1" {
+		t.Errorf("wrong vanished messages: %v", vanished)
+	}
+	if vanished, _ := mbox.Vanished(nil, highest+1); !vanished.Empty() {
+		t.Errorf("wrong vanished messages after the expunge: %v", vanished)
+	}
+
+	uids, err := mbox.UIDsAfter(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uids) != 3 || uids[0] != 1 || uids[2] != 3 {
+		t.Errorf("wrong UIDs: %v", uids)
+	}
+
+	status, err := u.Status("INBOX", []imap.StatusItem{imap.StatusMessages, modSeqStatusItem})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Items[modSeqStatusItem] != imap.RawString(strconv.FormatUint(highest+1, 10)) {
+		t.Errorf("wrong HIGHESTMODSEQ: %v", status.Items[modSeqStatusItem])
+	}
+
+	if err := u.CreateMailbox("Test"); err != nil {
+		t.Fatal(err)
+	}
+	addTestMessage(t, store, "test@example.org", "Test")
+	if err := u.DeleteMailbox("Test"); err != nil {
+		t.Fatal(err)
+	}
+	var rows int
+	if err := store.Back.DB.QueryRow(`SELECT COUNT(*) FROM msgModSeq`).Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 3 {
+		t.Errorf("modification sequences of the removed mailbox are not removed: %d rows", rows)
+	}
+}
+
+func TestModSeq_PruneVanished(t *testing.T) {
+	store, _ := createTestStorage(t)
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	u, err := store.GetOrCreateIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		addTestMessage(t, store, "test@example.org", "INBOX")
+	}
+
+	_, m, err := u.GetMailbox("INBOX", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	mbox := m.(*aclMailbox)
+
+	before, err := mbox.HighestModSeq()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uid := range []string{"1", "2", "4"} {
+		seq, _ := imap.ParseSeqSet(uid)
+		if err := mbox.DelMessages(true, seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	afterSecond := before + 2
+
+	removed, err := store.pruneVanished(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Errorf("wrong amount of removed rows: %d", removed)
+	}
+
+	// Only the last expunge is remembered.
+	vanished, err := mbox.Vanished(nil, afterSecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vanished.String() != "4" {
+		t.Errorf("wrong vanished messages: %v", vanished)
+	}
+
+	// Older modification sequences get all missing UIDs.
+	vanished, err = mbox.Vanished(nil, before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vanished.String() != "1:2,4" {
+		t.Errorf("wrong vanished messages before the floor: %v", vanished)
+	}
+	seq, _ := imap.ParseSeqSet("2:3")
+	vanished, err = mbox.Vanished(seq, before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vanished.String() != "2" {
+		t.Errorf("wrong vanished messages in the set: %v", vanished)
+	}
+
+	if removed, _ := store.pruneVanished(context.Background(), 1); removed != 0 {
+		t.Errorf("rows removed again: %d", removed)
+	}
+}
@@ -0,0 +1,375 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+type retentionRule struct {
+	// Mailbox name patterns (path.Match syntax).
+	mailboxes  []string
+	specialUse []string
+	// If not nil, the rule applies only to accounts present in the table.
+	accounts module.Table
+	maxAge   time.Duration
+}
+
+type retentionPolicy struct {
+	rules     []retentionRule
+	interval  time.Duration
+	batchSize int
+}
+
+// RetentionResult describes expired messages found in a mailbox.
+type RetentionResult struct {
+	Username string
+	Mailbox  string
+	MaxAge   time.Duration
+	// Amount of expired messages. If messages are being removed, this is
+	// the amount of removed messages.
+	Expired int
+}
+
+// parseMaxAge parses the duration, additionally accepting "d" (days) and
+// "w" (weeks) units.
+func parseMaxAge(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if !strings.HasSuffix(s, suffix) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(s, suffix))
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid duration: %s", s)
+		}
+		return time.Duration(n) * unit, nil
+	}
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if dur <= 0 {
+		return 0, fmt.Errorf("invalid duration: %s", s)
+	}
+	return dur, nil
+}
+
+func parseRetention(m *config.Map, node config.Node) (interface{}, error) {
+	policy := &retentionPolicy{}
+
+	child := config.NewMap(m.Globals, node)
+	child.Duration("interval", false, false, 1*time.Hour, &policy.interval)
+	child.Int("batch_size", false, false, 500, &policy.batchSize)
+	shorthand := func(specialUse bool) func(*config.Map, config.Node) error {
+		return func(_ *config.Map, node config.Node) error {
+			if len(node.Args) != 2 {
+				return config.NodeErr(node, "expected 2 arguments")
+			}
+			maxAge, err := parseMaxAge(node.Args[1])
+			if err != nil {
+				return config.NodeErr(node, "%v", err)
+			}
+			rule := retentionRule{maxAge: maxAge}
+			if specialUse {
+				rule.specialUse = []string{node.Args[0]}
+			} else {
+				rule.mailboxes = []string{node.Args[0]}
+			}
+			policy.rules = append(policy.rules, rule)
+			return nil
+		}
+	}
+	child.Callback("mailbox", shorthand(false))
+	child.Callback("special_use", shorthand(true))
+	child.Callback("rule", func(m *config.Map, node config.Node) error {
+		var (
+			rule   retentionRule
+			maxAge string
+		)
+		ruleM := config.NewMap(m.Globals, node)
+		ruleM.StringList("mailbox", false, false, nil, &rule.mailboxes)
+		ruleM.StringList("special_use", false, false, nil, &rule.specialUse)
+		ruleM.Custom("accounts", false, false, func() (interface{}, error) {
+			return nil, nil
+		}, modconfig.TableDirective, &rule.accounts)
+		ruleM.String("max_age", false, true, "", &maxAge)
+		if _, err := ruleM.Process(); err != nil {
+			return err
+		}
+
+		var err error
+		rule.maxAge, err = parseMaxAge(maxAge)
+		if err != nil {
+			return config.NodeErr(node, "%v", err)
+		}
+		policy.rules = append(policy.rules, rule)
+		return nil
+	})
+	if _, err := child.Process(); err != nil {
+		return nil, err
+	}
+
+	if policy.batchSize <= 0 {
+		return nil, config.NodeErr(node, "batch_size should be positive")
+	}
+	if policy.interval <= 0 {
+		return nil, config.NodeErr(node, "interval should be positive")
+	}
+	if len(policy.rules) == 0 {
+		return nil, config.NodeErr(node, "at least one retention rule is required")
+	}
+	for _, rule := range policy.rules {
+		for _, pattern := range rule.mailboxes {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, config.NodeErr(node, "malformed mailbox pattern: %s", pattern)
+			}
+		}
+	}
+
+	return policy, nil
+}
+
+func (r *retentionRule) matches(ctx context.Context, username, mbox, specialUse string) (bool, error) {
+	nameMatch := len(r.mailboxes) == 0 && len(r.specialUse) == 0
+	for _, pattern := range r.mailboxes {
+		if strings.EqualFold(mbox, imap.InboxName) && strings.EqualFold(pattern, imap.InboxName) {
+			nameMatch = true
+		}
+		if ok, _ := path.Match(pattern, mbox); ok {
+			nameMatch = true
+		}
+	}
+	for _, attr := range r.specialUse {
+		if specialUse != "" && strings.EqualFold(attr, specialUse) {
+			nameMatch = true
+		}
+	}
+	if !nameMatch {
+		return false, nil
+	}
+
+	if r.accounts != nil {
+		_, ok, err := r.accounts.Lookup(ctx, username)
+		if err != nil {
+			return false, err
+		}
+		return ok, nil
+	}
+	return true, nil
+}
+
+// maxAge returns the smallest maximum age across matching rules or 0 if no
+// rule matches.
+func (p *retentionPolicy) maxAge(ctx context.Context, username, mbox, specialUse string) (time.Duration, error) {
+	var res time.Duration
+	for _, rule := range p.rules {
+		ok, err := rule.matches(ctx, username, mbox, specialUse)
+		if err != nil {
+			return 0, err
+		}
+		if ok && (res == 0 || rule.maxAge < res) {
+			res = rule.maxAge
+		}
+	}
+	return res, nil
+}
+
+// HasRetention reports whether the retention policy is configured.
+func (store *Storage) HasRetention() bool {
+	return store.retention != nil
+}
+
+// ExpireMessages finds messages older than permitted by the retention policy
+// and, unless dryRun is set, removes them. Removal is done in batches, IMAP
+// clients are notified about removed messages.
+//
+// report is called for each mailbox with expired messages.
+func (store *Storage) ExpireMessages(ctx context.Context, dryRun bool, report func(RetentionResult)) error {
+	if store.retention == nil {
+		return errors.New("imapsql: retention policy is not configured")
+	}
+	db := store.Back.DB
+
+	type mailbox struct {
+		username, name, specialUse string
+		id                         int64
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT users.username, mboxes.id, mboxes.name, mboxes.specialuse
+		FROM mboxes
+		INNER JOIN users ON users.id = mboxes.uid
+		ORDER BY users.id, mboxes.id`)
+	if err != nil {
+		return fmt.Errorf("imapsql: retention: %w", err)
+	}
+	var mboxes []mailbox
+	for rows.Next() {
+		var (
+			mbox       mailbox
+			specialUse *string
+		)
+		if err := rows.Scan(&mbox.username, &mbox.id, &mbox.name, &specialUse); err != nil {
+			rows.Close()
+			return fmt.Errorf("imapsql: retention: %w", err)
+		}
+		if specialUse != nil {
+			mbox.specialUse = *specialUse
+		}
+		mboxes = append(mboxes, mbox)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return fmt.Errorf("imapsql: retention: %w", err)
+	}
+	rows.Close()
+
+	for _, mbox := range mboxes {
+		maxAge, err := store.retention.maxAge(ctx, mbox.username, mbox.name, mbox.specialUse)
+		if err != nil {
+			return fmt.Errorf("imapsql: retention: %s: %w", mbox.username, err)
+		}
+		if maxAge == 0 {
+			continue
+		}
+
+		res := RetentionResult{Username: mbox.username, Mailbox: mbox.name, MaxAge: maxAge}
+		cutoff := time.Now().Add(-maxAge).Unix()
+		if dryRun {
+			err := db.QueryRowContext(ctx, store.rebind(`SELECT COUNT(*) FROM msgs WHERE mboxId = ? AND date < ?`),
+				mbox.id, cutoff).Scan(&res.Expired)
+			if err != nil {
+				return fmt.Errorf("imapsql: retention: %w", err)
+			}
+		} else {
+			res.Expired, err = store.expireMailbox(ctx, mbox.username, mbox.name, mbox.id, cutoff)
+			if err != nil {
+				return fmt.Errorf("imapsql: retention: %s/%s: %w", mbox.username, mbox.name, err)
+			}
+		}
+		if res.Expired != 0 && report != nil {
+			report(res)
+		}
+	}
+	return nil
+}
+
+func (store *Storage) expireMailbox(ctx context.Context, username, name string, mboxID, cutoff int64) (int, error) {
+	removed := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return removed, err
+		}
+
+		rows, err := store.Back.DB.QueryContext(ctx, store.rebind(`
+			SELECT msgId FROM msgs
+			WHERE mboxId = ? AND date < ?
+			ORDER BY msgId
+			LIMIT ?`), mboxID, cutoff, store.retention.batchSize)
+		if err != nil {
+			return removed, err
+		}
+		var (
+			uids  imap.SeqSet
+			count int
+		)
+		for rows.Next() {
+			var uid uint32
+			if err := rows.Scan(&uid); err != nil {
+				rows.Close()
+				return removed, err
+			}
+			uids.AddNum(uid)
+			count++
+		}
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			return removed, err
+		}
+		rows.Close()
+		if count == 0 {
+			return removed, nil
+		}
+
+		u, err := store.GetIMAPAcct(username)
+		if err != nil {
+			return removed, err
+		}
+		_, mbox, err := u.GetMailbox(name, true, nil)
+		if err != nil {
+			return removed, err
+		}
+		err = mbox.(*imapsql.Mailbox).DelMessages(true, &uids)
+		mbox.Close()
+		if err != nil {
+			return removed, err
+		}
+		removed += count
+
+		if count < store.retention.batchSize {
+			return removed, nil
+		}
+	}
+}
+
+func (store *Storage) retentionSweeper() {
+	defer store.bgWorkers.Done()
+
+	// The first sweep is delayed as well so it happens after the update
+	// pipe is set up by the IMAP endpoint.
+	ticker := time.NewTicker(store.retention.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-store.bgStop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-store.bgStop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		err := store.ExpireMessages(ctx, false, func(res RetentionResult) {
+			store.Log.Msg("expired messages removed", "username", res.Username, "mailbox", res.Mailbox,
+				"count", res.Expired, "max_age", res.MaxAge)
+		})
+		cancel()
+		if err != nil && !errors.Is(err, context.Canceled) {
+			store.Log.Error("retention sweep failed", err)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapsql "github.com/foxcpp/go-imap-sql"
+)
+
+func TestParseMaxAge(t *testing.T) {
+	for in, out := range map[string]time.Duration{
+		"30d": 30 * 24 * time.Hour,
+		"2w":  14 * 24 * time.Hour,
+		"36h": 36 * time.Hour,
+	} {
+		dur, err := parseMaxAge(in)
+		if err != nil {
+			t.Errorf("%s: %v", in, err)
+			continue
+		}
+		if dur != out {
+			t.Errorf("%s: expected %v, got %v", in, out, dur)
+		}
+	}
+	for _, in := range []string{"", "d", "-1d", "0h", "1y"} {
+		if _, err := parseMaxAge(in); err == nil {
+			t.Errorf("%s: no error", in)
+		}
+	}
+}
+
+func TestExpireMessages(t *testing.T) {
+	store, _ := createTestStorage(t)
+	store.retention = &retentionPolicy{
+		rules: []retentionRule{
+			{specialUse: []string{imap.JunkAttr}, maxAge: 30 * 24 * time.Hour},
+			{mailboxes: []string{"Lists.*"}, maxAge: 7 * 24 * time.Hour},
+			{mailboxes: []string{"Lists.Short"}, maxAge: 24 * time.Hour},
+		},
+		batchSize: 2,
+	}
+
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	u, err := store.GetIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.(*imapsql.User).CreateMailboxSpecial("Spam", imap.JunkAttr); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Lists.Long", "Lists.Short"} {
+		if err := u.CreateMailbox(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	for _, msg := range []struct {
+		mbox string
+		age  time.Duration
+	}{
+		{"INBOX", 365 * 24 * time.Hour},
+		{"Spam", 60 * 24 * time.Hour},
+		{"Spam", 45 * 24 * time.Hour},
+		{"Spam", 31 * 24 * time.Hour},
+		{"Spam", 1 * time.Hour},
+		{"Lists.Long", 3 * 24 * time.Hour},
+		{"Lists.Short", 3 * 24 * time.Hour},
+	} {
+		body := bytes.NewBufferString("Subject: test\r\n\r\nHello!\r\n")
+		if err := u.CreateMessage(msg.mbox, nil, now.Add(-msg.age), body, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(dryRun bool) {
+		t.Helper()
+		results := map[string]int{}
+		err := store.ExpireMessages(context.Background(), dryRun, func(res RetentionResult) {
+			results[res.Mailbox] = res.Expired
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 2 || results["Spam"] != 3 || results["Lists.Short"] != 1 {
+			t.Errorf("wrong results (dry run = %v): %v", dryRun, results)
+		}
+	}
+	check(true)
+	check(false)
+
+	for name, count := range map[string]uint32{
+		"INBOX":       1,
+		"Spam":        1,
+		"Lists.Long":  1,
+		"Lists.Short": 0,
+	} {
+		status, err := u.Status(name, []imap.StatusItem{imap.StatusMessages})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Messages != count {
+			t.Errorf("%s: expected %d messages, got %d", name, count, status.Messages)
+		}
+	}
+
+	err = store.ExpireMessages(context.Background(), false, func(res RetentionResult) {
+		t.Errorf("unexpected result: %+v", res)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
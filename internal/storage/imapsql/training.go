@@ -0,0 +1,330 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// Messages copied or moved by users into the junk mailbox are submitted to
+// the trainer as spam, messages copied or moved out of it are submitted as
+// ham. Only references to the copies of messages in the destination mailbox
+// are queued, messages are read and submitted by background workers so slow
+// trainers do not delay IMAP commands.
+//
+// go-imap-sql does not report UIDs assigned to copied messages. They are
+// taken from UIDNEXT of the destination mailbox recorded before and after
+// the command.
+
+type trainingPolicy struct {
+	trainer module.SpamTrainer
+	// Names of junk mailboxes, in addition to ones with \Junk attribute.
+	junk []string
+	// Messages moved from junk to these mailboxes (and ones with \Trash
+	// attribute) are not submitted as ham.
+	ignore  []string
+	workers int
+	timeout time.Duration
+	queue   chan trainingJob
+}
+
+// trainingJob is the message stored in the mailbox of the account that
+// should be submitted to the trainer.
+type trainingJob struct {
+	username string
+	mbox     string
+	uid      uint32
+	spam     bool
+}
+
+// pendingTraining is the destination mailbox state recorded before count
+// messages are added to it.
+type pendingTraining struct {
+	username string
+	mbox     string
+	spam     bool
+	count    int
+	uidNext  uint32
+}
+
+func parseTraining(m *config.Map, node config.Node) (interface{}, error) {
+	var (
+		policy    = &trainingPolicy{}
+		queueSize int
+	)
+	child := config.NewMap(m.Globals, node)
+	child.Custom("trainer", false, true, nil, func(m *config.Map, node config.Node) (interface{}, error) {
+		var trainer module.SpamTrainer
+		err := modconfig.ModuleFromNode("imap.trainer", node.Args, node, m.Globals, &trainer)
+		return trainer, err
+	}, &policy.trainer)
+	child.StringList("junk_mailbox", false, false, nil, &policy.junk)
+	child.StringList("ignore_mailbox", false, false, []string{"Trash"}, &policy.ignore)
+	child.Int("queue_size", false, false, 1000, &queueSize)
+	child.Int("workers", false, false, 1, &policy.workers)
+	child.Duration("timeout", false, false, 1*time.Minute, &policy.timeout)
+	if _, err := child.Process(); err != nil {
+		return nil, err
+	}
+
+	if queueSize <= 0 {
+		return nil, config.NodeErr(node, "queue_size should be positive")
+	}
+	if policy.workers <= 0 {
+		return nil, config.NodeErr(node, "workers should be positive")
+	}
+	if policy.timeout <= 0 {
+		return nil, config.NodeErr(node, "timeout should be positive")
+	}
+	policy.queue = make(chan trainingJob, queueSize)
+	return policy, nil
+}
+
+// trainingMailbox reports whether the mailbox of the account is a junk
+// mailbox and whether it is ignored when submitting ham.
+func (store *Storage) trainingMailbox(ctx context.Context, username, mbox string) (junk, ignored bool, err error) {
+	if strings.EqualFold(mbox, imap.InboxName) {
+		return false, false, nil
+	}
+	for _, name := range store.training.junk {
+		if name == mbox {
+			return true, false, nil
+		}
+	}
+	for _, name := range store.training.ignore {
+		if name == mbox {
+			return false, true, nil
+		}
+	}
+
+	var specialUse sql.NullString
+	err = store.Back.DB.QueryRowContext(ctx, store.rebind(`
+		SELECT mboxes.specialuse FROM mboxes
+		INNER JOIN users ON users.id = mboxes.uid
+		WHERE users.username = ? AND mboxes.name = ?`), strings.ToLower(username), mbox).Scan(&specialUse)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, false, nil
+		}
+		return false, false, fmt.Errorf("imapsql: %w", err)
+	}
+	return specialUse.String == imap.JunkAttr, specialUse.String == imap.TrashAttr, nil
+}
+
+// trainingAction returns whether messages copied from one mailbox to
+// another should be submitted as spam or as ham. ok is false if they should
+// not be submitted at all.
+func (store *Storage) trainingAction(ctx context.Context, srcOwner, src, destOwner, dest string) (spam, ok bool, err error) {
+	if store.training == nil {
+		return false, false, nil
+	}
+	srcJunk, _, err := store.trainingMailbox(ctx, srcOwner, src)
+	if err != nil {
+		return false, false, err
+	}
+	destJunk, destIgnored, err := store.trainingMailbox(ctx, destOwner, dest)
+	if err != nil {
+		return false, false, err
+	}
+	switch {
+	case destJunk && !srcJunk:
+		return true, true, nil
+	case srcJunk && !destJunk && !destIgnored:
+		return false, true, nil
+	}
+	return false, false, nil
+}
+
+func (store *Storage) uidNext(ctx context.Context, username, mbox string) (uint32, error) {
+	var uidNext uint32
+	err := store.Back.DB.QueryRowContext(ctx, store.rebind(`
+		SELECT mboxes.uidnext FROM mboxes
+		INNER JOIN users ON users.id = mboxes.uid
+		WHERE users.username = ? AND mboxes.name = ?`), strings.ToLower(username), mbox).Scan(&uidNext)
+	if err != nil {
+		return 0, fmt.Errorf("imapsql: %w", err)
+	}
+	return uidNext, nil
+}
+
+// startTraining records the state of the mailbox before count messages that
+// should be submitted to the trainer are added to it.
+//
+// Errors are only logged since they should not prevent messages from being
+// stored, nil is returned in this case.
+func (store *Storage) startTraining(ctx context.Context, username, mbox string, spam bool, count int) *pendingTraining {
+	if strings.EqualFold(mbox, imap.InboxName) {
+		mbox = imap.InboxName
+	}
+	uidNext, err := store.uidNext(ctx, username, mbox)
+	if err != nil {
+		store.Log.Error("failed to check the mailbox for training", err, "account", username, "mbox", mbox)
+		return nil
+	}
+	return &pendingTraining{
+		username: username,
+		mbox:     mbox,
+		spam:     spam,
+		count:    count,
+		uidNext:  uidNext,
+	}
+}
+
+// finishTraining queues messages added to the mailbox since startTraining.
+// Nothing is queued if more messages than expected were added, some of them
+// were stored concurrently by other commands or deliveries.
+func (store *Storage) finishTraining(ctx context.Context, p *pendingTraining) {
+	if p == nil {
+		return
+	}
+	uidNext, err := store.uidNext(ctx, p.username, p.mbox)
+	if err != nil {
+		store.Log.Error("failed to check the mailbox for training", err, "account", p.username, "mbox", p.mbox)
+		return
+	}
+	if uidNext < p.uidNext || int(uidNext-p.uidNext) > p.count {
+		store.Log.Msg("mailbox is changed concurrently, messages are not submitted for training", "account", p.username, "mbox", p.mbox)
+		return
+	}
+	for uid := p.uidNext; uid < uidNext; uid++ {
+		store.queueTraining(trainingJob{username: p.username, mbox: p.mbox, uid: uid, spam: p.spam})
+	}
+}
+
+// queueTraining queues messages for submission to the trainer. Messages are
+// dropped if the queue is full.
+func (store *Storage) queueTraining(jobs ...trainingJob) {
+	for _, job := range jobs {
+		select {
+		case store.training.queue <- job:
+		default:
+			store.Log.Msg("training queue is full, message is not submitted", "account", job.username, "spam", job.spam)
+		}
+	}
+}
+
+// trainingBatch is the maximum number of queued jobs taken by a worker at
+// once.
+const trainingBatch = 64
+
+func (store *Storage) trainingWorker() {
+	defer store.bgWorkers.Done()
+
+	for {
+		select {
+		case <-store.bgStop:
+			return
+		case job := <-store.training.queue:
+			jobs := []trainingJob{job}
+		batch:
+			for len(jobs) < trainingBatch {
+				select {
+				case job := <-store.training.queue:
+					jobs = append(jobs, job)
+				default:
+					break batch
+				}
+			}
+			store.trainJobs(jobs)
+		}
+	}
+}
+
+// trainJobs submits messages to the trainer. Consecutive jobs referring to
+// the same mailbox (e.g. messages copied by one command) share the mailbox
+// handle, so the list of UIDs is loaded only once for them.
+func (store *Storage) trainJobs(jobs []trainingJob) {
+	for len(jobs) != 0 {
+		n := 1
+		for n < len(jobs) && jobs[n].username == jobs[0].username && jobs[n].mbox == jobs[0].mbox {
+			n++
+		}
+		if err := store.train(jobs[:n]); err != nil {
+			store.Log.Error("failed to submit messages to the trainer", err, "account", jobs[0].username, "mbox", jobs[0].mbox, "count", n)
+		}
+		jobs = jobs[n:]
+	}
+}
+
+// train submits messages stored in the same mailbox to the trainer. Errors
+// for individual messages are logged, the returned error means that the
+// mailbox could not be opened.
+func (store *Storage) train(jobs []trainingJob) error {
+	u, err := store.Back.GetUser(jobs[0].username)
+	if err != nil {
+		return err
+	}
+	_, mbox, err := u.GetMailbox(jobs[0].mbox, true, nil)
+	if err != nil {
+		return err
+	}
+	defer mbox.Close()
+
+	for _, job := range jobs {
+		if err := store.trainMessage(mbox.(*imapsql.Mailbox), job); err != nil {
+			store.Log.Error("failed to submit message to the trainer", err, "account", job.username, "mbox", job.mbox, "uid", job.uid, "spam", job.spam)
+		}
+	}
+	return nil
+}
+
+func (store *Storage) trainMessage(mbox *imapsql.Mailbox, job trainingJob) error {
+	msg, err := fetchMessage(mbox, job.uid)
+	if err != nil {
+		return err
+	}
+	if msg == nil {
+		store.Log.DebugMsg("message is removed before submission to the trainer", "account", job.username, "mbox", job.mbox, "uid", job.uid)
+		return nil
+	}
+
+	bufR := bufio.NewReader(bytes.NewReader(msg.body))
+	hdr, err := textproto.ReadHeader(bufR)
+	if err != nil {
+		return err
+	}
+	body, err := io.ReadAll(bufR)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), store.training.timeout)
+	defer cancel()
+	if err := store.training.trainer.Train(ctx, job.username, job.spam, hdr, buffer.MemoryBuffer{Slice: body}); err != nil {
+		return err
+	}
+	store.Log.DebugMsg("message submitted to the trainer", "account", job.username, "spam", job.spam)
+	return nil
+}
@@ -0,0 +1,268 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+)
+
+type testTrainer struct {
+	account string
+	spam    bool
+	subject string
+	body    string
+	// Number of submitted messages.
+	submitted int
+}
+
+func (t *testTrainer) Train(_ context.Context, accountName string, spam bool, hdr textproto.Header, body buffer.Buffer) error {
+	r, err := body.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(r); err != nil {
+		return err
+	}
+	t.account, t.spam, t.subject, t.body = accountName, spam, hdr.Get("Subject"), buf.String()
+	t.submitted++
+	return nil
+}
+
+// checkTraining checks that the queue contains the expected jobs, empties
+// it and returns them.
+func checkTraining(t *testing.T, store *Storage, account string, spam ...bool) []trainingJob {
+	t.Helper()
+	if len(store.training.queue) != len(spam) {
+		t.Fatalf("expected %d queued messages, got %d", len(spam), len(store.training.queue))
+	}
+	jobs := make([]trainingJob, 0, len(spam))
+	for _, expected := range spam {
+		job := <-store.training.queue
+		if job.username != account || job.spam != expected {
+			t.Errorf("unexpected job: %s, spam = %v (expected %s, spam = %v)", job.username, job.spam, account, expected)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+func TestTraining(t *testing.T) {
+	store, _ := createTestStorage(t)
+	store.deliveryNormalize = func(_ context.Context, s string) (string, error) {
+		return s, nil
+	}
+	trainer := &testTrainer{}
+	store.training = &trainingPolicy{
+		trainer: trainer,
+		junk:    []string{"Junk"},
+		ignore:  []string{"Trash"},
+		timeout: time.Minute,
+		queue:   make(chan trainingJob, 10),
+	}
+
+	if err := store.CreateIMAPAcct("alice@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	alice, err := store.GetOrCreateIMAPAcct("alice@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Junk", "Trash", "Archive"} {
+		if err := alice.CreateMailbox(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := alice.(*aclUser).CreateMailboxSpecial("Spam", imap.JunkAttr); err != nil {
+		t.Fatal(err)
+	}
+	deliverTestMessage(t, store, "<1@example.org>", "Hello!\r\n", "alice@example.org")
+	deliverTestMessage(t, store, "<2@example.org>", "Hello!\r\n", "alice@example.org")
+
+	mailbox := func(name string) backend.Mailbox {
+		t.Helper()
+		_, mbox, err := alice.GetMailbox(name, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { mbox.Close() })
+		return mbox
+	}
+	all, _ := imap.ParseSeqSet("1:*")
+	first, _ := imap.ParseSeqSet("1")
+
+	inbox := mailbox("INBOX")
+	if err := inbox.CopyMessages(false, all, "Archive"); err != nil {
+		t.Fatal(err)
+	}
+	checkTraining(t, store, "alice@example.org")
+	if err := inbox.CopyMessages(false, all, "Junk"); err != nil {
+		t.Fatal(err)
+	}
+	jobs := checkTraining(t, store, "alice@example.org", true, true)
+	if err := store.train(jobs); err != nil {
+		t.Fatal(err)
+	}
+	if trainer.submitted != 2 {
+		t.Errorf("expected 2 submitted messages, got %d", trainer.submitted)
+	}
+	if err := inbox.(backend.MoveMailbox).MoveMessages(false, first, "Spam"); err != nil {
+		t.Fatal(err)
+	}
+	jobs = checkTraining(t, store, "alice@example.org", true)
+	if jobs[0].mbox != "Spam" || jobs[0].uid != 1 {
+		t.Errorf("wrong moved message: %s, %d", jobs[0].mbox, jobs[0].uid)
+	}
+	if err := store.train(jobs); err != nil {
+		t.Fatal(err)
+	}
+	if trainer.subject != "test" || trainer.body != "Hello!\r\n" {
+		t.Errorf("unexpected message submitted: %+v", trainer)
+	}
+
+	junk := mailbox("Junk")
+	if err := junk.(backend.MoveMailbox).MoveMessages(true, first, "Spam"); err != nil {
+		t.Fatal(err)
+	}
+	checkTraining(t, store, "alice@example.org")
+	second, _ := imap.ParseSeqSet("2")
+	if err := junk.(backend.MoveMailbox).MoveMessages(true, second, "Trash"); err != nil {
+		t.Fatal(err)
+	}
+	checkTraining(t, store, "alice@example.org")
+	checkMessages(t, alice, "Junk", 0)
+
+	if err := mailbox("Spam").CopyMessages(false, first, "Archive"); err != nil {
+		t.Fatal(err)
+	}
+	checkTraining(t, store, "alice@example.org", false)
+
+	msg := "Subject: Buy now\r\n\r\nCheap!\r\n"
+	if err := alice.CreateMessage("Archive", nil, time.Now(), bytes.NewReader([]byte(msg)), nil); err != nil {
+		t.Fatal(err)
+	}
+	checkTraining(t, store, "alice@example.org")
+	if err := alice.CreateMessage("Junk", nil, time.Now(), bytes.NewReader([]byte(msg)), nil); err != nil {
+		t.Fatal(err)
+	}
+	checkMessages(t, alice, "Junk", 1)
+	jobs = checkTraining(t, store, "alice@example.org", true)
+	if err := store.train(jobs); err != nil {
+		t.Fatal(err)
+	}
+	if trainer.account != "alice@example.org" || !trainer.spam || trainer.subject != "Buy now" || trainer.body != "Cheap!\r\n" {
+		t.Errorf("unexpected message submitted: %+v", trainer)
+	}
+
+	// Jobs for missing mailboxes do not prevent other ones from being
+	// submitted.
+	trainer.submitted = 0
+	store.trainJobs([]trainingJob{
+		jobs[0],
+		{username: "alice@example.org", mbox: "Missing", uid: 1},
+		{username: "alice@example.org", mbox: "Archive", uid: 1},
+		{username: "alice@example.org", mbox: "Archive", uid: 2},
+	})
+	if trainer.submitted != 3 {
+		t.Errorf("expected 3 submitted messages, got %d", trainer.submitted)
+	}
+}
+
+func TestTraining_Expunged(t *testing.T) {
+	store, _ := createTestStorage(t)
+	trainer := &testTrainer{}
+	store.training = &trainingPolicy{
+		trainer: trainer,
+		junk:    []string{"Junk"},
+		timeout: time.Minute,
+		queue:   make(chan trainingJob, 10),
+	}
+
+	if err := store.CreateIMAPAcct("alice@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	alice, err := store.GetOrCreateIMAPAcct("alice@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.CreateMailbox("Junk"); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.CreateMessage("Junk", nil, time.Now(), bytes.NewReader([]byte("Subject: Buy now\r\n\r\nCheap!\r\n")), nil); err != nil {
+		t.Fatal(err)
+	}
+	jobs := checkTraining(t, store, "alice@example.org", true)
+
+	_, mbox, err := alice.GetMailbox("Junk", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mbox.Close()
+	all, _ := imap.ParseSeqSet("1:*")
+	if err := mbox.(*aclMailbox).DelMessages(false, all); err != nil {
+		t.Fatal(err)
+	}
+
+	// Messages removed before they are submitted are skipped.
+	if err := store.train(jobs); err != nil {
+		t.Fatal(err)
+	}
+	if trainer.account != "" {
+		t.Errorf("removed message is submitted: %+v", trainer)
+	}
+}
+
+func TestTraining_ConcurrentChange(t *testing.T) {
+	store, _ := createTestStorage(t)
+	store.training = &trainingPolicy{
+		trainer: &testTrainer{},
+		timeout: time.Minute,
+		queue:   make(chan trainingJob, 10),
+	}
+	if err := store.CreateIMAPAcct("alice@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	alice, err := store.GetOrCreateIMAPAcct("alice@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.CreateMailbox("Junk"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two messages are added while only one is expected.
+	pending := store.startTraining(context.Background(), "alice@example.org", "Junk", true, 1)
+	for i := 0; i < 2; i++ {
+		addTestMessage(t, store, "alice@example.org", "Junk")
+	}
+	store.finishTraining(context.Background(), pending)
+	checkTraining(t, store, "alice@example.org")
+}
@@ -23,7 +23,9 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"runtime/debug"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -44,6 +46,10 @@ type File struct {
 	mLck   sync.RWMutex
 	mStamp time.Time
 
+	// Serializes modifications of the file made using MutableTable
+	// interface.
+	editLck sync.Mutex
+
 	stopReloader chan struct{}
 	forceReload  chan struct{}
 
@@ -192,6 +198,7 @@ func readFile(path string, out map[string][]string) error {
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
 	scnr := bufio.NewScanner(f)
 	lineCounter := 0
@@ -253,6 +260,165 @@ func (f *File) LookupMulti(_ context.Context, val string) ([]string, error) {
 	return usedFile[val], nil
 }
 
+func (f *File) Keys() ([]string, error) {
+	f.mLck.RLock()
+	usedFile := f.m
+	f.mLck.RUnlock()
+
+	keys := make([]string, 0, len(usedFile))
+	for k := range usedFile {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func checkFileKey(k string) error {
+	if k == "" || strings.HasPrefix(k, "#") || strings.ContainsAny(k, ":\r\n") || strings.TrimSpace(k) != k {
+		return fmt.Errorf("%s: key can't be represented in file: %q", FileModName, k)
+	}
+	return nil
+}
+
+func (f *File) SetKey(k, v string) error {
+	if err := checkFileKey(k); err != nil {
+		return err
+	}
+	if strings.ContainsAny(v, "\r\n") {
+		return fmt.Errorf("%s: value can't contain newlines", FileModName)
+	}
+	return f.editFile(map[string]string{k: k + ": " + v})
+}
+
+func (f *File) RemoveKey(k string) error {
+	return f.editFile(map[string]string{k: ""})
+}
+
+// SetKeys implements module.BatchMutableTable. The file is rewritten only
+// once for all entries.
+func (f *File) SetKeys(entries map[string][]string) error {
+	edits := make(map[string]string, len(entries))
+	for k, vals := range entries {
+		if len(vals) == 0 {
+			edits[k] = ""
+			continue
+		}
+		if err := checkFileKey(k); err != nil {
+			return err
+		}
+		for _, v := range vals {
+			if strings.ContainsAny(v, "\r\n") {
+				return fmt.Errorf("%s: value can't contain newlines", FileModName)
+			}
+			if len(vals) > 1 && strings.Contains(v, ",") {
+				return fmt.Errorf("%s: one of multiple values can't contain commas: %q", FileModName, v)
+			}
+		}
+		edits[k] = k + ": " + strings.Join(vals, ", ")
+	}
+	return f.editFile(edits)
+}
+
+// fileLineKey returns the key defined on the line using the same rules as
+// readFile. Empty string is returned for comments and empty lines.
+func fileLineKey(line string) string {
+	if strings.HasPrefix(line, "#") {
+		return ""
+	}
+	return strings.TrimSpace(strings.SplitN(strings.TrimSpace(line), ":", 2)[0])
+}
+
+// editFile replaces all lines defining each key from edits with the new
+// line, or just removes them if the new line is empty. Comments and other
+// entries are preserved, lines for new keys are added to the end. The file is
+// replaced atomically and then reloaded.
+func (f *File) editFile(edits map[string]string) error {
+	if f.file == "" {
+		return fmt.Errorf("%s: no file configured", FileModName)
+	}
+
+	f.editLck.Lock()
+	defer f.editLck.Unlock()
+
+	perms := os.FileMode(0o644)
+	content, err := os.ReadFile(f.file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if info, err := os.Stat(f.file); err == nil {
+		perms = info.Mode().Perm()
+	}
+
+	lines := strings.Split(string(content), "\n")
+	out := make([]string, 0, len(lines)+len(edits))
+	replaced := make(map[string]bool, len(edits))
+	for _, line := range lines {
+		key := fileLineKey(line)
+		newLine, ok := edits[key]
+		if key == "" || !ok {
+			out = append(out, line)
+			continue
+		}
+		if !replaced[key] && newLine != "" {
+			out = append(out, newLine)
+		}
+		replaced[key] = true
+	}
+
+	added := make([]string, 0, len(edits))
+	for key, newLine := range edits {
+		if !replaced[key] && newLine != "" {
+			added = append(added, key)
+		}
+	}
+	if len(added) != 0 {
+		sort.Strings(added)
+		if len(out) != 0 && out[len(out)-1] == "" {
+			out = out[:len(out)-1]
+		}
+		for _, key := range added {
+			out = append(out, edits[key])
+		}
+		out = append(out, "")
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.file), filepath.Base(f.file)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(strings.Join(out, "\n")); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perms); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), f.file); err != nil {
+		return err
+	}
+
+	newm := make(map[string][]string, len(f.m)+1)
+	if err := readFile(f.file, newm); err != nil {
+		return err
+	}
+	info, err := os.Stat(f.file)
+	if err != nil {
+		return err
+	}
+
+	f.mLck.Lock()
+	f.m = newm
+	f.mStamp = info.ModTime()
+	f.mLck.Unlock()
+
+	return nil
+}
+
 func init() {
 	module.Register(FileModName, NewFile)
 }
@@ -19,7 +19,9 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package table
 
 import (
+	"context"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
@@ -220,3 +222,109 @@ func TestFileReload_Removed(t *testing.T) {
 func init() {
 	reloadInterval = 10 * time.Millisecond
 }
+
+func TestFileMutable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aliases")
+	if err := os.WriteFile(path, []byte("# comment\na: b\nc: d, e\na: f\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	mod, err := NewFile("", "", nil, []string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*File)
+	m.log = testutils.Logger(t, "file_map")
+	defer m.Close()
+
+	if err := mod.Init(&config.Map{Block: config.Node{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetKey("a", "g"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetKey("h", "i"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RemoveKey("c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetKey("x:y", "z"); err == nil {
+		t.Fatal("Expected an error for key with colon")
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "# comment\na: g\nh: i\n" {
+		t.Fatalf("Wrong file content: %q", content)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o640 {
+		t.Fatal("File permissions are not preserved:", info.Mode())
+	}
+
+	keys, err := m.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"a", "h"}) {
+		t.Fatal("Wrong keys:", keys)
+	}
+	val, ok, err := m.Lookup(context.Background(), "a")
+	if err != nil || !ok || val != "g" {
+		t.Fatal("Wrong lookup result:", val, ok, err)
+	}
+}
+
+func TestFileMutable_SetKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aliases")
+	if err := os.WriteFile(path, []byte("# comment\na: b\nc: d, e\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	mod, err := NewFile("", "", nil, []string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*File)
+	m.log = testutils.Logger(t, "file_map")
+	defer m.Close()
+
+	if err := mod.Init(&config.Map{Block: config.Node{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.SetKeys(map[string][]string{
+		"a": {"f", "g"},
+		"c": nil,
+		"z": {"y"},
+		"h": {"i"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "# comment\na: f, g\nh: i\nz: y\n" {
+		t.Fatalf("Wrong file content: %q", content)
+	}
+	vals, err := m.LookupMulti(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vals, []string{"f", "g"}) {
+		t.Fatal("Wrong lookup result:", vals)
+	}
+
+	if err := m.SetKeys(map[string][]string{"a": {"b, c", "d"}}); err == nil {
+		t.Fatal("Expected an error for multiple values with commas")
+	}
+}
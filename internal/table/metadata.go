@@ -0,0 +1,71 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package table
+
+import (
+	"context"
+
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// Metadata maps account names to values of the IMAP server annotation set by
+// the account.
+type Metadata struct {
+	modName  string
+	instName string
+
+	storage module.MetadataStorage
+	entry   string
+}
+
+func NewMetadata(modName, instName string, _, _ []string) (module.Module, error) {
+	return &Metadata{
+		modName:  modName,
+		instName: instName,
+	}, nil
+}
+
+func (m *Metadata) Init(cfg *config.Map) error {
+	cfg.Custom("storage", false, true, nil, func(m *config.Map, node config.Node) (interface{}, error) {
+		var storage module.MetadataStorage
+		err := modconfig.ModuleFromNode("storage", node.Args, node, m.Globals, &storage)
+		return storage, err
+	}, &m.storage)
+	cfg.String("entry", false, true, "", &m.entry)
+	_, err := cfg.Process()
+	return err
+}
+
+func (m *Metadata) Name() string {
+	return m.modName
+}
+
+func (m *Metadata) InstanceName() string {
+	return m.instName
+}
+
+func (m *Metadata) Lookup(ctx context.Context, key string) (string, bool, error) {
+	return m.storage.AccountMetadata(ctx, key, m.entry)
+}
+
+func init() {
+	module.Register("table.metadata", NewMetadata)
+}
@@ -93,6 +93,11 @@ func (s *SQL) Init(cfg *config.Map) error {
 	if err != nil {
 		return config.NodeErr(cfg.Block, "failed to open db: %v", err)
 	}
+	if module.DryRun {
+		// sql.Open does not connect to the database, it only checks whether
+		// the driver is known.
+		return db.Close()
+	}
 	s.db = db
 
 	for _, init := range initQueries {
@@ -134,6 +139,9 @@ func (s *SQL) Init(cfg *config.Map) error {
 }
 
 func (s *SQL) Close() error {
+	if s.db == nil {
+		return nil
+	}
 	s.lookup.Close()
 	return s.db.Close()
 }
@@ -0,0 +1,304 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package http_target implements target.http module that delivers messages
+// to an HTTP endpoint (webhook).
+//
+// Interfaces implemented:
+// - module.DeliveryTarget
+package http_target
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"runtime/trace"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	tls2 "github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "target.http"
+
+const (
+	formatRaw  = "raw"
+	formatJSON = "json"
+)
+
+type Target struct {
+	instName string
+	log      log.Logger
+
+	endpoint   string
+	format     string
+	headers    http.Header
+	includeRaw bool
+	client     *http.Client
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	t := &Target{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+		headers:  http.Header{},
+	}
+
+	switch len(inlineArgs) {
+	case 0:
+	case 1:
+		t.endpoint = inlineArgs[0]
+	default:
+		return nil, fmt.Errorf("%s: at most one argument is expected (endpoint URL)", modName)
+	}
+
+	return t, nil
+}
+
+func (t *Target) Init(cfg *config.Map) error {
+	var (
+		timeout   time.Duration
+		tlsConfig tls.Config
+	)
+	cfg.Bool("debug", true, false, &t.log.Debug)
+	cfg.String("endpoint", false, false, t.endpoint, &t.endpoint)
+	cfg.Enum("format", false, false, []string{formatRaw, formatJSON}, formatRaw, &t.format)
+	cfg.Bool("include_raw", false, false, &t.includeRaw)
+	cfg.Duration("timeout", false, false, 1*time.Minute, &timeout)
+	cfg.Callback("header", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) != 2 {
+			return config.NodeErr(node, "exactly two arguments are required: <name> <value>")
+		}
+		t.headers.Add(node.Args[0], node.Args[1])
+		return nil
+	})
+	cfg.Custom("tls_client", true, false, func() (interface{}, error) {
+		return tls.Config{}, nil
+	}, tls2.TLSClientBlock, &tlsConfig)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if t.endpoint == "" {
+		return fmt.Errorf("%s: endpoint URL is required", modName)
+	}
+	endpURL, err := url.Parse(t.endpoint)
+	if err != nil {
+		return fmt.Errorf("%s: malformed endpoint URL: %w", modName, err)
+	}
+	if endpURL.Scheme != "http" && endpURL.Scheme != "https" {
+		return fmt.Errorf("%s: endpoint should be a http:// or https:// URL", modName)
+	}
+
+	t.client = &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tlsConfig,
+		},
+		// Redirects for POST requests are rarely handled consistently,
+		// consider them a configuration problem.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return nil
+}
+
+func (t *Target) Name() string {
+	return modName
+}
+
+func (t *Target) InstanceName() string {
+	return t.instName
+}
+
+type delivery struct {
+	t        *Target
+	mailFrom string
+	log      log.Logger
+	msgMeta  *module.MsgMetadata
+
+	rcpts []string
+}
+
+func (t *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	return &delivery{
+		t:        t,
+		mailFrom: mailFrom,
+		log:      target.DeliveryLogger(t.log, msgMeta),
+		msgMeta:  msgMeta,
+	}, nil
+}
+
+func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOptions) error {
+	d.rcpts = append(d.rcpts, rcptTo)
+	return nil
+}
+
+func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	defer trace.StartRegion(ctx, "target.http/Body").End()
+
+	var (
+		req *http.Request
+		err error
+	)
+	switch d.t.format {
+	case formatJSON:
+		req, err = d.jsonRequest(ctx, header, body)
+	default:
+		req, err = d.rawRequest(ctx, header, body)
+	}
+	if err != nil {
+		return &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+			Message:      "Internal server error, try again later",
+			TargetName:   modName,
+			Err:          err,
+		}
+	}
+
+	for k, v := range d.t.headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("X-Maddy-Msg-Id", d.msgMeta.ID)
+
+	resp, err := d.t.client.Do(req)
+	if err != nil {
+		return &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 4, 0},
+			Message:      "Webhook request failed",
+			TargetName:   modName,
+			Err:          err,
+		}
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return d.statusError(resp.StatusCode, string(bytes.TrimSpace(respBody)))
+}
+
+func (d *delivery) rawRequest(ctx context.Context, header textproto.Header, body buffer.Buffer) (*http.Request, error) {
+	var hdrBuf bytes.Buffer
+	if err := textproto.WriteHeader(&hdrBuf, header); err != nil {
+		return nil, err
+	}
+	hdrLen := hdrBuf.Len()
+
+	bodyR, err := body.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.t.endpoint, struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(&hdrBuf, bodyR), bodyR})
+	if err != nil {
+		bodyR.Close()
+		return nil, err
+	}
+	req.ContentLength = int64(hdrLen + body.Len())
+	req.Header.Set("Content-Type", "message/rfc822")
+	req.Header.Set("X-Maddy-Sender", d.mailFrom)
+	for _, rcpt := range d.rcpts {
+		req.Header.Add("X-Maddy-Rcpt", rcpt)
+	}
+	req.Header.Set("X-Maddy-Quarantine", strconv.FormatBool(d.msgMeta.Quarantine))
+	return req, nil
+}
+
+func (d *delivery) jsonRequest(ctx context.Context, header textproto.Header, body buffer.Buffer) (*http.Request, error) {
+	blob, err := d.buildPayload(header, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.t.endpoint, bytes.NewReader(blob))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// statusError maps the HTTP status code into the delivery result: 2xx codes
+// indicate success, 4xx - permanent failures (except for 408 and 429),
+// anything else is a temporary failure.
+func (d *delivery) statusError(status int, respBody string) error {
+	if status/100 == 2 {
+		d.log.DebugMsg("delivered", "status", status)
+		return nil
+	}
+
+	misc := map[string]interface{}{
+		"http_status": status,
+	}
+	if respBody != "" {
+		misc["response"] = respBody
+	}
+	err := errors.New(http.StatusText(status))
+
+	if status/100 == 4 && status != http.StatusRequestTimeout && status != http.StatusTooManyRequests {
+		return &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 0, 0},
+			Message:      "Message rejected by the webhook",
+			TargetName:   modName,
+			Err:          err,
+			Misc:         misc,
+		}
+	}
+	return &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 0, 0},
+		Message:      "Webhook temporary failure",
+		TargetName:   modName,
+		Err:          err,
+		Misc:         misc,
+	}
+}
+
+func (d *delivery) Abort(ctx context.Context) error {
+	// Request is made in Body and cannot be rolled back.
+	return nil
+}
+
+func (d *delivery) Commit(ctx context.Context) error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,244 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package http_target
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type request struct {
+	header http.Header
+	body   []byte
+}
+
+func testServer(t *testing.T, status int) (*httptest.Server, *[]request) {
+	var reqs []request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		reqs = append(reqs, request{header: r.Header, body: body})
+		w.WriteHeader(status)
+		_, _ = io.WriteString(w, "response text")
+	}))
+	return srv, &reqs
+}
+
+func testTarget(t *testing.T, endpoint, format string) *Target {
+	return &Target{
+		log:      testutils.Logger(t, modName),
+		endpoint: endpoint,
+		format:   format,
+		headers:  http.Header{"Authorization": []string{"Bearer secret"}},
+		client:   http.DefaultClient,
+	}
+}
+
+func TestDelivery_Raw(t *testing.T) {
+	srv, reqs := testServer(t, http.StatusNoContent)
+	defer srv.Close()
+
+	tgt := testTarget(t, srv.URL, formatRaw)
+	testutils.DoTestDelivery(t, tgt, "test@example.org", []string{"rcpt1@example.org", "rcpt2@example.org"})
+
+	if len(*reqs) != 1 {
+		t.Fatalf("Expected 1 request, got %d", len(*reqs))
+	}
+	req := (*reqs)[0]
+	if string(req.body) != testutils.DeliveryData {
+		t.Errorf("Wrong body: %q", req.body)
+	}
+	if v := req.header.Get("Content-Type"); v != "message/rfc822" {
+		t.Errorf("Wrong Content-Type: %v", v)
+	}
+	if v := req.header.Get("Authorization"); v != "Bearer secret" {
+		t.Errorf("Wrong Authorization: %v", v)
+	}
+	if v := req.header.Get("X-Maddy-Sender"); v != "test@example.org" {
+		t.Errorf("Wrong X-Maddy-Sender: %v", v)
+	}
+	if v := req.header.Values("X-Maddy-Rcpt"); !reflect.DeepEqual(v, []string{"rcpt1@example.org", "rcpt2@example.org"}) {
+		t.Errorf("Wrong X-Maddy-Rcpt: %v", v)
+	}
+}
+
+func TestDelivery_StatusCodes(t *testing.T) {
+	for _, c := range []struct {
+		status    int
+		fail      bool
+		temporary bool
+	}{
+		{status: http.StatusOK},
+		{status: http.StatusAccepted},
+		{status: http.StatusBadRequest, fail: true},
+		{status: http.StatusNotFound, fail: true},
+		{status: http.StatusTooManyRequests, fail: true, temporary: true},
+		{status: http.StatusInternalServerError, fail: true, temporary: true},
+		{status: http.StatusServiceUnavailable, fail: true, temporary: true},
+		{status: http.StatusMovedPermanently, fail: true, temporary: true},
+	} {
+		srv, _ := testServer(t, c.status)
+		tgt := testTarget(t, srv.URL, formatRaw)
+		tgt.client = &http.Client{
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+
+		_, err := testutils.DoTestDeliveryErr(t, tgt, "test@example.org", []string{"rcpt@example.org"})
+		srv.Close()
+
+		if !c.fail {
+			if err != nil {
+				t.Errorf("%d: unexpected error: %v", c.status, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%d: expected an error, got none", c.status)
+			continue
+		}
+		if exterrors.IsTemporary(err) != c.temporary {
+			t.Errorf("%d: wrong error temporary flag: %v", c.status, err)
+		}
+	}
+}
+
+func TestDelivery_ConnectionFail(t *testing.T) {
+	srv, _ := testServer(t, http.StatusOK)
+	srv.Close()
+
+	tgt := testTarget(t, srv.URL, formatRaw)
+	_, err := testutils.DoTestDeliveryErr(t, tgt, "test@example.org", []string{"rcpt@example.org"})
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if !exterrors.IsTemporary(err) {
+		t.Errorf("Expected a temporary error, got %v", err)
+	}
+}
+
+const testMultipartMsg = "From: <test@example.org>\r\n" +
+	"Subject: =?utf-8?q?Hello_w=C3=B6rld?=\r\n" +
+	"Message-Id: <test@example.org>\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"Text body\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p>HTML body</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Disposition: attachment; filename=\"test.bin\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"AAECAw==\r\n" +
+	"--outer--\r\n"
+
+func TestDelivery_JSON(t *testing.T) {
+	srv, reqs := testServer(t, http.StatusOK)
+	defer srv.Close()
+
+	tgt := testTarget(t, srv.URL, formatJSON)
+
+	hdr, body := testutils.BodyFromStr(t, testMultipartMsg)
+	delivery, err := tgt.Start(context.Background(), &module.MsgMetadata{
+		ID:         "msgid",
+		Quarantine: true,
+	}, "test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.AddRcpt(context.Background(), "rcpt@example.org", smtp.RcptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.Body(context.Background(), hdr, body); err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.Commit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*reqs) != 1 {
+		t.Fatalf("Expected 1 request, got %d", len(*reqs))
+	}
+	req := (*reqs)[0]
+	if v := req.header.Get("Content-Type"); v != "application/json" {
+		t.Errorf("Wrong Content-Type: %v", v)
+	}
+
+	var p payload
+	if err := json.Unmarshal(req.body, &p); err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Envelope.From != "test@example.org" || !reflect.DeepEqual(p.Envelope.To, []string{"rcpt@example.org"}) {
+		t.Errorf("Wrong envelope: %+v", p.Envelope)
+	}
+	if p.Metadata.ID != "msgid" || !p.Metadata.Quarantine {
+		t.Errorf("Wrong metadata: %+v", p.Metadata)
+	}
+	if len(p.Headers) != 4 || p.Headers[0].Name != "From" {
+		t.Errorf("Wrong headers: %+v", p.Headers)
+	}
+	if p.Subject != "Hello wörld" {
+		t.Errorf("Wrong subject: %v", p.Subject)
+	}
+	if p.MessageID != "test@example.org" {
+		t.Errorf("Wrong message ID: %v", p.MessageID)
+	}
+	if strings.TrimSpace(p.Text) != "Text body" {
+		t.Errorf("Wrong text: %q", p.Text)
+	}
+	if strings.TrimSpace(p.HTML) != "<p>HTML body</p>" {
+		t.Errorf("Wrong HTML: %q", p.HTML)
+	}
+	if len(p.Attachments) != 1 {
+		t.Fatalf("Expected 1 attachment, got %+v", p.Attachments)
+	}
+	att := p.Attachments[0]
+	if att.Filename != "test.bin" || att.ContentType != "application/octet-stream" || att.Inline ||
+		!reflect.DeepEqual(att.Content, []byte{0, 1, 2, 3}) {
+		t.Errorf("Wrong attachment: %+v", att)
+	}
+	if p.ParseError != "" || p.Raw != nil {
+		t.Errorf("Unexpected parse error or raw message: %v", p.ParseError)
+	}
+}
@@ -0,0 +1,249 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package http_target
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/emersion/go-message"
+	_ "github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+)
+
+type payloadHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type payloadAttachment struct {
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"content_type"`
+	ContentID   string `json:"content_id,omitempty"`
+	Inline      bool   `json:"inline"`
+	Size        int    `json:"size"`
+	Content     []byte `json:"content"`
+}
+
+type payloadEnvelope struct {
+	From string   `json:"from"`
+	To   []string `json:"to"`
+}
+
+type payloadTLS struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+}
+
+type payloadMeta struct {
+	ID            string            `json:"id"`
+	OriginalFrom  string            `json:"original_from,omitempty"`
+	OriginalRcpts map[string]string `json:"original_rcpts,omitempty"`
+	Quarantine    bool              `json:"quarantine"`
+	SMTPUTF8      bool              `json:"smtputf8"`
+	Proto         string            `json:"proto,omitempty"`
+	SourceIP      string            `json:"source_ip,omitempty"`
+	SourceHost    string            `json:"source_host,omitempty"`
+	SourceRDNS    string            `json:"source_rdns,omitempty"`
+	AuthUser      string            `json:"auth_user,omitempty"`
+	TLS           *payloadTLS       `json:"tls,omitempty"`
+}
+
+type payload struct {
+	Envelope    payloadEnvelope     `json:"envelope"`
+	Metadata    payloadMeta         `json:"metadata"`
+	Headers     []payloadHeader     `json:"headers"`
+	Subject     string              `json:"subject"`
+	MessageID   string              `json:"message_id,omitempty"`
+	Text        string              `json:"text,omitempty"`
+	HTML        string              `json:"html,omitempty"`
+	Attachments []payloadAttachment `json:"attachments"`
+	ParseError  string              `json:"parse_error,omitempty"`
+	Raw         []byte              `json:"raw,omitempty"`
+}
+
+func (d *delivery) payloadMeta() payloadMeta {
+	meta := payloadMeta{
+		ID:            d.msgMeta.ID,
+		OriginalFrom:  d.msgMeta.OriginalFrom,
+		OriginalRcpts: d.msgMeta.OriginalRcpts,
+		Quarantine:    d.msgMeta.Quarantine,
+		SMTPUTF8:      d.msgMeta.SMTPOpts.UTF8,
+	}
+
+	conn := d.msgMeta.Conn
+	if conn == nil {
+		return meta
+	}
+
+	meta.Proto = conn.Proto
+	meta.SourceHost = conn.Hostname
+	meta.AuthUser = conn.AuthUser
+	if tcpAddr, ok := conn.RemoteAddr.(*net.TCPAddr); ok {
+		meta.SourceIP = tcpAddr.IP.String()
+	}
+	if conn.RDNSName != nil {
+		if name, err := conn.RDNSName.Get(); err == nil && name != nil {
+			meta.SourceRDNS, _ = name.(string)
+		}
+	}
+	if conn.TLS.HandshakeComplete {
+		meta.TLS = &payloadTLS{
+			Version:     tls.VersionName(conn.TLS.Version),
+			CipherSuite: tls.CipherSuiteName(conn.TLS.CipherSuite),
+		}
+	}
+	return meta
+}
+
+func (d *delivery) buildPayload(header textproto.Header, body buffer.Buffer) ([]byte, error) {
+	p := payload{
+		Envelope: payloadEnvelope{
+			From: d.mailFrom,
+			To:   d.rcpts,
+		},
+		Metadata:    d.payloadMeta(),
+		Attachments: []payloadAttachment{},
+	}
+
+	for fields := header.Fields(); fields.Next(); {
+		p.Headers = append(p.Headers, payloadHeader{
+			Name:  fields.Key(),
+			Value: fields.Value(),
+		})
+	}
+
+	mailHdr := mail.Header{Header: message.Header{Header: header}}
+	p.Subject, _ = mailHdr.Subject()
+	p.MessageID, _ = mailHdr.MessageID()
+
+	var raw []byte
+	if d.t.includeRaw {
+		var err error
+		raw, err = readRaw(header, body)
+		if err != nil {
+			return nil, err
+		}
+		p.Raw = raw
+	}
+
+	if err := d.parseBody(&p, header, body); err != nil {
+		d.log.Error("failed to parse the message", err)
+		p.ParseError = err.Error()
+		if p.Raw == nil {
+			raw, err := readRaw(header, body)
+			if err != nil {
+				return nil, err
+			}
+			p.Raw = raw
+		}
+	}
+
+	return json.Marshal(p)
+}
+
+func readRaw(header textproto.Header, body buffer.Buffer) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := textproto.WriteHeader(&buf, header); err != nil {
+		return nil, err
+	}
+	bodyR, err := body.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer bodyR.Close()
+	if _, err := io.Copy(&buf, bodyR); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// parseBody walks the MIME structure of the message and extracts text and
+// HTML bodies and attachments.
+//
+// Parts with unknown charsets or transfer encodings are included as is.
+func (d *delivery) parseBody(p *payload, header textproto.Header, body buffer.Buffer) error {
+	bodyR, err := body.Open()
+	if err != nil {
+		return err
+	}
+	defer bodyR.Close()
+
+	ent, err := message.New(message.Header{Header: header}, bodyR)
+	if err != nil && !message.IsUnknownCharset(err) {
+		return err
+	}
+	mr := mail.NewReader(ent)
+	defer mr.Close()
+
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil && !message.IsUnknownCharset(err) {
+			return err
+		}
+
+		content, err := io.ReadAll(part.Body)
+		if err != nil && !message.IsUnknownCharset(err) {
+			return err
+		}
+
+		switch h := part.Header.(type) {
+		case *mail.InlineHeader:
+			contentType, _, _ := h.ContentType()
+			switch {
+			case contentType == "text/plain" && p.Text == "":
+				p.Text = string(content)
+				continue
+			case contentType == "text/html" && p.HTML == "":
+				p.HTML = string(content)
+				continue
+			}
+			p.Attachments = append(p.Attachments, attachment(h.Header, content, true))
+		case *mail.AttachmentHeader:
+			p.Attachments = append(p.Attachments, attachment(h.Header, content, false))
+		}
+	}
+}
+
+func attachment(h message.Header, content []byte, inline bool) payloadAttachment {
+	contentType, _, _ := h.ContentType()
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	ah := mail.AttachmentHeader{Header: h}
+	filename, _ := ah.Filename()
+	return payloadAttachment{
+		Filename:    filename,
+		ContentType: contentType,
+		ContentID:   strings.Trim(h.Get("Content-Id"), "<>"),
+		Inline:      inline,
+		Size:        len(content),
+		Content:     content,
+	}
+}
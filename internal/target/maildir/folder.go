@@ -0,0 +1,137 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package maildir
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// Maildir info flags as defined in https://cr.yp.to/proto/maildir.html.
+var imapToInfoFlag = map[string]byte{
+	imap.DraftFlag:    'D',
+	imap.FlaggedFlag:  'F',
+	"$Forwarded":      'P',
+	imap.AnsweredFlag: 'R',
+	imap.SeenFlag:     'S',
+	imap.DeletedFlag:  'T',
+}
+
+// infoFlags converts IMAP flags into the Maildir info flags string.
+// Flags that have no Maildir equivalent are ignored.
+func infoFlags(flags []string) string {
+	if len(flags) == 0 {
+		return ""
+	}
+
+	res := make([]byte, 0, len(flags))
+	seen := make(map[byte]struct{}, len(flags))
+	for _, f := range flags {
+		c, ok := imapToInfoFlag[imap.CanonicalFlag(f)]
+		if !ok {
+			continue
+		}
+		if _, ok := seen[c]; ok {
+			continue
+		}
+		seen[c] = struct{}{}
+		res = append(res, c)
+	}
+
+	// Flags must be in ASCII order.
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return string(res)
+}
+
+// folderPath returns the path of the Maildir++ subfolder for the IMAP folder
+// name. Hierarchy delimiter "/" is converted to ".", INBOX is the Maildir
+// root itself.
+func folderPath(root, folder string) (string, error) {
+	if folder == "" || strings.EqualFold(folder, imap.InboxName) {
+		return root, nil
+	}
+	if len(folder) > 6 && strings.EqualFold(folder[:6], imap.InboxName+"/") {
+		folder = folder[6:]
+	}
+
+	parts := strings.Split(folder, "/")
+	for _, p := range parts {
+		if p == "" || strings.ContainsAny(p, ".\x00") {
+			return "", fmt.Errorf("folder name cannot be represented in Maildir++: %q", folder)
+		}
+	}
+
+	return filepath.Join(root, "."+strings.Join(parts, ".")), nil
+}
+
+// ensureMaildir creates tmp, new and cur directories for the Maildir (and
+// the Maildir++ subfolder) if they do not exist yet.
+func (t *Target) ensureMaildir(root, dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, "tmp")); err == nil {
+		return nil
+	}
+	if !t.autoMkdir {
+		return fmt.Errorf("maildir does not exist: %s", dir)
+	}
+
+	dirs := []string{dir}
+	if dir != root {
+		dirs = []string{root, dir}
+	}
+	for _, d := range dirs {
+		for _, sub := range []string{"tmp", "new", "cur"} {
+			if err := os.MkdirAll(filepath.Join(d, sub), 0o700); err != nil {
+				return err
+			}
+		}
+	}
+	if dir != root {
+		f, err := os.OpenFile(filepath.Join(dir, "maildirfolder"), os.O_WRONLY|os.O_CREATE, 0o600)
+		if err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
+		if f != nil {
+			f.Close()
+		}
+	}
+	return nil
+}
+
+var deliveryCounter uint64
+
+// uniqueName generates the file name for a new message as recommended by
+// https://cr.yp.to/proto/maildir.html.
+func uniqueName(hostname string) string {
+	now := time.Now()
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+	return strconv.FormatInt(now.Unix(), 10) +
+		".M" + strconv.Itoa(now.Nanosecond()/1000) +
+		"P" + strconv.Itoa(os.Getpid()) +
+		"Q" + strconv.FormatUint(atomic.AddUint64(&deliveryCounter, 1), 10) +
+		"." + hostname
+}
@@ -0,0 +1,338 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package maildir implements target.maildir module that stores messages
+// in Maildir directories for use by existing Maildir-based consumers.
+//
+// Messages are written to the tmp/ directory of each recipient Maildir and
+// moved to new/ (or cur/) on Commit. Files are renamed one recipient at a
+// time so Commit is not atomic across recipients: if a rename fails, the
+// message is still delivered to recipients processed before. Per-recipient
+// errors of the body write are reported via module.PartialDelivery.
+//
+// Interfaces implemented:
+// - module.DeliveryTarget
+// - module.PartialDelivery
+package maildir
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/trace"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/authz"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "target.maildir"
+
+type Target struct {
+	instName string
+	log      log.Logger
+
+	pathMap   module.Table
+	normalize authz.NormalizeFunc
+	filters   module.IMAPFilter
+	junkMbox  string
+	autoMkdir bool
+	hostname  string
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Target{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (t *Target) Init(cfg *config.Map) error {
+	var normalize string
+	cfg.Bool("debug", true, false, &t.log.Debug)
+	modconfig.Table(cfg, "path_map", false, true, nil, &t.pathMap)
+	cfg.String("delivery_normalize", false, false, "precis_casefold_email", &normalize)
+	cfg.Custom("imap_filter", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, func(m *config.Map, node config.Node) (interface{}, error) {
+		var filter module.IMAPFilter
+		err := modconfig.GroupFromNode("imap_filters", node.Args, node, m.Globals, &filter)
+		return filter, err
+	}, &t.filters)
+	cfg.String("junk_mailbox", false, false, "Junk", &t.junkMbox)
+	cfg.Bool("create_dirs", false, true, &t.autoMkdir)
+	cfg.String("hostname", true, false, "", &t.hostname)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	var ok bool
+	t.normalize, ok = authz.NormalizeFuncs[normalize]
+	if !ok {
+		return fmt.Errorf("%s: unknown normalization function: %s", modName, normalize)
+	}
+
+	if t.hostname == "" {
+		var err error
+		t.hostname, err = os.Hostname()
+		if err != nil {
+			return fmt.Errorf("%s: %w", modName, err)
+		}
+	}
+
+	return nil
+}
+
+func (t *Target) Name() string {
+	return modName
+}
+
+func (t *Target) InstanceName() string {
+	return t.instName
+}
+
+type rcptData struct {
+	rcptTo  string
+	path    string
+	tmpPath string
+	dstPath string
+}
+
+// delivery implements module.PartialDelivery.
+type delivery struct {
+	t        *Target
+	mailFrom string
+	log      log.Logger
+	msgMeta  *module.MsgMetadata
+
+	// Recipients keyed by normalized address, in order they were added.
+	rcpts     map[string]*rcptData
+	rcptOrder []string
+}
+
+func (t *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	return &delivery{
+		t:        t,
+		mailFrom: mailFrom,
+		log:      target.DeliveryLogger(t.log, msgMeta),
+		msgMeta:  msgMeta,
+		rcpts:    map[string]*rcptData{},
+	}, nil
+}
+
+func userDoesNotExist(actual error) error {
+	return &exterrors.SMTPError{
+		Code:         550,
+		EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+		Message:      "User does not exist",
+		TargetName:   modName,
+		Err:          actual,
+	}
+}
+
+func storageError(err error) error {
+	return &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+		Message:      "Internal server error, try again later",
+		TargetName:   modName,
+		Err:          err,
+	}
+}
+
+func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOptions) error {
+	defer trace.StartRegion(ctx, "target.maildir/AddRcpt").End()
+
+	key, err := d.t.normalize(rcptTo)
+	if err != nil {
+		return userDoesNotExist(err)
+	}
+	if _, ok := d.rcpts[key]; ok {
+		return nil
+	}
+
+	path, ok, err := d.t.pathMap.Lookup(ctx, key)
+	if err != nil {
+		return storageError(err)
+	}
+	if !ok || path == "" {
+		return userDoesNotExist(nil)
+	}
+
+	d.rcpts[key] = &rcptData{
+		rcptTo: rcptTo,
+		path:   path,
+	}
+	d.rcptOrder = append(d.rcptOrder, key)
+	return nil
+}
+
+func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	defer trace.StartRegion(ctx, "target.maildir/Body").End()
+
+	for _, key := range d.rcptOrder {
+		if err := d.storeRcpt(key, header, body); err != nil {
+			d.cleanup()
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *delivery) BodyNonAtomic(ctx context.Context, sc module.StatusCollector, header textproto.Header, body buffer.Buffer) {
+	defer trace.StartRegion(ctx, "target.maildir/BodyNonAtomic").End()
+
+	for _, key := range d.rcptOrder {
+		sc.SetStatus(d.rcpts[key].rcptTo, d.storeRcpt(key, header, body))
+	}
+}
+
+// storeRcpt writes the message to tmp/ directory of the recipient Maildir.
+// It is moved to its final place on Commit.
+func (d *delivery) storeRcpt(key string, header textproto.Header, body buffer.Buffer) error {
+	rcpt := d.rcpts[key]
+
+	var (
+		folder string
+		flags  []string
+	)
+	if d.msgMeta.Quarantine {
+		folder = d.t.junkMbox
+	} else if d.t.filters != nil {
+		var err error
+		folder, flags, err = d.t.filters.IMAPFilter(key, rcpt.rcptTo, d.msgMeta, header, body)
+		if err != nil {
+			d.log.Error("IMAPFilter failed", err, "rcpt", rcpt.rcptTo)
+			folder, flags = "", nil
+		}
+	}
+
+	dir, err := folderPath(rcpt.path, folder)
+	if err != nil {
+		d.log.Error("invalid folder name, using INBOX", err, "rcpt", rcpt.rcptTo, "folder", folder)
+		dir = rcpt.path
+	}
+	if err := d.t.ensureMaildir(rcpt.path, dir); err != nil {
+		d.log.Error("failed to prepare maildir", err, "rcpt", rcpt.rcptTo)
+		return storageError(err)
+	}
+
+	name := uniqueName(d.t.hostname)
+	tmpPath := filepath.Join(dir, "tmp", name)
+	if err := writeMessage(tmpPath, d.mailFrom, key, header, body); err != nil {
+		os.Remove(tmpPath)
+		d.log.Error("failed to write message", err, "rcpt", rcpt.rcptTo)
+		return storageError(err)
+	}
+
+	rcpt.tmpPath = tmpPath
+	infoFlags := infoFlags(flags)
+	if infoFlags == "" {
+		rcpt.dstPath = filepath.Join(dir, "new", name)
+	} else {
+		rcpt.dstPath = filepath.Join(dir, "cur", name+":2,"+infoFlags)
+	}
+
+	d.log.DebugMsg("message written", "rcpt", rcpt.rcptTo, "path", rcpt.dstPath)
+	return nil
+}
+
+func writeMessage(path, mailFrom, deliveredTo string, header textproto.Header, body buffer.Buffer) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header = header.Copy()
+	header.Add("Delivered-To", deliveredTo)
+	header.Add("Return-Path", "<"+target.SanitizeForHeader(mailFrom)+">")
+	if err := textproto.WriteHeader(f, header); err != nil {
+		return err
+	}
+
+	r, err := body.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (d *delivery) cleanup() {
+	for _, rcpt := range d.rcpts {
+		if rcpt.tmpPath == "" {
+			continue
+		}
+		if err := os.Remove(rcpt.tmpPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			d.log.Error("failed to remove temporary file", err, "path", rcpt.tmpPath)
+		}
+		rcpt.tmpPath = ""
+	}
+}
+
+func (d *delivery) Abort(ctx context.Context) error {
+	d.cleanup()
+	return nil
+}
+
+func (d *delivery) Commit(ctx context.Context) error {
+	defer trace.StartRegion(ctx, "target.maildir/Commit").End()
+
+	var lastErr error
+	for _, key := range d.rcptOrder {
+		rcpt := d.rcpts[key]
+		if rcpt.tmpPath == "" {
+			continue
+		}
+		if err := os.Rename(rcpt.tmpPath, rcpt.dstPath); err != nil {
+			d.log.Error("failed to move message", err, "rcpt", rcpt.rcptTo)
+			os.Remove(rcpt.tmpPath)
+			lastErr = err
+		}
+		rcpt.tmpPath = ""
+	}
+	if lastErr != nil {
+		return storageError(lastErr)
+	}
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,258 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package maildir
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/authz"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type testFilter struct {
+	folder string
+	flags  []string
+}
+
+func (f testFilter) IMAPFilter(string, string, *module.MsgMetadata, textproto.Header, buffer.Buffer) (string, []string, error) {
+	return f.folder, f.flags, nil
+}
+
+func testTarget(t *testing.T, dir string, filter module.IMAPFilter) *Target {
+	return &Target{
+		log: testutils.Logger(t, modName),
+		pathMap: testutils.Table{M: map[string]string{
+			"test1@example.org": filepath.Join(dir, "test1"),
+			"test2@example.org": filepath.Join(dir, "test2"),
+		}},
+		normalize: authz.NormalizeFuncs["precis_casefold_email"],
+		filters:   filter,
+		junkMbox:  "Junk",
+		autoMkdir: true,
+		hostname:  "mx.example.org",
+	}
+}
+
+func readDir(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func checkMsg(t *testing.T, dir, rcpt string) {
+	t.Helper()
+	names := readDir(t, dir)
+	if len(names) != 1 {
+		t.Fatalf("Expected 1 message in %s, got %v", dir, names)
+	}
+	blob, err := os.ReadFile(filepath.Join(dir, names[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Return-Path: <test@example.org>\r\n" +
+		"Delivered-To: " + rcpt + "\r\n" +
+		testutils.DeliveryData
+	if string(blob) != expected {
+		t.Errorf("Wrong message contents: %q", blob)
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	dir := testutils.Dir(t)
+	defer os.RemoveAll(dir)
+	tgt := testTarget(t, dir, nil)
+
+	testutils.DoTestDelivery(t, tgt, "test@example.org", []string{"test1@example.org", "TEST2@example.org"})
+
+	checkMsg(t, filepath.Join(dir, "test1", "new"), "test1@example.org")
+	checkMsg(t, filepath.Join(dir, "test2", "new"), "test2@example.org")
+	if names := readDir(t, filepath.Join(dir, "test1", "tmp")); len(names) != 0 {
+		t.Errorf("tmp/ is not empty: %v", names)
+	}
+}
+
+func TestDelivery_UnknownRcpt(t *testing.T) {
+	dir := testutils.Dir(t)
+	defer os.RemoveAll(dir)
+	tgt := testTarget(t, dir, nil)
+
+	_, err := testutils.DoTestDeliveryErr(t, tgt, "test@example.org", []string{"test1@example.org", "test3@example.org"})
+	testutils.CheckSMTPErr(t, err, 550, exterrors.EnhancedCode{5, 1, 1}, "User does not exist")
+}
+
+func TestDelivery_NoCreateDirs(t *testing.T) {
+	dir := testutils.Dir(t)
+	defer os.RemoveAll(dir)
+	tgt := testTarget(t, dir, nil)
+	tgt.autoMkdir = false
+
+	_, err := testutils.DoTestDeliveryErr(t, tgt, "test@example.org", []string{"test1@example.org"})
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if !exterrors.IsTemporary(err) {
+		t.Errorf("Expected a temporary error, got %v", err)
+	}
+}
+
+func TestDelivery_Filter(t *testing.T) {
+	dir := testutils.Dir(t)
+	defer os.RemoveAll(dir)
+	tgt := testTarget(t, dir, testFilter{
+		folder: "Archive/2020",
+		flags:  []string{"\\Seen", "\\flagged", "custom"},
+	})
+
+	testutils.DoTestDelivery(t, tgt, "test@example.org", []string{"test1@example.org"})
+
+	folder := filepath.Join(dir, "test1", ".Archive.2020")
+	if _, err := os.Stat(filepath.Join(folder, "maildirfolder")); err != nil {
+		t.Error("maildirfolder is not created:", err)
+	}
+	names := readDir(t, filepath.Join(folder, "cur"))
+	if len(names) != 1 {
+		t.Fatalf("Expected 1 message in cur/, got %v", names)
+	}
+	if !strings.HasSuffix(names[0], ":2,FS") {
+		t.Errorf("Wrong info flags: %v", names[0])
+	}
+	checkMsg(t, filepath.Join(folder, "cur"), "test1@example.org")
+}
+
+func TestDelivery_Quarantine(t *testing.T) {
+	dir := testutils.Dir(t)
+	defer os.RemoveAll(dir)
+	tgt := testTarget(t, dir, testFilter{folder: "Other"})
+
+	testutils.DoTestDeliveryMeta(t, tgt, "test@example.org", []string{"test1@example.org"}, &module.MsgMetadata{
+		Quarantine: true,
+	})
+
+	checkMsg(t, filepath.Join(dir, "test1", ".Junk", "new"), "test1@example.org")
+}
+
+func TestDelivery_Abort(t *testing.T) {
+	dir := testutils.Dir(t)
+	defer os.RemoveAll(dir)
+	tgt := testTarget(t, dir, nil)
+
+	delivery, err := tgt.Start(context.Background(), &module.MsgMetadata{ID: "test"}, "test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.AddRcpt(context.Background(), "test1@example.org", smtp.RcptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	hdr, body := testutils.BodyFromStr(t, testutils.DeliveryData)
+	if err := delivery.Body(context.Background(), hdr, body); err != nil {
+		t.Fatal(err)
+	}
+	if names := readDir(t, filepath.Join(dir, "test1", "tmp")); len(names) != 1 {
+		t.Errorf("Expected 1 message in tmp/, got %v", names)
+	}
+	if err := delivery.Abort(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if names := readDir(t, filepath.Join(dir, "test1", sub)); len(names) != 0 {
+			t.Errorf("%s/ is not empty: %v", sub, names)
+		}
+	}
+}
+
+func TestDelivery_NonAtomic(t *testing.T) {
+	dir := testutils.Dir(t)
+	defer os.RemoveAll(dir)
+	tgt := testTarget(t, dir, nil)
+	tgt.autoMkdir = false
+
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, "test1", sub), 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sc := statusCollector{}
+	testutils.DoTestDeliveryNonAtomic(t, sc, tgt, "test@example.org", []string{"test1@example.org", "test2@example.org"})
+
+	if err := sc["test1@example.org"]; err != nil {
+		t.Errorf("Unexpected error for test1: %v", err)
+	}
+	if err := sc["test2@example.org"]; err == nil {
+		t.Error("Expected an error for test2, got none")
+	}
+	if names := readDir(t, filepath.Join(dir, "test1", "new")); len(names) != 1 {
+		t.Errorf("Expected 1 message in new/, got %v", names)
+	}
+}
+
+type statusCollector map[string]error
+
+func (sc statusCollector) SetStatus(rcptTo string, err error) {
+	sc[rcptTo] = err
+}
+
+func TestFolderPath(t *testing.T) {
+	for _, c := range []struct {
+		folder   string
+		expected string
+		fail     bool
+	}{
+		{folder: "", expected: "root"},
+		{folder: "INBOX", expected: "root"},
+		{folder: "inbox", expected: "root"},
+		{folder: "Junk", expected: "root/.Junk"},
+		{folder: "INBOX/Lists", expected: "root/.Lists"},
+		{folder: "Archive/2020/Q1", expected: "root/.Archive.2020.Q1"},
+		{folder: "../etc", fail: true},
+		{folder: "a//b", fail: true},
+		{folder: "a.b", fail: true},
+	} {
+		path, err := folderPath("root", c.folder)
+		if c.fail {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", c.folder, path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", c.folder, err)
+			continue
+		}
+		if path != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.folder, c.expected, path)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pipe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+var placeholderRe = regexp.MustCompile(`{[a-zA-Z0-9_]+?}`)
+
+// sysexitsCodes maps exit codes defined in sysexits.h to the corresponding
+// SMTP status codes. The mapping is the same as used by Postfix pipe(8).
+var sysexitsCodes = map[int]struct {
+	code     int
+	enchCode exterrors.EnhancedCode
+	msg      string
+}{
+	64: {554, exterrors.EnhancedCode{5, 3, 0}, "Local delivery agent: usage error"},
+	65: {554, exterrors.EnhancedCode{5, 6, 0}, "Local delivery agent: data format error"},
+	66: {554, exterrors.EnhancedCode{5, 3, 0}, "Local delivery agent: cannot open input"},
+	67: {550, exterrors.EnhancedCode{5, 1, 1}, "User does not exist"},
+	68: {550, exterrors.EnhancedCode{5, 1, 2}, "Host name is unknown"},
+	69: {554, exterrors.EnhancedCode{5, 3, 0}, "Service unavailable"},
+	70: {554, exterrors.EnhancedCode{5, 3, 0}, "Local delivery agent: internal software error"},
+	71: {451, exterrors.EnhancedCode{4, 3, 0}, "Local delivery agent: system error"},
+	72: {554, exterrors.EnhancedCode{5, 3, 0}, "Local delivery agent: critical OS file missing"},
+	73: {554, exterrors.EnhancedCode{5, 2, 0}, "Local delivery agent: cannot create output file"},
+	74: {554, exterrors.EnhancedCode{5, 3, 0}, "Local delivery agent: input/output error"},
+	75: {451, exterrors.EnhancedCode{4, 3, 0}, "Local delivery agent: temporary failure"},
+	76: {554, exterrors.EnhancedCode{5, 5, 0}, "Local delivery agent: remote error in protocol"},
+	77: {550, exterrors.EnhancedCode{5, 7, 0}, "Local delivery agent: permission denied"},
+	78: {554, exterrors.EnhancedCode{5, 3, 5}, "Local delivery agent: configuration error"},
+}
+
+const maxStderrLen = 1024
+
+// limitedBuffer is an io.Writer that keeps only first maxStderrLen bytes
+// written to it.
+type limitedBuffer struct {
+	bytes.Buffer
+}
+
+func (lb *limitedBuffer) Write(b []byte) (int, error) {
+	if room := maxStderrLen - lb.Len(); room > 0 {
+		if len(b) > room {
+			lb.Buffer.Write(b[:room])
+		} else {
+			lb.Buffer.Write(b)
+		}
+	}
+	return len(b), nil
+}
+
+func (d *delivery) expandArgs(rcptTo string) []string {
+	expArgs := make([]string, 0, len(d.t.cmdArgs))
+
+	for _, arg := range d.t.cmdArgs {
+		// Argument consisting only of {rcpts} is expanded into a separate
+		// argument for each recipient.
+		if arg == "{rcpts}" {
+			expArgs = append(expArgs, d.rcpts...)
+			continue
+		}
+
+		expArgs = append(expArgs, placeholderRe.ReplaceAllStringFunc(arg, func(placeholder string) string {
+			switch placeholder {
+			case "{auth_user}":
+				if d.msgMeta.Conn == nil {
+					return ""
+				}
+				return d.msgMeta.Conn.AuthUser
+			case "{source_ip}":
+				if d.msgMeta.Conn == nil {
+					return ""
+				}
+				tcpAddr, _ := d.msgMeta.Conn.RemoteAddr.(*net.TCPAddr)
+				if tcpAddr == nil {
+					return ""
+				}
+				return tcpAddr.IP.String()
+			case "{source_host}":
+				if d.msgMeta.Conn == nil {
+					return ""
+				}
+				return d.msgMeta.Conn.Hostname
+			case "{source_rdns}":
+				if d.msgMeta.Conn == nil {
+					return ""
+				}
+				valI, err := d.msgMeta.Conn.RDNSName.Get()
+				if err != nil {
+					return ""
+				}
+				if valI == nil {
+					return ""
+				}
+				return valI.(string)
+			case "{msg_id}":
+				return d.msgMeta.ID
+			case "{sender}":
+				return d.mailFrom
+			case "{original_sender}":
+				return d.msgMeta.OriginalFrom
+			case "{rcpt_to}":
+				return rcptTo
+			case "{original_rcpt_to}":
+				if rcptTo == "" {
+					return ""
+				}
+				oldestOriginalRcpt := rcptTo
+				for originalRcpt, ok := rcptTo, true; ok; originalRcpt, ok = d.msgMeta.OriginalRcpts[originalRcpt] {
+					oldestOriginalRcpt = originalRcpt
+				}
+				return oldestOriginalRcpt
+			case "{rcpts}":
+				return strings.Join(d.rcpts, ",")
+			}
+			return placeholder
+		}))
+	}
+
+	return expArgs
+}
+
+func (d *delivery) environ(rcptTo string) []string {
+	var env []string
+	if d.t.inheritEnv {
+		env = os.Environ()
+	} else {
+		env = []string{"PATH=" + os.Getenv("PATH")}
+	}
+	env = append(env,
+		"SENDER="+d.mailFrom,
+		"MSG_ID="+d.msgMeta.ID,
+	)
+	if rcptTo != "" {
+		env = append(env, "RECIPIENT="+rcptTo)
+	} else {
+		env = append(env, "RECIPIENTS="+strings.Join(d.rcpts, " "))
+	}
+	return append(env, d.t.env...)
+}
+
+// run executes the command for the specified recipient (or for all
+// recipients if rcptTo is empty) with the message passed via stdin.
+func (d *delivery) run(ctx context.Context, rcptTo string, header textproto.Header, body buffer.Buffer) error {
+	if d.t.timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.t.timeout)
+		defer cancel()
+	}
+
+	cmdName, args := d.t.cmd, d.expandArgs(rcptTo)
+	if d.t.user != "" {
+		args = append([]string{d.t.user, "--", cmdName}, args...)
+		cmdName = d.t.helperPath
+	}
+
+	header = header.Copy()
+	if rcptTo != "" {
+		header.Add("Delivered-To", rcptTo)
+	}
+	header.Add("Return-Path", "<"+target.SanitizeForHeader(d.mailFrom)+">")
+
+	var hdrBuf bytes.Buffer
+	if err := textproto.WriteHeader(&hdrBuf, header); err != nil {
+		return d.internalError(err, cmdName)
+	}
+	bodyR, err := body.Open()
+	if err != nil {
+		return d.internalError(err, cmdName)
+	}
+	defer bodyR.Close()
+
+	cmd := exec.CommandContext(ctx, cmdName, args...)
+	cmd.Stdin = io.MultiReader(&hdrBuf, bodyR)
+	cmd.Env = d.environ(rcptTo)
+	var stderr limitedBuffer
+	cmd.Stderr = &stderr
+
+	d.log.DebugMsg("running command", "cmd", cmd.String(), "rcpt", rcptTo)
+
+	err = cmd.Run()
+	if err == nil {
+		return nil
+	}
+
+	if ctx.Err() != nil {
+		return &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 4, 7},
+			Message:      "Local delivery agent timed out",
+			TargetName:   modName,
+			Err:          ctx.Err(),
+			Misc: map[string]interface{}{
+				"cmd":  cmd.String(),
+				"rcpt": rcptTo,
+			},
+		}
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return d.internalError(err, cmd.String())
+	}
+
+	return d.exitCodeError(exitErr, cmd.String(), rcptTo, strings.TrimSpace(stderr.String()))
+}
+
+func (d *delivery) exitCodeError(exitErr *exec.ExitError, cmdLine, rcptTo, stderr string) error {
+	exitCode := exitErr.ExitCode()
+	misc := map[string]interface{}{
+		"cmd":       cmdLine,
+		"exit_code": exitCode,
+	}
+	if rcptTo != "" {
+		misc["rcpt"] = rcptTo
+	}
+	if stderr != "" {
+		misc["stderr"] = stderr
+	}
+
+	switch {
+	case d.t.tempCodes[exitCode]:
+		return &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+			Message:      "Local delivery agent: temporary failure",
+			TargetName:   modName,
+			Err:          exitErr,
+			Misc:         misc,
+		}
+	case d.t.permCodes[exitCode]:
+		return &exterrors.SMTPError{
+			Code:         554,
+			EnhancedCode: exterrors.EnhancedCode{5, 3, 0},
+			Message:      "Local delivery agent: permanent failure",
+			TargetName:   modName,
+			Err:          exitErr,
+			Misc:         misc,
+		}
+	}
+
+	if status, ok := sysexitsCodes[exitCode]; ok {
+		return &exterrors.SMTPError{
+			Code:         status.code,
+			EnhancedCode: status.enchCode,
+			Message:      status.msg,
+			TargetName:   modName,
+			Err:          exitErr,
+			Misc:         misc,
+		}
+	}
+
+	// Unknown exit codes and termination by a signal (-1) are considered
+	// temporary errors so the message is not lost due to a crash.
+	return &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+		Message:      "Local delivery agent: temporary failure",
+		TargetName:   modName,
+		Err:          exitErr,
+		Reason:       "unexpected exit code",
+		Misc:         misc,
+	}
+}
+
+func (d *delivery) internalError(err error, cmdLine string) error {
+	return &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+		Message:      "Internal server error, try again later",
+		TargetName:   modName,
+		Err:          err,
+		Misc: map[string]interface{}{
+			"cmd": cmdLine,
+		},
+	}
+}
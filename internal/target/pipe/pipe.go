@@ -0,0 +1,240 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package pipe implements target.pipe module that passes messages to
+// an external command (local delivery agent, ticketing system, archiver, etc).
+//
+// Interfaces implemented:
+// - module.DeliveryTarget
+package pipe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime/trace"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "target.pipe"
+
+const (
+	modePerRcpt = "per_rcpt"
+	modePerMsg  = "per_msg"
+)
+
+type Target struct {
+	instName string
+	log      log.Logger
+
+	cmd     string
+	cmdArgs []string
+
+	mode       string
+	timeout    time.Duration
+	user       string
+	helperPath string
+	inheritEnv bool
+	env        []string
+	tempCodes  map[int]bool
+	permCodes  map[int]bool
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) == 0 {
+		return nil, errors.New("pipe: at least one argument is required (command name)")
+	}
+
+	return &Target{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+		cmd:      inlineArgs[0],
+		cmdArgs:  inlineArgs[1:],
+	}, nil
+}
+
+func (t *Target) Init(cfg *config.Map) error {
+	var tempCodes, permCodes []string
+	cfg.Bool("debug", true, false, &t.log.Debug)
+	cfg.Enum("mode", false, false, []string{modePerRcpt, modePerMsg}, modePerRcpt, &t.mode)
+	cfg.Duration("timeout", false, false, 5*time.Minute, &t.timeout)
+	cfg.String("user", false, false, "", &t.user)
+	cfg.Bool("inherit_env", false, false, &t.inheritEnv)
+	cfg.Callback("env", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) != 2 {
+			return config.NodeErr(node, "exactly two arguments are required: <name> <value>")
+		}
+		t.env = append(t.env, node.Args[0]+"="+node.Args[1])
+		return nil
+	})
+	cfg.StringList("temporary_codes", false, false, nil, &tempCodes)
+	cfg.StringList("permanent_codes", false, false, nil, &permCodes)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	var err error
+	t.tempCodes, err = parseCodes(tempCodes)
+	if err != nil {
+		return fmt.Errorf("pipe: temporary_codes: %w", err)
+	}
+	t.permCodes, err = parseCodes(permCodes)
+	if err != nil {
+		return fmt.Errorf("pipe: permanent_codes: %w", err)
+	}
+
+	if t.user != "" {
+		t.helperPath = filepath.Join(config.LibexecDirectory, "maddy-pipe-helper")
+		if _, err := os.Stat(t.helperPath); err != nil {
+			return fmt.Errorf("pipe: no helper binary (maddy-pipe-helper) found in %s", config.LibexecDirectory)
+		}
+		// The command is looked up by the helper after switching the user.
+		return nil
+	}
+
+	// Check whether the inline argument command is usable.
+	if _, err := exec.LookPath(t.cmd); err != nil {
+		return fmt.Errorf("pipe: %w", err)
+	}
+
+	return nil
+}
+
+func parseCodes(codes []string) (map[int]bool, error) {
+	res := make(map[int]bool, len(codes))
+	for _, c := range codes {
+		code, err := strconv.Atoi(c)
+		if err != nil {
+			return nil, err
+		}
+		if code <= 0 || code > 255 {
+			return nil, fmt.Errorf("invalid exit code: %d", code)
+		}
+		res[code] = true
+	}
+	return res, nil
+}
+
+func (t *Target) Name() string {
+	return modName
+}
+
+func (t *Target) InstanceName() string {
+	return t.instName
+}
+
+// delivery implements module.PartialDelivery.
+type delivery struct {
+	t        *Target
+	mailFrom string
+	log      log.Logger
+	msgMeta  *module.MsgMetadata
+
+	rcpts []string
+}
+
+func (t *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	return &delivery{
+		t:        t,
+		mailFrom: mailFrom,
+		log:      target.DeliveryLogger(t.log, msgMeta),
+		msgMeta:  msgMeta,
+	}, nil
+}
+
+func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOptions) error {
+	for _, rcpt := range d.rcpts {
+		if rcpt == rcptTo {
+			return nil
+		}
+	}
+	d.rcpts = append(d.rcpts, rcptTo)
+	return nil
+}
+
+func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	defer trace.StartRegion(ctx, "target.pipe/Body").End()
+
+	if d.t.mode == modePerMsg {
+		return d.run(ctx, "", header, body)
+	}
+
+	// Commands that were already run for some recipients cannot be undone
+	// if the command fails for another one, and the whole message would be
+	// delivered again to all of them on retry. Such messages are accepted
+	// only via BodyNonAtomic that reports the status for each recipient
+	// (e.g. when target.queue is used).
+	if len(d.rcpts) > 1 {
+		d.log.Msg("per_rcpt mode requires target.queue for messages with multiple recipients", "rcpts", len(d.rcpts))
+		return &exterrors.SMTPError{
+			Code:         554,
+			EnhancedCode: exterrors.EnhancedCode{5, 3, 3},
+			Message:      "Local delivery agent cannot accept messages with multiple recipients",
+			TargetName:   modName,
+			Reason:       "per_rcpt mode is used without target.queue",
+		}
+	}
+	for _, rcpt := range d.rcpts {
+		if err := d.run(ctx, rcpt, header, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *delivery) BodyNonAtomic(ctx context.Context, sc module.StatusCollector, header textproto.Header, body buffer.Buffer) {
+	defer trace.StartRegion(ctx, "target.pipe/BodyNonAtomic").End()
+
+	if d.t.mode == modePerMsg {
+		err := d.run(ctx, "", header, body)
+		for _, rcpt := range d.rcpts {
+			sc.SetStatus(rcpt, err)
+		}
+		return
+	}
+
+	for _, rcpt := range d.rcpts {
+		sc.SetStatus(rcpt, d.run(ctx, rcpt, header, body))
+	}
+}
+
+func (d *delivery) Abort(ctx context.Context) error {
+	// Commands are executed in Body and cannot be rolled back.
+	return nil
+}
+
+func (d *delivery) Commit(ctx context.Context) error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,163 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pipe
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testTarget(t *testing.T, mode string, args ...string) *Target {
+	return &Target{
+		log:     testutils.Logger(t, modName),
+		cmd:     "/bin/sh",
+		cmdArgs: append([]string{"-c"}, args...),
+		mode:    mode,
+		timeout: 5 * time.Second,
+	}
+}
+
+func TestPipe_PerRcpt(t *testing.T) {
+	dir := testutils.Dir(t)
+	defer os.RemoveAll(dir)
+
+	tgt := testTarget(t, modePerRcpt, `cat > "$0/$1"`, dir, "{rcpt_to}")
+	sc := statusCollector{}
+	testutils.DoTestDeliveryNonAtomic(t, sc, tgt, "test@example.org", []string{"rcpt1@example.org", "rcpt2@example.org"})
+	for rcpt, err := range sc {
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %v", rcpt, err)
+		}
+	}
+
+	for _, rcpt := range []string{"rcpt1@example.org", "rcpt2@example.org"} {
+		blob, err := os.ReadFile(filepath.Join(dir, rcpt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "Return-Path: <test@example.org>\r\n" +
+			"Delivered-To: " + rcpt + "\r\n" +
+			testutils.DeliveryData
+		if string(blob) != expected {
+			t.Errorf("Wrong message for %s: %q", rcpt, blob)
+		}
+	}
+}
+
+func TestPipe_PerMsg(t *testing.T) {
+	dir := testutils.Dir(t)
+	defer os.RemoveAll(dir)
+
+	tgt := testTarget(t, modePerMsg, `echo "$# $* $SENDER $CUSTOM" > "$0/args"`, dir, "{rcpts}")
+	tgt.env = []string{"CUSTOM=value"}
+	testutils.DoTestDelivery(t, tgt, "test@example.org", []string{"rcpt1@example.org", "rcpt2@example.org"})
+
+	blob, err := os.ReadFile(filepath.Join(dir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(blob) != "2 rcpt1@example.org rcpt2@example.org test@example.org value\n" {
+		t.Errorf("Wrong command arguments: %q", blob)
+	}
+}
+
+func TestPipe_ExitCodes(t *testing.T) {
+	check := func(script string, tempCodes map[int]bool, code int, enchCode exterrors.EnhancedCode) {
+		t.Helper()
+		tgt := testTarget(t, modePerRcpt, script)
+		tgt.tempCodes = tempCodes
+		_, err := testutils.DoTestDeliveryErr(t, tgt, "test@example.org", []string{"rcpt@example.org"})
+		if err == nil {
+			t.Fatal("Expected an error, got none")
+		}
+		smtpErr, ok := err.(*exterrors.SMTPError)
+		if !ok {
+			t.Fatalf("Not SMTPError: %T %v", err, err)
+		}
+		if smtpErr.Code != code || smtpErr.EnhancedCode != enchCode {
+			t.Errorf("Wrong status: %d %v, expected %d %v", smtpErr.Code, smtpErr.EnhancedCode, code, enchCode)
+		}
+	}
+
+	check("exit 75", nil, 451, exterrors.EnhancedCode{4, 3, 0})
+	check("exit 67", nil, 550, exterrors.EnhancedCode{5, 1, 1})
+	check("exit 1", nil, 451, exterrors.EnhancedCode{4, 3, 0})
+	check("exit 67", map[int]bool{67: true}, 451, exterrors.EnhancedCode{4, 3, 0})
+	check("kill -9 $$", nil, 451, exterrors.EnhancedCode{4, 3, 0})
+}
+
+func TestPipe_Timeout(t *testing.T) {
+	tgt := testTarget(t, modePerRcpt, "exec sleep 5")
+	tgt.timeout = 100 * time.Millisecond
+
+	_, err := testutils.DoTestDeliveryErr(t, tgt, "test@example.org", []string{"rcpt@example.org"})
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if !exterrors.IsTemporary(err) {
+		t.Errorf("Expected a temporary error, got %v", err)
+	}
+}
+
+func TestPipe_NonAtomic(t *testing.T) {
+	tgt := testTarget(t, modePerRcpt, `[ "$0" = "rcpt1@example.org" ] || exit 67`, "{rcpt_to}")
+
+	sc := statusCollector{}
+	testutils.DoTestDeliveryNonAtomic(t, sc, tgt, "test@example.org", []string{"rcpt1@example.org", "rcpt2@example.org"})
+	if err := sc["rcpt1@example.org"]; err != nil {
+		t.Errorf("Unexpected error for rcpt1: %v", err)
+	}
+	if err := sc["rcpt2@example.org"]; err == nil || exterrors.IsTemporary(err) {
+		t.Errorf("Expected a permanent error for rcpt2, got %v", err)
+	}
+}
+
+func TestPipe_PerRcptAtomic(t *testing.T) {
+	dir := testutils.Dir(t)
+	defer os.RemoveAll(dir)
+
+	tgt := testTarget(t, modePerRcpt, `cat > "$0/$1"`, dir, "{rcpt_to}")
+	testutils.DoTestDelivery(t, tgt, "test@example.org", []string{"rcpt@example.org"})
+	if _, err := os.Stat(filepath.Join(dir, "rcpt@example.org")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Commands are not run at all if the message cannot be delivered to
+	// each recipient separately.
+	_, err := testutils.DoTestDeliveryErr(t, tgt, "test@example.org", []string{"rcpt1@example.org", "rcpt2@example.org"})
+	if err == nil || exterrors.IsTemporary(err) {
+		t.Errorf("Expected a permanent error, got %v", err)
+	}
+	for _, rcpt := range []string{"rcpt1@example.org", "rcpt2@example.org"} {
+		if _, err := os.Stat(filepath.Join(dir, rcpt)); !os.IsNotExist(err) {
+			t.Errorf("Command is executed for %s", rcpt)
+		}
+	}
+}
+
+type statusCollector map[string]error
+
+func (sc statusCollector) SetStatus(rcptTo string, err error) {
+	sc[rcptTo] = err
+}
@@ -0,0 +1,223 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+var (
+	ErrUnknownMsg = errors.New("queue: no such message")
+	ErrMsgBusy    = errors.New("queue: delivery attempt is in progress")
+)
+
+// MsgInfo describes the queued message for management purposes.
+type MsgInfo struct {
+	ID   string
+	From string
+
+	// Recipients that will be tried next.
+	To []string
+
+	FailedRcpts          []string
+	TemporaryFailedRcpts []string
+	RcptErrs             map[string]*smtp.SMTPError
+	TriesCount           map[string]int
+
+	FirstAttempt time.Time
+	LastAttempt  time.Time
+
+	// Time of the next delivery attempt. Zero if the delivery attempt is in
+	// progress right now.
+	NextAttempt time.Time
+}
+
+func validMsgID(id string) bool {
+	return id != "" && !strings.ContainsAny(id, `/\.`)
+}
+
+func (q *Queue) scheduled() map[string]time.Time {
+	res := make(map[string]time.Time)
+	for _, slot := range q.wheel.Slots() {
+		res[slot.Value.(queueSlot).ID] = slot.Time
+	}
+	return res
+}
+
+func (q *Queue) msgInfo(id string, nextAttempt time.Time) (MsgInfo, error) {
+	meta, err := q.readMessageMeta(id)
+	if err != nil {
+		return MsgInfo{}, err
+	}
+
+	return MsgInfo{
+		ID:                   id,
+		From:                 meta.From,
+		To:                   meta.To,
+		FailedRcpts:          meta.FailedRcpts,
+		TemporaryFailedRcpts: meta.TemporaryFailedRcpts,
+		RcptErrs:             meta.RcptErrs,
+		TriesCount:           meta.TriesCount,
+		FirstAttempt:         meta.FirstAttempt,
+		LastAttempt:          meta.LastAttempt,
+		NextAttempt:          nextAttempt,
+	}, nil
+}
+
+// List returns information about all messages stored in the queue
+// ordered by the next delivery attempt time.
+func (q *Queue) List() ([]MsgInfo, error) {
+	dirInfo, err := os.ReadDir(q.location)
+	if err != nil {
+		return nil, err
+	}
+
+	scheduled := q.scheduled()
+
+	res := make([]MsgInfo, 0, len(scheduled))
+	for _, entry := range dirInfo {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".meta") {
+			continue
+		}
+		id := strings.TrimSuffix(entry.Name(), ".meta")
+
+		info, err := q.msgInfo(id, scheduled[id])
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Delivered while we were reading the directory.
+				continue
+			}
+			return nil, err
+		}
+		res = append(res, info)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].NextAttempt.Before(res[j].NextAttempt)
+	})
+
+	return res, nil
+}
+
+// Inspect returns information about the queued message.
+func (q *Queue) Inspect(id string) (MsgInfo, error) {
+	if !validMsgID(id) {
+		return MsgInfo{}, ErrUnknownMsg
+	}
+
+	info, err := q.msgInfo(id, q.scheduled()[id])
+	if err != nil {
+		if os.IsNotExist(err) {
+			return MsgInfo{}, ErrUnknownMsg
+		}
+		return MsgInfo{}, err
+	}
+	return info, nil
+}
+
+// notScheduledErr returns the error describing why the message is not
+// present in the wheel.
+func (q *Queue) notScheduledErr(id string) error {
+	if !validMsgID(id) {
+		return ErrUnknownMsg
+	}
+	if _, err := os.Stat(filepath.Join(q.location, id+".meta")); err != nil {
+		return ErrUnknownMsg
+	}
+	return ErrMsgBusy
+}
+
+// Flush schedules the delivery attempt for the message to happen right now.
+func (q *Queue) Flush(id string) error {
+	count := q.wheel.Reschedule(time.Now(), func(v interface{}) bool {
+		return v.(queueSlot).ID == id
+	})
+	if count == 0 {
+		return q.notScheduledErr(id)
+	}
+	return nil
+}
+
+// FlushAll schedules the delivery attempt for all queued messages to happen
+// right now.
+//
+// It returns the amount of affected messages.
+func (q *Queue) FlushAll() int {
+	return q.wheel.Reschedule(time.Now(), func(interface{}) bool {
+		return true
+	})
+}
+
+// Remove removes the message from the queue without attempting to deliver
+// it.
+//
+// If bounce is true, the DSN is sent to the sender for all recipients the
+// message was not delivered to yet (if 'bounce' is configured for the
+// queue).
+func (q *Queue) Remove(id string, bounce bool) error {
+	slot, ok := q.wheel.Remove(func(v interface{}) bool {
+		return v.(queueSlot).ID == id
+	})
+	if !ok {
+		return q.notScheduledErr(id)
+	}
+
+	qs := slot.Value.(queueSlot)
+	meta := qs.Meta
+	if meta == nil {
+		var err error
+		meta, err = q.readMessageMeta(id)
+		if err != nil {
+			q.Log.Error("failed to read meta-data of removed message", err, "msg_id", id)
+			meta = &QueueMetadata{MsgMeta: &module.MsgMetadata{ID: id}}
+			bounce = false
+		}
+	}
+
+	if bounce {
+		_, header, _, err := q.openMessage(id)
+		if err != nil {
+			q.Log.Error("failed to read removed message", err, "msg_id", id)
+		} else {
+			if meta.RcptErrs == nil {
+				meta.RcptErrs = map[string]*smtp.SMTPError{}
+			}
+			for _, rcpt := range meta.To {
+				meta.RcptErrs[rcpt] = &smtp.SMTPError{
+					Code:         554,
+					EnhancedCode: smtp.EnhancedCode{5, 0, 0},
+					Message:      "Message removed from the queue by the administrator",
+				}
+			}
+			q.emitDSN(meta, header, meta.To)
+		}
+	}
+
+	q.Log.Msg("message removed from the queue", "msg_id", id, "rcpts", meta.To, "bounce", bounce)
+	q.removeFromDisk(meta.MsgMeta)
+	return nil
+}
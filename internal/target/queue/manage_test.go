@@ -0,0 +1,126 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// deferredTestMsg queues a message that fails the first delivery attempt
+// and waits until the next attempt is scheduled.
+func deferredTestMsg(t *testing.T, q *Queue, dt *unreliableTarget) string {
+	t.Helper()
+
+	id := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+
+	for i := 0; i < 50; i++ {
+		if _, ok := q.scheduled()[id]; ok {
+			return id
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Message was not rescheduled")
+	return ""
+}
+
+func TestQueueManage_ListFlush(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{
+		bodyFailures: []error{
+			exterrors.WithTemporary(errors.New("you shall not pass"), true),
+		},
+		aborted:   make(chan testutils.Msg, 10),
+		committed: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.initialRetryTime = time.Hour
+	defer cleanQueue(t, q)
+
+	id := deferredTestMsg(t, q, &dt)
+
+	list, err := q.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Fatal("Wrong amount of messages:", len(list))
+	}
+	info := list[0]
+	if info.ID != id || info.From != "tester@example.com" || len(info.To) != 1 || info.To[0] != "tester1@example.org" {
+		t.Fatalf("Wrong message info: %+v", info)
+	}
+	if info.TriesCount["tester1@example.org"] != 1 {
+		t.Fatal("Wrong tries count:", info.TriesCount)
+	}
+	if time.Until(info.NextAttempt) < 30*time.Minute {
+		t.Fatal("Wrong next attempt time:", info.NextAttempt)
+	}
+
+	if _, err := q.Inspect("../" + id); !errors.Is(err, ErrUnknownMsg) {
+		t.Fatal("Expected ErrUnknownMsg, got", err)
+	}
+	if err := q.Flush("ffffffff"); !errors.Is(err, ErrUnknownMsg) {
+		t.Fatal("Expected ErrUnknownMsg, got", err)
+	}
+
+	if err := q.Flush(id); err != nil {
+		t.Fatal(err)
+	}
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester1@example.org"}, "")
+
+	q.Close()
+	checkQueueDir(t, q, []string{})
+}
+
+func TestQueueManage_Remove(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{
+		bodyFailures: []error{
+			exterrors.WithTemporary(errors.New("you shall not pass"), true),
+		},
+		aborted:   make(chan testutils.Msg, 10),
+		committed: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.initialRetryTime = time.Hour
+	defer cleanQueue(t, q)
+
+	id := deferredTestMsg(t, q, &dt)
+
+	if err := q.Remove(id, false); err != nil {
+		t.Fatal(err)
+	}
+	checkQueueDir(t, q, []string{})
+
+	if _, err := q.Inspect(id); !errors.Is(err, ErrUnknownMsg) {
+		t.Fatal("Expected ErrUnknownMsg, got", err)
+	}
+	if err := q.Remove(id, false); !errors.Is(err, ErrUnknownMsg) {
+		t.Fatal("Expected ErrUnknownMsg, got", err)
+	}
+}
@@ -18,18 +18,73 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
 package queue
 
-import "github.com/prometheus/client_golang/prometheus"
-
-var queuedMsgs = prometheus.NewGaugeVec(
-	prometheus.GaugeOpts{
-		Namespace: "maddy",
-		Subsystem: "queue",
-		Name:      "length",
-		Help:      "Amount of queued messages",
-	},
-	[]string{"module", "location"},
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	queueLengthDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("maddy", "queue", "length"),
+		"Amount of queued messages",
+		[]string{"module", "location"}, nil,
+	)
+	queueOldestDesc = prometheus.NewDesc(
+		prometheus.BuildFQName("maddy", "queue", "oldest_message_age_seconds"),
+		"Time since the oldest queued message was accepted, 0 if queue is empty",
+		[]string{"module", "location"}, nil,
+	)
 )
 
+// queueCollector reports statistics for running queue instances. Values are
+// computed at collection time so age of the oldest message is always
+// up-to-date.
+type queueCollector struct {
+	lck    sync.Mutex
+	queues map[*Queue]struct{}
+}
+
+var runningQueues = &queueCollector{
+	queues: make(map[*Queue]struct{}),
+}
+
+func (qc *queueCollector) add(q *Queue) {
+	qc.lck.Lock()
+	defer qc.lck.Unlock()
+	qc.queues[q] = struct{}{}
+}
+
+func (qc *queueCollector) remove(q *Queue) {
+	qc.lck.Lock()
+	defer qc.lck.Unlock()
+	delete(qc.queues, q)
+}
+
+func (qc *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueLengthDesc
+	ch <- queueOldestDesc
+}
+
+func (qc *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	qc.lck.Lock()
+	defer qc.lck.Unlock()
+
+	now := time.Now()
+	for q := range qc.queues {
+		length, oldest := q.stats()
+		age := 0.0
+		if length != 0 {
+			age = now.Sub(oldest).Seconds()
+		}
+		ch <- prometheus.MustNewConstMetric(queueLengthDesc, prometheus.GaugeValue,
+			float64(length), q.name, q.location)
+		ch <- prometheus.MustNewConstMetric(queueOldestDesc, prometheus.GaugeValue,
+			age, q.name, q.location)
+	}
+}
+
 func init() {
-	prometheus.MustRegister(queuedMsgs)
+	prometheus.MustRegister(runningQueues)
 }
@@ -82,9 +82,11 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/tracing"
 	"github.com/foxcpp/maddy/internal/dsn"
 	"github.com/foxcpp/maddy/internal/msgpipeline"
 	"github.com/foxcpp/maddy/internal/target"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // partialError describes state of partially successful message delivery.
@@ -153,6 +155,11 @@ type Queue struct {
 	// Buffered channel used to restrict count of deliveries attempted
 	// in parallel.
 	deliverySemaphore chan struct{}
+
+	// Time of the first delivery attempt for each queued message, used
+	// for metrics.
+	msgsLck sync.Mutex
+	msgs    map[string]time.Time
 }
 
 type QueueMetadata struct {
@@ -238,6 +245,10 @@ func (q *Queue) Init(cfg *config.Map) error {
 		q.location = filepath.Join(config.StateDirectory, q.name)
 	}
 
+	if module.NoRun {
+		return nil
+	}
+
 	// TODO: Check location write permissions.
 	if err := os.MkdirAll(q.location, os.ModePerm); err != nil {
 		return err
@@ -249,10 +260,12 @@ func (q *Queue) Init(cfg *config.Map) error {
 func (q *Queue) start(maxParallelism int) error {
 	q.wheel = NewTimeWheel(q.dispatch)
 	q.deliverySemaphore = make(chan struct{}, maxParallelism)
+	q.msgs = make(map[string]time.Time)
 
 	if err := q.readDiskQueue(); err != nil {
 		return err
 	}
+	runningQueues.add(q)
 
 	q.Log.Debugf("delivery target: %T", q.Target)
 
@@ -260,6 +273,10 @@ func (q *Queue) start(maxParallelism int) error {
 }
 
 func (q *Queue) Close() error {
+	if q.wheel == nil {
+		return nil
+	}
+	runningQueues.remove(q)
 	q.wheel.Close()
 	q.deliveryWg.Wait()
 
@@ -274,6 +291,7 @@ func (q *Queue) Close() error {
 //
 // No error handling is done since this function is called from panic handler.
 func (q *Queue) discardBroken(id string) {
+	q.untrackMsg(id)
 	err := os.Rename(filepath.Join(q.location, id+".meta"), filepath.Join(q.location, id+".meta_broken"))
 	if err != nil {
 		// Note: Global logger is used in case there is something wrong with Queue.Log.
@@ -281,6 +299,31 @@ func (q *Queue) discardBroken(id string) {
 	}
 }
 
+func (q *Queue) trackMsg(id string, firstAttempt time.Time) {
+	q.msgsLck.Lock()
+	defer q.msgsLck.Unlock()
+	q.msgs[id] = firstAttempt
+}
+
+func (q *Queue) untrackMsg(id string) {
+	q.msgsLck.Lock()
+	defer q.msgsLck.Unlock()
+	delete(q.msgs, id)
+}
+
+// stats returns the amount of queued messages and the time of the first
+// delivery attempt for the oldest one.
+func (q *Queue) stats() (length int, oldest time.Time) {
+	q.msgsLck.Lock()
+	defer q.msgsLck.Unlock()
+	for _, t := range q.msgs {
+		if oldest.IsZero() || t.Before(oldest) {
+			oldest = t
+		}
+	}
+	return len(q.msgs), oldest
+}
+
 func (q *Queue) dispatch(value TimeSlot) {
 	slot := value.Value.(queueSlot)
 
@@ -472,6 +515,25 @@ func (q *Queue) deliver(meta *QueueMetadata, header textproto.Header, body buffe
 	msgCtx, msgTask := trace.NewTask(context.Background(), "Queue delivery")
 	defer msgTask.End()
 
+	// Each attempt is a separate trace linked to the one that
+	// accepted the message.
+	msgCtx, span := tracing.StartLinked(msgCtx, "queue delivery attempt", meta.MsgMeta.TraceParent,
+		attribute.String("maddy.msg_id", msgMeta.ID))
+	defer func() {
+		failed := 0
+		for _, err := range perr.Errs {
+			if err != nil {
+				failed++
+				span.RecordError(err)
+			}
+		}
+		span.SetAttributes(attribute.Int("maddy.rcpts_failed", failed))
+		if failed == len(meta.To) {
+			tracing.RecordError(span, errors.New("delivery failed for all recipients"))
+		}
+		span.End()
+	}()
+
 	mailCtx, mailTask := trace.NewTask(msgCtx, "MAIL FROM")
 	delivery, err := q.Target.Start(mailCtx, msgMeta, meta.From)
 	mailTask.End()
@@ -594,6 +656,7 @@ func (qd *queueDelivery) Commit(ctx context.Context) error {
 		panic("queue: double Commit")
 	}
 
+	qd.q.trackMsg(qd.meta.MsgMeta.ID, qd.meta.FirstAttempt)
 	qd.q.wheel.Add(time.Time{}, queueSlot{
 		ID:   qd.meta.MsgMeta.ID,
 		Meta: qd.meta,
@@ -619,6 +682,7 @@ func (q *Queue) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom
 func (q *Queue) removeFromDisk(msgMeta *module.MsgMetadata) {
 	id := msgMeta.ID
 	dl := target.DeliveryLogger(q.Log, msgMeta)
+	q.untrackMsg(id)
 
 	// Order is important.
 	// If we remove header and body but can't remove meta now - readDiskQueue
@@ -703,6 +767,7 @@ func (q *Queue) readDiskQueue() error {
 		q.wheel.Add(nextTryTime, queueSlot{
 			ID: id,
 		})
+		q.trackMsg(id, meta.FirstAttempt)
 		loadedCount++
 	}
 
@@ -884,6 +949,10 @@ func (q *Queue) Name() string {
 	return "queue"
 }
 
+// Exclusive marks the queue as not reloadable since two instances can't
+// process the same queue directory.
+func (q *Queue) Exclusive() {}
+
 func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpts []string) {
 	// If, apparently, we have no DSN msgpipeline configured - do nothing.
 	if q.dsnPipeline == nil {
@@ -957,6 +1026,12 @@ func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpt
 	msgCtx, msgTask := trace.NewTask(context.Background(), "DSN Delivery")
 	defer msgTask.End()
 
+	msgCtx, span := tracing.StartLinked(msgCtx, "queue DSN", meta.MsgMeta.TraceParent,
+		attribute.String("maddy.msg_id", dsnID),
+		attribute.String("maddy.dsn_for", meta.MsgMeta.ID))
+	dsnMeta.TraceParent = tracing.TraceParent(msgCtx)
+	defer func() { tracing.End(span, err) }()
+
 	mailCtx, mailTask := trace.NewTask(msgCtx, "MAIL FROM")
 	dsnDelivery, err := q.dsnPipeline.Start(mailCtx, dsnMeta, "")
 	mailTask.End()
@@ -823,6 +823,54 @@ func TestQueueDSN_RcptRewrite(t *testing.T) {
 	}
 }
 
+func TestQueueStats(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{
+		bodyFailures: []error{
+			exterrors.WithTemporary(errors.New("go away"), true),
+		},
+		aborted: make(chan testutils.Msg, 10),
+	}
+	dir := t.TempDir()
+	q := newTestQueueDir(t, &dt, dir)
+	q.initialRetryTime = time.Hour
+
+	if length, _ := q.stats(); length != 0 {
+		t.Fatalf("wrong length for empty queue: %d", length)
+	}
+
+	start := time.Now()
+	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org"})
+	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
+
+	length, oldest := q.stats()
+	if length != 1 {
+		t.Fatalf("wrong length after failed delivery: %d", length)
+	}
+	if oldest.Before(start.Add(-time.Second)) || oldest.After(time.Now()) {
+		t.Errorf("wrong time of the first attempt: %v (started at %v)", oldest, start)
+	}
+	q.Close()
+
+	// Stats should be restored from disk.
+	dt = unreliableTarget{
+		bodyFailures: []error{
+			exterrors.WithTemporary(errors.New("go away"), true),
+		},
+		aborted: make(chan testutils.Msg, 10),
+	}
+	q = newTestQueueDir(t, &dt, dir)
+	q.Close()
+	length, restoredOldest := q.stats()
+	if length != 1 {
+		t.Fatalf("wrong length after restart: %d", length)
+	}
+	if !restoredOldest.Equal(oldest) {
+		t.Errorf("wrong time of the first attempt after restart: %v, want %v", restoredOldest, oldest)
+	}
+}
+
 func init() {
 	dontRecover = true
 }
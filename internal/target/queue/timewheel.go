@@ -70,6 +70,75 @@ func (tw *TimeWheel) Add(target time.Time, value interface{}) {
 	tw.updateNotify <- target
 }
 
+// Slots returns a snapshot of all scheduled slots.
+func (tw *TimeWheel) Slots() []TimeSlot {
+	tw.slotsLock.Lock()
+	defer tw.slotsLock.Unlock()
+
+	res := make([]TimeSlot, 0, tw.slots.Len())
+	for e := tw.slots.Front(); e != nil; e = e.Next() {
+		res = append(res, e.Value.(TimeSlot))
+	}
+	return res
+}
+
+// Remove removes the first slot with the value for which match returns true.
+//
+// It returns false if there is no such slot. The removed slot is guaranteed
+// to not be dispatched.
+func (tw *TimeWheel) Remove(match func(value interface{}) bool) (TimeSlot, bool) {
+	if atomic.LoadUint32(&tw.stopped) == 1 {
+		return TimeSlot{}, false
+	}
+
+	tw.slotsLock.Lock()
+	var removed TimeSlot
+	found := false
+	for e := tw.slots.Front(); e != nil; e = e.Next() {
+		slot := e.Value.(TimeSlot)
+		if match(slot.Value) {
+			tw.slots.Remove(e)
+			removed = slot
+			found = true
+			break
+		}
+	}
+	tw.slotsLock.Unlock()
+
+	if found {
+		// Make tick goroutine recalculate the closest slot.
+		tw.updateNotify <- time.Time{}
+	}
+	return removed, found
+}
+
+// Reschedule changes the dispatch time for all slots with values for which
+// match returns true.
+//
+// It returns the amount of changed slots.
+func (tw *TimeWheel) Reschedule(target time.Time, match func(value interface{}) bool) int {
+	if atomic.LoadUint32(&tw.stopped) == 1 {
+		return 0
+	}
+
+	tw.slotsLock.Lock()
+	count := 0
+	for e := tw.slots.Front(); e != nil; e = e.Next() {
+		slot := e.Value.(TimeSlot)
+		if match(slot.Value) {
+			slot.Time = target
+			e.Value = slot
+			count++
+		}
+	}
+	tw.slotsLock.Unlock()
+
+	if count != 0 {
+		tw.updateNotify <- time.Time{}
+	}
+	return count
+}
+
 func (tw *TimeWheel) Close() {
 	atomic.StoreUint32(&tw.stopped, 1)
 
@@ -120,11 +189,29 @@ func (tw *TimeWheel) tick() {
 		for {
 			select {
 			case <-timer.C:
+				// The slot might have been removed or rescheduled in the
+				// meantime, check whether it is still there.
 				tw.slotsLock.Lock()
-				tw.slots.Remove(closestEl)
+				present := false
+				for e := tw.slots.Front(); e != nil; e = e.Next() {
+					if e == closestEl {
+						present = true
+						break
+					}
+				}
+				if present {
+					closestSlot = closestEl.Value.(TimeSlot)
+					if closestSlot.Time.After(time.Now()) {
+						present = false
+					} else {
+						tw.slots.Remove(closestEl)
+					}
+				}
 				tw.slotsLock.Unlock()
 
-				tw.dispatch(closestSlot)
+				if present {
+					tw.dispatch(closestSlot)
+				}
 
 				break selectloop
 			case newTarget := <-tw.updateNotify:
@@ -125,3 +125,68 @@ func TestTimeWheelAdd_EmptyUpdWait(t *testing.T) {
 		t.Errorf("Wrong slot value: %v", slot.Value)
 	}
 }
+
+func TestTimeWheelRemove(t *testing.T) {
+	t.Parallel()
+
+	called := make(chan TimeSlot, 2)
+
+	w := NewTimeWheel(func(slot TimeSlot) {
+		called <- slot
+	})
+	defer w.Close()
+
+	w.Add(time.Now().Add(500*time.Millisecond), 1)
+	w.Add(time.Now().Add(750*time.Millisecond), 2)
+
+	_, ok := w.Remove(func(v interface{}) bool { return v.(int) == 1 })
+	if !ok {
+		t.Fatal("Slot not removed")
+	}
+	if _, ok := w.Remove(func(v interface{}) bool { return v.(int) == 3 }); ok {
+		t.Fatal("Non-existent slot removed")
+	}
+
+	slot := <-called
+	if val, _ := slot.Value.(int); val != 2 {
+		t.Errorf("Wrong slot value: %v", slot.Value)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if len(called) != 0 {
+		t.Fatal("Removed slot was dispatched")
+	}
+}
+
+func TestTimeWheelReschedule(t *testing.T) {
+	t.Parallel()
+
+	called := make(chan TimeSlot)
+
+	w := NewTimeWheel(func(slot TimeSlot) {
+		called <- slot
+	})
+	defer w.Close()
+
+	w.Add(time.Now().Add(time.Hour), 1)
+	w.Add(time.Now().Add(2*time.Hour), 2)
+
+	if c := w.Reschedule(time.Now(), func(v interface{}) bool { return v.(int) == 2 }); c != 1 {
+		t.Fatal("Wrong amount of rescheduled slots:", c)
+	}
+
+	timer := time.NewTimer(time.Second)
+	defer timer.Stop()
+	select {
+	case slot := <-called:
+		if val, _ := slot.Value.(int); val != 2 {
+			t.Errorf("Wrong slot value: %v", slot.Value)
+		}
+	case <-timer.C:
+		t.Fatal("Rescheduled slot was not dispatched")
+	}
+
+	if slots := w.Slots(); len(slots) != 1 || slots[0].Value.(int) != 1 {
+		t.Fatal("Wrong slots left:", slots)
+	}
+}
@@ -32,7 +32,9 @@ import (
 	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/tracing"
 	"github.com/foxcpp/maddy/internal/smtpconn"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type mxConn struct {
@@ -152,7 +154,12 @@ retry:
 	return tlsLevel, tlsErr, nil
 }
 
-func (rd *remoteDelivery) attemptMX(ctx context.Context, conn *mxConn, record *net.MX) error {
+func (rd *remoteDelivery) attemptMX(ctx context.Context, conn *mxConn, record *net.MX) (err error) {
+	ctx, span := tracing.Start(ctx, "remote MX attempt",
+		attribute.String("maddy.remote_server", record.Host),
+		attribute.String("maddy.domain", conn.domain))
+	defer func() { tracing.End(span, err) }()
+
 	mxLevel := module.MXNone
 
 	connCtx, cancel := context.WithCancel(ctx)
@@ -199,6 +206,10 @@ func (rd *remoteDelivery) attemptMX(ctx context.Context, conn *mxConn, record *n
 	mxLevelCnt.WithLabelValues(rd.rt.Name(), mxLevel.String()).Inc()
 	tlsLevelCnt.WithLabelValues(rd.rt.Name(), tlsLevel.String()).Inc()
 
+	span.SetAttributes(
+		attribute.String("maddy.mx_level", mxLevel.String()),
+		attribute.String("maddy.tls_level", tlsLevel.String()))
+
 	return nil
 }
 
@@ -18,7 +18,12 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
 package remote
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
 
 var mxLevelCnt = prometheus.NewCounterVec(
 	prometheus.CounterOpts{
@@ -40,7 +45,137 @@ var tlsLevelCnt = prometheus.NewCounterVec(
 	[]string{"module", "level"},
 )
 
+var deliveriesCnt = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "maddy",
+		Subsystem: "remote",
+		Name:      "deliveries",
+		Help:      "Outcome of delivery attempts for each recipient, domain is 'other' if it is not among the most active ones",
+	},
+	[]string{"module", "domain", "result"},
+)
+
+var deliveryDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "maddy",
+		Subsystem: "remote",
+		Name:      "delivery_duration_seconds",
+		Help:      "Time spent delivering the message to the destination domain, including connection establishment",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+	},
+	[]string{"module", "domain"},
+)
+
 func init() {
 	prometheus.MustRegister(mxLevelCnt)
 	prometheus.MustRegister(tlsLevelCnt)
+	prometheus.MustRegister(deliveriesCnt)
+	prometheus.MustRegister(deliveryDuration)
+}
+
+// topDomains bounds the cardinality of per-domain metrics by giving a separate
+// label value only to the N domains with most deliveries. Remaining domains
+// are reported as "other".
+//
+// Counts are halved periodically so the set of top domains follows changes
+// in traffic. Series created for domains that later dropped out of top N are
+// deleted.
+type topDomains struct {
+	lck     sync.Mutex
+	module  string
+	n       int
+	counts  map[string]uint64
+	top     map[string]struct{}
+	updates int
+}
+
+const (
+	topDomainsRecalcInterval = 100
+	// Amount of tracked domains (as a multiple of N) that triggers decay.
+	topDomainsMaxTracked = 20
+)
+
+// deliveryResults are the values of the result label of deliveriesCnt.
+var deliveryResults = []string{"delivered", "temporary_failure", "permanent_failure"}
+
+func newTopDomains(module string, n int) *topDomains {
+	return &topDomains{
+		module: module,
+		n:      n,
+		counts: make(map[string]uint64),
+		top:    make(map[string]struct{}, n),
+	}
+}
+
+// label records a delivery to the domain and returns the label value to use
+// for it.
+func (td *topDomains) label(domain string) string {
+	td.lck.Lock()
+	defer td.lck.Unlock()
+
+	if td.n <= 0 {
+		return "other"
+	}
+
+	td.counts[domain]++
+	td.updates++
+
+	if _, ok := td.top[domain]; !ok && len(td.top) < td.n {
+		td.top[domain] = struct{}{}
+	}
+	if td.updates%topDomainsRecalcInterval == 0 {
+		td.recalc()
+	}
+
+	if _, ok := td.top[domain]; ok {
+		return domain
+	}
+	return "other"
+}
+
+func (td *topDomains) recalc() {
+	if len(td.counts) > td.n*topDomainsMaxTracked {
+		for domain, cnt := range td.counts {
+			if cnt/2 == 0 {
+				delete(td.counts, domain)
+			} else {
+				td.counts[domain] = cnt / 2
+			}
+		}
+	}
+
+	domains := make([]string, 0, len(td.counts))
+	for domain := range td.counts {
+		domains = append(domains, domain)
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		ci, cj := td.counts[domains[i]], td.counts[domains[j]]
+		if ci != cj {
+			return ci > cj
+		}
+		return domains[i] < domains[j]
+	})
+	if len(domains) > td.n {
+		domains = domains[:td.n]
+	}
+
+	top := make(map[string]struct{}, td.n)
+	for _, domain := range domains {
+		top[domain] = struct{}{}
+	}
+	for domain := range td.top {
+		if _, ok := top[domain]; !ok {
+			td.deleteSeries(domain)
+		}
+	}
+	td.top = top
+}
+
+// deleteSeries removes metrics series for the domain that is no longer among
+// the top ones.
+func (td *topDomains) deleteSeries(domain string) {
+	for _, result := range deliveryResults {
+		deliveriesCnt.DeleteLabelValues(td.module, domain, result)
+	}
+	deliveryDuration.DeleteLabelValues(td.module, domain)
 }
@@ -0,0 +1,109 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestTopDomains(t *testing.T) {
+	td := newTopDomains("remote", 2)
+
+	check := func(domain, expected string) {
+		t.Helper()
+		if label := td.label(domain); label != expected {
+			t.Errorf("label(%s) = %s, want %s", domain, label, expected)
+		}
+	}
+
+	check("a.example", "a.example")
+	check("b.example", "b.example")
+	check("c.example", "other")
+	check("a.example", "a.example")
+
+	// c.example becomes more active than b.example and replaces it on the
+	// next recalculation.
+	for td.updates%topDomainsRecalcInterval != topDomainsRecalcInterval-1 {
+		td.label("c.example")
+	}
+	check("c.example", "c.example")
+	check("b.example", "other")
+	check("a.example", "a.example")
+}
+
+func TestTopDomains_Decay(t *testing.T) {
+	td := newTopDomains("remote", 1)
+	for i := 0; i < topDomainsRecalcInterval*10; i++ {
+		td.label("popular.example")
+		td.label("domain" + strconv.Itoa(i) + ".example")
+	}
+	if len(td.counts) > topDomainsRecalcInterval {
+		t.Fatalf("too many tracked domains: %d", len(td.counts))
+	}
+	if _, ok := td.top["popular.example"]; !ok || len(td.top) != 1 {
+		t.Fatalf("wrong top domains: %v", td.top)
+	}
+}
+
+func TestTopDomains_Disabled(t *testing.T) {
+	td := newTopDomains("remote", 0)
+	if label := td.label("example.org"); label != "other" {
+		t.Errorf("label = %s, want other", label)
+	}
+}
+
+func seriesCount(c prometheus.Collector) int {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+
+	cnt := 0
+	for range ch {
+		cnt++
+	}
+	return cnt
+}
+
+func TestTopDomains_DeleteSeries(t *testing.T) {
+	const n = 3
+	td := newTopDomains("test_top_domains", n)
+	baseCnt := seriesCount(deliveriesCnt)
+	baseDuration := seriesCount(deliveryDuration)
+
+	for i := 0; i < topDomainsRecalcInterval*20; i++ {
+		// Active domain changes every recalculation interval.
+		domain := "domain" + strconv.Itoa(i/topDomainsRecalcInterval) + ".example"
+		label := td.label(domain)
+		deliveriesCnt.WithLabelValues(td.module, label, "delivered").Inc()
+		deliveryDuration.WithLabelValues(td.module, label).Observe(1)
+
+		// Top domains and "other".
+		if cnt := seriesCount(deliveriesCnt) - baseCnt; cnt > n+1 {
+			t.Fatalf("too many deliveries series after %d deliveries: %d", i+1, cnt)
+		}
+		if cnt := seriesCount(deliveryDuration) - baseDuration; cnt > n+1 {
+			t.Fatalf("too many delivery_duration series after %d deliveries: %d", i+1, cnt)
+		}
+	}
+}
@@ -78,6 +78,8 @@ type Target struct {
 	pool           *pool.P
 	connReuseLimit int
 
+	metricsDomains *topDomains
+
 	Log log.Logger
 
 	connectTimeout    time.Duration
@@ -141,6 +143,8 @@ func (rt *Target) Init(cfg *config.Map) error {
 	cfg.Duration("connect_timeout", false, false, 5*time.Minute, &rt.connectTimeout)
 	cfg.Duration("command_timeout", false, false, 5*time.Minute, &rt.commandTimeout)
 	cfg.Duration("submission_timeout", false, false, 5*time.Minute, &rt.submissionTimeout)
+	var metricsDomains int
+	cfg.Int("metrics_domains", false, false, 25, &metricsDomains)
 
 	poolCfg := pool.Config{
 		MaxKeys:             5000,
@@ -155,6 +159,7 @@ func (rt *Target) Init(cfg *config.Map) error {
 		return err
 	}
 	rt.pool = pool.New(poolCfg)
+	rt.metricsDomains = newTopDomains(rt.Name(), metricsDomains)
 
 	// INTERNATIONALIZATION: See RFC 6531 Section 3.7.1.
 	rt.hostname, err = idna.ToASCII(rt.hostname)
@@ -207,6 +212,10 @@ type remoteDelivery struct {
 	recipients  []string
 	connections map[string]*mxConn
 
+	// Per-domain metrics state, see domainMetrics.
+	domainLabels map[string]string
+	domainStart  map[string]time.Time
+
 	policies []module.DeliveryMXAuthPolicy
 }
 
@@ -267,6 +276,9 @@ func (rt *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFr
 		Log:         target.DeliveryLogger(rt.Log, msgMeta),
 		connections: map[string]*mxConn{},
 		policies:    policies,
+
+		domainLabels: map[string]string{},
+		domainStart:  map[string]time.Time{},
 	}, nil
 }
 
@@ -307,13 +319,18 @@ func (rd *remoteDelivery) AddRcpt(ctx context.Context, to string, opts smtp.Rcpt
 		}
 	}
 
+	rd.startDomainMetrics(domain)
+
 	conn, err := rd.connectionForDomain(ctx, domain)
 	if err != nil {
+		rd.countDelivery(domain, err)
 		return err
 	}
 
 	if err := conn.Rcpt(ctx, to, opts); err != nil {
-		return moduleError(err)
+		err = moduleError(err)
+		rd.countDelivery(domain, err)
+		return err
 	}
 	conn.lastUseAt = time.Now()
 
@@ -424,7 +441,10 @@ func (rd *remoteDelivery) BodyNonAtomic(ctx context.Context, c module.StatusColl
 			err = conn.Data(ctx, header, bodyR)
 			for _, rcpt := range conn.Rcpts() {
 				c.SetStatus(rcpt, err)
+				rd.countDelivery(conn.domain, err)
 			}
+			deliveryDuration.WithLabelValues(rd.rt.Name(), rd.domainLabels[conn.domain]).
+				Observe(time.Since(rd.domainStart[conn.domain]).Seconds())
 			rd.connections[i].errored = err != nil
 			conn.lastUseAt = time.Now()
 		}()
@@ -433,6 +453,28 @@ func (rd *remoteDelivery) BodyNonAtomic(ctx context.Context, c module.StatusColl
 	wg.Wait()
 }
 
+// startDomainMetrics records the start of delivery to the domain and picks
+// the label value to use for it in metrics.
+func (rd *remoteDelivery) startDomainMetrics(domain string) {
+	if _, ok := rd.domainLabels[domain]; ok {
+		return
+	}
+	rd.domainLabels[domain] = rd.rt.metricsDomains.label(domain)
+	rd.domainStart[domain] = time.Now()
+}
+
+func (rd *remoteDelivery) countDelivery(domain string, err error) {
+	result := "delivered"
+	if err != nil {
+		if exterrors.IsTemporaryOrUnspec(err) {
+			result = "temporary_failure"
+		} else {
+			result = "permanent_failure"
+		}
+	}
+	deliveriesCnt.WithLabelValues(rd.rt.Name(), rd.domainLabels[domain], result).Inc()
+}
+
 func (rd *remoteDelivery) Abort(ctx context.Context) error {
 	return rd.Close()
 }
@@ -67,6 +67,7 @@ func testTarget(t *testing.T, zones map[string]mockdns.Zone, extResolver *dns.Ex
 			MaxConnLifetimeSec:  150,    // 2.5 mins, half of recommended idle time from RFC 5321
 			StaleKeyLifetimeSec: 60 * 5, // should be bigger than MaxConnLifetimeSec
 		}),
+		metricsDomains: newTopDomains("remote", 25),
 	}
 
 	return &tgt
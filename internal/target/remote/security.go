@@ -84,8 +84,10 @@ func (c *mtastsPolicy) Init(cfg *config.Map) error {
 
 	switch storeType {
 	case "fs":
-		if err := os.MkdirAll(storeDir, os.ModePerm); err != nil {
-			return err
+		if !module.DryRun {
+			if err := os.MkdirAll(storeDir, os.ModePerm); err != nil {
+				return err
+			}
 		}
 		c.cache = mtasts.NewFSCache(storeDir)
 	case "ram":
@@ -0,0 +1,162 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp_downstream
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	selectFailover   = "failover"
+	selectRoundRobin = "round_robin"
+)
+
+type targetHealth struct {
+	failures  int
+	downUntil time.Time
+}
+
+// balancer decides in which order configured targets should be tried and
+// keeps track of their health.
+//
+// Health tracking is passive: after maxFailures consecutive connection
+// failures the target is considered down and is tried only after all healthy
+// targets for the cooldown period. Once the cooldown expires, the next
+// connection attempt decides whether the target is back. A single successful
+// connection resets the failure counter.
+//
+// Zero value is usable and corresponds to the "failover" mode without health
+// tracking.
+type balancer struct {
+	mode        string
+	maxFailures int
+	cooldown    time.Duration
+
+	// now is replaced in tests.
+	now func() time.Time
+
+	lock   sync.Mutex
+	next   int
+	health []targetHealth
+}
+
+func (b *balancer) timeNow() time.Time {
+	if b.now == nil {
+		return time.Now()
+	}
+	return b.now()
+}
+
+func (b *balancer) ensureHealth(count int) {
+	if len(b.health) != count {
+		b.health = make([]targetHealth, count)
+	}
+}
+
+// order returns indexes of count targets in the order they should be tried.
+//
+// Targets that are down are never excluded completely, they are just moved to
+// the end of the list (the ones that will recover sooner go first) so
+// messages are not rejected when all targets are marked down.
+func (b *balancer) order(count int) []int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.ensureHealth(count)
+
+	start := 0
+	if b.mode == selectRoundRobin && count != 0 {
+		start = b.next % count
+		b.next = (b.next + 1) % count
+	}
+
+	now := b.timeNow()
+	healthy := make([]int, 0, count)
+	var down []int
+	for i := 0; i < count; i++ {
+		indx := (start + i) % count
+		if b.maxFailures > 0 && now.Before(b.health[indx].downUntil) {
+			down = append(down, indx)
+			continue
+		}
+		healthy = append(healthy, indx)
+	}
+
+	sort.SliceStable(down, func(i, j int) bool {
+		return b.health[down[i]].downUntil.Before(b.health[down[j]].downUntil)
+	})
+
+	return append(healthy, down...)
+}
+
+// success resets the failure counter for the target.
+//
+// It returns true if target was considered down before.
+func (b *balancer) success(indx int) (wasDown bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if indx >= len(b.health) {
+		return false
+	}
+
+	h := &b.health[indx]
+	wasDown = b.maxFailures > 0 && h.failures >= b.maxFailures
+	h.failures = 0
+	h.downUntil = time.Time{}
+	return wasDown
+}
+
+// failure records the failed connection attempt.
+//
+// It returns true if target is marked down as a result.
+func (b *balancer) failure(indx int) (markedDown bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.maxFailures <= 0 || indx >= len(b.health) {
+		return false
+	}
+
+	h := &b.health[indx]
+	h.failures++
+	if h.failures >= b.maxFailures {
+		h.downUntil = b.timeNow().Add(b.cooldown)
+		return true
+	}
+	return false
+}
+
+// downCount returns the amount of targets that are currently considered down.
+func (b *balancer) downCount() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.maxFailures <= 0 {
+		return 0
+	}
+
+	now := b.timeNow()
+	count := 0
+	for _, h := range b.health {
+		if now.Before(h.downUntil) {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,199 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp_downstream
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestBalancer_Failover(t *testing.T) {
+	now := time.Now()
+	b := balancer{
+		mode:        selectFailover,
+		maxFailures: 2,
+		cooldown:    time.Minute,
+		now:         func() time.Time { return now },
+	}
+
+	check := func(expected ...int) {
+		t.Helper()
+		if order := b.order(3); !reflect.DeepEqual(order, expected) {
+			t.Errorf("Wrong order: %v, expected %v", order, expected)
+		}
+	}
+
+	check(0, 1, 2)
+	if b.failure(0) {
+		t.Error("Target marked down after the first failure")
+	}
+	check(0, 1, 2)
+	if !b.failure(0) {
+		t.Error("Target is not marked down after max_failures")
+	}
+	check(1, 2, 0)
+
+	now = now.Add(30 * time.Second)
+	b.failure(1)
+	b.failure(1)
+	// Both are down, 0 goes first since it will recover sooner.
+	check(2, 0, 1)
+
+	now = now.Add(31 * time.Second)
+	// Cooldown for 0 expired, it is tried again.
+	check(0, 2, 1)
+	if !b.failure(0) {
+		t.Error("Target is not marked down after failure following cooldown")
+	}
+	check(2, 1, 0)
+
+	if !b.success(0) {
+		t.Error("success should report that target was down")
+	}
+	check(0, 2, 1)
+}
+
+func TestBalancer_RoundRobin(t *testing.T) {
+	b := balancer{
+		mode:        selectRoundRobin,
+		maxFailures: 1,
+		cooldown:    time.Minute,
+	}
+
+	check := func(expected ...int) {
+		t.Helper()
+		if order := b.order(3); !reflect.DeepEqual(order, expected) {
+			t.Errorf("Wrong order: %v, expected %v", order, expected)
+		}
+	}
+
+	check(0, 1, 2)
+	check(1, 2, 0)
+	b.failure(2)
+	check(0, 1, 2)
+	check(0, 1, 2)
+	check(1, 0, 2)
+}
+
+func TestBalancer_NoHealthTracking(t *testing.T) {
+	var b balancer
+	for i := 0; i < 5; i++ {
+		if b.failure(0) {
+			t.Fatal("Target marked down with health tracking disabled")
+		}
+	}
+	if order := b.order(2); !reflect.DeepEqual(order, []int{0, 1}) {
+		t.Errorf("Wrong order: %v", order)
+	}
+}
+
+func TestDownstreamDelivery_RoundRobin(t *testing.T) {
+	be1, srv1 := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv1.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv1)
+	be2, srv2 := testutils.SMTPServer(t, "127.0.0.2:"+testPort)
+	defer srv2.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv2)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.2",
+				Port:   testPort,
+			},
+		},
+		balancer: balancer{mode: selectRoundRobin},
+		log:      testutils.Logger(t, "target.smtp"),
+	}
+
+	for i := 0; i < 4; i++ {
+		testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	}
+	if len(be1.Messages) != 2 || len(be2.Messages) != 2 {
+		t.Errorf("Messages are not distributed evenly: %d, %d", len(be1.Messages), len(be2.Messages))
+	}
+}
+
+func TestDownstreamDelivery_MarkDown(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.2:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.2",
+				Port:   testPort,
+			},
+		},
+		balancer: balancer{mode: selectFailover, maxFailures: 1, cooldown: time.Hour},
+		log:      testutils.Logger(t, "target.smtp"),
+	}
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	be.CheckMsg(t, 1, "test@example.invalid", []string{"rcpt@example.invalid"})
+
+	// The first target should be skipped after it was marked down.
+	if order := mod.balancer.order(2); !reflect.DeepEqual(order, []int{1, 0}) {
+		t.Errorf("Wrong order: %v", order)
+	}
+}
+
+func TestBalancer_DownCount(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := balancer{
+		maxFailures: 1,
+		cooldown:    time.Minute,
+		now:         func() time.Time { return now },
+	}
+	b.order(2)
+
+	b.failure(0)
+	if c := b.downCount(); c != 1 {
+		t.Fatal("Wrong down count:", c)
+	}
+	b.failure(1)
+	if c := b.downCount(); c != 2 {
+		t.Fatal("Wrong down count:", c)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if c := b.downCount(); c != 0 {
+		t.Fatal("Wrong down count after cooldown:", c)
+	}
+}
@@ -0,0 +1,47 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp_downstream
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	connAttempts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "downstream",
+			Name:      "conn_attempts",
+			Help:      "Connection attempts to downstream targets",
+		},
+		[]string{"module", "target", "result"},
+	)
+	targetUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "maddy",
+			Subsystem: "downstream",
+			Name:      "target_up",
+			Help:      "Whether the downstream target is considered healthy (1) or down (0)",
+		},
+		[]string{"module", "target"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(connAttempts)
+	prometheus.MustRegister(targetUp)
+}
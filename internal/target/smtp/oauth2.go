@@ -0,0 +1,258 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp_downstream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const xoauth2 = "XOAUTH2"
+
+// oauth2TokenSource obtains access tokens from the OAuth 2.0 token endpoint
+// using the refresh token grant (RFC 6749 Section 6) and caches them until
+// shortly before their expiry.
+type oauth2TokenSource struct {
+	endpoint      string
+	clientID      string
+	clientSecret  string
+	scope         string
+	refreshBefore time.Duration
+	client        *http.Client
+
+	// now is replaced in tests.
+	now func() time.Time
+
+	lock         sync.Mutex
+	refreshToken string
+	accessToken  string
+	expiry       time.Time
+}
+
+type oauth2TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Token returns the cached access token or requests a new one if there is no
+// cached token or it is about to expire.
+func (s *oauth2TokenSource) Token(ctx context.Context) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.accessToken != "" && (s.expiry.IsZero() || s.now().Add(s.refreshBefore).Before(s.expiry)) {
+		return s.accessToken, nil
+	}
+
+	if err := s.refresh(ctx); err != nil {
+		return "", err
+	}
+	return s.accessToken, nil
+}
+
+// Invalidate drops the cached access token so the next Token call will
+// request a new one. It is used when the server rejects the token.
+func (s *oauth2TokenSource) Invalidate() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.accessToken = ""
+	s.expiry = time.Time{}
+}
+
+func (s *oauth2TokenSource) refresh(ctx context.Context) error {
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", s.refreshToken)
+	form.Set("client_id", s.clientID)
+	if s.clientSecret != "" {
+		form.Set("client_secret", s.clientSecret)
+	}
+	if s.scope != "" {
+		form.Set("scope", s.scope)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	start := s.now()
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("oauth2: token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("oauth2: token request failed: %w", err)
+	}
+
+	var tokenResp oauth2TokenResponse
+	if err := json.Unmarshal(body, &tokenResp); err != nil {
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("oauth2: token endpoint returned status %d", resp.StatusCode)
+		}
+		return fmt.Errorf("oauth2: malformed token response: %w", err)
+	}
+	if resp.StatusCode/100 != 2 || tokenResp.Error != "" {
+		if tokenResp.Error == "" {
+			return fmt.Errorf("oauth2: token endpoint returned status %d", resp.StatusCode)
+		}
+		if tokenResp.ErrorDescription != "" {
+			return fmt.Errorf("oauth2: token endpoint returned error: %s (%s)", tokenResp.Error, tokenResp.ErrorDescription)
+		}
+		return fmt.Errorf("oauth2: token endpoint returned error: %s", tokenResp.Error)
+	}
+	if tokenResp.AccessToken == "" {
+		return errors.New("oauth2: token endpoint returned no access token")
+	}
+	if tokenResp.TokenType != "" && !strings.EqualFold(tokenResp.TokenType, "bearer") {
+		return fmt.Errorf("oauth2: unsupported token type: %s", tokenResp.TokenType)
+	}
+
+	s.accessToken = tokenResp.AccessToken
+	s.expiry = time.Time{}
+	if tokenResp.ExpiresIn > 0 {
+		s.expiry = start.Add(time.Duration(tokenResp.ExpiresIn) * time.Second)
+	}
+	// Some providers rotate refresh tokens on each use.
+	if tokenResp.RefreshToken != "" {
+		s.refreshToken = tokenResp.RefreshToken
+	}
+	return nil
+}
+
+// xoauth2Client implements the XOAUTH2 SASL mechanism used by Google and
+// Microsoft.
+//
+// See https://developers.google.com/gmail/imap/xoauth2-protocol.
+type xoauth2Client struct {
+	username string
+	token    string
+}
+
+func (c *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	return xoauth2, []byte("user=" + c.username + "\x01auth=Bearer " + c.token + "\x01\x01"), nil
+}
+
+func (c *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	// Server sends a JSON-encoded error as a challenge and expects an empty
+	// response, after that the authentication fails with a proper SMTP error.
+	return []byte{}, nil
+}
+
+// invalidatingClient drops the cached token if the server sends any
+// challenge for OAuth mechanisms since it indicates authentication failure.
+type invalidatingClient struct {
+	sasl.Client
+	src *oauth2TokenSource
+}
+
+func (c invalidatingClient) Next(challenge []byte) ([]byte, error) {
+	c.src.Invalidate()
+	return c.Client.Next(challenge)
+}
+
+func oauth2AuthBlock(node config.Node) (interface{}, error) {
+	src := &oauth2TokenSource{
+		now: time.Now,
+	}
+	var (
+		username   string
+		mechanism  string
+		reqTimeout time.Duration
+	)
+
+	childM := config.NewMap(nil, node)
+	childM.String("token_endpoint", false, true, "", &src.endpoint)
+	childM.String("client_id", false, true, "", &src.clientID)
+	childM.String("client_secret", false, false, "", &src.clientSecret)
+	childM.String("refresh_token", false, true, "", &src.refreshToken)
+	childM.String("scope", false, false, "", &src.scope)
+	childM.String("username", false, true, "", &username)
+	childM.Enum("mechanism", false, false, []string{"xoauth2", "oauthbearer"}, "xoauth2", &mechanism)
+	childM.Duration("refresh_before", false, false, 1*time.Minute, &src.refreshBefore)
+	childM.Duration("request_timeout", false, false, 30*time.Second, &reqTimeout)
+	if _, err := childM.Process(); err != nil {
+		return nil, err
+	}
+
+	endpURL, err := url.Parse(src.endpoint)
+	if err != nil {
+		return nil, config.NodeErr(node, "malformed token_endpoint: %v", err)
+	}
+	if endpURL.Scheme != "https" && endpURL.Scheme != "http" {
+		return nil, config.NodeErr(node, "token_endpoint should be a http:// or https:// URL")
+	}
+
+	src.client = &http.Client{Timeout: reqTimeout}
+
+	return saslClientFactory(func(*module.MsgMetadata) (sasl.Client, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), reqTimeout)
+		defer cancel()
+
+		token, err := src.Token(ctx)
+		if err != nil {
+			return nil, &exterrors.SMTPError{
+				Code:         454,
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+				Message:      "Unable to authenticate to the remote server",
+				TargetName:   "target.smtp",
+				Err:          err,
+			}
+		}
+
+		switch mechanism {
+		case "oauthbearer":
+			return invalidatingClient{
+				Client: sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+					Username: username,
+					Token:    token,
+				}),
+				src: src,
+			}, nil
+		default:
+			return invalidatingClient{
+				Client: &xoauth2Client{username: username, token: token},
+				src:    src,
+			}, nil
+		}
+	}), nil
+}
@@ -0,0 +1,278 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp_downstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// testTokenEndpoint starts a stand-in for the OAuth2 token endpoint that
+// issues tokens "token1", "token2", ... for the refresh token "refresh".
+func testTokenEndpoint(t *testing.T, expiresIn int) (*httptest.Server, *int32) {
+	var counter int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.PostForm.Get("grant_type") != "refresh_token" ||
+			r.PostForm.Get("refresh_token") != "refresh" ||
+			r.PostForm.Get("client_id") != "client" ||
+			r.PostForm.Get("client_secret") != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		n := atomic.AddInt32(&counter, 1)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "token" + strconv.Itoa(int(n)),
+			"token_type":   "Bearer",
+			"expires_in":   expiresIn,
+		})
+	}))
+	return srv, &counter
+}
+
+func testOAuth2Factory(t *testing.T, endpoint, mechanism string) saslClientFactory {
+	factory, err := saslAuthDirective(&config.Map{}, config.Node{
+		Name: "auth",
+		Args: []string{"oauth2"},
+		Children: []config.Node{
+			{Name: "token_endpoint", Args: []string{endpoint}},
+			{Name: "client_id", Args: []string{"client"}},
+			{Name: "client_secret", Args: []string{"secret"}},
+			{Name: "refresh_token", Args: []string{"refresh"}},
+			{Name: "username", Args: []string{"test@example.invalid"}},
+			{Name: "mechanism", Args: []string{mechanism}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return factory.(saslClientFactory)
+}
+
+type xoauth2Server struct {
+	conn *smtp.Conn
+	done bool
+}
+
+func (s *xoauth2Server) Next(response []byte) ([]byte, bool, error) {
+	if s.done {
+		return nil, true, errors.New("authentication failed")
+	}
+	s.done = true
+
+	// user=USER\x01auth=Bearer TOKEN\x01\x01
+	parts := bytes.Split(response, []byte{0x01})
+	if len(parts) != 4 || !bytes.HasPrefix(parts[0], []byte("user=")) || !bytes.HasPrefix(parts[1], []byte("auth=Bearer ")) {
+		return nil, true, errors.New("malformed response")
+	}
+	user := string(bytes.TrimPrefix(parts[0], []byte("user=")))
+	token := string(bytes.TrimPrefix(parts[1], []byte("auth=Bearer ")))
+	if err := s.conn.Session().AuthPlain(user, token); err != nil {
+		return []byte(`{"status":"401"}`), false, nil
+	}
+	return nil, true, nil
+}
+
+func enableOAuth(s *smtp.Server) {
+	s.EnableAuth(xoauth2, func(conn *smtp.Conn) sasl.Server {
+		return &xoauth2Server{conn: conn}
+	})
+	s.EnableAuth(sasl.OAuthBearer, func(conn *smtp.Conn) sasl.Server {
+		return sasl.NewOAuthBearerServer(func(opts sasl.OAuthBearerOptions) *sasl.OAuthBearerError {
+			if err := conn.Session().AuthPlain(opts.Username, opts.Token); err != nil {
+				return &sasl.OAuthBearerError{Status: "invalid_token", Schemes: "bearer"}
+			}
+			return nil
+		})
+	})
+}
+
+func testOAuth2Delivery(t *testing.T, mechanism string) {
+	tokenSrv, counter := testTokenEndpoint(t, 3600)
+	defer tokenSrv.Close()
+
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort, enableOAuth)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		saslFactory: testOAuth2Factory(t, tokenSrv.URL, mechanism),
+		log:         testutils.Logger(t, "target.smtp"),
+	}
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+	for i, msg := range be.Messages {
+		if msg.AuthUser != "test@example.invalid" {
+			t.Errorf("Wrong AuthUser for message %d: %v", i, msg.AuthUser)
+		}
+		if msg.AuthPass != "token1" {
+			t.Errorf("Wrong token for message %d: %v", i, msg.AuthPass)
+		}
+	}
+	if n := atomic.LoadInt32(counter); n != 1 {
+		t.Errorf("Expected 1 token request, got %d", n)
+	}
+}
+
+func TestSASL_OAuth2_XOAUTH2(t *testing.T) {
+	testOAuth2Delivery(t, "xoauth2")
+}
+
+func TestSASL_OAuth2_OAUTHBEARER(t *testing.T) {
+	testOAuth2Delivery(t, "oauthbearer")
+}
+
+func TestSASL_OAuth2_AuthFail(t *testing.T) {
+	tokenSrv, counter := testTokenEndpoint(t, 3600)
+	defer tokenSrv.Close()
+
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort, enableOAuth)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	be.AuthErr = &smtp.SMTPError{
+		Code:         535,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 8},
+		Message:      "Hey",
+	}
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		saslFactory: testOAuth2Factory(t, tokenSrv.URL, "xoauth2"),
+		log:         testutils.Logger(t, "target.smtp"),
+	}
+
+	_, err := testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if err == nil {
+		t.Error("Expected an error, got none")
+	}
+
+	// Rejected token should not be reused.
+	_, err = testutils.DoTestDeliveryErr(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	if err == nil {
+		t.Error("Expected an error, got none")
+	}
+	if n := atomic.LoadInt32(counter); n != 2 {
+		t.Errorf("Expected 2 token requests, got %d", n)
+	}
+}
+
+func TestSASL_OAuth2_TokenEndpointFail(t *testing.T) {
+	tokenSrv, _ := testTokenEndpoint(t, 3600)
+	defer tokenSrv.Close()
+
+	factory, err := saslAuthDirective(&config.Map{}, config.Node{
+		Name: "auth",
+		Args: []string{"oauth2"},
+		Children: []config.Node{
+			{Name: "token_endpoint", Args: []string{tokenSrv.URL}},
+			{Name: "client_id", Args: []string{"client"}},
+			{Name: "client_secret", Args: []string{"secret"}},
+			{Name: "refresh_token", Args: []string{"revoked"}},
+			{Name: "username", Args: []string{"test@example.invalid"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = factory.(saslClientFactory)(nil)
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	var smtpErr interface{ Temporary() bool }
+	if !errors.As(err, &smtpErr) || !smtpErr.Temporary() {
+		t.Errorf("Expected a temporary error, got %v", err)
+	}
+}
+
+func TestOAuth2TokenSource_Refresh(t *testing.T) {
+	tokenSrv, counter := testTokenEndpoint(t, 600)
+	defer tokenSrv.Close()
+
+	now := time.Now()
+	src := &oauth2TokenSource{
+		endpoint:      tokenSrv.URL,
+		clientID:      "client",
+		clientSecret:  "secret",
+		refreshToken:  "refresh",
+		refreshBefore: time.Minute,
+		client:        tokenSrv.Client(),
+		now:           func() time.Time { return now },
+	}
+
+	check := func(expected string) {
+		t.Helper()
+		token, err := src.Token(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != expected {
+			t.Errorf("Expected %s, got %s", expected, token)
+		}
+	}
+
+	check("token1")
+	now = now.Add(5 * time.Minute)
+	check("token1")
+	// Within refresh_before of the expiry time.
+	now = now.Add(4*time.Minute + 30*time.Second)
+	check("token2")
+	src.Invalidate()
+	check("token3")
+
+	if n := atomic.LoadInt32(counter); n != 3 {
+		t.Errorf("Expected 3 token requests, got %d", n)
+	}
+}
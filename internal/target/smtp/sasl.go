@@ -32,12 +32,12 @@ type saslClientFactory = func(msgMeta *module.MsgMetadata) (sasl.Client, error)
 //
 // Authentication information of the current client should be passed in arguments.
 func saslAuthDirective(_ *config.Map, node config.Node) (interface{}, error) {
-	if len(node.Children) != 0 {
-		return nil, config.NodeErr(node, "can't declare a block here")
-	}
 	if len(node.Args) == 0 {
 		return nil, config.NodeErr(node, "at least one argument required")
 	}
+	if len(node.Children) != 0 && node.Args[0] != "oauth2" {
+		return nil, config.NodeErr(node, "can't declare a block here")
+	}
 	switch node.Args[0] {
 	case "off":
 		return nil, nil
@@ -71,6 +71,11 @@ func saslAuthDirective(_ *config.Map, node config.Node) (interface{}, error) {
 		return func(*module.MsgMetadata) (sasl.Client, error) {
 			return sasl.NewExternalClient(""), nil
 		}, nil
+	case "oauth2":
+		if len(node.Args) > 1 {
+			return nil, config.NodeErr(node, "no additional arguments required")
+		}
+		return oauth2AuthBlock(node)
 	default:
 		return nil, config.NodeErr(node, "unknown authentication mechanism: %s", node.Args[0])
 	}
@@ -65,6 +65,8 @@ type Downstream struct {
 	commandTimeout    time.Duration
 	submissionTimeout time.Duration
 
+	balancer balancer
+
 	log log.Logger
 }
 
@@ -104,6 +106,9 @@ func (u *Downstream) Init(cfg *config.Map) error {
 	cfg.Duration("connect_timeout", false, false, 5*time.Minute, &u.connectTimeout)
 	cfg.Duration("command_timeout", false, false, 5*time.Minute, &u.commandTimeout)
 	cfg.Duration("submission_timeout", false, false, 5*time.Minute, &u.submissionTimeout)
+	cfg.Enum("selection", false, false, []string{selectFailover, selectRoundRobin}, selectFailover, &u.balancer.mode)
+	cfg.Int("max_failures", false, false, 3, &u.balancer.maxFailures)
+	cfg.Duration("failure_cooldown", false, false, 1*time.Minute, &u.balancer.cooldown)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
@@ -129,6 +134,13 @@ func (u *Downstream) Init(cfg *config.Map) error {
 	if len(u.endpoints) == 0 {
 		return fmt.Errorf("%s: at least one target endpoint is required", u.modName)
 	}
+	if u.balancer.maxFailures < 0 {
+		return fmt.Errorf("%s: max_failures should not be negative", u.modName)
+	}
+
+	for _, endp := range u.endpoints {
+		targetUp.WithLabelValues(u.modName, endp.String()).Set(1)
+	}
 
 	return nil
 }
@@ -141,6 +153,30 @@ func (u *Downstream) InstanceName() string {
 	return u.instName
 }
 
+// CheckHealth reports an error if all configured targets are marked down.
+func (u *Downstream) CheckHealth(_ context.Context) error {
+	if len(u.endpoints) != 0 && u.balancer.downCount() == len(u.endpoints) {
+		return errors.New("all targets are marked down")
+	}
+	return nil
+}
+
+func (u *Downstream) targetFailed(endp config.Endpoint, indx int) {
+	connAttempts.WithLabelValues(u.modName, endp.String(), "failed").Inc()
+	if u.balancer.failure(indx) {
+		u.log.Msg("target is marked down", "downstream_server", endp.String(), "cooldown", u.balancer.cooldown)
+		targetUp.WithLabelValues(u.modName, endp.String()).Set(0)
+	}
+}
+
+func (u *Downstream) targetSucceeded(endp config.Endpoint, indx int) {
+	connAttempts.WithLabelValues(u.modName, endp.String(), "ok").Inc()
+	if u.balancer.success(indx) {
+		u.log.Msg("target is up again", "downstream_server", endp.String())
+		targetUp.WithLabelValues(u.modName, endp.String()).Set(1)
+	}
+}
+
 type delivery struct {
 	u   *Downstream
 	log log.Logger
@@ -200,7 +236,8 @@ func (d *delivery) connect(ctx context.Context) error {
 		conn.SubmissionTimeout = d.u.submissionTimeout
 	}
 
-	for _, endp := range d.u.endpoints {
+	for _, indx := range d.u.balancer.order(len(d.u.endpoints)) {
+		endp := d.u.endpoints[indx]
 		var (
 			didTLS bool
 			err    error
@@ -214,6 +251,7 @@ func (d *delivery) connect(ctx context.Context) error {
 			if len(d.u.endpoints) != 1 {
 				d.log.Msg("connect error", err, "downstream_server", net.JoinHostPort(endp.Host, endp.Port))
 			}
+			d.u.targetFailed(endp, indx)
 			lastErr = err
 			continue
 		}
@@ -222,10 +260,12 @@ func (d *delivery) connect(ctx context.Context) error {
 
 		if !didTLS && d.u.requireTLS {
 			conn.Close()
+			d.u.targetFailed(endp, indx)
 			lastErr = errors.New("TLS is required, but unsupported by downstream")
 			continue
 		}
 
+		d.u.targetSucceeded(endp, indx)
 		lastErr = nil
 		break
 	}
@@ -21,12 +21,12 @@ package maddy
 import (
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
 	"runtime/debug"
+	"strings"
 
 	"github.com/caddyserver/certmagic"
 	parser "github.com/foxcpp/maddy/framework/cfgparser"
@@ -44,6 +44,7 @@ import (
 	_ "github.com/foxcpp/maddy/internal/auth/dovecot_sasl"
 	_ "github.com/foxcpp/maddy/internal/auth/external"
 	_ "github.com/foxcpp/maddy/internal/auth/ldap"
+	_ "github.com/foxcpp/maddy/internal/auth/lockout"
 	_ "github.com/foxcpp/maddy/internal/auth/netauth"
 	_ "github.com/foxcpp/maddy/internal/auth/pam"
 	_ "github.com/foxcpp/maddy/internal/auth/pass_table"
@@ -58,19 +59,26 @@ import (
 	_ "github.com/foxcpp/maddy/internal/check/requiretls"
 	_ "github.com/foxcpp/maddy/internal/check/rspamd"
 	_ "github.com/foxcpp/maddy/internal/check/spf"
+	_ "github.com/foxcpp/maddy/internal/endpoint/admin"
 	_ "github.com/foxcpp/maddy/internal/endpoint/dovecot_sasld"
 	_ "github.com/foxcpp/maddy/internal/endpoint/imap"
 	_ "github.com/foxcpp/maddy/internal/endpoint/openmetrics"
 	_ "github.com/foxcpp/maddy/internal/endpoint/smtp"
 	_ "github.com/foxcpp/maddy/internal/imap_filter"
 	_ "github.com/foxcpp/maddy/internal/imap_filter/command"
+	_ "github.com/foxcpp/maddy/internal/imap_trainer/command"
+	_ "github.com/foxcpp/maddy/internal/imap_trainer/webhook"
 	_ "github.com/foxcpp/maddy/internal/libdns"
 	_ "github.com/foxcpp/maddy/internal/modify"
 	_ "github.com/foxcpp/maddy/internal/modify/dkim"
+	_ "github.com/foxcpp/maddy/internal/storage/blob/encrypted"
 	_ "github.com/foxcpp/maddy/internal/storage/blob/fs"
 	_ "github.com/foxcpp/maddy/internal/storage/blob/s3"
 	_ "github.com/foxcpp/maddy/internal/storage/imapsql"
 	_ "github.com/foxcpp/maddy/internal/table"
+	_ "github.com/foxcpp/maddy/internal/target/http"
+	_ "github.com/foxcpp/maddy/internal/target/maildir"
+	_ "github.com/foxcpp/maddy/internal/target/pipe"
 	_ "github.com/foxcpp/maddy/internal/target/queue"
 	_ "github.com/foxcpp/maddy/internal/target/remote"
 	_ "github.com/foxcpp/maddy/internal/target/smtp"
@@ -189,7 +197,15 @@ func Run(c *cli.Context) error {
 
 	os.Setenv("PATH", config.LibexecDirectory+string(filepath.ListSeparator)+os.Getenv("PATH"))
 
-	f, err := os.Open(c.Path("config"))
+	// Path should be absolute since it is used to reload the configuration
+	// after the working directory is changed.
+	cfgPath, err := filepath.Abs(c.Path("config"))
+	if err != nil {
+		systemdStatusErr(err)
+		return cli.Exit(err.Error(), 2)
+	}
+
+	f, err := os.Open(cfgPath)
 	if err != nil {
 		systemdStatusErr(err)
 		return cli.Exit(err.Error(), 2)
@@ -204,7 +220,7 @@ func Run(c *cli.Context) error {
 
 	defer log.DefaultLogger.Out.Close()
 
-	if err := moduleMain(cfg); err != nil {
+	if err := moduleMain(cfgPath, cfg); err != nil {
 		systemdStatusErr(err)
 		return cli.Exit(err.Error(), 1)
 	}
@@ -246,11 +262,13 @@ func InitDirs() error {
 		config.LibexecDirectory = DefaultLibexecDirectory
 	}
 
-	if err := ensureDirectoryWritable(config.StateDirectory); err != nil {
-		return err
-	}
-	if err := ensureDirectoryWritable(config.RuntimeDirectory); err != nil {
-		return err
+	if !module.DryRun {
+		if err := ensureDirectoryWritable(config.StateDirectory); err != nil {
+			return err
+		}
+		if err := ensureDirectoryWritable(config.RuntimeDirectory); err != nil {
+			return err
+		}
 	}
 
 	// Make sure all paths we are going to use are absolute
@@ -267,7 +285,7 @@ func InitDirs() error {
 
 	// Change the working directory to make all relative paths
 	// in configuration relative to state directory.
-	if err := os.Chdir(config.StateDirectory); err != nil {
+	if err := os.Chdir(config.StateDirectory); err != nil && !module.DryRun {
 		log.Println(err)
 	}
 
@@ -300,6 +318,8 @@ func ReadGlobals(cfg []config.Node) (map[string]interface{}, []config.Node, erro
 	globals.StringList("auth_domains", false, false, nil, nil)
 	globals.Custom("log", false, false, defaultLogOutput, logOutput, &log.DefaultLogger.Out)
 	globals.Bool("debug", false, log.DefaultLogger.Debug, &log.DefaultLogger.Debug)
+	globals.Callback("log_level", logLevels)
+	globals.Callback("tracing", tracingDirective)
 	config.EnumMapped(globals, "auth_map_normalize", true, false, authz.NormalizeFuncs, authz.NormalizeAuto, nil)
 	modconfig.Table(globals, "auth_map", true, false, nil, nil)
 	globals.AllowUnknown()
@@ -307,7 +327,7 @@ func ReadGlobals(cfg []config.Node) (map[string]interface{}, []config.Node, erro
 	return globals.Values, unknown, err
 }
 
-func moduleMain(cfg []config.Node) error {
+func moduleMain(cfgPath string, cfg []config.Node) error {
 	globals, modBlocks, err := ReadGlobals(cfg)
 	if err != nil {
 		return err
@@ -318,6 +338,7 @@ func moduleMain(cfg []config.Node) error {
 	}
 
 	hooks.AddHook(hooks.EventLogRotate, reinitLogging)
+	module.Reload = reload
 
 	endpoints, mods, err := RegisterModules(globals, modBlocks)
 	if err != nil {
@@ -329,12 +350,22 @@ func moduleMain(cfg []config.Node) error {
 		return err
 	}
 
+	setRunState(&runState{
+		cfgPath:     cfgPath,
+		globals:     globals,
+		globalNodes: globalNodes(cfg, modBlocks),
+		endpoints:   endpoints,
+		mods:        mods,
+		opened:      module.OpenedInstances(),
+	})
+
 	systemdStatus(SDReady, "Listening for incoming connections...")
 
 	handleSignals()
 
 	systemdStatus(SDStopping, "Waiting for running transactions to complete...")
 
+	closeRunning()
 	hooks.RunHooks(hooks.EventShutdown)
 
 	return nil
@@ -346,84 +377,187 @@ type ModInfo struct {
 }
 
 func RegisterModules(globals map[string]interface{}, nodes []config.Node) (endpoints, mods []ModInfo, err error) {
+	return registerModules(globals, nodes, nil)
+}
+
+// registerModules creates module instances for the configuration blocks and
+// adds them to the global registry.
+//
+// Blocks present in the keep map (see blockKey) are not recreated, instead
+// the existing initialized instance is registered.
+func registerModules(globals map[string]interface{}, nodes []config.Node, keep map[string]ModInfo) (endpoints, mods []ModInfo, err error) {
 	mods = make([]ModInfo, 0, len(nodes))
 
 	for _, block := range nodes {
-		var instName string
-		var modAliases []string
-		if len(block.Args) == 0 {
-			instName = block.Name
+		info, isEndpoint, err := registerBlock(globals, block, keep)
+		if err != nil {
+			return nil, nil, err
+		}
+		if isEndpoint {
+			endpoints = append(endpoints, info)
 		} else {
-			instName = block.Args[0]
-			modAliases = block.Args[1:]
+			mods = append(mods, info)
 		}
+	}
 
-		modName := block.Name
+	if len(endpoints) == 0 {
+		return nil, nil, fmt.Errorf("at least one endpoint should be configured")
+	}
 
-		endpFactory := module.GetEndpoint(modName)
-		if endpFactory != nil {
-			inst, err := endpFactory(modName, block.Args)
-			if err != nil {
-				return nil, nil, err
-			}
+	return endpoints, mods, nil
+}
 
-			endpoints = append(endpoints, ModInfo{Instance: inst, Cfg: block})
-			continue
-		}
+// registerBlock creates the module instance for a single configuration block
+// and adds it to the global registry unless it is an endpoint.
+func registerBlock(globals map[string]interface{}, block config.Node, keep map[string]ModInfo) (info ModInfo, isEndpoint bool, err error) {
+	var instName string
+	var modAliases []string
+	if len(block.Args) == 0 {
+		instName = block.Name
+	} else {
+		instName = block.Args[0]
+		modAliases = block.Args[1:]
+	}
 
-		factory := module.Get(modName)
-		if factory == nil {
-			return nil, nil, config.NodeErr(block, "unknown module or global directive: %s", modName)
-		}
+	modName := block.Name
+	kept, isKept := keep[blockKey(block)]
 
-		if module.HasInstance(instName) {
-			return nil, nil, config.NodeErr(block, "config block named %s already exists", instName)
+	endpFactory := module.GetEndpoint(modName)
+	if endpFactory != nil {
+		if isKept {
+			module.KeepInstance(kept.Instance)
+			return kept, true, nil
 		}
 
-		inst, err := factory(modName, instName, modAliases, nil)
+		inst, err := endpFactory(modName, block.Args)
 		if err != nil {
-			return nil, nil, err
+			return ModInfo{}, true, err
 		}
 
-		block := block
+		return ModInfo{Instance: inst, Cfg: block}, true, nil
+	}
+
+	factory := module.Get(modName)
+	if factory == nil {
+		return ModInfo{}, false, config.NodeErr(block, "unknown module or global directive: %s", modName)
+	}
+
+	if module.HasInstance(instName) {
+		return ModInfo{}, false, config.NodeErr(block, "config block named %s already exists", instName)
+	}
+
+	var inst module.Module
+	if isKept {
+		inst = kept.Instance
+		module.MarkInitialized(inst, config.NewMap(globals, block))
+	} else {
+		inst, err = factory(modName, instName, modAliases, nil)
+		if err != nil {
+			return ModInfo{}, false, err
+		}
 		module.RegisterInstance(inst, config.NewMap(globals, block))
-		for _, alias := range modAliases {
-			if module.HasInstance(alias) {
-				return nil, nil, config.NodeErr(block, "config block named %s already exists", alias)
-			}
-			module.RegisterAlias(alias, instName)
+	}
+
+	for _, alias := range modAliases {
+		if module.HasInstance(alias) {
+			return ModInfo{}, false, config.NodeErr(block, "config block named %s already exists", alias)
 		}
+		module.RegisterAlias(alias, instName)
+	}
+
+	log.Debugf("%v:%v: register config block %v %v", block.File, block.Line, instName, modAliases)
+	return ModInfo{Instance: inst, Cfg: block}, false, nil
+}
 
-		log.Debugf("%v:%v: register config block %v %v", block.File, block.Line, instName, modAliases)
-		mods = append(mods, ModInfo{Instance: inst, Cfg: block})
+// CheckModules creates and initializes module instances for the configuration
+// blocks the same way as the server startup does, but does not stop on the
+// first error. All found problems are returned, each annotated with the
+// location of the offending block.
+//
+// It should be called with module.DryRun set, otherwise modules will acquire
+// resources as usual.
+func CheckModules(globals map[string]interface{}, nodes []config.Node) []error {
+	var (
+		errs      []error
+		seen      = make(map[string]bool)
+		endpoints []ModInfo
+		mods      []ModInfo
+	)
+	addErr := func(block config.Node, err error) {
+		if !strings.HasPrefix(err.Error(), block.File+":") {
+			err = fmt.Errorf("%s:%d: %w", block.File, block.Line, err)
+		}
+		if seen[err.Error()] {
+			return
+		}
+		seen[err.Error()] = true
+		errs = append(errs, err)
+	}
+
+	for _, block := range nodes {
+		info, isEndpoint, err := registerBlock(globals, block, nil)
+		if err != nil {
+			addErr(block, err)
+			continue
+		}
+		if isEndpoint {
+			endpoints = append(endpoints, info)
+		} else {
+			mods = append(mods, info)
+		}
 	}
 
 	if len(endpoints) == 0 {
-		return nil, nil, fmt.Errorf("at least one endpoint should be configured")
+		errs = append(errs, fmt.Errorf("at least one endpoint should be configured"))
 	}
 
-	return endpoints, mods, nil
+	initFailed := false
+	for _, endp := range endpoints {
+		if err := endp.Instance.Init(config.NewMap(globals, endp.Cfg)); err != nil {
+			addErr(endp.Cfg, err)
+			initFailed = true
+		}
+	}
+
+	for _, mod := range mods {
+		name := mod.Instance.InstanceName()
+		if module.Initialized[name] {
+			continue
+		}
+
+		// Failed endpoints might not have reached the reference to the block.
+		if !initFailed {
+			addErr(mod.Cfg, fmt.Errorf("unused configuration block - %s (%s)", name, mod.Instance.Name()))
+		}
+
+		// Initialize it anyway to report configuration errors in it.
+		if _, err := module.GetInstance(name); err != nil {
+			addErr(mod.Cfg, err)
+		}
+	}
+
+	return errs
 }
 
 func initModules(globals map[string]interface{}, endpoints, mods []ModInfo) error {
 	for _, endp := range endpoints {
-		if err := endp.Instance.Init(config.NewMap(globals, endp.Cfg)); err != nil {
+		if err := initEndpoint(globals, endp); err != nil {
 			return err
 		}
-
-		if closer, ok := endp.Instance.(io.Closer); ok {
-			endp := endp
-			hooks.AddHook(hooks.EventShutdown, func() {
-				log.Debugf("close %s (%s)", endp.Instance.Name(), endp.Instance.InstanceName())
-				if err := closer.Close(); err != nil {
-					log.Printf("module %s (%s) close failed: %v", endp.Instance.Name(), endp.Instance.InstanceName(), err)
-				}
-			})
-		}
 	}
 
+	return checkUnused(mods)
+}
+
+func initEndpoint(globals map[string]interface{}, endp ModInfo) error {
+	return module.InitInstance(endp.Instance, config.NewMap(globals, endp.Cfg))
+}
+
+// checkUnused returns an error if any of the registered configuration blocks
+// was not initialized, that is, not referenced by anything.
+func checkUnused(mods []ModInfo) error {
 	for _, inst := range mods {
-		if module.Initialized[inst.Instance.InstanceName()] {
+		if module.HasInitialized(inst.Instance.InstanceName()) {
 			continue
 		}
 
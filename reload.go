@@ -0,0 +1,376 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package maddy
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/hooks"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/netresource"
+)
+
+// drainTimeout is the maximum amount of time replaced endpoints are allowed
+// to serve existing connections after configuration reload.
+const drainTimeout = 10 * time.Minute
+
+// runState describes the configuration the server is currently running with.
+type runState struct {
+	cfgPath     string
+	globals     map[string]interface{}
+	globalNodes []config.Node
+	endpoints   []ModInfo
+	mods        []ModInfo
+
+	// opened contains all initialized instances that need to be closed,
+	// including inline module definitions, see module.OpenedInstances.
+	opened []module.Module
+}
+
+var (
+	running   *runState
+	reloadLck sync.Mutex
+)
+
+func setRunState(s *runState) {
+	reloadLck.Lock()
+	defer reloadLck.Unlock()
+	running = s
+}
+
+// closeRunning closes all instances used by the running configuration.
+// Instances replaced by configuration reload are closed by retire.
+func closeRunning() {
+	reloadLck.Lock()
+	defer reloadLck.Unlock()
+	if running == nil {
+		return
+	}
+	module.CloseInstances(running.opened)
+	running = nil
+}
+
+// instancesDiff returns the instances from a that are not present in b.
+func instancesDiff(a, b []module.Module) []module.Module {
+	inB := make(map[module.Module]bool, len(b))
+	for _, mod := range b {
+		inB[mod] = true
+	}
+	var res []module.Module
+	for _, mod := range a {
+		if !inB[mod] {
+			res = append(res, mod)
+		}
+	}
+	return res
+}
+
+// globalNodes returns the nodes from cfg that are not present in modBlocks,
+// that is, global directives. modBlocks is expected to be a subsequence of
+// cfg as returned by ReadGlobals.
+func globalNodes(cfg, modBlocks []config.Node) []config.Node {
+	var res []config.Node
+	j := 0
+	for _, node := range cfg {
+		if j < len(modBlocks) && reflect.DeepEqual(node, modBlocks[j]) {
+			j++
+			continue
+		}
+		res = append(res, node)
+	}
+	return res
+}
+
+// splitConfig separates global directives from configuration blocks.
+//
+// Directives that were global in the running configuration are considered
+// global, anything else should be a configuration block.
+func splitConfig(cfg, oldGlobals []config.Node) (globals, blocks []config.Node, err error) {
+	globalNames := make(map[string]bool, len(oldGlobals))
+	for _, node := range oldGlobals {
+		globalNames[node.Name] = true
+	}
+
+	for _, node := range cfg {
+		if globalNames[node.Name] {
+			globals = append(globals, node)
+			continue
+		}
+		if module.GetEndpoint(node.Name) == nil && module.Get(node.Name) == nil {
+			return nil, nil, config.NodeErr(node, "unknown module or global directive: %s (global directives can't be added without server restart)", node.Name)
+		}
+		blocks = append(blocks, node)
+	}
+	return globals, blocks, nil
+}
+
+// blockKey returns the string that identifies the configuration block across
+// reloads. It is the instance name for modules and the module name with
+// listening addresses for endpoints.
+func blockKey(node config.Node) string {
+	if module.GetEndpoint(node.Name) != nil {
+		return "endpoint " + node.Name + " " + strings.Join(node.Args, " ")
+	}
+	if len(node.Args) == 0 {
+		return node.Name
+	}
+	return node.Args[0]
+}
+
+// nodesEqual compares configuration nodes ignoring their location.
+func nodesEqual(a, b config.Node) bool {
+	if a.Name != b.Name || len(a.Args) != len(b.Args) || len(a.Children) != len(b.Children) {
+		return false
+	}
+	for i := range a.Args {
+		if a.Args[i] != b.Args[i] {
+			return false
+		}
+	}
+	return nodeListsEqual(a.Children, b.Children)
+}
+
+func nodeListsEqual(a, b []config.Node) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !nodesEqual(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// references returns names of all configuration blocks referenced using the
+// &name syntax anywhere in node.
+func references(node config.Node) []string {
+	var refs []string
+	for _, arg := range append([]string{node.Name}, node.Args...) {
+		if strings.HasPrefix(arg, "&") {
+			refs = append(refs, arg[1:])
+		}
+	}
+	for _, child := range node.Children {
+		refs = append(refs, references(child)...)
+	}
+	return refs
+}
+
+// unchangedBlocks returns the running blocks that can be used as is with the
+// new configuration. Block is considered changed if its configuration is
+// different or if it references a changed or removed block.
+func unchangedBlocks(running []ModInfo, blocks []config.Node) map[string]ModInfo {
+	old := make(map[string]ModInfo, len(running))
+	for _, m := range running {
+		old[blockKey(m.Cfg)] = m
+	}
+
+	// Map instance names and aliases to block keys.
+	names := make(map[string]string, len(blocks))
+	kept := make(map[string]ModInfo, len(blocks))
+	for _, block := range blocks {
+		key := blockKey(block)
+		if module.GetEndpoint(block.Name) == nil {
+			names[key] = key
+			if len(block.Args) > 1 {
+				for _, alias := range block.Args[1:] {
+					names[alias] = key
+				}
+			}
+		}
+
+		if m, ok := old[key]; ok && nodesEqual(m.Cfg, block) {
+			kept[key] = m
+		}
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for key, m := range kept {
+			for _, ref := range references(m.Cfg) {
+				if _, ok := kept[names[ref]]; !ok {
+					delete(kept, key)
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	return kept
+}
+
+// reload replaces changed configuration blocks and then runs EventReload hooks
+// so secondary files are re-read too. Hooks are run even if configuration
+// reload fails since the running configuration is kept in that case.
+//
+// It is used both for SIGUSR2 and module.Reload.
+func reload() error {
+	err := reloadConfig()
+	hooks.RunHooks(hooks.EventReload)
+	return err
+}
+
+// reloadConfig re-reads the configuration file and replaces configuration
+// blocks that were changed.
+//
+// Unchanged blocks are kept as is. New endpoints take over listening sockets
+// of the replaced ones while the connections accepted by the old endpoints
+// are allowed to finish, after that the old instances are closed.
+//
+// Global directives can't be changed using reload.
+func reloadConfig() error {
+	reloadLck.Lock()
+	defer reloadLck.Unlock()
+
+	state := running
+	if state == nil {
+		return errors.New("server is not running")
+	}
+
+	f, err := os.Open(state.cfgPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cfg, err := parser.Read(f, state.cfgPath)
+	if err != nil {
+		return err
+	}
+
+	globals, blocks, err := splitConfig(cfg, state.globalNodes)
+	if err != nil {
+		return err
+	}
+	if !nodeListsEqual(globals, state.globalNodes) {
+		return errors.New("global directives are changed, server restart is required")
+	}
+
+	kept := unchangedBlocks(append(append([]ModInfo{}, state.endpoints...), state.mods...), blocks)
+	isKept := func(m ModInfo) bool {
+		k, ok := kept[blockKey(m.Cfg)]
+		return ok && k.Instance == m.Instance
+	}
+
+	var oldEndpoints, oldMods []ModInfo
+	for _, endp := range state.endpoints {
+		if !isKept(endp) {
+			oldEndpoints = append(oldEndpoints, endp)
+		}
+	}
+	for _, mod := range state.mods {
+		if isKept(mod) {
+			continue
+		}
+		if _, ok := mod.Instance.(module.Exclusive); ok {
+			return config.NodeErr(mod.Cfg, "%s (%s) can't be replaced, server restart is required",
+				mod.Instance.InstanceName(), mod.Instance.Name())
+		}
+		oldMods = append(oldMods, mod)
+	}
+
+	if len(oldEndpoints) == 0 && len(oldMods) == 0 && len(kept) == len(blocks) {
+		log.Println("configuration reload: no changes")
+		return nil
+	}
+
+	netresource.Begin()
+	restore := module.ResetInstances()
+	endpoints, mods, err := registerModules(state.globals, blocks, kept)
+	if err != nil {
+		netresource.Rollback()
+		restore()
+		return err
+	}
+
+	err = func() error {
+		for _, endp := range endpoints {
+			if isKept(endp) {
+				continue
+			}
+			if err := initEndpoint(state.globals, endp); err != nil {
+				return err
+			}
+		}
+		return checkUnused(mods)
+	}()
+	opened := module.OpenedInstances()
+	if err != nil {
+		// Modules are initialized lazily, so only close the ones that were
+		// actually used.
+		module.CloseInstances(instancesDiff(opened, state.opened))
+		netresource.Rollback()
+		restore()
+		return err
+	}
+
+	netresource.Commit()
+	module.CommitInstances()
+	running = &runState{
+		cfgPath:     state.cfgPath,
+		globals:     state.globals,
+		globalNodes: state.globalNodes,
+		endpoints:   endpoints,
+		mods:        mods,
+		opened:      opened,
+	}
+
+	log.Printf("configuration reloaded, %d endpoints and %d blocks replaced", len(oldEndpoints), len(oldMods))
+
+	go retire(oldEndpoints, instancesDiff(state.opened, opened))
+
+	return nil
+}
+
+// retire waits for the replaced endpoints to finish serving existing
+// connections and then closes all replaced instances.
+func retire(endpoints []ModInfo, mods []module.Module) {
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, endp := range endpoints {
+		drainer, ok := endp.Instance.(module.Drainer)
+		if !ok {
+			continue
+		}
+
+		wg.Add(1)
+		go func(endp ModInfo) {
+			defer wg.Done()
+			if err := drainer.Drain(ctx); err != nil {
+				log.Printf("%s: connections are not finished after %v, closing them: %v", endp.Instance.Name(), drainTimeout, err)
+			}
+		}(endp)
+	}
+	wg.Wait()
+
+	module.CloseInstances(mods)
+}
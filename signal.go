@@ -36,6 +36,9 @@ import (
 // (SIGTERM, SIGHUP, SIGINT) will cause this function to return.
 //
 // SIGUSR1 will call reinitLogging without returning.
+//
+// SIGUSR2 will reload the configuration and run EventReload hooks (see
+// reload) without returning.
 func handleSignals() os.Signal {
 	sig := make(chan os.Signal, 5)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGINT, syscall.SIGUSR1, syscall.SIGUSR2)
@@ -50,7 +53,9 @@ func handleSignals() os.Signal {
 		case syscall.SIGUSR2:
 			log.Printf("signal received (%s), reloading state", s.String())
 			systemdStatus(SDReloading, "Reloading state...")
-			hooks.RunHooks(hooks.EventReload)
+			if err := reload(); err != nil {
+				log.Printf("configuration reload failed, continuing with the old configuration: %v", err)
+			}
 			systemdStatus(SDReady, "Listening for incoming connections...")
 		default:
 			go func() {
@@ -4,7 +4,12 @@
 package tests_test
 
 import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/foxcpp/maddy/tests"
 )
@@ -46,6 +51,7 @@ func TestIMAPEndpointAuthMap(tt *testing.T) {
 	imapConn.ExpectPattern(`\* *`)
 	imapConn.ExpectPattern(`\* *`)
 	imapConn.ExpectPattern(`\* *`)
+	imapConn.ExpectPattern(`\* *`)
 	imapConn.ExpectPattern(`. OK *`)
 }
 
@@ -94,3 +100,387 @@ func TestIMAPEndpointStorageMap(tt *testing.T) {
 	imapConn2.Expect(`* LIST (\HasNoChildren) "." "testbox"`)
 	imapConn2.ExpectPattern(". OK *")
 }
+
+func TestIMAPACL(tt *testing.T) {
+	tt.Parallel()
+	t := tests.NewT(tt)
+
+	t.DNS(nil)
+	t.Port("imap")
+	t.Config(`
+		storage.imapsql test_store {
+			driver sqlite3
+			dsn imapsql.db
+		}
+
+		imap tcp://127.0.0.1:{env:TEST_PORT_imap} {
+			tls off
+
+			auth_map email_localpart
+			auth pass_table static {
+				entry "user" "bcrypt:$2a$10$z9SvUwUjkY8wKOWd9IbISeEmbJua2cXRPqw7s2BnLXJuc6pIMPncK" # password: 123
+			}
+			storage &test_store
+		}
+	`)
+	t.Run(1)
+	defer t.Close()
+
+	owner := t.Conn("imap")
+	defer owner.Close()
+	owner.ExpectPattern(`\* OK *`)
+	owner.Writeln(". LOGIN user@example.org 123")
+	owner.ExpectPattern(". OK *")
+	owner.Writeln(". CREATE Support")
+	owner.ExpectPattern(". OK *")
+	owner.Writeln(". SETACL Support user@example.com lrswi")
+	owner.ExpectPattern(". OK *")
+	owner.Writeln(". GETACL Support")
+	owner.Expect(`* ACL "Support" "user@example.com" "lrswi" "user@example.org" "lrswipkxteacd"`)
+	owner.ExpectPattern(". OK *")
+
+	other := t.Conn("imap")
+	defer other.Close()
+	other.ExpectPattern(`\* OK *`)
+	other.Writeln(". LOGIN user@example.com 123")
+	other.ExpectPattern(". OK *")
+	other.Writeln(". NAMESPACE")
+	other.Expect(`* NAMESPACE (("" ".")) NIL (("Shared." "."))`)
+	other.ExpectPattern(". OK *")
+	other.Writeln(`. LIST "" "Shared*"`)
+	other.Expect(`* LIST (\Noselect \HasChildren) "." "Shared"`)
+	other.Expect(`* LIST (\Noselect \HasChildren) "." "Shared.user@example.org"`)
+	other.Expect(`* LIST (\HasNoChildren) "." "Shared.user@example.org.Support"`)
+	other.ExpectPattern(". OK *")
+	other.Writeln(". MYRIGHTS Shared.user@example.org.Support")
+	other.Expect(`* MYRIGHTS "Shared.user@example.org.Support" "lrswi"`)
+	other.ExpectPattern(". OK *")
+	other.Writeln(". GETACL Shared.user@example.org.Support")
+	other.ExpectPattern(". NO *")
+	other.Writeln(". DELETE Shared.user@example.org.Support")
+	other.ExpectPattern(". NO *")
+
+	owner.Writeln(". DELETEACL Support user@example.com")
+	owner.ExpectPattern(". OK *")
+	other.Writeln(". MYRIGHTS Shared.user@example.org.Support")
+	other.ExpectPattern(". NO *")
+}
+
+func TestIMAPCondStore(tt *testing.T) {
+	tt.Parallel()
+	t := tests.NewT(tt)
+
+	t.DNS(nil)
+	t.Port("imap")
+	t.Config(`
+		storage.imapsql test_store {
+			driver sqlite3
+			dsn imapsql.db
+		}
+
+		imap tcp://127.0.0.1:{env:TEST_PORT_imap} {
+			tls off
+
+			auth pass_table static {
+				entry "user" "bcrypt:$2a$10$z9SvUwUjkY8wKOWd9IbISeEmbJua2cXRPqw7s2BnLXJuc6pIMPncK" # password: 123
+			}
+			storage &test_store
+		}
+	`)
+	t.Run(1)
+	defer t.Close()
+
+	// selectModSeq reads untagged SELECT responses up to HIGHESTMODSEQ and
+	// returns UIDVALIDITY.
+	selectModSeq := func(c *tests.Conn, highest string) string {
+		uidValidity := ""
+		for {
+			line := c.ExpectPattern(`\* *`)
+			if strings.HasPrefix(line, "* OK [UIDVALIDITY ") {
+				uidValidity = strings.Fields(line)[3]
+				uidValidity = strings.TrimSuffix(uidValidity, "]")
+			}
+			if line == "* OK [HIGHESTMODSEQ "+highest+"] Highest" {
+				return uidValidity
+			}
+		}
+	}
+
+	c := t.Conn("imap")
+	defer c.Close()
+	c.ExpectPattern(`\* OK *`)
+	c.Writeln(". LOGIN user 123")
+	c.ExpectPattern(". OK *")
+	for i := 0; i < 2; i++ {
+		c.Writeln(". APPEND INBOX {25}")
+		c.ExpectPattern(`+ *`)
+		c.Writeln("Subject: test")
+		c.Writeln("")
+		c.Writeln("Hello!")
+		c.Writeln("")
+		c.ExpectPattern(". OK *")
+	}
+	c.Writeln(". ENABLE QRESYNC")
+	c.Expect("* ENABLED QRESYNC")
+	c.ExpectPattern(". OK *")
+	c.Writeln(". SELECT INBOX")
+	uidValidity := selectModSeq(&c, "3")
+	c.ExpectPattern(`. OK \[READ-WRITE\] *`)
+
+	c.Writeln(". FETCH 1:* (FLAGS) (CHANGEDSINCE 2)")
+	c.Expect(`* 2 FETCH (FLAGS (\Recent) MODSEQ (3))`)
+	c.ExpectPattern(". OK *")
+
+	c.Writeln(`. STORE 1 (UNCHANGEDSINCE 1) +FLAGS.SILENT (\Flagged)`)
+	c.Expect(". OK [MODIFIED 1] Conditional STORE failed")
+	c.Writeln(`. UID STORE 1 (UNCHANGEDSINCE 2) +FLAGS.SILENT (\Flagged)`)
+	c.Expect(`* 1 FETCH (UID 1 MODSEQ (4))`)
+	c.ExpectPattern(". OK *")
+
+	c.Writeln(`. STORE 2 +FLAGS.SILENT (\Deleted)`)
+	c.Expect(`* 2 FETCH (MODSEQ (5))`)
+	c.ExpectPattern(". OK *")
+	c.Writeln(". EXPUNGE")
+	c.Expect("* VANISHED 2")
+	c.Expect(". OK [HIGHESTMODSEQ 6] EXPUNGE completed")
+
+	c.Writeln(". UID FETCH 1:* (FLAGS) (CHANGEDSINCE 3 VANISHED)")
+	c.Expect("* VANISHED (EARLIER) 2")
+	c.ExpectPattern(`\* 1 FETCH (FLAGS (*) UID 1 MODSEQ (4))`)
+	c.ExpectPattern(". OK *")
+
+	c.Writeln(". SEARCH MODSEQ 4")
+	c.Expect("* SEARCH 1 (MODSEQ 4)")
+	c.ExpectPattern(". OK *")
+
+	c.Writeln(". STATUS INBOX (HIGHESTMODSEQ)")
+	c.Expect("* STATUS INBOX (HIGHESTMODSEQ 6)")
+	c.ExpectPattern(". OK *")
+
+	other := t.Conn("imap")
+	defer other.Close()
+	other.ExpectPattern(`\* OK *`)
+	other.Writeln(". LOGIN user 123")
+	other.ExpectPattern(". OK *")
+	other.Writeln(". ENABLE QRESYNC")
+	other.Expect("* ENABLED QRESYNC")
+	other.ExpectPattern(". OK *")
+	other.Writeln(". SELECT INBOX (QRESYNC (" + uidValidity + " 3))")
+	selectModSeq(&other, "6")
+	other.Expect("* VANISHED (EARLIER) 2")
+	other.ExpectPattern(`\* 1 FETCH (UID 1 FLAGS (\\Flagged*) MODSEQ (4))`)
+	other.ExpectPattern(`. OK \[READ-WRITE\] *`)
+
+	c.Writeln(`. STORE 1 +FLAGS.SILENT (\Deleted)`)
+	c.Expect(`* 1 FETCH (MODSEQ (7))`)
+	c.ExpectPattern(". OK *")
+	c.Writeln(". EXPUNGE")
+	c.Expect("* VANISHED 1")
+	c.Expect(". OK [HIGHESTMODSEQ 8] EXPUNGE completed")
+
+	other.Writeln(". NOOP")
+	other.ExpectPattern(`\* 1 FETCH (FLAGS (*) UID 1*)`)
+	other.Expect("* VANISHED 1")
+	other.ExpectPattern(". OK *")
+}
+
+func TestIMAPMetadata(tt *testing.T) {
+	tt.Parallel()
+	t := tests.NewT(tt)
+
+	t.DNS(nil)
+	t.Port("imap")
+	t.Config(`
+		storage.imapsql test_store {
+			driver sqlite3
+			dsn imapsql.db
+			metadata_max_size 16B
+		}
+
+		imap tcp://127.0.0.1:{env:TEST_PORT_imap} {
+			tls off
+
+			auth pass_table static {
+				entry "user" "bcrypt:$2a$10$z9SvUwUjkY8wKOWd9IbISeEmbJua2cXRPqw7s2BnLXJuc6pIMPncK" # password: 123
+			}
+			storage &test_store
+		}
+	`)
+	t.Run(1)
+	defer t.Close()
+
+	c := t.Conn("imap")
+	defer c.Close()
+	c.ExpectPattern(`\* OK *`)
+	c.Writeln(". LOGIN user 123")
+	c.ExpectPattern(". OK *")
+
+	c.Writeln(`. SETMETADATA "" (/private/comment "Hello!" /private/vendor/test/key "value")`)
+	c.ExpectPattern(". OK *")
+	c.Writeln(`. GETMETADATA "" /private/comment`)
+	c.Expect(`* METADATA "" ("/private/comment" "Hello!")`)
+	c.ExpectPattern(". OK *")
+	c.Writeln(`. GETMETADATA (DEPTH infinity MAXSIZE 5) "" (/private/vendor /private/missing /private/comment)`)
+	c.Expect(`* METADATA "" ("/private/missing" NIL "/private/vendor/test/key" "value")`)
+	c.Expect(". OK [METADATA LONGENTRIES 6] GETMETADATA completed")
+
+	c.Writeln(`. SETMETADATA INBOX (/shared/comment "Too long value for the limit")`)
+	c.Expect(". NO [METADATA MAXSIZE 16] Metadata entry value is too big")
+	c.Writeln(`. SETMETADATA INBOX (/shared/comment "Mailbox")`)
+	c.ExpectPattern(". OK *")
+	c.Writeln(`. SETMETADATA "" (/private/comment NIL)`)
+	c.ExpectPattern(". OK *")
+	c.Writeln(`. GETMETADATA (DEPTH 1) INBOX (/shared /private)`)
+	c.Expect(`* METADATA INBOX ("/private" NIL "/shared/comment" "Mailbox")`)
+	c.ExpectPattern(". OK *")
+	c.Writeln(`. GETMETADATA "" /private/comment`)
+	c.Expect(`* METADATA "" ("/private/comment" NIL)`)
+	c.ExpectPattern(". OK *")
+}
+
+func TestIMAPTraining(tt *testing.T) {
+	tt.Parallel()
+	t := tests.NewT(tt)
+
+	type submission struct {
+		account, action, body string
+	}
+	submissions := make(chan submission, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		submissions <- submission{
+			account: r.Header.Get("X-Maddy-Account"),
+			action:  r.Header.Get("X-Maddy-Training"),
+			body:    string(body),
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	expect := func(action string) {
+		tt.Helper()
+		select {
+		case s := <-submissions:
+			if s.account != "user" || s.action != action || !strings.Contains(s.body, "Subject: Buy now") {
+				tt.Errorf("unexpected submission: %+v", s)
+			}
+		case <-time.After(5 * time.Second):
+			tt.Fatalf("message is not submitted as %s", action)
+		}
+	}
+
+	t.DNS(nil)
+	t.Port("imap")
+	t.Env("TEST_TRAINER_URL=" + srv.URL)
+	t.Config(`
+		storage.imapsql test_store {
+			driver sqlite3
+			dsn imapsql.db
+
+			training {
+				trainer webhook {env:TEST_TRAINER_URL}
+			}
+		}
+
+		imap tcp://127.0.0.1:{env:TEST_PORT_imap} {
+			tls off
+
+			auth pass_table static {
+				entry "user" "bcrypt:$2a$10$z9SvUwUjkY8wKOWd9IbISeEmbJua2cXRPqw7s2BnLXJuc6pIMPncK" # password: 123
+			}
+			storage &test_store
+		}
+	`)
+	t.Run(1)
+	defer t.Close()
+
+	c := t.Conn("imap")
+	defer c.Close()
+	c.ExpectPattern(`\* OK *`)
+	c.Writeln(". LOGIN user 123")
+	c.ExpectPattern(". OK *")
+	c.Writeln(". CREATE Junk")
+	c.ExpectPattern(". OK *")
+	c.Writeln(". CREATE Archive")
+	c.ExpectPattern(". OK *")
+
+	c.Writeln(". APPEND INBOX {28}")
+	c.ExpectPattern(`+ *`)
+	c.Writeln("Subject: Buy now")
+	c.Writeln("")
+	c.Writeln("Cheap!")
+	c.Writeln("")
+	c.ExpectPattern(". OK *")
+
+	c.Writeln(". SELECT INBOX")
+	for {
+		line, err := c.Readln()
+		if err != nil {
+			tt.Fatal(err)
+		}
+		if strings.HasPrefix(line, ". OK") {
+			break
+		}
+	}
+	c.Writeln(". MOVE 1 Junk")
+	c.Expect(`* 1 EXPUNGE`)
+	c.ExpectPattern(". OK *")
+	expect("spam")
+
+	c.Writeln(". SELECT Junk")
+	for {
+		line, err := c.Readln()
+		if err != nil {
+			tt.Fatal(err)
+		}
+		if strings.HasPrefix(line, ". OK") {
+			break
+		}
+	}
+	c.Writeln(". COPY 1 Archive")
+	c.ExpectPattern(". OK *")
+	expect("ham")
+}
+
+func TestIMAPLockout(tt *testing.T) {
+	tt.Parallel()
+	t := tests.NewT(tt)
+
+	t.DNS(nil)
+	t.Port("imap")
+	t.Config(`
+		storage.imapsql test_store {
+			driver sqlite3
+			dsn imapsql.db
+		}
+
+		imap tcp://127.0.0.1:{env:TEST_PORT_imap} {
+			tls off
+
+			auth pass_table static {
+				entry "user" "bcrypt:$2a$10$z9SvUwUjkY8wKOWd9IbISeEmbJua2cXRPqw7s2BnLXJuc6pIMPncK" # password: 123
+			}
+			auth_lockout {
+				username {
+					max_failures 2
+				}
+				delay 0s
+			}
+			storage &test_store
+		}
+	`)
+	t.Run(1)
+	defer t.Close()
+
+	c := t.Conn("imap")
+	defer c.Close()
+	c.ExpectPattern(`\* OK *`)
+	for i := 0; i < 2; i++ {
+		c.Writeln(". LOGIN user 456")
+		c.ExpectPattern(". NO *")
+	}
+	c.Writeln(". LOGIN user 123")
+	c.Expect(". NO [UNAVAILABLE] Temporary authentication failure, try again later")
+	// AHVzZXIAMTIz = "\x00user\x00123"
+	c.Writeln(". AUTHENTICATE PLAIN AHVzZXIAMTIz")
+	c.Expect(". NO [UNAVAILABLE] Temporary authentication failure, try again later")
+}
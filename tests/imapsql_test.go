@@ -72,6 +72,7 @@ func TestImapsqlDelivery(tt *testing.T) {
 	imapConn.ExpectPattern(`\* *`)
 	imapConn.ExpectPattern(`\* *`)
 	imapConn.ExpectPattern(`\* *`)
+	imapConn.ExpectPattern(`\* *`)
 	imapConn.ExpectPattern(`. OK *`)
 
 	smtpConn := t.Conn("smtp")
@@ -159,6 +160,7 @@ func TestImapsqlDeliveryMap(tt *testing.T) {
 	imapConn.ExpectPattern(`\* *`)
 	imapConn.ExpectPattern(`\* *`)
 	imapConn.ExpectPattern(`\* *`)
+	imapConn.ExpectPattern(`\* *`)
 	imapConn.ExpectPattern(`. OK *`)
 
 	smtpConn := t.Conn("smtp")
@@ -231,6 +233,7 @@ func TestImapsqlAuthMap(tt *testing.T) {
 	imapConn.ExpectPattern(`\* *`)
 	imapConn.ExpectPattern(`\* *`)
 	imapConn.ExpectPattern(`\* *`)
+	imapConn.ExpectPattern(`\* *`)
 	imapConn.ExpectPattern(`. OK *`)
 
 	smtpConn := t.Conn("smtp")
@@ -0,0 +1,86 @@
+//go:build integration
+// +build integration
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tests_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/tests"
+)
+
+func reloadCfg(hostname string) string {
+	return `
+		smtp tcp://127.0.0.1:{env:TEST_PORT_smtp} {
+			hostname ` + hostname + `
+			tls off
+
+			deliver_to dummy
+		}`
+}
+
+func TestReload(tt *testing.T) {
+	tt.Parallel()
+
+	t := tests.NewT(tt)
+	t.DNS(nil)
+	t.Port("smtp")
+	t.Config(reloadCfg("mx1.maddy.test"))
+	t.Run(1)
+	defer t.Close()
+
+	oldConn := t.Conn("smtp")
+	defer oldConn.Close()
+	oldConn.ExpectPattern("220 mx1.maddy.test *")
+
+	// Give the server some time to install the signal handler.
+	time.Sleep(500 * time.Millisecond)
+	if msg := t.Reload(reloadCfg("mx2.maddy.test")); !strings.Contains(msg, "configuration reloaded") {
+		t.Fatal("Reload failed:", msg)
+	}
+
+	// Connection accepted before reload is still served.
+	oldConn.Writeln("HELO localhost")
+	oldConn.ExpectPattern("250 *")
+
+	newConn := t.Conn("smtp")
+	defer newConn.Close()
+	newConn.ExpectPattern("220 mx2.maddy.test *")
+	newConn.Writeln("QUIT")
+	newConn.ExpectPattern("221 *")
+
+	oldConn.Writeln("QUIT")
+	oldConn.ExpectPattern("221 *")
+
+	// Invalid configuration is rejected, the server continues to run with
+	// the previous one.
+	if msg := t.Reload(reloadCfg("mx3.maddy.test") + "\nunknown_directive 1"); !strings.Contains(msg, "configuration reload failed") {
+		t.Fatal("Reload succeeded:", msg)
+	}
+
+	conn := t.Conn("smtp")
+	defer conn.Close()
+	conn.ExpectPattern("220 mx2.maddy.test *")
+	conn.Writeln("QUIT")
+	conn.ExpectPattern("221 *")
+}
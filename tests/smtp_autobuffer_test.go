@@ -74,6 +74,7 @@ func TestSMTPEndpoint_LargeMessage(tt *testing.T) {
 	imapConn.ExpectPattern(`\* *`)
 	imapConn.ExpectPattern(`\* *`)
 	imapConn.ExpectPattern(`\* *`)
+	imapConn.ExpectPattern(`\* *`)
 	imapConn.ExpectPattern(`. OK *`)
 
 	smtpConn := t.Conn("smtp")
@@ -164,6 +165,7 @@ func TestSMTPEndpoint_FileBuffer(tt *testing.T) {
 		imapConn.ExpectPattern(`\* *`)
 		imapConn.ExpectPattern(`\* *`)
 		imapConn.ExpectPattern(`\* *`)
+		imapConn.ExpectPattern(`\* *`)
 		imapConn.ExpectPattern(`. OK *`)
 
 		smtpConn := t.Conn("smtp")
@@ -253,6 +255,7 @@ func TestSMTPEndpoint_Autobuffer(tt *testing.T) {
 	imapConn.ExpectPattern(`\* *`)
 	imapConn.ExpectPattern(`\* *`)
 	imapConn.ExpectPattern(`\* *`)
+	imapConn.ExpectPattern(`\* *`)
 	imapConn.ExpectPattern(`. OK *`)
 
 	smtpConn := t.Conn("smtp")
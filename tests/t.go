@@ -34,6 +34,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -58,6 +59,9 @@ type T struct {
 	portsRev map[uint16]string
 
 	servProc *exec.Cmd
+
+	// Receives the log lines reporting the configuration reload result.
+	reloadMsg chan string
 }
 
 func NewT(t *testing.T) *T {
@@ -235,20 +239,29 @@ func (t *T) Run(waitListeners int) {
 	}
 
 	// Log scanning goroutine checks for the "listening" messages and sends 'true'
-	// on the channel each time.
+	// on the channel each time until waitListeners messages are seen.
 	listeningMsg := make(chan bool)
+	t.reloadMsg = make(chan string, 1)
 
 	go func() {
 		defer logOut.Close()
 		defer close(listeningMsg)
+		waiting := waitListeners
 		scnr := bufio.NewScanner(logOut)
 		for scnr.Scan() {
 			line := scnr.Text()
 
-			if strings.Contains(line, "listening on") {
+			if strings.Contains(line, "listening on") && waiting > 0 {
+				waiting--
 				listeningMsg <- true
 				line += " (test runner>listener wait trigger<)"
 			}
+			if strings.Contains(line, "configuration reload") {
+				select {
+				case t.reloadMsg <- line:
+				default:
+				}
+			}
 
 			t.Log("maddy:", line)
 		}
@@ -266,6 +279,36 @@ func (t *T) Run(waitListeners int) {
 	t.servProc = cmd
 }
 
+// Reload replaces the server configuration and asks the running server to
+// reload it. Reload returns the log message reporting the result.
+func (t *T) Reload(cfg string) string {
+	t.Helper()
+
+	if t.servProc == nil {
+		panic("tests: Reload called before Run")
+	}
+
+	t.cfg = cfg
+	configPreable := "state_dir " + filepath.Join(t.testDir, "statedir") + "\n" +
+		"runtime_dir " + filepath.Join(t.testDir, "runtime") + "\n\n"
+	err := os.WriteFile(filepath.Join(t.testDir, "maddy.conf"), []byte(configPreable+t.cfg), os.ModePerm)
+	if err != nil {
+		t.Fatal("Test configuration failed:", err)
+	}
+
+	if err := t.servProc.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatal("Unable to signal the server process:", err)
+	}
+
+	select {
+	case msg := <-t.reloadMsg:
+		return msg
+	case <-time.After(10 * time.Second):
+		t.Fatal("No reload result reported by the server")
+		return ""
+	}
+}
+
 func (t *T) StateDir() string {
 	return filepath.Join(t.testDir, "statedir")
 }
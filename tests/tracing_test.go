@@ -0,0 +1,189 @@
+//go:build integration
+// +build integration
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tests_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/internal/testutils"
+	"github.com/foxcpp/maddy/tests"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpCollector is an OTLP/HTTP collector stand-in that records received
+// spans.
+type otlpCollector struct {
+	lck   sync.Mutex
+	spans []*tracepb.Span
+}
+
+func (c *otlpCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req coltracepb.ExportTraceServiceRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.lck.Lock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+	c.lck.Unlock()
+
+	resp, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(resp)
+}
+
+func (c *otlpCollector) span(t *tests.T, name string) *tracepb.Span {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	for _, s := range c.spans {
+		if s.Name == name {
+			return s
+		}
+	}
+	t.Fatal("Span was not exported:", name)
+	return nil
+}
+
+func TestTracing(tt *testing.T) {
+	tt.Parallel()
+	t := tests.NewT(tt)
+	t.DNS(map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+	})
+	t.Port("smtp")
+	tgtPort := t.Port("remote_smtp")
+	otlpPort := t.Port("otlp")
+	t.Config(`
+		hostname mx.maddy.test
+		tls off
+		tracing {
+			endpoint http://127.0.0.1:{env:TEST_PORT_otlp}
+		}
+		smtp tcp://127.0.0.1:{env:TEST_PORT_smtp} {
+			check {
+				require_mx_record
+			}
+			deliver_to queue outbound_queue {
+				target remote
+			}
+		}`)
+
+	col := &otlpCollector{}
+	l, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(int(otlpPort)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: col}
+	go srv.Serve(l) //nolint:errcheck
+	defer srv.Close()
+
+	be, s := testutils.SMTPServer(tt, "127.0.0.1:"+strconv.Itoa(int(tgtPort)))
+	defer s.Close()
+
+	t.Run(1)
+	closed := false
+	defer func() {
+		if !closed {
+			t.Close()
+		}
+	}()
+
+	c := t.Conn("smtp")
+	defer c.Close()
+	c.SMTPNegotation("client.maddy.test", nil, nil)
+	c.Writeln("MAIL FROM:<from@example.invalid>")
+	c.ExpectPattern("250 *")
+	c.Writeln("RCPT TO:<to@example.invalid>")
+	c.ExpectPattern("250 *")
+	c.Writeln("DATA")
+	c.ExpectPattern("354 *")
+	c.Writeln("From: <from@example.invalid>")
+	c.Writeln("To: <to@example.invalid>")
+	c.Writeln("Subject: Hello!")
+	c.Writeln("")
+	c.Writeln("Hello!")
+	c.Writeln(".")
+	c.ExpectPattern("250 2.0.0 OK: queued")
+	c.Writeln("QUIT")
+	c.ExpectPattern("221 *")
+
+	for i := 0; i < 10; i++ {
+		if be.SessionCounter != 0 {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	if be.SessionCounter == 0 {
+		t.Fatal("Message was not delivered")
+	}
+
+	// Remaining spans are flushed on shutdown.
+	t.Close()
+	closed = true
+
+	session := col.span(t, "smtp session")
+	txn := col.span(t, "smtp transaction")
+	if !bytes.Equal(txn.ParentSpanId, session.SpanId) {
+		t.Error("Transaction span is not a child of the session span")
+	}
+	check := col.span(t, "check.require_mx_record")
+	if !bytes.Equal(check.TraceId, txn.TraceId) {
+		t.Error("Check span belongs to a different trace")
+	}
+
+	attempt := col.span(t, "queue delivery attempt")
+	if bytes.Equal(attempt.TraceId, txn.TraceId) {
+		t.Error("Delivery attempt should be a separate trace")
+	}
+	if len(attempt.Links) != 1 || !bytes.Equal(attempt.Links[0].SpanId, txn.SpanId) {
+		t.Error("Delivery attempt is not linked to the transaction")
+	}
+	mx := col.span(t, "remote MX attempt")
+	if !bytes.Equal(mx.TraceId, attempt.TraceId) {
+		t.Error("MX attempt span is not a part of the delivery attempt trace")
+	}
+}